@@ -6,3 +6,5 @@ require (
 	github.com/samply/golang-fhir-models/fhir-models v0.3.2
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/klauspost/compress v1.18.0
@@ -3,12 +3,14 @@ package main
 import (
 	"csv2fhir/internal/config"
 	"csv2fhir/internal/csv"
+	"csv2fhir/internal/dedupe"
 	"csv2fhir/internal/output"
 	"csv2fhir/internal/transform"
 	"encoding/json"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
@@ -244,7 +246,7 @@ func TestNDJSONOutput(t *testing.T) {
 	}
 }
 
-// TestMemoryLimit tests resource limit enforcement
+// TestMemoryLimit tests enforcement of an explicit resource limit
 func TestMemoryLimit(t *testing.T) {
 	tmpDir := t.TempDir()
 	outputPath := filepath.Join(tmpDir, "output.json")
@@ -272,6 +274,277 @@ func TestMemoryLimit(t *testing.T) {
 	writer.Close()
 }
 
+// TestBundleOutput_Streaming tests that bundles are not limited by default
+func TestBundleOutput_Streaming(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "output.json")
+
+	writer, err := output.NewWriter(outputPath, output.FormatBundle)
+	if err != nil {
+		t.Fatalf("Failed to create bundle writer: %v", err)
+	}
+
+	// More than the old 10k in-memory limit
+	const count = 12000
+	for i := 0; i < count; i++ {
+		if err := writer.Write(&fhir.Observation{Id: strPtr("OBS")}); err != nil {
+			t.Fatalf("Failed to write resource %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	var bundle fhir.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("Failed to parse bundle: %v", err)
+	}
+	if bundle.Type != fhir.BundleTypeCollection {
+		t.Errorf("Expected collection bundle, got %s", bundle.Type)
+	}
+	if bundle.Total == nil || *bundle.Total != count {
+		t.Errorf("Expected total=%d in bundle", count)
+	}
+	if len(bundle.Entry) != count {
+		t.Errorf("Expected %d entries, got %d", count, len(bundle.Entry))
+	}
+}
+
+// TestBundleOutput_Empty tests that a bundle is written even without resources
+func TestBundleOutput_Empty(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "output.json")
+
+	writer, err := output.NewWriter(outputPath, output.FormatBundle)
+	if err != nil {
+		t.Fatalf("Failed to create bundle writer: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	var bundle fhir.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("Failed to parse empty bundle: %v", err)
+	}
+	if bundle.Total == nil || *bundle.Total != 0 || len(bundle.Entry) != 0 {
+		t.Error("Expected empty bundle with total=0")
+	}
+}
+
+// TestAtomicOutput tests that output only appears at its path after Close
+func TestAtomicOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "output.ndjson")
+
+	writer, err := output.NewWriter(outputPath, output.FormatNDJSON)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.Write(&fhir.Observation{Id: strPtr("OBS1")}); err != nil {
+		t.Fatalf("Failed to write resource: %v", err)
+	}
+
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("Expected no output file before Close")
+	}
+	if _, err := os.Stat(output.PartialPath(outputPath)); err != nil {
+		t.Errorf("Expected partial output file while writing: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("Expected output file after Close: %v", err)
+	}
+	if _, err := os.Stat(output.PartialPath(outputPath)); !os.IsNotExist(err) {
+		t.Error("Expected partial output file to be gone after Close")
+	}
+}
+
+// TestAbortOutput tests that an aborted writer leaves no output behind
+func TestAbortOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "output.json")
+
+	writer, err := output.NewWriter(outputPath, output.FormatBundle)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Write(&fhir.Observation{Id: strPtr("OBS1")})
+
+	if err := writer.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	// Close after Abort must not resurrect the output
+	writer.Close()
+
+	entries, _ := os.ReadDir(tmpDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected no files after Abort, found %d", len(entries))
+	}
+}
+
+// TestIncompleteOutput tests that kept output of an interrupted run is marked
+// incomplete in every format: bundles by a tag, bulk exports by a missing
+// manifest and the other formats by a file next to the output
+func TestIncompleteOutput(t *testing.T) {
+	tests := []struct {
+		format output.Format
+		marked func(data []byte, outputPath string) bool
+	}{
+		{output.FormatBundle, func(data []byte, _ string) bool {
+			var bundle fhir.Bundle
+			return json.Unmarshal(data, &bundle) == nil && bundle.Meta != nil &&
+				len(bundle.Meta.Tag) == 1 && *bundle.Meta.Tag[0].Code == "incomplete"
+		}},
+		{output.FormatXML, func(data []byte, _ string) bool {
+			return strings.Contains(string(data), `<meta><tag><system value="https://github.com/lemmack/csv2fhir/tags"/><code value="incomplete"/>`)
+		}},
+		{output.FormatNDJSON, markedBySidecar},
+		{output.FormatXMLStream, markedBySidecar},
+		{output.FormatBulk, func(_ []byte, outputPath string) bool {
+			_, err := os.Stat(filepath.Join(outputPath, output.BulkManifestName))
+			return os.IsNotExist(err)
+		}},
+	}
+	for _, tt := range tests {
+		outputPath := filepath.Join(t.TempDir(), "output")
+		var writer output.ResourceWriter
+		var err error
+		if tt.format == output.FormatBulk {
+			writer, err = output.NewBulkWriter(outputPath, "file:///input.csv", output.Options{})
+		} else {
+			writer, err = output.NewWriterWithOptions(outputPath, output.Options{Format: tt.format})
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to create writer: %v", tt.format, err)
+		}
+		writer.Write(&fhir.Observation{Id: strPtr("OBS1")})
+		writer.MarkIncomplete()
+		if err := writer.Close(); err != nil {
+			t.Fatalf("%s: failed to close writer: %v", tt.format, err)
+		}
+
+		var data []byte
+		if tt.format != output.FormatBulk {
+			if data, err = os.ReadFile(outputPath); err != nil {
+				t.Fatalf("%s: failed to read output: %v", tt.format, err)
+			}
+		}
+		if !tt.marked(data, outputPath) {
+			t.Errorf("%s: expected the output to be marked incomplete", tt.format)
+		}
+	}
+
+	// A complete run replacing the output removes the earlier marker
+	outputPath := filepath.Join(t.TempDir(), "output.ndjson")
+	for _, incomplete := range []bool{true, false} {
+		writer, err := output.NewWriter(outputPath, output.FormatNDJSON)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if incomplete {
+			writer.MarkIncomplete()
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+	}
+	if _, err := os.Stat(output.IncompletePath(outputPath)); !os.IsNotExist(err) {
+		t.Error("Expected the marker of the earlier run to be removed")
+	}
+}
+
+// markedBySidecar reports whether the file marking incomplete output exists
+func markedBySidecar(_ []byte, outputPath string) bool {
+	data, err := os.ReadFile(output.IncompletePath(outputPath))
+	return err == nil && strings.Contains(string(data), "interrupted after writing 1 resources")
+}
+
+// TestResumeRejected tests that a refused resume leaves the partial output alone
+func TestResumeRejected(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputPath := filepath.Join(tmpDir, "output.ndjson")
+	partial := []byte(`{"resourceType":"Observation","id":"OBS1"}` + "\n")
+	if err := os.WriteFile(output.PartialPath(outputPath), partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := output.Options{Format: output.FormatNDJSON, Compression: output.CompressionGzip}
+	if _, err := output.NewWriterForResume(outputPath, opts, 0); err == nil {
+		t.Fatal("Expected resume of compressed output to fail")
+	}
+	data, err := os.ReadFile(output.PartialPath(outputPath))
+	if err != nil || string(data) != string(partial) {
+		t.Errorf("Expected partial output to be kept, got %q (%v)", data, err)
+	}
+}
+
+// TestMergedXML tests that merged rows are written as valid FHIR XML: in
+// element order and with one type of each choice element
+func TestMergedXML(t *testing.T) {
+	first, second, unit := json.Number("95.10"), json.Number("96"), "mg/dL"
+	rows := []interface{}{
+		&fhir.Observation{Id: strPtr("OBS1"), Status: fhir.ObservationStatusPreliminary, ValueString: strPtr("pending")},
+		&fhir.Observation{Id: strPtr("OBS1"), Status: fhir.ObservationStatusFinal,
+			ValueQuantity: &fhir.Quantity{Value: &first, Unit: &unit}},
+		&fhir.Observation{Id: strPtr("OBS1"), Status: fhir.ObservationStatusAmended,
+			Code: fhir.CodeableConcept{Text: strPtr("Glucose")}, ValueQuantity: &fhir.Quantity{Value: &second}},
+	}
+
+	detector, err := dedupe.NewDetector(dedupe.Merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detector.Close()
+	for i, row := range rows {
+		data, _ := json.Marshal(row)
+		keys, _ := dedupe.Keys(row)
+		if _, err := detector.Hold(dedupe.Entry{RowNumber: i + 2, Resource: data}, keys); err != nil {
+			t.Fatalf("Hold failed: %v", err)
+		}
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "output.xml")
+	writer, err := output.NewWriter(outputPath, output.FormatXMLStream)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	err = detector.Release(func(entry dedupe.Entry) error {
+		resource, err := decodeResource(entry.Resource)
+		if err != nil {
+			return err
+		}
+		return writer.Write(resource)
+	})
+	if err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	want := `<Observation xmlns="http://hl7.org/fhir"><id value="OBS1"/><status value="amended"/>` +
+		`<code><text value="Glucose"/></code><valueQuantity><value value="96"/><unit value="mg/dL"/></valueQuantity></Observation>`
+	if strings.TrimSpace(string(data)) != want {
+		t.Errorf("Merged XML:\ngot  %s\nwant %s", data, want)
+	}
+}
+
 // Helper function to create string pointer
 func strPtr(s string) *string {
 	return &s
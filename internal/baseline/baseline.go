@@ -0,0 +1,300 @@
+package baseline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"csv2fhir/internal/fhirjson"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// indexHeader is the first line of a hash index file
+const indexHeader = "# csv2fhir baseline index v1"
+
+// Status is how a resource compares with the baseline
+type Status int
+
+const (
+	Added     Status = iota // New id, or no id
+	Changed                 // Same id, different content
+	Unchanged               // Same id and content
+)
+
+// Fingerprint identifies a resource and its content
+type Fingerprint struct {
+	Key  string // "Type/id"; empty for resources without an id
+	Hash string // SHA-256 of the resource content
+}
+
+// Change is the result of comparing a resource with the baseline
+type Change struct {
+	Fingerprint
+	Status Status
+}
+
+// Index holds the content hashes of resources by "Type/id": those of the
+// baseline and those seen in this run
+type Index struct {
+	previous map[string]string
+	current  map[string]string
+	failed   int // Rows of this run that failed before their resources were checked
+}
+
+// New returns an index with an empty baseline, where every resource is added
+func New() *Index {
+	return &Index{previous: map[string]string{}, current: map[string]string{}}
+}
+
+// Load reads a baseline: either the NDJSON output of a previous run, plain,
+// gzip or zstd compressed, or a hash index written by Save. Provenance
+// resources of the previous run are ignored.
+func Load(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open baseline: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := decompress(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	index := New()
+	buffered := bufio.NewReader(reader)
+	first, err := buffered.Peek(len(indexHeader))
+	if err == nil && string(first) == indexHeader {
+		err = index.readIndex(buffered)
+	} else {
+		err = index.readNDJSON(buffered)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// decompress returns a reader of the decompressed content
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip baseline: %w", err)
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd baseline: %w", err)
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// readIndex reads "Type/id hash" lines
+func (x *Index) readIndex(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, hash, ok := strings.Cut(text, " ")
+		if !ok || key == "" || len(hash) != sha256.Size*2 {
+			return fmt.Errorf("baseline index line %d is not \"Type/id hash\"", line)
+		}
+		x.previous[key] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read baseline index: %w", err)
+	}
+	return nil
+}
+
+// readNDJSON hashes the resources of NDJSON output
+func (x *Index) readNDJSON(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for n := 1; ; n++ {
+		var resource map[string]interface{}
+		if err := decoder.Decode(&resource); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read baseline resource %d: %w", n, err)
+		}
+		if resource["resourceType"] == "Provenance" {
+			continue
+		}
+		fingerprint, err := hashElements(resource)
+		if err != nil {
+			return err
+		}
+		if fingerprint.Key != "" {
+			x.previous[fingerprint.Key] = fingerprint.Hash
+		}
+	}
+}
+
+// Check compares a resource, fingerprinted by Hash, with the baseline. A
+// resource seen in the baseline is no longer reported by Removed.
+func (x *Index) Check(fingerprint Fingerprint) Change {
+	change := Change{Fingerprint: fingerprint, Status: Added}
+	if fingerprint.Key == "" {
+		return change
+	}
+	if previous, ok := x.previous[fingerprint.Key]; ok {
+		change.Status = Changed
+		if previous == fingerprint.Hash {
+			change.Status = Unchanged
+		}
+		// Kept until the new content is committed, so a resource that fails
+		// to be written is still found changed next time
+		if _, seen := x.current[fingerprint.Key]; !seen {
+			x.current[fingerprint.Key] = previous
+		}
+	}
+	return change
+}
+
+// Commit records the content of a resource written or left unchanged
+func (x *Index) Commit(change Change) {
+	if change.Key != "" {
+		x.current[change.Key] = change.Hash
+	}
+}
+
+// Fail records a row of this run that failed before its resources were
+// checked. Its resources may still be in the input, so after a failed row no
+// baseline resource is reported removed and Save keeps those not seen.
+func (x *Index) Fail() {
+	x.failed++
+}
+
+// Failed returns the number of rows recorded by Fail
+func (x *Index) Failed() int {
+	return x.failed
+}
+
+// Removed returns the "Type/id" of the baseline resources not seen in this
+// run, sorted; none when a row failed
+func (x *Index) Removed() []string {
+	if x.failed > 0 {
+		return nil
+	}
+	var removed []string
+	for key := range x.previous {
+		if _, ok := x.current[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// Retain keeps a removed resource in the index, e.g. when its deletion could
+// not be written
+func (x *Index) Retain(key string) {
+	if hash, ok := x.previous[key]; ok {
+		x.current[key] = hash
+	}
+}
+
+// Save writes the hashes of this run's resources as a hash index for the next
+// run's baseline. The file is replaced atomically.
+func (x *Index) Save(path string) error {
+	if x.failed > 0 {
+		for key, hash := range x.previous {
+			if _, ok := x.current[key]; !ok {
+				x.current[key] = hash
+			}
+		}
+	}
+	keys := make([]string, 0, len(x.current))
+	for key := range x.current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create baseline index: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	writer.WriteString(indexHeader + "\n")
+	for _, key := range keys {
+		writer.WriteString(key + " " + x.current[key] + "\n")
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write baseline index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace baseline index: %w", err)
+	}
+	return nil
+}
+
+// Hash fingerprints a resource. It is safe for concurrent use. meta is left
+// out of the hash: it describes the run that wrote the resource, e.g. its
+// lastUpdated, rather than the resource.
+func Hash(resource interface{}) (Fingerprint, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var elements map[string]interface{}
+	if err := decoder.Decode(&elements); err != nil {
+		return Fingerprint{}, fmt.Errorf("failed to read resource: %w", err)
+	}
+	return hashElements(elements)
+}
+
+// hashElements hashes a decoded resource in canonical JSON, the same form
+// -canonical writes, so the hash does not depend on the layout, escaping or
+// number format the resource was read in.
+func hashElements(elements map[string]interface{}) (Fingerprint, error) {
+	var fingerprint Fingerprint
+	resourceType, _ := elements["resourceType"].(string)
+	if id, ok := elements["id"].(string); ok && id != "" && resourceType != "" {
+		fingerprint.Key = resourceType + "/" + id
+	}
+	delete(elements, "meta")
+
+	data, err := json.Marshal(elements)
+	if err == nil {
+		data, err = fhirjson.Canonical(data)
+	}
+	if err != nil {
+		return Fingerprint{}, fmt.Errorf("failed to hash resource: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	fingerprint.Hash = hex.EncodeToString(sum[:])
+	return fingerprint, nil
+}
@@ -0,0 +1,179 @@
+package baseline
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"csv2fhir/internal/fhirjson"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// TestHash tests that hashes ignore layout and meta but not content
+func TestHash(t *testing.T) {
+	patient := &fhir.Patient{Id: strPtr("P1")}
+	fingerprint, err := Hash(patient)
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	if fingerprint.Key != "Patient/P1" {
+		t.Errorf("Unexpected key %s", fingerprint.Key)
+	}
+
+	stamped := &fhir.Patient{Id: strPtr("P1"), Meta: &fhir.Meta{LastUpdated: strPtr("2026-01-01T00:00:00Z")}}
+	if other, _ := Hash(stamped); other != fingerprint {
+		t.Error("Expected meta to be left out of the hash")
+	}
+	changed := &fhir.Patient{Id: strPtr("P1"), BirthDate: strPtr("2000-01-01")}
+	if other, _ := Hash(changed); other.Hash == fingerprint.Hash {
+		t.Error("Expected a different hash for different content")
+	}
+	if other, _ := Hash(&fhir.Patient{}); other.Key != "" {
+		t.Errorf("Expected no key without an id, got %s", other.Key)
+	}
+
+	// The hash is of the canonical JSON that --canonical writes
+	data, _ := json.Marshal(changed)
+	canonical, err := fhirjson.Canonical(data)
+	if err != nil {
+		t.Fatalf("Canonical failed: %v", err)
+	}
+	sum := sha256.Sum256(canonical)
+	if other, _ := Hash(changed); other.Hash != hex.EncodeToString(sum[:]) {
+		t.Error("Expected the hash of the canonical JSON")
+	}
+}
+
+// TestHash_NumberFormat tests that exponents are normalized before hashing
+// while the precision of decimals is kept
+func TestHash_NumberFormat(t *testing.T) {
+	hash := func(value string) string {
+		fingerprint, err := hashElements(map[string]interface{}{
+			"resourceType": "Observation", "id": "O1", "valueDecimal": json.Number(value),
+		})
+		if err != nil {
+			t.Fatalf("hashElements failed: %v", err)
+		}
+		return fingerprint.Hash
+	}
+	if hash("1E2") != hash("100") {
+		t.Error("Expected 1E2 and 100 to hash alike")
+	}
+	if hash("1.50") == hash("1.5") {
+		t.Error("Expected 1.50 and 1.5 to hash differently")
+	}
+}
+
+// TestIndex tests change detection against NDJSON output and saved indexes
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	previous := filepath.Join(dir, "previous.ndjson.gz")
+	file, err := os.Create(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(file)
+	// Pretty-printed, keys in another order, with a Provenance to ignore
+	gz.Write([]byte(`{"resourceType": "Patient", "id": "P1"}
+{"id":"P2","resourceType":"Patient","birthDate":"2000-01-01"}
+{"id":"P3","resourceType":"Patient"}
+{"id":"PR1","resourceType":"Provenance"}
+`))
+	gz.Close()
+	file.Close()
+
+	index, err := Load(previous)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	check := func(resource interface{}) Change {
+		fingerprint, err := Hash(resource)
+		if err != nil {
+			t.Fatalf("Hash failed: %v", err)
+		}
+		return index.Check(fingerprint)
+	}
+
+	unchanged := check(&fhir.Patient{Id: strPtr("P1")})
+	changed := check(&fhir.Patient{Id: strPtr("P2"), BirthDate: strPtr("2001-01-01")})
+	added := check(&fhir.Patient{Id: strPtr("P4")})
+	if unchanged.Status != Unchanged || changed.Status != Changed || added.Status != Added {
+		t.Errorf("Unexpected statuses: %v %v %v", unchanged.Status, changed.Status, added.Status)
+	}
+	if removed := index.Removed(); !reflect.DeepEqual(removed, []string{"Patient/P3"}) {
+		t.Errorf("Expected Patient/P3 removed, got %v", removed)
+	}
+
+	// The changed resource is not committed, as if it failed to be written
+	index.Commit(unchanged)
+	index.Commit(added)
+	indexPath := filepath.Join(dir, "index.txt")
+	if err := index.Save(indexPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	next, err := Load(indexPath)
+	if err != nil {
+		t.Fatalf("Load of index failed: %v", err)
+	}
+	if !reflect.DeepEqual(next.previous, map[string]string{
+		"Patient/P1": unchanged.Hash,
+		"Patient/P2": index.previous["Patient/P2"],
+		"Patient/P4": added.Hash,
+	}) {
+		t.Errorf("Unexpected saved index: %v", next.previous)
+	}
+}
+
+func TestIndex_Failed(t *testing.T) {
+	dir := t.TempDir()
+	previous := filepath.Join(dir, "previous.ndjson")
+	if err := os.WriteFile(previous, []byte(`{"resourceType":"Patient","id":"P1"}
+{"resourceType":"Patient","id":"P2"}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	index, err := Load(previous)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	// P2's row fails, so P2 is missing from the run but not removed
+	fingerprint, err := Hash(&fhir.Patient{Id: strPtr("P1"), BirthDate: strPtr("2000-01-01")})
+	if err != nil {
+		t.Fatalf("Hash failed: %v", err)
+	}
+	index.Commit(index.Check(fingerprint))
+	index.Fail()
+	if removed := index.Removed(); len(removed) != 0 {
+		t.Errorf("Expected no removed resources after a failed row, got %v", removed)
+	}
+	if index.Failed() != 1 {
+		t.Errorf("Expected 1 failed row, got %d", index.Failed())
+	}
+
+	indexPath := filepath.Join(dir, "index.txt")
+	if err := index.Save(indexPath); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	next, err := Load(indexPath)
+	if err != nil {
+		t.Fatalf("Load of index failed: %v", err)
+	}
+	if !reflect.DeepEqual(next.previous, map[string]string{
+		"Patient/P1": fingerprint.Hash,
+		"Patient/P2": index.previous["Patient/P2"],
+	}) {
+		t.Errorf("Unexpected saved index: %v", next.previous)
+	}
+}
@@ -0,0 +1,115 @@
+package checkpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Checkpoint records how far a conversion has progressed so that an
+// interrupted run can continue where it stopped
+type Checkpoint struct {
+	InputPath       string `json:"inputPath"`
+	InputChecksum   string `json:"inputChecksum"`        // SHA-256 of the input CSV
+	MappingChecksum string `json:"mappingChecksum"`      // SHA-256 of the mapping file
+	RowNumber       int    `json:"rowNumber"`            // Last contiguously committed CSV row
+	InputOffset     int64  `json:"inputOffset"`          // Input byte offset just past RowNumber
+	OutputOffset    int64  `json:"outputOffset"`         // Output bytes written up to RowNumber
+	Resources       int    `json:"resources"`            // Resources written up to RowNumber
+	RunID           string `json:"runId,omitempty"`      // Run id stamped into the output
+	RunStarted      string `json:"runStarted,omitempty"` // Run start time stamped into the output
+	UpdatedAt       string `json:"updatedAt"`
+}
+
+// DefaultPath returns the checkpoint path used for an output file
+func DefaultPath(outputPath string) string {
+	return outputPath + ".checkpoint"
+}
+
+// FileChecksum returns the hex-encoded SHA-256 checksum of a file
+func FileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Load reads a checkpoint file
+func Load(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// Save writes the checkpoint atomically, so a crash mid-write never leaves
+// a truncated checkpoint behind
+func (c *Checkpoint) Save(path string) error {
+	c.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to replace checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Verify checks that the checkpoint was written for the same input and mapping
+func (c *Checkpoint) Verify(inputChecksum, mappingChecksum string) error {
+	if c.InputChecksum != inputChecksum {
+		return fmt.Errorf("input file has changed since the checkpoint was written")
+	}
+	if c.MappingChecksum != mappingChecksum {
+		return fmt.Errorf("mapping file has changed since the checkpoint was written")
+	}
+	return nil
+}
+
+// Remove deletes a checkpoint file, ignoring a file that does not exist
+func Remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package checkpoint
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSaveAndLoad tests round-tripping a checkpoint through a file
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.ndjson.checkpoint")
+
+	cp := &Checkpoint{
+		InputPath:       "data.csv",
+		InputChecksum:   "abc",
+		MappingChecksum: "def",
+		RowNumber:       42,
+		InputOffset:     1234,
+		OutputOffset:    5678,
+		Resources:       40,
+	}
+	if err := cp.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.RowNumber != 42 || loaded.InputOffset != 1234 || loaded.OutputOffset != 5678 || loaded.Resources != 40 {
+		t.Errorf("Unexpected checkpoint after load: %+v", loaded)
+	}
+	if loaded.UpdatedAt == "" {
+		t.Error("Expected UpdatedAt to be set")
+	}
+
+	// No temp files should be left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the checkpoint file, found %d entries", len(entries))
+	}
+}
+
+// TestLoad_FileNotFound tests error handling for a missing checkpoint
+func TestLoad_FileNotFound(t *testing.T) {
+	if _, err := Load("/nonexistent/checkpoint"); err == nil {
+		t.Fatal("Expected error for missing checkpoint, got nil")
+	}
+}
+
+// TestVerify tests checksum verification
+func TestVerify(t *testing.T) {
+	cp := &Checkpoint{InputChecksum: "in", MappingChecksum: "map"}
+
+	if err := cp.Verify("in", "map"); err != nil {
+		t.Errorf("Expected matching checksums to verify, got %v", err)
+	}
+	if err := cp.Verify("other", "map"); err == nil {
+		t.Error("Expected error for changed input")
+	}
+	if err := cp.Verify("in", "other"); err == nil {
+		t.Error("Expected error for changed mapping")
+	}
+}
+
+// TestFileChecksum tests checksums of file contents
+func TestFileChecksum(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.csv")
+	b := filepath.Join(dir, "b.csv")
+	os.WriteFile(a, []byte("id\n1\n"), 0644)
+	os.WriteFile(b, []byte("id\n2\n"), 0644)
+
+	sumA, err := FileChecksum(a)
+	if err != nil {
+		t.Fatalf("FileChecksum failed: %v", err)
+	}
+	sumB, _ := FileChecksum(b)
+	if sumA == sumB {
+		t.Error("Expected different checksums for different content")
+	}
+	if len(sumA) != 64 {
+		t.Errorf("Expected hex SHA-256 checksum, got %q", sumA)
+	}
+}
+
+// TestRemove tests that removing a missing checkpoint is not an error
+func TestRemove(t *testing.T) {
+	if err := Remove(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("Expected no error removing missing checkpoint, got %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -11,11 +12,127 @@ import (
 
 // MappingConfig represents the YAML mapping configuration
 type MappingConfig struct {
-	Resource   string            `yaml:"resource"`
-	IDColumn   string            `yaml:"id_column"`
-	Mappings   map[string]string `yaml:"mappings"`
-	Defaults   map[string]string `yaml:"defaults"`
-	csvColumns map[string]bool   // Track available CSV columns for validation
+	Resource    string             `yaml:"resource"`
+	IDColumn    string             `yaml:"id_column"`
+	Mappings    map[string]string  `yaml:"mappings"`
+	Defaults    map[string]string  `yaml:"defaults"`
+	Bundle      BundleConfig       `yaml:"bundle"`
+	Meta        MetaConfig         `yaml:"meta"`
+	Narrative   string             `yaml:"narrative"` // Go template rendered into text.div
+	Attachments []AttachmentConfig `yaml:"attachments"`
+	Duplicates  string             `yaml:"duplicates"` // warn, error, keep-first, keep-last or merge
+	Rules       []RuleConfig       `yaml:"rules"`
+	Validation  ValidationConfig   `yaml:"validation"`
+	csvColumns  map[string]bool    // Track available CSV columns for validation
+}
+
+// AttachmentConfig embeds a file named by the row into an Attachment element
+type AttachmentConfig struct {
+	Path        string `yaml:"path"`         // Attachment element, e.g. content[0].attachment
+	File        string `yaml:"file"`         // File path, e.g. ${file_path}
+	ContentType string `yaml:"content_type"` // Sniffed from the file when empty
+	Binary      bool   `yaml:"binary"`       // Store the data in a Binary resource referenced by url
+}
+
+// RuleConfig is a FHIRPath invariant every resource must satisfy
+type RuleConfig struct {
+	ID         string `yaml:"id"`         // Rule id for overrides (default: derived from the expression)
+	Expression string `yaml:"expression"` // e.g. valueQuantity.exists() implies valueQuantity.unit.exists()
+	Severity   string `yaml:"severity"`   // error (default), warning or information
+	Message    string `yaml:"message"`
+	Field      string `yaml:"field"` // FHIR path reported with the issue, the resource type by default
+}
+
+// BundleConfig holds mapping-level bundle settings
+type BundleConfig struct {
+	// Identifier system used to build request.ifNoneExist for conditional creates
+	IfNoneExistSystem string `yaml:"if_none_exist_system"`
+
+	// Composition or MessageHeader of document and message bundles
+	Header HeaderConfig `yaml:"header"`
+}
+
+// HeaderConfig describes the first entry of document and message bundles
+type HeaderConfig struct {
+	// Document bundles
+	Title        string       `yaml:"title"`
+	Type         CodingConfig `yaml:"type"`
+	Author       string       `yaml:"author"` // Reference, e.g. Organization/LAB1
+	SectionTitle string       `yaml:"section_title"`
+
+	// Message bundles
+	Event        CodingConfig     `yaml:"event"`
+	Source       EndpointConfig   `yaml:"source"`
+	Destinations []EndpointConfig `yaml:"destinations"`
+}
+
+// CodingConfig is a code from a code system
+type CodingConfig struct {
+	System  string `yaml:"system"`
+	Code    string `yaml:"code"`
+	Display string `yaml:"display"`
+}
+
+// EndpointConfig is a message source or destination
+type EndpointConfig struct {
+	Endpoint string `yaml:"endpoint"`
+	Name     string `yaml:"name"`
+}
+
+// MetaConfig holds meta elements stamped on every resource. Values may use
+// CSV columns and the run variables ${input_file}, ${run_id} and ${timestamp}.
+type MetaConfig struct {
+	Profile     []string       `yaml:"profile"`
+	Source      string         `yaml:"source"`
+	Tag         []CodingConfig `yaml:"tag"`
+	LastUpdated string         `yaml:"last_updated"`
+}
+
+// RunVariables are the variables available to meta values besides CSV
+// columns. They take precedence over columns of the same name.
+var RunVariables = []string{"input_file", "run_id", "timestamp"}
+
+// IsZero reports whether no meta elements are configured
+func (m MetaConfig) IsZero() bool {
+	return len(m.Profile) == 0 && m.Source == "" && len(m.Tag) == 0 && m.LastUpdated == ""
+}
+
+// Resolve returns the meta config with the run variables in vars substituted.
+// Column variables are left for SubstituteVariables.
+func (m MetaConfig) Resolve(vars map[string]string) MetaConfig {
+	substitute := func(template string) string {
+		return variableRegex.ReplaceAllStringFunc(template, func(match string) string {
+			if value, ok := vars[match[2:len(match)-1]]; ok {
+				return value
+			}
+			return match
+		})
+	}
+
+	resolved := MetaConfig{
+		Source:      substitute(m.Source),
+		LastUpdated: substitute(m.LastUpdated),
+	}
+	for _, profile := range m.Profile {
+		resolved.Profile = append(resolved.Profile, substitute(profile))
+	}
+	for _, tag := range m.Tag {
+		resolved.Tag = append(resolved.Tag, CodingConfig{
+			System:  substitute(tag.System),
+			Code:    substitute(tag.Code),
+			Display: substitute(tag.Display),
+		})
+	}
+	return resolved
+}
+
+// templates returns every meta value that may contain variables
+func (m MetaConfig) templates() []string {
+	templates := append([]string{m.Source, m.LastUpdated}, m.Profile...)
+	for _, tag := range m.Tag {
+		templates = append(templates, tag.System, tag.Code, tag.Display)
+	}
+	return templates
 }
 
 // PathSegment represents a part of a FHIR path (field name or array index)
@@ -50,6 +167,30 @@ func LoadMapping(path string) (*MappingConfig, error) {
 		config.Defaults = make(map[string]string)
 	}
 
+	for i, attachment := range config.Attachments {
+		if attachment.Path == "" || attachment.File == "" {
+			return nil, fmt.Errorf("attachment %d requires path and file", i+1)
+		}
+	}
+
+	switch config.Duplicates {
+	case "", "warn", "error", "keep-first", "keep-last", "merge":
+	default:
+		return nil, fmt.Errorf("unsupported duplicates policy: %s (supported: warn, error, keep-first, keep-last, merge)", config.Duplicates)
+	}
+
+	for i, rule := range config.Rules {
+		if strings.TrimSpace(rule.Expression) == "" {
+			return nil, fmt.Errorf("rule %d has no expression", i+1)
+		}
+		if rule.Severity != "" && !isSeverity(rule.Severity) {
+			return nil, fmt.Errorf("unsupported severity for rule %d: %s (supported: error, warning, information)", i+1, rule.Severity)
+		}
+	}
+	if err := config.Validation.validate(); err != nil {
+		return nil, fmt.Errorf("invalid validation section: %w", err)
+	}
+
 	config.csvColumns = make(map[string]bool)
 
 	return &config, nil
@@ -82,6 +223,24 @@ func (m *MappingConfig) ValidateColumns() error {
 		}
 	}
 
+	// Check attachments
+	for _, attachment := range m.Attachments {
+		for _, col := range append(extractVariables(attachment.File), extractVariables(attachment.ContentType)...) {
+			if !m.csvColumns[col] {
+				missingColumns[col] = true
+			}
+		}
+	}
+
+	// Check meta values, which may also use run variables
+	for _, value := range m.Meta.templates() {
+		for _, col := range extractVariables(value) {
+			if !m.csvColumns[col] && !isRunVariable(col) {
+				missingColumns[col] = true
+			}
+		}
+	}
+
 	if len(missingColumns) > 0 {
 		missing := make([]string, 0, len(missingColumns))
 		for col := range missingColumns {
@@ -93,6 +252,67 @@ func (m *MappingConfig) ValidateColumns() error {
 	return nil
 }
 
+// SourceColumns returns the CSV columns the mapping fills an element and its
+// children from, for reporting issues found in it. Elements are matched by
+// their indices first, then ignoring indices and slice names, so an issue in
+// category:Laboratory.coding finds the columns of category[0].coding[0].code.
+func (m *MappingConfig) SourceColumns(field string) []string {
+	var exact, loose []string
+	if field == "id" && m.IDColumn != "" {
+		exact = append(exact, m.IDColumn)
+	}
+	base := stripIndices(field)
+	for path, value := range m.Mappings {
+		switch {
+		case containsPath(path, field):
+			exact = append(exact, extractVariables(value)...)
+		case containsPath(stripIndices(path), base):
+			loose = append(loose, extractVariables(value)...)
+		}
+	}
+	if len(exact) == 0 {
+		exact = loose
+	}
+
+	seen := make(map[string]bool)
+	columns := exact[:0]
+	for _, column := range exact {
+		if !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// containsPath reports whether path is element or one of its children
+func containsPath(path, element string) bool {
+	if element == "" || !strings.HasPrefix(path, element) {
+		return false
+	}
+	rest := path[len(element):]
+	return rest == "" || rest[0] == '.' || rest[0] == '['
+}
+
+// sliceOrIndex matches the indices and slice names of a path
+var sliceOrIndex = regexp.MustCompile(`\[\d+\]|:[^.\[]+`)
+
+// stripIndices removes the indices and slice names of a path
+func stripIndices(path string) string {
+	return sliceOrIndex.ReplaceAllString(path, "")
+}
+
+// isRunVariable reports whether name is one of the RunVariables
+func isRunVariable(name string) bool {
+	for _, variable := range RunVariables {
+		if variable == name {
+			return true
+		}
+	}
+	return false
+}
+
 // SubstituteVariables replaces ${column_name} or ${func:name:column_name} with values from the CSV row
 // Returns the substituted string and an error if any variables couldn't be substituted
 func SubstituteVariables(template string, row map[string]string) (string, error) {
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -39,6 +40,56 @@ defaults:
 	}
 }
 
+// TestLoadMapping_BundleSection tests loading bundle settings
+func TestLoadMapping_BundleSection(t *testing.T) {
+	content := `resource: Patient
+mappings:
+  identifier[0].value: "${mrn}"
+bundle:
+  if_none_exist_system: "http://hospital.org/mrn"
+`
+	tmpFile := createTempYAMLFile(t, content)
+
+	config, err := LoadMapping(tmpFile)
+	if err != nil {
+		t.Fatalf("LoadMapping failed: %v", err)
+	}
+	if config.Bundle.IfNoneExistSystem != "http://hospital.org/mrn" {
+		t.Errorf("Expected if_none_exist_system to be loaded, got %q", config.Bundle.IfNoneExistSystem)
+	}
+}
+
+// TestLoadMapping_BundleHeader tests loading the document and message header
+func TestLoadMapping_BundleHeader(t *testing.T) {
+	content := `resource: Observation
+mappings:
+  status: final
+bundle:
+  header:
+    title: Lab results
+    type: {system: "http://loinc.org", code: "11502-2", display: "Laboratory report"}
+    author: Organization/LAB1
+    event: {system: "http://example.org/events", code: "lab-result"}
+    source: {endpoint: "urn:lab:1", name: Main lab}
+    destinations:
+      - endpoint: "https://ehr.example.org/fhir"
+`
+	tmpFile := createTempYAMLFile(t, content)
+
+	config, err := LoadMapping(tmpFile)
+	if err != nil {
+		t.Fatalf("LoadMapping failed: %v", err)
+	}
+	header := config.Bundle.Header
+	if header.Title != "Lab results" || header.Type.Code != "11502-2" || header.Author != "Organization/LAB1" {
+		t.Errorf("Unexpected document header: %+v", header)
+	}
+	if header.Event.Code != "lab-result" || header.Source.Name != "Main lab" ||
+		len(header.Destinations) != 1 || header.Destinations[0].Endpoint != "https://ehr.example.org/fhir" {
+		t.Errorf("Unexpected message header: %+v", header)
+	}
+}
+
 // TestLoadMapping_FileNotFound tests error handling for missing files
 func TestLoadMapping_FileNotFound(t *testing.T) {
 	_, err := LoadMapping("/nonexistent/file.yaml")
@@ -408,3 +459,157 @@ func createTempYAMLFile(t *testing.T, content string) string {
 	}
 	return tmpFile
 }
+
+// TestMetaConfig_Resolve tests substituting run variables and keeping column variables
+func TestMetaConfig_Resolve(t *testing.T) {
+	meta := MetaConfig{
+		Profile:     []string{"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient"},
+		Source:      "urn:feed:${input_file}#${site}",
+		Tag:         []CodingConfig{{System: "http://example.org/run", Code: "${run_id}"}},
+		LastUpdated: "${timestamp}",
+	}
+	resolved := meta.Resolve(map[string]string{"input_file": "patients.csv", "run_id": "run-1", "timestamp": "2026-01-02T03:04:05Z"})
+
+	if resolved.Source != "urn:feed:patients.csv#${site}" {
+		t.Errorf("Unexpected source %q", resolved.Source)
+	}
+	if resolved.Tag[0].Code != "run-1" || resolved.LastUpdated != "2026-01-02T03:04:05Z" {
+		t.Errorf("Unexpected resolved meta: %+v", resolved)
+	}
+	if meta.Tag[0].Code != "${run_id}" {
+		t.Error("Resolve modified the original config")
+	}
+	if resolved.IsZero() || !(MetaConfig{}).IsZero() {
+		t.Error("Unexpected IsZero result")
+	}
+}
+
+// TestValidateColumns_Meta tests that meta values may use run variables and existing columns
+func TestValidateColumns_Meta(t *testing.T) {
+	config := &MappingConfig{
+		Mappings: map[string]string{},
+		Meta:     MetaConfig{Source: "urn:feed:${input_file}#${site}"},
+	}
+	config.SetCSVColumns([]string{"site"})
+	if err := config.ValidateColumns(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	config.Meta.Tag = []CodingConfig{{Code: "${batch}"}}
+	if err := config.ValidateColumns(); err == nil {
+		t.Error("Expected error for missing meta column")
+	}
+}
+
+// TestLoadMapping_Attachments tests loading and checking attachment mappings
+func TestLoadMapping_Attachments(t *testing.T) {
+	content := `resource: DocumentReference
+mappings:
+  status: current
+attachments:
+  - path: content[0].attachment
+    file: "${file_path}"
+    content_type: application/pdf
+    binary: true
+`
+	config, err := LoadMapping(createTempYAMLFile(t, content))
+	if err != nil {
+		t.Fatalf("LoadMapping failed: %v", err)
+	}
+	if len(config.Attachments) != 1 || config.Attachments[0].File != "${file_path}" || !config.Attachments[0].Binary {
+		t.Errorf("Unexpected attachments: %+v", config.Attachments)
+	}
+
+	config.SetCSVColumns([]string{"id"})
+	if err := config.ValidateColumns(); err == nil {
+		t.Error("Expected error for missing attachment column")
+	}
+
+	content = `resource: DocumentReference
+attachments:
+  - path: content[0].attachment
+`
+	if _, err := LoadMapping(createTempYAMLFile(t, content)); err == nil {
+		t.Error("Expected error for attachment without file")
+	}
+}
+
+// TestLoadMapping_Duplicates tests reading and checking the duplicates policy
+func TestLoadMapping_Duplicates(t *testing.T) {
+	config, err := LoadMapping(createTempYAMLFile(t, "resource: Patient\nduplicates: keep-last\n"))
+	if err != nil {
+		t.Fatalf("LoadMapping failed: %v", err)
+	}
+	if config.Duplicates != "keep-last" {
+		t.Errorf("Expected keep-last, got %s", config.Duplicates)
+	}
+
+	if _, err := LoadMapping(createTempYAMLFile(t, "resource: Patient\nduplicates: newest\n")); err == nil {
+		t.Error("Expected error for unsupported duplicates policy")
+	}
+}
+
+// TestLoadMapping_Rules tests that rules need an expression and a known severity
+func TestLoadMapping_Rules(t *testing.T) {
+	yaml := `resource: Observation
+rules:
+  - expression: valueQuantity.exists() implies valueQuantity.unit.exists()
+    message: Quantities need a unit
+  - expression: effective <= now()
+    severity: warning
+`
+	config, err := LoadMapping(createTempYAMLFile(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadMapping failed: %v", err)
+	}
+	if len(config.Rules) != 2 || config.Rules[1].Severity != "warning" || config.Rules[0].Message != "Quantities need a unit" {
+		t.Errorf("Unexpected rules: %+v", config.Rules)
+	}
+
+	for _, invalid := range []string{
+		"resource: Patient\nrules:\n  - message: No expression\n",
+		"resource: Patient\nrules:\n  - expression: active\n    severity: fatal\n",
+	} {
+		if _, err := LoadMapping(createTempYAMLFile(t, invalid)); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+// TestSourceColumns tests that issues in elements are traced back to columns
+func TestSourceColumns(t *testing.T) {
+	config := &MappingConfig{
+		IDColumn: "record_id",
+		Mappings: map[string]string{
+			"subject.reference":          "Patient/${patient_id}",
+			"code.coding[0].code":        "${loinc_code}",
+			"code.coding[0].display":     "${test_name}",
+			"code.coding[1].code":        "${local_code}",
+			"category[0].coding[0].code": "${category}",
+			"valueQuantity.value":        "${func:trim:result_value}",
+			"status":                     "final",
+		},
+	}
+	tests := []struct {
+		field string
+		want  []string
+	}{
+		{"id", []string{"record_id"}},
+		{"subject", []string{"patient_id"}},
+		{"subject.reference", []string{"patient_id"}},
+		{"code.coding[0]", []string{"loinc_code", "test_name"}},
+		{"code.coding[1].code", []string{"local_code"}},
+		{"code", []string{"local_code", "loinc_code", "test_name"}},
+		{"category:Laboratory.coding", []string{"category"}},
+		{"valueQuantity", []string{"result_value"}},
+		{"status", nil},
+		{"Observation", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got := config.SourceColumns(tt.field)
+		if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("SourceColumns(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
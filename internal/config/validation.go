@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationConfig adjusts the issues validation reports, in the mapping's
+// validation section or a separate file
+type ValidationConfig struct {
+	Overrides []IssueOverride `yaml:"overrides"`
+	Suppress  []IssueMatch    `yaml:"suppress"`
+}
+
+// IssueMatch selects issues by rule id, resource type and field. Empty
+// parts match any issue.
+type IssueMatch struct {
+	Rule     string `yaml:"rule"`     // e.g. datetime-format or the id of a mapping rule
+	Resource string `yaml:"resource"` // e.g. Observation
+	Field    string `yaml:"field"`    // The element or any of its children, e.g. code
+}
+
+// UnmarshalYAML accepts a rule id alone for the issues of the rule
+func (m *IssueMatch) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		m.Rule = node.Value
+		return nil
+	}
+	type plain IssueMatch
+	return node.Decode((*plain)(m))
+}
+
+// IssueOverride changes the severity of the issues it matches
+type IssueOverride struct {
+	Rule     string `yaml:"rule"`
+	Resource string `yaml:"resource"`
+	Field    string `yaml:"field"`
+	Severity string `yaml:"severity"` // error, warning or information
+}
+
+// LoadValidationConfig loads a validation config file, which has the keys of
+// a mapping's validation section
+func LoadValidationConfig(path string) (*ValidationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validation config: %w", err)
+	}
+	var config ValidationConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse validation config: %w", err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// validate checks that overrides have a severity and select issues, and
+// suppressions name a rule
+func (v ValidationConfig) validate() error {
+	for i, override := range v.Overrides {
+		if override.Rule == "" && override.Field == "" {
+			return fmt.Errorf("override %d needs a rule or field", i+1)
+		}
+		if !isSeverity(override.Severity) {
+			return fmt.Errorf("unsupported severity for override %d: %q (supported: error, warning, information)", i+1, override.Severity)
+		}
+	}
+	for i, match := range v.Suppress {
+		if match.Rule == "" {
+			return fmt.Errorf("suppression %d needs a rule", i+1)
+		}
+	}
+	return nil
+}
+
+// isSeverity reports whether s is a severity of validation issues
+func isSeverity(s string) bool {
+	return s == "error" || s == "warning" || s == "information"
+}
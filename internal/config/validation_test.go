@@ -0,0 +1,55 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLoadValidationConfig tests overrides and suppressions given as rule ids or matches
+func TestLoadValidationConfig(t *testing.T) {
+	yaml := `overrides:
+  - rule: datetime-format
+    severity: warning
+  - rule: required-field
+    resource: Observation
+    field: subject
+    severity: information
+suppress:
+  - profile-max-length
+  - rule: binding
+    field: code
+`
+	config, err := LoadValidationConfig(createTempYAMLFile(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadValidationConfig failed: %v", err)
+	}
+	expected := &ValidationConfig{
+		Overrides: []IssueOverride{
+			{Rule: "datetime-format", Severity: "warning"},
+			{Rule: "required-field", Resource: "Observation", Field: "subject", Severity: "information"},
+		},
+		Suppress: []IssueMatch{{Rule: "profile-max-length"}, {Rule: "binding", Field: "code"}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+}
+
+// TestLoadValidationConfig_Invalid tests that incomplete entries are rejected
+func TestLoadValidationConfig_Invalid(t *testing.T) {
+	for _, yaml := range []string{
+		"overrides:\n  - rule: binding\n",
+		"overrides:\n  - rule: binding\n    severity: fatal\n",
+		"overrides:\n  - resource: Observation\n    severity: warning\n",
+		"suppress:\n  - field: code\n",
+	} {
+		if _, err := LoadValidationConfig(createTempYAMLFile(t, yaml)); err == nil {
+			t.Errorf("Expected error for %q", yaml)
+		}
+	}
+
+	mapping := "resource: Observation\nvalidation:\n  suppress:\n    - field: code\n"
+	if _, err := LoadMapping(createTempYAMLFile(t, mapping)); err == nil {
+		t.Error("Expected error for an invalid validation section")
+	}
+}
@@ -0,0 +1,185 @@
+package csv
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// StdinPath is the input path that reads from standard input
+const StdinPath = "-"
+
+// Magic numbers of the supported compressed input formats
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// input is an opened CSV source. seeker is set only for plain files, which
+// can be repositioned directly; compressed inputs are decompressed from the
+// start instead.
+type input struct {
+	io.Reader
+	seeker  io.Seeker
+	closers []io.Closer
+}
+
+// Close closes the decompressor and the underlying file
+func (in *input) Close() error {
+	var first error
+	for _, closer := range in.closers {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// openInput opens path ("-" for stdin) and transparently decompresses gzip,
+// zstd and zip content, detected by its leading bytes rather than its name so
+// compressed stdin works too. member selects the file to read from a zip
+// archive and may be empty when the archive holds a single file.
+func openInput(path, member string) (*input, error) {
+	var file *os.File
+	if path == StdinPath {
+		file = os.Stdin
+	} else {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open CSV file: %w", err)
+		}
+	}
+
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read gzip input: %w", err)
+		}
+		return &input{Reader: gz, closers: []io.Closer{gz, file}}, nil
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to read zstd input: %w", err)
+		}
+		return &input{Reader: decoder, closers: []io.Closer{decoder.IOReadCloser(), file}}, nil
+
+	case bytes.HasPrefix(magic, zipMagic):
+		return openZipMember(file, buffered, member)
+	}
+
+	if member != "" {
+		file.Close()
+		return nil, fmt.Errorf("input member %q given but input is not a zip archive", member)
+	}
+	if path == StdinPath {
+		return &input{Reader: buffered, closers: []io.Closer{file}}, nil
+	}
+
+	// Plain files are read directly so they can be seeked on resume
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to rewind CSV file: %w", err)
+	}
+	return &input{Reader: file, seeker: file, closers: []io.Closer{file}}, nil
+}
+
+// openZipMember opens one file of a zip archive. Zip archives need random
+// access, so an archive read from stdin is first copied to a temporary file.
+func openZipMember(file *os.File, buffered *bufio.Reader, member string) (*input, error) {
+	closers := []io.Closer{file}
+	archive := file
+	if file == os.Stdin {
+		tmp, err := os.CreateTemp("", "csv2fhir-*.zip")
+		if err != nil {
+			return nil, fmt.Errorf("failed to buffer zip input: %w", err)
+		}
+		closers = []io.Closer{tmp, removeFile(tmp.Name())}
+		if _, err := io.Copy(tmp, buffered); err != nil {
+			closeAll(closers)
+			return nil, fmt.Errorf("failed to buffer zip input: %w", err)
+		}
+		archive = tmp
+	}
+
+	info, err := archive.Stat()
+	if err != nil {
+		closeAll(closers)
+		return nil, fmt.Errorf("failed to stat zip input: %w", err)
+	}
+	zipReader, err := zip.NewReader(archive, info.Size())
+	if err != nil {
+		closeAll(closers)
+		return nil, fmt.Errorf("failed to read zip input: %w", err)
+	}
+
+	selected, err := selectZipMember(zipReader, member)
+	if err != nil {
+		closeAll(closers)
+		return nil, err
+	}
+	contents, err := selected.Open()
+	if err != nil {
+		closeAll(closers)
+		return nil, fmt.Errorf("failed to open zip member %s: %w", selected.Name, err)
+	}
+	return &input{Reader: contents, closers: append([]io.Closer{contents}, closers...)}, nil
+}
+
+// selectZipMember finds the named member, or the only file when member is empty
+func selectZipMember(zipReader *zip.Reader, member string) (*zip.File, error) {
+	var names []string
+	var files []*zip.File
+	for _, f := range zipReader.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if member != "" && f.Name == member {
+			return f, nil
+		}
+		names = append(names, f.Name)
+		files = append(files, f)
+	}
+	sort.Strings(names)
+
+	switch {
+	case member != "":
+		return nil, fmt.Errorf("zip archive has no member %q (members: %s)", member, strings.Join(names, ", "))
+	case len(files) == 0:
+		return nil, fmt.Errorf("zip archive is empty")
+	case len(files) > 1:
+		return nil, fmt.Errorf("zip archive has %d files, choose one with --input-member (members: %s)", len(files), strings.Join(names, ", "))
+	}
+	return files[0], nil
+}
+
+// removeFile is a Closer that deletes a temporary file
+type removeFile string
+
+// Close deletes the file
+func (r removeFile) Close() error {
+	return os.Remove(string(r))
+}
+
+// closeAll closes closers, ignoring errors
+func closeAll(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package csv
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const compressedCSV = "name,age\nJohn,30\nJane,25\nBob,40\n"
+
+// TestNewReader_Compressed tests reading gzip and zstd inputs
+func TestNewReader_Compressed(t *testing.T) {
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	gzWriter.Write([]byte(compressedCSV))
+	gzWriter.Close()
+
+	var zst bytes.Buffer
+	zstWriter, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	zstWriter.Write([]byte(compressedCSV))
+	zstWriter.Close()
+
+	for name, data := range map[string][]byte{"test.csv.gz": gz.Bytes(), "test.csv.zst": zst.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatalf("Failed to write input: %v", err)
+			}
+			assertRows(t, path, Options{}, []string{"John", "Jane", "Bob"})
+		})
+	}
+}
+
+// TestNewReader_Zip tests selecting a member of a zip input
+func TestNewReader_Zip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extract.zip")
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"data/patients.csv": compressedCSV, "README.txt": "not csv"} {
+		f, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip member: %v", err)
+		}
+		f.Write([]byte(content))
+	}
+	zipWriter.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+
+	assertRows(t, path, Options{Member: "data/patients.csv"}, []string{"John", "Jane", "Bob"})
+
+	_, err := NewReaderWithOptions(path, Options{})
+	if err == nil || !strings.Contains(err.Error(), "data/patients.csv") {
+		t.Errorf("Expected error listing the members, got %v", err)
+	}
+	if _, err := NewReaderWithOptions(path, Options{Member: "missing.csv"}); err == nil {
+		t.Error("Expected error for missing member")
+	}
+}
+
+// TestResumeAt_Compressed tests resuming a gzip input at a row offset
+func TestResumeAt_Compressed(t *testing.T) {
+	var gz bytes.Buffer
+	gzWriter := gzip.NewWriter(&gz)
+	gzWriter.Write([]byte(compressedCSV))
+	gzWriter.Close()
+	path := filepath.Join(t.TempDir(), "test.csv.gz")
+	if err := os.WriteFile(path, gz.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+
+	reader, err := NewReader(path, ',')
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	first, err := reader.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	reader.Close()
+
+	reader, err = NewReader(path, ',')
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	defer reader.Close()
+	if err := reader.ResumeAt(first.Offset, first.RowNumber); err != nil {
+		t.Fatalf("ResumeAt failed: %v", err)
+	}
+	row, err := reader.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if row.Data["name"] != "Jane" || row.RowNumber != 3 {
+		t.Errorf("Expected Jane at row 3, got %s at row %d", row.Data["name"], row.RowNumber)
+	}
+}
+
+// assertRows reads every row of path and compares the name column
+func assertRows(t *testing.T, path string, opts Options, want []string) {
+	t.Helper()
+	reader, err := NewReaderWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("NewReaderWithOptions failed: %v", err)
+	}
+	defer reader.Close()
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("Expected %d rows, got %d", len(want), len(rows))
+	}
+	for i, row := range rows {
+		if row.Data["name"] != want[i] {
+			t.Errorf("Row %d: expected %s, got %s", i, want[i], row.Data["name"])
+		}
+	}
+}
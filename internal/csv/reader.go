@@ -4,39 +4,57 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
-	"os"
 )
 
 // Reader wraps csv.Reader and provides streaming row-by-row access
 type Reader struct {
-	file      *os.File
-	csvReader *csv.Reader
-	headers   []string
-	rowNumber int
+	input      *input
+	path       string
+	opts       Options
+	csvReader  *csv.Reader
+	delimiter  rune
+	headers    []string
+	rowNumber  int
+	baseOffset int64 // Input offset the current csv.Reader started at
+	dataOffset int64 // Input offset of the first data row
 }
 
 // Row represents a CSV row as a map of column name to value
 type Row struct {
 	Data      map[string]string
 	RowNumber int
+	Offset    int64 // Byte offset of the input just past this row
+}
+
+// Options configures a Reader
+type Options struct {
+	Delimiter rune
+	Member    string // File to read from a zip input; may be empty if the archive holds one file
 }
 
 // NewReader creates a new CSV reader
 func NewReader(path string, delimiter rune) (*Reader, error) {
-	file, err := os.Open(path)
+	return NewReaderWithOptions(path, Options{Delimiter: delimiter})
+}
+
+// NewReaderWithOptions creates a new CSV reader with the given options. path
+// may be "-" for stdin; gzip, zstd and zip inputs are decompressed.
+func NewReaderWithOptions(path string, opts Options) (*Reader, error) {
+	delimiter := opts.Delimiter
+	if delimiter == 0 {
+		delimiter = ','
+	}
+	in, err := openInput(path, opts.Member)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open CSV file: %w", err)
+		return nil, err
 	}
 
-	csvReader := csv.NewReader(file)
-	csvReader.Comma = delimiter
-	csvReader.TrimLeadingSpace = true
-	csvReader.ReuseRecord = true // Memory optimization for large files
+	csvReader := newCSVReader(in, delimiter)
 
 	// Read header row
 	headers, err := csvReader.Read()
 	if err != nil {
-		file.Close()
+		in.Close()
 		return nil, fmt.Errorf("failed to read CSV headers: %w", err)
 	}
 
@@ -45,18 +63,71 @@ func NewReader(path string, delimiter rune) (*Reader, error) {
 	copy(headersCopy, headers)
 
 	return &Reader{
-		file:      file,
-		csvReader: csvReader,
-		headers:   headersCopy,
-		rowNumber: 1, // Row 1 is the header, data starts at row 2
+		input:      in,
+		path:       path,
+		opts:       opts,
+		csvReader:  csvReader,
+		delimiter:  delimiter,
+		headers:    headersCopy,
+		rowNumber:  1, // Row 1 is the header, data starts at row 2
+		dataOffset: csvReader.InputOffset(),
 	}, nil
 }
 
+// newCSVReader creates a csv.Reader with the settings shared by all readers
+func newCSVReader(r io.Reader, delimiter rune) *csv.Reader {
+	csvReader := csv.NewReader(r)
+	csvReader.Comma = delimiter
+	csvReader.TrimLeadingSpace = true
+	csvReader.ReuseRecord = true // Memory optimization for large files
+	return csvReader
+}
+
 // Headers returns the CSV column headers
 func (r *Reader) Headers() []string {
 	return r.headers
 }
 
+// Offset returns the byte offset of the input just past the last row read
+func (r *Reader) Offset() int64 {
+	return r.baseOffset + r.csvReader.InputOffset()
+}
+
+// ResumeAt repositions the reader at a byte offset previously returned by Offset
+// or Row.Offset. rowNumber is the number of the last row before that offset,
+// so the next row read is numbered rowNumber+1. Offsets of compressed inputs
+// count decompressed bytes, so those are decompressed again up to offset.
+func (r *Reader) ResumeAt(offset int64, rowNumber int) error {
+	if offset < r.dataOffset {
+		return fmt.Errorf("cannot seek to offset %d: inside the header row", offset)
+	}
+	if r.input.seeker != nil {
+		if _, err := r.input.seeker.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek CSV file: %w", err)
+		}
+	} else {
+		if r.path == StdinPath {
+			return fmt.Errorf("cannot seek in input read from stdin")
+		}
+		in, err := openInput(r.path, r.opts.Member)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, in, offset); err != nil {
+			in.Close()
+			return fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+		}
+		r.input.Close()
+		r.input = in
+	}
+
+	// csv.Reader buffers its input, so a fresh one is needed after seeking
+	r.csvReader = newCSVReader(r.input, r.delimiter)
+	r.baseOffset = offset
+	r.rowNumber = rowNumber
+	return nil
+}
+
 // Read reads the next row from the CSV file
 func (r *Reader) Read() (*Row, error) {
 	record, err := r.csvReader.Read()
@@ -81,6 +152,7 @@ func (r *Reader) Read() (*Row, error) {
 	return &Row{
 		Data:      rowData,
 		RowNumber: r.rowNumber,
+		Offset:    r.Offset(),
 	}, nil
 }
 
@@ -104,8 +176,8 @@ func (r *Reader) ReadAll() ([]*Row, error) {
 
 // Close closes the underlying file
 func (r *Reader) Close() error {
-	if r.file != nil {
-		return r.file.Close()
+	if r.input != nil {
+		return r.input.Close()
 	}
 	return nil
 }
@@ -386,6 +386,68 @@ third,300
 	}
 }
 
+// TestResumeAt tests resuming a reader from a row offset
+func TestResumeAt(t *testing.T) {
+	content := `name,value
+first,100
+"sec
+ond",200
+third,300
+`
+	tmpFile := createTempCSVFile(t, content)
+
+	reader, err := NewReader(tmpFile, ',')
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	first, err := reader.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	second, err := reader.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	reader.Close()
+
+	// Reopen and continue after the first row
+	reader, err = NewReader(tmpFile, ',')
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	defer reader.Close()
+
+	if err := reader.ResumeAt(first.Offset, first.RowNumber); err != nil {
+		t.Fatalf("ResumeAt failed: %v", err)
+	}
+
+	row, err := reader.Read()
+	if err != nil {
+		t.Fatalf("Read after seek failed: %v", err)
+	}
+	if row.Data["name"] != "sec\nond" {
+		t.Errorf("Expected multi-line value after seek, got %q", row.Data["name"])
+	}
+	if row.RowNumber != second.RowNumber {
+		t.Errorf("Expected row number %d, got %d", second.RowNumber, row.RowNumber)
+	}
+	if row.Offset != second.Offset {
+		t.Errorf("Expected offset %d, got %d", second.Offset, row.Offset)
+	}
+
+	row, err = reader.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if row.Data["name"] != "third" || row.RowNumber != 4 {
+		t.Errorf("Unexpected row after seek: %+v", row)
+	}
+
+	if err := reader.ResumeAt(0, 1); err == nil {
+		t.Error("Expected error seeking into the header row")
+	}
+}
+
 // Helper function to create a temporary CSV file
 func createTempCSVFile(t *testing.T, content string) string {
 	tmpDir := t.TempDir()
@@ -0,0 +1,563 @@
+package dedupe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"csv2fhir/internal/fhirjson"
+)
+
+// Policy decides what happens to a row whose resource duplicates the id or
+// an identifier of an earlier row's resource
+type Policy string
+
+const (
+	Warn      Policy = "warn"       // Report the duplicate and write both
+	Error     Policy = "error"      // Reject the later row
+	KeepFirst Policy = "keep-first" // Skip the later row
+	KeepLast  Policy = "keep-last"  // Write only the later row
+	Merge     Policy = "merge"      // Write one resource combining both rows
+)
+
+// Policies lists the valid policies, the first being the default
+var Policies = []Policy{Warn, Error, KeepFirst, KeepLast, Merge}
+
+// Defers reports whether resources are held until the end of the run, as a
+// later row may replace them
+func (p Policy) Defers() bool {
+	return p == KeepLast || p == Merge
+}
+
+// Duplicate is a row sharing a key with an earlier row
+type Duplicate struct {
+	Key       string // Patient/P1 or Patient?identifier=system|value
+	RowNumber int
+	Previous  int // Row number of the earlier row
+}
+
+// Error describes the duplicate
+func (d Duplicate) Error() string {
+	return fmt.Sprintf("row %d: %s duplicates row %d", d.RowNumber, d.Key, d.Previous)
+}
+
+// Entry is a resource held until the end of the run with what is written
+// along with it
+type Entry struct {
+	RowNumber    int               `json:"row"`
+	Resource     json.RawMessage   `json:"resource,omitempty"`
+	Attached     []json.RawMessage `json:"attached,omitempty"` // Written before the resource, e.g. its Binary resources
+	PartitionKey string            `json:"partition,omitempty"`
+	Keys         []string          `json:"keys,omitempty"` // Set by the detector; of all rows merged into the entry
+}
+
+// Detector finds resources sharing keys within a run. Rows are kept in a
+// temporary file with their keys, and with their resources for the deferring
+// policies; in memory keys are 64-bit hashes with the index of their row's
+// entry, about 20-40 bytes each, so millions of rows fit. A hash found is
+// confirmed against the keys of the entry, so two keys sharing a hash are
+// never taken for duplicates.
+type Detector struct {
+	policy   Policy
+	keys     map[uint64]uint32 // Key hash -> entry index
+	overflow map[string]uint32 // Keys whose hash another key has -> entry index
+
+	spool      *os.File
+	writer     *bufio.Writer
+	size       int64
+	offsets    []int64         // Of the spooled entries
+	superseded map[uint32]bool // Entries replaced by a later row
+}
+
+// NewDetector creates a detector for a policy; an empty policy is Warn
+func NewDetector(policy Policy) (*Detector, error) {
+	if policy == "" {
+		policy = Warn
+	}
+	spool, err := os.CreateTemp("", "csv2fhir-duplicates-*.ndjson")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create duplicates spool: %w", err)
+	}
+	return &Detector{
+		policy:     policy,
+		keys:       map[uint64]uint32{},
+		overflow:   map[string]uint32{},
+		spool:      spool,
+		writer:     bufio.NewWriter(spool),
+		superseded: map[uint32]bool{},
+	}, nil
+}
+
+// Policy returns the detector's policy
+func (d *Detector) Policy() Policy {
+	return d.policy
+}
+
+// Keys returns the keys of a resource that must be unique in a run: its
+// Type/id and each identifier with a value, as Type?identifier=system|value
+func Keys(resource interface{}) ([]string, error) {
+	var value identity
+	if !value.fromStruct(resource) {
+		data, ok := resource.(json.RawMessage)
+		if !ok {
+			var err error
+			if data, err = json.Marshal(resource); err != nil {
+				return nil, fmt.Errorf("failed to marshal resource: %w", err)
+			}
+		}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("failed to parse resource: %w", err)
+		}
+	}
+
+	var keys []string
+	if value.ID != "" {
+		keys = append(keys, value.ResourceType+"/"+value.ID)
+	}
+	seen := map[string]bool{}
+	for _, identifier := range value.Identifier {
+		if identifier.Value == "" {
+			continue
+		}
+		key := value.ResourceType + "?identifier=" + identifier.Value
+		if identifier.System != "" {
+			key = value.ResourceType + "?identifier=" + identifier.System + "|" + identifier.Value
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// identity holds the elements of a resource keys are made of
+type identity struct {
+	ResourceType string         `json:"resourceType"`
+	ID           string         `json:"id"`
+	Identifier   identifierList `json:"identifier"`
+}
+
+// identifierList holds the identifiers of a resource, read from a list or
+// from the single identifier of resources like Bundle
+type identifierList []identifier
+
+// identifier is a business identifier
+type identifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+// UnmarshalJSON reads a list of identifiers or a single one
+func (l *identifierList) UnmarshalJSON(data []byte) error {
+	if len(bytes.TrimSpace(data)) > 0 && bytes.TrimSpace(data)[0] == '{' {
+		var single identifier
+		if err := json.Unmarshal(data, &single); err != nil {
+			return err
+		}
+		*l = identifierList{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]identifier)(l))
+}
+
+// fromStruct reads the identity of a resource of the FHIR models, whose
+// type name is the resource type, without marshaling it
+func (i *identity) fromStruct(resource interface{}) bool {
+	v := reflect.ValueOf(resource)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	v = v.Elem()
+	id, identifiers := v.FieldByName("Id"), v.FieldByName("Identifier")
+	if !id.IsValid() || id.Type() != reflect.TypeOf((*string)(nil)) {
+		return false
+	}
+	i.ResourceType = v.Type().Name()
+	if !id.IsNil() {
+		i.ID = id.Elem().String()
+	}
+	var items []reflect.Value
+	switch {
+	case !identifiers.IsValid():
+	case identifiers.Kind() == reflect.Slice:
+		for n := 0; n < identifiers.Len(); n++ {
+			items = append(items, identifiers.Index(n))
+		}
+	case identifiers.Kind() == reflect.Ptr && !identifiers.IsNil():
+		items = append(items, identifiers.Elem())
+	}
+	for _, item := range items {
+		system, value := item.FieldByName("System"), item.FieldByName("Value")
+		if !value.IsValid() || value.IsNil() {
+			continue
+		}
+		next := identifier{Value: value.Elem().String()}
+		if system.IsValid() && !system.IsNil() {
+			next.System = system.Elem().String()
+		}
+		i.Identifier = append(i.Identifier, next)
+	}
+	return true
+}
+
+// Check records the keys of a row for the Warn, Error and KeepFirst policies
+// and returns the earlier rows it duplicates. A duplicate row is only
+// recorded with Warn, as the others don't write it.
+func (d *Detector) Check(keys []string, rowNumber int) ([]Duplicate, error) {
+	var duplicates []Duplicate
+	var fresh []string
+	for _, key := range keys {
+		_, previous, ok, err := d.find(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			duplicates = append(duplicates, Duplicate{Key: key, RowNumber: rowNumber, Previous: previous.RowNumber})
+		} else {
+			fresh = append(fresh, key)
+		}
+	}
+	if len(fresh) == 0 || len(duplicates) > 0 && d.policy != Warn {
+		return duplicates, nil
+	}
+	index, err := d.add(Entry{RowNumber: rowNumber, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range fresh {
+		if err := d.record(key, index); err != nil {
+			return nil, err
+		}
+	}
+	return duplicates, nil
+}
+
+// Hold spools an entry for the KeepLast and Merge policies, replacing the
+// entries of earlier rows it duplicates, and returns those duplicates. With
+// Merge the entry written combines the earlier entries and this one.
+func (d *Detector) Hold(entry Entry, keys []string) ([]Duplicate, error) {
+	var duplicates []Duplicate
+	var earlier []uint32
+	for _, key := range keys {
+		index, previous, ok, err := d.find(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || d.superseded[index] {
+			continue
+		}
+		duplicates = append(duplicates, Duplicate{Key: key, RowNumber: entry.RowNumber, Previous: previous.RowNumber})
+		if !containsIndex(earlier, index) {
+			earlier = append(earlier, index)
+		}
+	}
+
+	entry.Keys = keys
+	if d.policy == Merge && len(earlier) > 0 {
+		sort.Slice(earlier, func(i, j int) bool { return earlier[i] < earlier[j] })
+		merged, err := d.merge(earlier, entry)
+		if err != nil {
+			return nil, err
+		}
+		entry = merged
+	}
+	for _, index := range earlier {
+		d.superseded[index] = true
+	}
+
+	index, err := d.add(entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range entry.Keys {
+		if err := d.record(key, index); err != nil {
+			return nil, err
+		}
+	}
+	return duplicates, nil
+}
+
+// find returns the entry a key was recorded with and whether there is one.
+// The entry of a key's hash holds the key only if no other key of the same
+// hash came first.
+func (d *Detector) find(key string) (uint32, Entry, bool, error) {
+	index, ok := d.overflow[key]
+	if !ok {
+		if index, ok = d.keys[hashKey(key)]; !ok {
+			return 0, Entry{}, false, nil
+		}
+	}
+	entry, err := d.read(index)
+	if err != nil {
+		return 0, Entry{}, false, err
+	}
+	return index, entry, contains(entry.Keys, key), nil
+}
+
+// record points a key at an entry. A key whose hash points at an entry
+// without it is remembered in full.
+func (d *Detector) record(key string, index uint32) error {
+	if _, ok := d.overflow[key]; ok {
+		d.overflow[key] = index
+		return nil
+	}
+	hash := hashKey(key)
+	if previous, ok := d.keys[hash]; ok && previous != index {
+		entry, err := d.read(previous)
+		if err != nil {
+			return err
+		}
+		if !contains(entry.Keys, key) {
+			d.overflow[key] = index
+			return nil
+		}
+	}
+	d.keys[hash] = index
+	return nil
+}
+
+// add spools an entry and returns its index
+func (d *Detector) add(entry Entry) (uint32, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("failed to spool row %d: %w", entry.RowNumber, err)
+	}
+	index := uint32(len(d.offsets))
+	d.offsets = append(d.offsets, d.size)
+	n, err := d.writer.Write(append(data, '\n'))
+	d.size += int64(n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to spool row %d: %w", entry.RowNumber, err)
+	}
+	return index, nil
+}
+
+// merge combines the resources of earlier entries and an entry, later rows
+// taking precedence. The merged entry keeps the keys of all of them, so rows
+// sharing a key with any of them are merged into it too.
+func (d *Detector) merge(earlier []uint32, entry Entry) (Entry, error) {
+	var resource interface{}
+	var attached []json.RawMessage
+	var keys []string
+	for _, index := range earlier {
+		previous, err := d.read(index)
+		if err != nil {
+			return Entry{}, err
+		}
+		value, err := fhirjson.Parse(previous.Resource)
+		if err != nil {
+			return Entry{}, fmt.Errorf("failed to read spooled resource: %w", err)
+		}
+		resource = mergeValues(resource, value)
+		attached = appendNew(attached, previous.Attached...)
+		keys = appendKeys(keys, previous.Keys...)
+	}
+	value, err := fhirjson.Parse(entry.Resource)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to parse resource: %w", err)
+	}
+	data, err := fhirjson.Marshal(mergeValues(resource, value))
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to merge resources: %w", err)
+	}
+	entry.Resource = data
+	entry.Attached = appendNew(attached, entry.Attached...)
+	entry.Keys = appendKeys(keys, entry.Keys...)
+	return entry, nil
+}
+
+// mergeValues combines two JSON values: objects element by element, lists by
+// adding the items of b that a lacks, and b replacing other values. Objects
+// keep the order of a, with elements only b has placed after the element
+// preceding them in b. A type of a choice element in b takes the place of the
+// other types of it in a, so valueString replaces valueQuantity.
+func mergeValues(a, b interface{}) interface{} {
+	switch bv := b.(type) {
+	case *fhirjson.Object:
+		av, ok := a.(*fhirjson.Object)
+		if !ok {
+			return b
+		}
+		result := fhirjson.NewObject()
+		for _, key := range av.Keys() {
+			result.Insert(result.Len(), key, av.Get(key))
+		}
+		preceding := ""
+		for _, key := range bv.Keys() {
+			at := removeOtherChoices(result, key)
+			switch {
+			case result.Has(key):
+				result.Set(key, mergeValues(result.Get(key), bv.Get(key)))
+			case at >= 0:
+				result.Insert(at, key, bv.Get(key))
+			default:
+				result.Insert(result.Index(preceding)+1, key, bv.Get(key))
+			}
+			preceding = key
+		}
+		return result
+	case []interface{}:
+		av, ok := a.([]interface{})
+		if !ok {
+			return b
+		}
+		result := append([]interface{}{}, av...)
+		for _, item := range bv {
+			found := false
+			for _, existing := range av {
+				if reflect.DeepEqual(existing, item) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	return b
+}
+
+// removeOtherChoices removes the types of a choice element other than key's,
+// with their primitive extensions, and returns where the first of them was,
+// or -1
+func removeOtherChoices(o *fhirjson.Object, key string) int {
+	base := fhirjson.ChoiceBase(key)
+	if base == "" {
+		return -1
+	}
+	name := strings.TrimPrefix(key, "_")
+	at := -1
+	for _, other := range append([]string{}, o.Keys()...) {
+		if fhirjson.ChoiceBase(other) == base && strings.TrimPrefix(other, "_") != name {
+			if at < 0 {
+				at = o.Index(other)
+			}
+			o.Remove(other)
+		}
+	}
+	return at
+}
+
+// read returns a spooled entry
+func (d *Detector) read(index uint32) (Entry, error) {
+	if err := d.writer.Flush(); err != nil {
+		return Entry{}, fmt.Errorf("failed to write duplicates spool: %w", err)
+	}
+	reader := bufio.NewReader(io.NewSectionReader(d.spool, d.offsets[index], d.size-d.offsets[index]))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to read duplicates spool: %w", err)
+	}
+	var entry Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return Entry{}, fmt.Errorf("failed to read duplicates spool: %w", err)
+	}
+	return entry, nil
+}
+
+// Release calls fn for the held entries no later row replaced, in the order
+// they were held
+func (d *Detector) Release(fn func(Entry) error) error {
+	if d.spool == nil || !d.policy.Defers() {
+		return nil
+	}
+	if err := d.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write duplicates spool: %w", err)
+	}
+	if _, err := d.spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read duplicates spool: %w", err)
+	}
+	reader := bufio.NewReader(d.spool)
+	for index := range d.offsets {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read duplicates spool: %w", err)
+		}
+		if d.superseded[uint32(index)] {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("failed to read duplicates spool: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close removes the spool
+func (d *Detector) Close() error {
+	if d.spool == nil {
+		return nil
+	}
+	d.spool.Close()
+	err := os.Remove(d.spool.Name())
+	d.spool = nil
+	return err
+}
+
+// hashKey hashes a key with 64-bit FNV-1a
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// appendNew appends the resources not already in list
+func appendNew(list []json.RawMessage, resources ...json.RawMessage) []json.RawMessage {
+	for _, resource := range resources {
+		found := false
+		for _, existing := range list {
+			if string(existing) == string(resource) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, resource)
+		}
+	}
+	return list
+}
+
+// appendKeys appends the keys not already in list
+func appendKeys(list []string, keys ...string) []string {
+	for _, key := range keys {
+		if !contains(list, key) {
+			list = append(list, key)
+		}
+	}
+	return list
+}
+
+// contains reports whether list has s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsIndex reports whether list has index
+func containsIndex(list []uint32, index uint32) bool {
+	for _, item := range list {
+		if item == index {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+package dedupe
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"csv2fhir/internal/fhirjson"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// TestKeys tests that ids and identifiers with a value become keys
+func TestKeys(t *testing.T) {
+	patient := &fhir.Patient{
+		Id: strPtr("P1"),
+		Identifier: []fhir.Identifier{
+			{System: strPtr("urn:mrn"), Value: strPtr("123")},
+			{Value: strPtr("local")},
+			{System: strPtr("urn:mrn"), Value: strPtr("123")},
+			{System: strPtr("urn:empty")},
+		},
+	}
+	keys, err := Keys(patient)
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	expected := []string{"Patient/P1", "Patient?identifier=urn:mrn|123", "Patient?identifier=local"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+// TestCheck tests that Warn keeps every row and the other policies only the first
+func TestCheck(t *testing.T) {
+	for _, policy := range []Policy{Warn, Error, KeepFirst} {
+		d, err := NewDetector(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duplicates, err := d.Check([]string{"Patient/P1", "Patient?identifier=A"}, 2); err != nil || len(duplicates) != 0 {
+			t.Errorf("%s: unexpected duplicates %v (%v)", policy, duplicates, err)
+		}
+		duplicates, err := d.Check([]string{"Patient/P2", "Patient?identifier=A"}, 3)
+		if err != nil || len(duplicates) != 1 || duplicates[0].Error() != "row 3: Patient?identifier=A duplicates row 2" {
+			t.Errorf("%s: unexpected duplicates %v (%v)", policy, duplicates, err)
+		}
+
+		// Patient/P2 is only taken by the second row if it was written
+		duplicates, _ = d.Check([]string{"Patient/P2"}, 4)
+		if policy == Warn && (len(duplicates) != 1 || duplicates[0].Previous != 3) {
+			t.Errorf("%s: expected a duplicate of row 3, got %v", policy, duplicates)
+		}
+		if policy != Warn && len(duplicates) != 0 {
+			t.Errorf("%s: unexpected duplicates %v", policy, duplicates)
+		}
+		d.Close()
+	}
+}
+
+// TestCheck_HashCollision tests that keys sharing a hash are told apart
+func TestCheck_HashCollision(t *testing.T) {
+	d, err := NewDetector(Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.Check([]string{"Patient/P1"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Give Patient/P2 the hash of Patient/P1
+	d.keys[hashKey("Patient/P2")] = d.keys[hashKey("Patient/P1")]
+
+	if duplicates, err := d.Check([]string{"Patient/P2"}, 3); err != nil || len(duplicates) != 0 {
+		t.Errorf("Expected no duplicate of a key sharing a hash, got %v (%v)", duplicates, err)
+	}
+	for _, tt := range []struct {
+		key      string
+		previous int
+	}{{"Patient/P1", 2}, {"Patient/P2", 3}} {
+		duplicates, err := d.Check([]string{tt.key}, 4)
+		if err != nil || len(duplicates) != 1 || duplicates[0].Previous != tt.previous {
+			t.Errorf("Expected %s to duplicate row %d, got %v (%v)", tt.key, tt.previous, duplicates, err)
+		}
+	}
+}
+
+// TestHold tests that held entries are replaced or merged by later rows
+func TestHold(t *testing.T) {
+	rows := []Entry{
+		{RowNumber: 2, Resource: json.RawMessage(`{"resourceType":"Observation","id":"O1","status":"final","valueQuantity":{"value":95.10},"identifier":[{"value":"A1"}]}`), PartitionKey: "a"},
+		{RowNumber: 3, Resource: json.RawMessage(`{"resourceType":"Observation","id":"O2","status":"final"}`)},
+		{RowNumber: 4, Resource: json.RawMessage(`{"resourceType":"Observation","id":"O1","status":"amended","identifier":[{"value":"A2"}]}`), PartitionKey: "b",
+			Attached: []json.RawMessage{json.RawMessage(`{"resourceType":"Binary","id":"B1"}`)}},
+	}
+	tests := []struct {
+		policy   Policy
+		expected []string
+	}{
+		{KeepLast, []string{
+			`{"resourceType":"Observation","id":"O2","status":"final"}`,
+			`{"resourceType":"Observation","id":"O1","status":"amended","identifier":[{"value":"A2"}]}`,
+		}},
+		{Merge, []string{
+			`{"resourceType":"Observation","id":"O2","status":"final"}`,
+			`{"resourceType":"Observation","id":"O1","status":"amended","valueQuantity":{"value":95.10},"identifier":[{"value":"A1"},{"value":"A2"}]}`,
+		}},
+	}
+	for _, tt := range tests {
+		d, err := NewDetector(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range rows {
+			keys, err := Keys(entry.Resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			duplicates, err := d.Hold(entry, keys)
+			if err != nil {
+				t.Fatalf("%s: Hold failed: %v", tt.policy, err)
+			}
+			if entry.RowNumber == 4 && (len(duplicates) != 1 || duplicates[0].Previous != 2) {
+				t.Errorf("%s: expected a duplicate of row 2, got %v", tt.policy, duplicates)
+			}
+		}
+
+		var released []Entry
+		err = d.Release(func(entry Entry) error {
+			released = append(released, entry)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Release failed: %v", tt.policy, err)
+		}
+		if len(released) != len(tt.expected) {
+			t.Fatalf("%s: expected %d entries, got %d", tt.policy, len(tt.expected), len(released))
+		}
+		for i, entry := range released {
+			if string(entry.Resource) != tt.expected[i] {
+				t.Errorf("%s: expected %s, got %s", tt.policy, tt.expected[i], entry.Resource)
+			}
+		}
+		last := released[1]
+		if last.RowNumber != 4 || last.PartitionKey != "b" || len(last.Attached) != 1 {
+			t.Errorf("%s: unexpected entry %+v", tt.policy, last)
+		}
+
+		spool := d.spool.Name()
+		if err := d.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if _, err := os.Stat(spool); !os.IsNotExist(err) {
+			t.Errorf("Expected the spool to be removed")
+		}
+	}
+}
+
+// TestHold_MergedKeys tests that a merged entry takes over the earlier row's
+// identifiers, and keep-last leaves them free
+func TestHold_MergedKeys(t *testing.T) {
+	first := Entry{RowNumber: 2, Resource: json.RawMessage(`{"resourceType":"Patient","id":"P1","identifier":[{"value":"A"}]}`)}
+	second := Entry{RowNumber: 3, Resource: json.RawMessage(`{"resourceType":"Patient","id":"P1"}`)}
+	third := Entry{RowNumber: 4, Resource: json.RawMessage(`{"resourceType":"Patient","id":"P2","identifier":[{"value":"A"}]}`)}
+
+	for _, tt := range []struct {
+		policy Policy
+		found  bool
+	}{{KeepLast, false}, {Merge, true}} {
+		d, err := NewDetector(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var duplicates []Duplicate
+		for _, entry := range []Entry{first, second, third} {
+			keys, _ := Keys(entry.Resource)
+			if duplicates, err = d.Hold(entry, keys); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if found := len(duplicates) == 1 && duplicates[0].Previous == 3; found != tt.found {
+			t.Errorf("%s: unexpected duplicates of row 4: %v", tt.policy, duplicates)
+		}
+		d.Close()
+	}
+}
+
+// TestMergeValues tests that merged objects keep their element order and a
+// choice element a single type
+func TestMergeValues(t *testing.T) {
+	tests := []struct {
+		name, a, b, want string
+	}{
+		{
+			name: "later elements follow their predecessor",
+			a:    `{"id":"O1","status":"final","valueQuantity":{"value":1.0,"unit":"mg"},"resourceType":"Observation"}`,
+			b:    `{"id":"O1","status":"amended","code":{"text":"x"},"valueQuantity":{"value":2.50},"resourceType":"Observation"}`,
+			want: `{"id":"O1","status":"amended","code":{"text":"x"},"valueQuantity":{"value":2.50,"unit":"mg"},"resourceType":"Observation"}`,
+		},
+		{
+			name: "later choice type replaces the earlier",
+			a:    `{"id":"O1","valueString":"high","_valueString":{"id":"s"},"interpretation":[{"text":"H"}],"resourceType":"Observation"}`,
+			b:    `{"id":"O1","valueQuantity":{"value":1},"resourceType":"Observation"}`,
+			want: `{"id":"O1","valueQuantity":{"value":1},"interpretation":[{"text":"H"}],"resourceType":"Observation"}`,
+		},
+		{
+			name: "elements ending in a type are not choices of others",
+			a:    `{"birthDate":"1980","deceasedBoolean":false}`,
+			b:    `{"deceasedDateTime":"2020","name":[{"family":"A"}]}`,
+			want: `{"birthDate":"1980","deceasedDateTime":"2020","name":[{"family":"A"}]}`,
+		},
+	}
+	for _, tt := range tests {
+		a, err := fhirjson.Parse([]byte(tt.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := fhirjson.Parse([]byte(tt.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fhirjson.Marshal(mergeValues(a, b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestKeys_Struct tests that keys of model structs match those of their JSON
+func TestKeys_Struct(t *testing.T) {
+	resources := []interface{}{
+		&fhir.Observation{Id: strPtr("O1"), Identifier: []fhir.Identifier{{System: strPtr("urn:acc"), Value: strPtr("A1")}}},
+		&fhir.Binary{Id: strPtr("B1")},
+		&fhir.Bundle{Id: strPtr("BU1"), Identifier: &fhir.Identifier{Value: strPtr("X")}},
+	}
+	for _, resource := range resources {
+		keys, err := Keys(resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(resource)
+		expected, err := Keys(json.RawMessage(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected %v, got %v", expected, keys)
+		}
+	}
+}
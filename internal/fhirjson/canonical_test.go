@@ -0,0 +1,35 @@
+package fhirjson
+
+import "testing"
+
+// TestCanonical tests key order, number normalization and string escaping
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"sorted keys", `{ "b": 1, "a": { "d": [1, 2], "c": null } }`, `{"a":{"c":null,"d":[1,2]},"b":1}`},
+		{"numbers", `[1E2, -0e0, 1e-7, 1e21, 1.5E1]`, `[100,0,1e-7,1e+21,15]`},
+		// FHIR decimals keep their precision
+		{"decimals", `[1.50, 0.0000001, 100, 9007199254740993, -0.0]`, `[1.50,0.0000001,100,9007199254740993,-0.0]`},
+		{"escapes", `"<a&b>\u2028\t\u0001\"\\"`, "\"<a&b>\u2028\\t\\u0001\\\"\\\\\""},
+		// Sorted by UTF-16 code units: U+FB33 sorts after the surrogate pair of U+1F600
+		{"utf16 order", `{"\ufb33":1,"\ud83d\ude00":2,"a":3}`, "{\"a\":3,\"\U0001F600\":2,\"\uFB33\":1}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Canonical([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("Canonical failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Canonical(%s) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Canonical([]byte(`[1e400]`)); err == nil {
+		t.Error("Expected error for number out of range")
+	}
+}
@@ -0,0 +1,34 @@
+package fhirjson
+
+import "strings"
+
+// ChoiceSuffixes are the types a choice element's name can end in, e.g.
+// DateTime of valueDateTime
+var ChoiceSuffixes = []string{
+	"Base64Binary", "Boolean", "Canonical", "Code", "Date", "DateTime", "Decimal", "Id", "Instant",
+	"Integer", "Integer64", "Markdown", "Oid", "PositiveInt", "String", "Time", "UnsignedInt", "Uri",
+	"Url", "Uuid",
+	"Address", "Age", "Annotation", "Attachment", "Availability", "CodeableConcept", "CodeableReference",
+	"Coding", "ContactDetail", "ContactPoint", "Contributor", "Count", "DataRequirement", "Distance",
+	"Dosage", "Duration", "Expression", "ExtendedContactDetail", "HumanName", "Identifier", "Meta",
+	"Money", "ParameterDefinition", "Period", "Quantity", "Range", "Ratio", "RatioRange", "Reference",
+	"RelatedArtifact", "SampledData", "Signature", "Timing", "TriggerDefinition", "UsageContext",
+}
+
+// ChoiceBase returns the choice element a key may be a type of, e.g. value
+// for valueQuantity and _valueString, or "" when the key ends in no type.
+// Elements that merely end in a type, like birthDate, have a base too, so
+// two keys are types of one choice only when both have the same base.
+func ChoiceBase(key string) string {
+	name := strings.TrimPrefix(key, "_")
+	longest := ""
+	for _, suffix := range ChoiceSuffixes {
+		if len(suffix) > len(longest) && len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			longest = suffix
+		}
+	}
+	if longest == "" {
+		return ""
+	}
+	return name[:len(name)-len(longest)]
+}
@@ -0,0 +1,21 @@
+package fhirjson
+
+import "testing"
+
+// TestChoiceBase tests that the longest type suffix names the choice
+func TestChoiceBase(t *testing.T) {
+	tests := map[string]string{
+		"valueQuantity":             "value",
+		"_valueString":              "value",
+		"effectiveDateTime":         "effective",
+		"medicationCodeableConcept": "medication",
+		"birthDate":                 "birth",
+		"status":                    "",
+		"String":                    "",
+	}
+	for key, want := range tests {
+		if got := ChoiceBase(key); got != want {
+			t.Errorf("ChoiceBase(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package fhirjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Object is a JSON object that keeps the order of its keys. The FHIR models
+// marshal fields in the element order of the specification, which the XML
+// format requires, so resources are read into objects rather than maps.
+// Values are *Object, []interface{}, string, json.Number, bool or nil.
+type Object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// NewObject creates an object from alternating keys and values
+func NewObject(pairs ...interface{}) *Object {
+	o := &Object{values: map[string]interface{}{}}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		o.Set(pairs[i].(string), pairs[i+1])
+	}
+	return o
+}
+
+// Keys returns the keys in order
+func (o *Object) Keys() []string {
+	return o.keys
+}
+
+// Len returns the number of keys
+func (o *Object) Len() int {
+	return len(o.keys)
+}
+
+// Get returns the value of a key, or nil
+func (o *Object) Get(key string) interface{} {
+	return o.values[key]
+}
+
+// Has reports whether the object has a key
+func (o *Object) Has(key string) bool {
+	_, ok := o.values[key]
+	return ok
+}
+
+// Index returns the position of a key, or -1
+func (o *Object) Index(key string) int {
+	for i, k := range o.keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Set sets a key, keeping its position if it exists. New keys go before
+// resourceType, which the models write last.
+func (o *Object) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.insert(len(o.keys), key)
+		if n := len(o.keys); n > 1 && o.keys[n-2] == "resourceType" {
+			o.keys[n-2], o.keys[n-1] = o.keys[n-1], o.keys[n-2]
+		}
+	}
+	o.values[key] = value
+}
+
+// Insert sets a new key at a position, or like Set when the key exists or
+// at is out of range
+func (o *Object) Insert(at int, key string, value interface{}) {
+	if at < 0 || at > len(o.keys) || o.Has(key) {
+		o.Set(key, value)
+		return
+	}
+	o.insert(at, key)
+	o.values[key] = value
+}
+
+// insert adds a key at a position
+func (o *Object) insert(at int, key string) {
+	o.keys = append(o.keys, "")
+	copy(o.keys[at+1:], o.keys[at:])
+	o.keys[at] = key
+}
+
+// Remove deletes a key and returns its value, or nil
+func (o *Object) Remove(key string) interface{} {
+	value, ok := o.values[key]
+	if !ok {
+		return nil
+	}
+	delete(o.values, key)
+	if i := o.Index(key); i >= 0 {
+		o.keys = append(o.keys[:i], o.keys[i+1:]...)
+	}
+	return value
+}
+
+// Replace puts a key with a value where the key old was, or sets it when
+// old does not exist. old is removed.
+func (o *Object) Replace(old, key string, value interface{}) {
+	at := o.Index(old)
+	if at < 0 || o.Has(key) && key != old {
+		o.Remove(old)
+		o.Set(key, value)
+		return
+	}
+	o.keys[at] = key
+	delete(o.values, old)
+	o.values[key] = value
+}
+
+// Reorder puts the keys in a new order, which must hold the same keys
+func (o *Object) Reorder(keys []string) {
+	copy(o.keys, keys)
+}
+
+// MarshalJSON writes the object as compact JSON in key order
+func (o *Object) MarshalJSON() ([]byte, error) {
+	return Marshal(o)
+}
+
+// Parse parses JSON into objects, lists and primitives. Numbers are
+// json.Number, so they keep their exact text.
+func Parse(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	value, err := decode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err == nil {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// ParseObject parses a JSON object, e.g. a resource
+func ParseObject(data []byte) (*Object, error) {
+	value, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := value.(*Object)
+	if !ok {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	return o, nil
+}
+
+// decode reads the next JSON value from the decoder
+func decode(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			o := NewObject()
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decode(decoder)
+				if err != nil {
+					return nil, err
+				}
+				if !o.Has(key.(string)) {
+					o.keys = append(o.keys, key.(string))
+				}
+				o.values[key.(string)] = value
+			}
+			_, err := decoder.Token() // Closing brace
+			return o, err
+		case '[':
+			list := []interface{}{}
+			for decoder.More() {
+				item, err := decode(decoder)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			_, err := decoder.Token() // Closing bracket
+			return list, err
+		}
+		return nil, fmt.Errorf("unexpected delimiter %v", t)
+	}
+	return token, nil
+}
+
+// Marshal writes a value as compact JSON, objects in key order
+func Marshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := write(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write writes a value as compact JSON
+func write(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case *Object:
+		buf.WriteByte('{')
+		for i, key := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			keyJSON, _ := json.Marshal(key)
+			buf.Write(keyJSON)
+			buf.WriteByte(':')
+			if err := write(buf, v.values[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := write(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case json.Number:
+		buf.WriteString(v.String())
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to write JSON: %w", err)
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// Text returns a primitive as the text FHIR XML writes in value attributes,
+// e.g. true or 1.50, and whether the value is a primitive
+func Text(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	}
+	return "", false
+}
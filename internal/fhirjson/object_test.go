@@ -0,0 +1,86 @@
+package fhirjson
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestParse tests that parsing and writing keep key order and number text
+func TestParse(t *testing.T) {
+	input := `{"id":"P1","value":{"value":1.50,"unit":"mg"},"given":["a",null,true],"resourceType":"Observation"}`
+	value, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	got, err := Marshal(value)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(got) != input {
+		t.Errorf("Marshal:\ngot  %s\nwant %s", got, input)
+	}
+
+	// Objects nested in other values marshal in order too
+	data, err := json.Marshal(map[string]interface{}{"resource": value})
+	if err != nil || string(data) != `{"resource":`+input+`}` {
+		t.Errorf("json.Marshal = %s, %v", data, err)
+	}
+
+	for _, bad := range []string{`{"a":`, `{} {}`} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Expected an error parsing %s", bad)
+		}
+	}
+	if _, err := ParseObject([]byte(`[]`)); err == nil {
+		t.Error("Expected an error for a list given as object")
+	}
+}
+
+// TestObject tests editing keys in place
+func TestObject(t *testing.T) {
+	o, err := ParseObject([]byte(`{"id":"P1","status":"final","resourceType":"Observation"}`))
+	if err != nil {
+		t.Fatalf("ParseObject failed: %v", err)
+	}
+
+	o.Set("code", "x")               // New keys go before resourceType
+	o.Set("id", "P2")                // Existing keys keep their place
+	o.Insert(1, "meta", NewObject()) // At a position
+	o.Replace("status", "state", "done")
+	if got := o.Remove("missing"); got != nil {
+		t.Errorf("Remove of a missing key = %v", got)
+	}
+
+	got, _ := Marshal(o)
+	want := `{"id":"P2","meta":{},"state":"done","code":"x","resourceType":"Observation"}`
+	if string(got) != want {
+		t.Errorf("Marshal:\ngot  %s\nwant %s", got, want)
+	}
+	if o.Len() != 5 || o.Index("code") != 3 || o.Has("status") {
+		t.Errorf("Unexpected keys %v", o.Keys())
+	}
+
+	o.Reorder([]string{"resourceType", "id", "meta", "state", "code"})
+	if o.Keys()[0] != "resourceType" || o.Get("state") != "done" {
+		t.Errorf("Unexpected keys after Reorder: %v", o.Keys())
+	}
+}
+
+// TestText tests the XML text of primitives
+func TestText(t *testing.T) {
+	for _, tt := range []struct {
+		value interface{}
+		want  string
+		ok    bool
+	}{
+		{"a", "a", true},
+		{json.Number("1.50"), "1.50", true},
+		{false, "false", true},
+		{nil, "", false},
+		{NewObject(), "", false},
+	} {
+		if got, ok := Text(tt.value); got != tt.want || ok != tt.ok {
+			t.Errorf("Text(%v) = %q, %v; want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
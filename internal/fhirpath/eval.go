@@ -0,0 +1,617 @@
+package fhirpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"csv2fhir/internal/fhirjson"
+)
+
+// Expression is a compiled FHIRPath expression. It supports navigation,
+// indexers, the operators of FHIRPath, literals including dates and
+// quantities, and the common functions listed in functions.
+type Expression struct {
+	source string
+	root   node
+}
+
+// now returns the time now() and today() evaluate to
+var now = time.Now
+
+// Parse compiles a FHIRPath expression
+func Parse(expr string) (*Expression, error) {
+	root, err := parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIRPath expression %q: %w", expr, err)
+	}
+	return &Expression{source: expr, root: root}, nil
+}
+
+// String returns the expression as written
+func (e *Expression) String() string {
+	return e.source
+}
+
+// env is what an expression is evaluated against: the resource for
+// %resource and the input of the expression or of a function's criteria
+type env struct {
+	resource item
+	this     []item
+	now      time.Time
+}
+
+// Evaluate returns the collection an expression selects in a resource, given
+// as JSON bytes, a Document or a value to marshal. Numbers
+// are returned as json.Number, dates and times as strings.
+func (e *Expression) Evaluate(resource interface{}) ([]interface{}, error) {
+	items, err := e.evaluate(resource)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(items))
+	for i, it := range items {
+		result[i] = toJSON(it.value)
+	}
+	return result, nil
+}
+
+// EvaluateBool evaluates an expression to a boolean, as for invariants. ok
+// is false when the result is empty.
+func (e *Expression) EvaluateBool(resource interface{}) (result, ok bool, err error) {
+	items, err := e.evaluate(resource)
+	if err != nil {
+		return false, false, err
+	}
+	return toBoolean(items)
+}
+
+// EvaluateString returns the first value an expression selects as a string,
+// or "" if it selects nothing. Complex values are returned as JSON.
+func (e *Expression) EvaluateString(resource interface{}) (string, error) {
+	values, err := e.Evaluate(resource)
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	switch v := values[0].(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	}
+	data, err := json.Marshal(values[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return string(data), nil
+}
+
+// Document is a decoded resource, for evaluating several expressions on it
+// without decoding it for each
+type Document struct {
+	root interface{}
+}
+
+// Decode decodes a resource given as JSON bytes or as a value to marshal
+func Decode(resource interface{}) (*Document, error) {
+	data, ok := resource.([]byte)
+	if raw, isRaw := resource.(json.RawMessage); isRaw {
+		data, ok = raw, true
+	}
+	if !ok {
+		var err error
+		if data, err = json.Marshal(resource); err != nil {
+			return nil, fmt.Errorf("failed to marshal resource: %w", err)
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("failed to parse resource: %w", err)
+	}
+	return &Document{root: root}, nil
+}
+
+// ResourceType returns the resourceType of the document
+func (d *Document) ResourceType() string {
+	obj, _ := d.root.(map[string]interface{})
+	resourceType, _ := obj["resourceType"].(string)
+	return resourceType
+}
+
+// evaluate evaluates the expression on a resource or a Document
+func (e *Expression) evaluate(resource interface{}) ([]item, error) {
+	doc, ok := resource.(*Document)
+	if !ok {
+		var err error
+		if doc, err = Decode(resource); err != nil {
+			return nil, err
+		}
+	}
+	root := doc.root
+
+	context := item{value: root}
+	items, err := eval(e.root, env{resource: context, this: []item{context}, now: now()})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.source, err)
+	}
+	return items, nil
+}
+
+// eval evaluates a node
+func eval(n node, e env) ([]item, error) {
+	switch n := n.(type) {
+	case literalNode:
+		return n.value, nil
+	case thisNode:
+		return e.this, nil
+	case variableNode:
+		switch n.name {
+		case "resource", "context", "rootResource":
+			return []item{e.resource}, nil
+		case "ucum":
+			return []item{{value: "http://unitsofmeasure.org"}}, nil
+		case "sct":
+			return []item{{value: "http://snomed.info/sct"}}, nil
+		case "loinc":
+			return []item{{value: "http://loinc.org"}}, nil
+		}
+		return nil, fmt.Errorf("unknown variable %%%s", n.name)
+	case memberNode:
+		input := e.this
+		if n.target != nil {
+			var err error
+			if input, err = eval(n.target, e); err != nil {
+				return nil, err
+			}
+		}
+		return navigate(input, n.name, n.target == nil), nil
+	case functionNode:
+		input := e.this
+		if n.target != nil {
+			var err error
+			if input, err = eval(n.target, e); err != nil {
+				return nil, err
+			}
+		}
+		return functions[n.name].call(input, n.args, e)
+	case indexNode:
+		input, err := eval(n.target, e)
+		if err != nil {
+			return nil, err
+		}
+		index, err := evalInteger(n.index, e)
+		if err != nil || index == nil {
+			return nil, err
+		}
+		if *index < 0 || *index >= int64(len(input)) {
+			return nil, nil
+		}
+		return input[*index : *index+1], nil
+	case unaryNode:
+		operand, err := eval(n.operand, e)
+		if err != nil || len(operand) == 0 || n.op == "+" {
+			return operand, err
+		}
+		it, err := singleton(operand)
+		if err != nil {
+			return nil, err
+		}
+		switch v := it.value.(type) {
+		case number:
+			return []item{{value: number{r: new(big.Rat).Neg(v.r), integer: v.integer}}}, nil
+		case quantity:
+			v.value = number{r: new(big.Rat).Neg(v.value.r), integer: v.value.integer}
+			return []item{{value: v}}, nil
+		}
+		return nil, fmt.Errorf("cannot negate %s", typeName(it))
+	case typeNode:
+		operand, err := eval(n.operand, e)
+		if err != nil {
+			return nil, err
+		}
+		return typeOperator(n.op, operand, n.typeName)
+	case binaryNode:
+		return evalBinary(n, e)
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+// navigate selects the children of the items with a name. A choice element
+// such as value[x] is found by its name without the type, and at the start of
+// an expression a resource type selects resources of that type.
+func navigate(input []item, name string, first bool) []item {
+	var result []item
+	for _, it := range input {
+		object, ok := it.value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if first && object["resourceType"] == name {
+			result = append(result, it)
+			continue
+		}
+		if child, ok := object[name]; ok {
+			result = appendJSON(result, child, "")
+			continue
+		}
+		// A choice element has a single value, so the first type found is it
+		for _, suffix := range fhirjson.ChoiceSuffixes {
+			if child, ok := object[name+suffix]; ok {
+				result = appendJSON(result, child, choiceType(suffix))
+				break
+			}
+		}
+	}
+	return result
+}
+
+// appendJSON appends a JSON value to a collection, flattening lists
+func appendJSON(result []item, value interface{}, typ string) []item {
+	switch v := value.(type) {
+	case nil:
+	case []interface{}:
+		for _, child := range v {
+			if child != nil {
+				result = append(result, item{value: fromJSON(child), typ: typ})
+			}
+		}
+	default:
+		result = append(result, item{value: fromJSON(v), typ: typ})
+	}
+	return result
+}
+
+// choiceType returns the type a choice element's suffix names, e.g. dateTime
+// for DateTime and Quantity for Quantity
+func choiceType(suffix string) string {
+	switch suffix {
+	case "Base64Binary", "Boolean", "Canonical", "Code", "Date", "DateTime", "Decimal", "Id", "Instant",
+		"Integer", "Integer64", "Markdown", "Oid", "PositiveInt", "String", "Time", "UnsignedInt", "Uri", "Url", "Uuid":
+		return strings.ToLower(suffix[:1]) + suffix[1:]
+	}
+	return suffix
+}
+
+// typeOperator evaluates is and as
+func typeOperator(op string, operand []item, typeName string) ([]item, error) {
+	if len(operand) == 0 {
+		return nil, nil
+	}
+	it, err := singleton(operand)
+	if err != nil {
+		return nil, err
+	}
+	matches := isType(it, typeName)
+	if op == "is" {
+		return boolean(matches), nil
+	}
+	if matches {
+		return []item{it}, nil
+	}
+	return nil, nil
+}
+
+// evalBinary evaluates the operators
+func evalBinary(n binaryNode, e env) ([]item, error) {
+	left, err := eval(n.left, e)
+	if err != nil {
+		return nil, err
+	}
+	// Boolean operators decided by the left side skip the right, so it may
+	// rely on the left, as in a.exists() implies a.single() = 1
+	switch n.op {
+	case "and", "or", "implies":
+		a, ok, err := toBoolean(left)
+		if err != nil {
+			return nil, err
+		}
+		if ok && a == (n.op == "or") {
+			return boolean(n.op != "and"), nil
+		}
+	}
+	right, err := eval(n.right, e)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "and", "or", "xor", "implies":
+		return logic(n.op, left, right)
+	case "|":
+		return union(left, right), nil
+	case "=", "!=":
+		result, ok := collectionsEqual(left, right)
+		if !ok {
+			return nil, nil
+		}
+		return boolean(result == (n.op == "=")), nil
+	case "~", "!~":
+		return boolean(collectionsEquivalent(left, right) == (n.op == "~")), nil
+	case "in", "contains":
+		element, collection := left, right
+		if n.op == "contains" {
+			element, collection = right, left
+		}
+		if len(element) == 0 {
+			return nil, nil
+		}
+		it, err := singleton(element)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range collection {
+			if result, ok := equal(it.value, other.value); ok && result {
+				return boolean(true), nil
+			}
+		}
+		return boolean(false), nil
+	case "&":
+		var b strings.Builder
+		for _, side := range [][]item{left, right} {
+			if len(side) == 0 {
+				continue
+			}
+			it, err := singleton(side)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := it.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("& expects strings, not %s", typeName(it))
+			}
+			b.WriteString(s)
+		}
+		return []item{{value: b.String()}}, nil
+	}
+
+	if len(left) == 0 || len(right) == 0 {
+		return nil, nil
+	}
+	a, err := singleton(left)
+	if err != nil {
+		return nil, err
+	}
+	b, err := singleton(right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<", "<=", ">", ">=":
+		cmp, ok, err := compare(a.value, b.value)
+		if err != nil || !ok {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return boolean(cmp < 0), nil
+		case "<=":
+			return boolean(cmp <= 0), nil
+		case ">":
+			return boolean(cmp > 0), nil
+		}
+		return boolean(cmp >= 0), nil
+	}
+	return arithmetic(n.op, a, b)
+}
+
+// arithmetic evaluates + - * / div and mod on numbers, + on strings, and
+// + and - of quantities on dates, times and quantities
+func arithmetic(op string, a, b item) ([]item, error) {
+	if an, ok := a.value.(number); ok {
+		if bn, ok := b.value.(number); ok {
+			r := new(big.Rat)
+			integer := an.integer && bn.integer
+			switch op {
+			case "+":
+				r.Add(an.r, bn.r)
+			case "-":
+				r.Sub(an.r, bn.r)
+			case "*":
+				r.Mul(an.r, bn.r)
+			case "/", "div", "mod":
+				if bn.r.Sign() == 0 {
+					return nil, nil
+				}
+				r.Quo(an.r, bn.r)
+				if op == "/" {
+					integer = false
+					break
+				}
+				quotient := new(big.Int).Quo(r.Num(), r.Denom()) // Truncated
+				if op == "div" {
+					r.SetInt(quotient)
+					break
+				}
+				r.Sub(an.r, new(big.Rat).Mul(new(big.Rat).SetInt(quotient), bn.r))
+			}
+			return []item{{value: number{r: r, integer: integer}}}, nil
+		}
+	}
+	if as, ok := a.value.(string); ok && op == "+" {
+		if bs, ok := b.value.(string); ok {
+			return []item{{value: as + bs}}, nil
+		}
+	}
+	if bq, ok := b.value.(quantity); ok && (op == "+" || op == "-") {
+		sign := 1
+		if op == "-" {
+			sign = -1
+		}
+		if at, ok := asTemporal(a.value); ok {
+			result, ok := addDuration(at, bq, sign)
+			if !ok {
+				return nil, fmt.Errorf("cannot add %s to a date or time", bq.unit)
+			}
+			return []item{{value: result}}, nil
+		}
+		if aq, ok := asQuantity(a.value); ok && aq.unit == bq.unit {
+			r := new(big.Rat)
+			if sign > 0 {
+				r.Add(aq.value.r, bq.value.r)
+			} else {
+				r.Sub(aq.value.r, bq.value.r)
+			}
+			return []item{{value: quantity{value: number{r: r}, unit: aq.unit}}}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(a), typeName(b))
+}
+
+// logic evaluates the three-valued boolean operators
+func logic(op string, left, right []item) ([]item, error) {
+	a, aok, err := toBoolean(left)
+	if err != nil {
+		return nil, err
+	}
+	b, bok, err := toBoolean(right)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "and":
+		if (aok && !a) || (bok && !b) {
+			return boolean(false), nil
+		}
+		if aok && bok {
+			return boolean(true), nil
+		}
+	case "or":
+		if (aok && a) || (bok && b) {
+			return boolean(true), nil
+		}
+		if aok && bok {
+			return boolean(false), nil
+		}
+	case "xor":
+		if aok && bok {
+			return boolean(a != b), nil
+		}
+	case "implies":
+		if (aok && !a) || (bok && b) {
+			return boolean(true), nil
+		}
+		if aok && bok {
+			return boolean(false), nil
+		}
+	}
+	return nil, nil
+}
+
+// collectionsEqual compares collections item by item; ok is false when the
+// result is empty
+func collectionsEqual(left, right []item) (result, ok bool) {
+	if len(left) == 0 || len(right) == 0 {
+		return false, false
+	}
+	if len(left) != len(right) {
+		return false, true
+	}
+	for i := range left {
+		result, ok := equal(left[i].value, right[i].value)
+		if !ok {
+			return false, false
+		}
+		if !result {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// collectionsEquivalent compares collections in any order
+func collectionsEquivalent(left, right []item) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	used := make([]bool, len(right))
+	for _, a := range left {
+		found := false
+		for j, b := range right {
+			if !used[j] && equivalent(a.value, b.value) {
+				used[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// union combines collections without duplicates
+func union(left, right []item) []item {
+	var result []item
+	for _, it := range append(append([]item{}, left...), right...) {
+		if !containsItem(result, it) {
+			result = append(result, it)
+		}
+	}
+	return result
+}
+
+// containsItem reports whether a collection has an item equal to it
+func containsItem(collection []item, it item) bool {
+	for _, other := range collection {
+		if result, ok := equal(other.value, it.value); ok && result {
+			return true
+		}
+	}
+	return false
+}
+
+// toBoolean converts a collection to a boolean: a single boolean is its
+// value and any other single item true. ok is false for an empty collection.
+func toBoolean(items []item) (result, ok bool, err error) {
+	switch len(items) {
+	case 0:
+		return false, false, nil
+	case 1:
+		if b, isBool := items[0].value.(bool); isBool {
+			return b, true, nil
+		}
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("expected a single boolean, got %d items", len(items))
+}
+
+// singleton returns the only item of a collection
+func singleton(items []item) (item, error) {
+	if len(items) != 1 {
+		return item{}, fmt.Errorf("expected a single item, got %d", len(items))
+	}
+	return items[0], nil
+}
+
+// boolean returns a collection holding a boolean
+func boolean(b bool) []item {
+	return []item{{value: b}}
+}
+
+// evalInteger evaluates an argument to an integer, or nil if it is empty
+func evalInteger(n node, e env) (*int64, error) {
+	items, err := eval(n, e)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	it, err := singleton(items)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := it.value.(number)
+	if !ok || !v.r.IsInt() {
+		return nil, fmt.Errorf("expected an integer, got %s", typeName(it))
+	}
+	i := v.r.Num().Int64()
+	return &i, nil
+}
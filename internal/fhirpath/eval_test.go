@@ -0,0 +1,240 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const patient = `{"resourceType":"Patient","id":"PAT1","active":true,"birthDate":"1980-05-17",` +
+	`"name":[{"use":"official","family":"Smith","given":["Ann","Marie"]},{"use":"nickname","given":["Annie"]}],` +
+	`"telecom":[{"system":"phone","value":"555-0101"},{"system":"email","value":"ann@example.org"}],` +
+	`"extension":[{"url":"http://example.org/weight","valueQuantity":{"value":72.5,"unit":"kg","system":"http://unitsofmeasure.org","code":"kg"}}]}`
+
+// stubNow fixes the time now() and today() evaluate to for the test
+func stubNow(t *testing.T) {
+	t.Helper()
+	now = func() time.Time { return time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC) }
+	t.Cleanup(func() { now = time.Now })
+}
+
+// evaluateJSON evaluates an expression and returns the result as JSON
+func evaluateJSON(t *testing.T, expr, resource string) string {
+	t.Helper()
+	e, err := Parse(expr)
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %v", expr, err)
+	}
+	values, err := e.Evaluate([]byte(resource))
+	if err != nil {
+		t.Fatalf("Evaluate(%q) failed: %v", expr, err)
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// TestExpression_Evaluate tests navigation, operators and literals
+func TestExpression_Evaluate(t *testing.T) {
+	stubNow(t)
+	tests := []struct {
+		expr string
+		want string
+	}{
+		// Navigation
+		{"name.given", `["Ann","Marie","Annie"]`},
+		{"Patient.name[0].family", `["Smith"]`},
+		{"name[5]", `[]`},
+		{"Observation.id", `[]`},
+		{"extension.value.unit", `["kg"]`},
+		{"extension.valueQuantity.value", `[72.5]`},
+		{"%resource.id", `["PAT1"]`},
+
+		// Equality and comparison
+		{"id = 'PAT1'", `[true]`},
+		{"id != 'PAT1'", `[false]`},
+		{"gender = 'female'", `[]`},
+		{"name.given = 'Ann'", `[false]`},
+		{"name.family ~ 'SMITH'", `[true]`},
+		{"birthDate >= @1900-01-01", `[true]`},
+		{"birthDate < @1980-05", `[]`},
+		{"birthDate < @1980-06", `[true]`},
+		{"birthDate = @1980-05", `[]`},
+		{"birthDate <= today()", `[true]`},
+		{"1 < 2.5", `[true]`},
+		{"'abc' < 'abd'", `[true]`},
+		{"extension.value > 70 'kg'", `[true]`},
+		{"extension.value > 80 'kg'", `[false]`},
+
+		// Boolean logic
+		{"active and name.exists()", `[true]`},
+		{"gender.exists() or active", `[true]`},
+		{"gender = 'male' and false", `[false]`},
+		{"gender = 'male' and true", `[]`},
+		{"gender = 'male' or true", `[true]`},
+		{"true xor true", `[false]`},
+		{"false implies gender = 'male'", `[true]`},
+		{"deceased.exists() implies deceased = false", `[true]`},
+		{"active implies name.count() > 2", `[false]`},
+		{"false and (name.given.single() = 'a')", `[false]`},
+		{"true or name.given.single() = 'a'", `[true]`},
+		{"active.not() implies name.given.single() = 'a'", `[true]`},
+
+		// Arithmetic
+		{"1 + 2 * 3", `[7]`},
+		{"(1 + 2) * 3", `[9]`},
+		{"7 div 2", `[3]`},
+		{"7 mod 2", `[1]`},
+		{"1 / 4", `[0.25]`},
+		{"-(1 + 1)", `[-2]`},
+		{"'a' + 'b'", `["ab"]`},
+		{"'a' & {}", `["a"]`},
+		{"1 + {}", `[]`},
+
+		// Dates and quantities
+		{"@2024-01-31 + 1 month", `["2024-02-29"]`},
+		{"@2024-02-29 + 1 year", `["2025-02-28"]`},
+		{"birthDate + 18 years", `["1998-05-17"]`},
+		{"now() - 18 years", `["2006-03-15T10:30:00.000Z"]`},
+		{"today() - 7 days", `["2024-03-08"]`},
+		{"birthDate <= now() - 18 years", `[true]`},
+		{"@2024-03-15T10:00:00Z < @2024-03-15T12:00:00+01:00", `[true]`},
+		{"@T10:30 < @T11:00", `[true]`},
+
+		// Collections and types
+		{"name.given | name.family", `["Ann","Marie","Annie","Smith"]`},
+		{"'Ann' in name.given", `[true]`},
+		{"name.given contains 'Bob'", `[false]`},
+		{"extension.value is Quantity", `[true]`},
+		{"extension.value as Quantity).unit", ``},
+		{"(extension.value as Quantity).unit", `["kg"]`},
+		{"active is Boolean", `[true]`},
+		{"$this.id", `["PAT1"]`},
+	}
+	for _, tt := range tests {
+		if tt.want == "" {
+			if _, err := Parse(tt.expr); err == nil {
+				t.Errorf("Expected error for %q", tt.expr)
+			}
+			continue
+		}
+		if got := evaluateJSON(t, tt.expr, patient); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestExpression_EvaluateBool tests invariants like those of mapping rules
+func TestExpression_EvaluateBool(t *testing.T) {
+	stubNow(t)
+	observation := `{"resourceType":"Observation","status":"final","effectiveDateTime":"2025-01-01T08:00:00Z",` +
+		`"valueQuantity":{"value":95}}`
+	tests := []struct {
+		expr   string
+		result bool
+		ok     bool
+	}{
+		{"valueQuantity.exists() implies valueQuantity.unit.exists()", false, true},
+		{"effective <= now()", false, true},
+		{"effectiveDateTime <= now() + 1 year", true, true},
+		{"status in ('final' | 'amended')", true, true},
+		{"issued <= now()", false, false},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.expr, err)
+		}
+		result, ok, err := e.EvaluateBool([]byte(observation))
+		if err != nil {
+			t.Fatalf("EvaluateBool(%q) failed: %v", tt.expr, err)
+		}
+		if result != tt.result || ok != tt.ok {
+			t.Errorf("%s = %v (ok %v), want %v (ok %v)", tt.expr, result, ok, tt.result, tt.ok)
+		}
+	}
+}
+
+// TestExpression_EvaluateString tests the values of partition keys
+func TestExpression_EvaluateString(t *testing.T) {
+	observation := `{"resourceType":"Observation","id":"OBS1","subject":{"reference":"Patient/PAT1"},` +
+		`"code":{"coding":[{"code":"2339-0"},{"code":"2345-7"}]},"valueQuantity":{"value":95.0}}`
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"subject.reference", "Patient/PAT1"},
+		{"Observation.subject.reference", "Patient/PAT1"},
+		{"Patient.id", ""},
+		{"code.coding.code", "2339-0"},
+		{"valueQuantity.value", "95.0"},
+		{"status", ""},
+		{"subject", `{"reference":"Patient/PAT1"}`},
+		{"valueQuantity.value > 90", "true"},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.expr, err)
+		}
+		got, err := e.EvaluateString([]byte(observation))
+		if err != nil {
+			t.Fatalf("EvaluateString(%q) failed: %v", tt.expr, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestExpression_ChoiceElements tests that only the types of choice elements
+// are found by the element's name
+func TestExpression_ChoiceElements(t *testing.T) {
+	request := `{"resourceType":"MedicationRequest","statusReason":{"text":"held"},` +
+		`"dosageInstruction":[{"text":"daily"}],"reportedBoolean":true}`
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"status.exists()", `[false]`},
+		{"dosage.exists()", `[false]`},
+		{"reported", `[true]`},
+		{"reported is boolean", `[true]`},
+		{"statusReason.text", `["held"]`},
+	}
+	for _, tt := range tests {
+		if got := evaluateJSON(t, tt.expr, request); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+// TestExpression_EvaluateErrors tests errors found while evaluating
+func TestExpression_EvaluateErrors(t *testing.T) {
+	for _, expr := range []string{"name.given and true", "name.given + 1", "'a' < 1", "name.single()", "id.matches('[')"} {
+		e, err := Parse(expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expr, err)
+		}
+		if _, err := e.Evaluate([]byte(patient)); err == nil {
+			t.Errorf("Expected error for %q", expr)
+		}
+	}
+}
+
+// TestDecode tests that a decoded document is evaluated like its JSON
+func TestDecode(t *testing.T) {
+	doc, err := Decode(map[string]interface{}{"resourceType": "Patient", "id": "PAT1"})
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if doc.ResourceType() != "Patient" {
+		t.Errorf("Expected Patient, got %q", doc.ResourceType())
+	}
+	e, _ := Parse("Patient.id = 'PAT1'")
+	if result, ok, err := e.EvaluateBool(doc); err != nil || !ok || !result {
+		t.Errorf("Expected true, got %v (ok %v, err %v)", result, ok, err)
+	}
+	if _, err := Decode([]byte("{")); err == nil {
+		t.Error("Expected error for invalid JSON")
+	}
+}
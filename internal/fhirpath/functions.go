@@ -0,0 +1,490 @@
+package fhirpath
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// function is a FHIRPath function. Arguments are passed unevaluated, as
+// criteria like those of where() are evaluated for each input item.
+type function struct {
+	minArgs, maxArgs int
+	typeArg          bool // The argument is a type name, as in ofType(Quantity)
+	call             func(input []item, args []node, e env) ([]item, error)
+}
+
+// arity describes the number of arguments a function takes
+func (f function) arity() string {
+	switch {
+	case f.minArgs == f.maxArgs && f.maxArgs == 0:
+		return "no arguments"
+	case f.minArgs == f.maxArgs && f.maxArgs == 1:
+		return "1 argument"
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("%d arguments", f.maxArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
+}
+
+// functions lists the supported functions by name
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		// Existence
+		"empty": {call: func(input []item, args []node, e env) ([]item, error) {
+			return boolean(len(input) == 0), nil
+		}},
+		"exists": {maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			if len(args) == 1 {
+				var err error
+				if input, err = filter(input, args[0], e); err != nil {
+					return nil, err
+				}
+			}
+			return boolean(len(input) > 0), nil
+		}},
+		"all": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			for _, it := range input {
+				result, ok, err := criterion(it, args[0], e)
+				if err != nil {
+					return nil, err
+				}
+				if !ok || !result {
+					return boolean(false), nil
+				}
+			}
+			return boolean(true), nil
+		}},
+		"allTrue":  {call: booleans(func(b []bool) bool { return !containsBool(b, false) })},
+		"anyTrue":  {call: booleans(func(b []bool) bool { return containsBool(b, true) })},
+		"allFalse": {call: booleans(func(b []bool) bool { return !containsBool(b, true) })},
+		"anyFalse": {call: booleans(func(b []bool) bool { return containsBool(b, false) })},
+		"count": {call: func(input []item, args []node, e env) ([]item, error) {
+			return []item{{value: newInteger(int64(len(input)))}}, nil
+		}},
+		"distinct": {call: func(input []item, args []node, e env) ([]item, error) {
+			return union(input, nil), nil
+		}},
+		"isDistinct": {call: func(input []item, args []node, e env) ([]item, error) {
+			return boolean(len(union(input, nil)) == len(input)), nil
+		}},
+		"hasValue": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) != 1 {
+				return boolean(false), nil
+			}
+			_, isObject := input[0].value.(map[string]interface{})
+			return boolean(!isObject), nil
+		}},
+
+		// Filtering and projection
+		"where": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			return filter(input, args[0], e)
+		}},
+		"select": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			var result []item
+			for _, it := range input {
+				e.this = []item{it}
+				items, err := eval(args[0], e)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, items...)
+			}
+			return result, nil
+		}},
+		"ofType": {minArgs: 1, maxArgs: 1, typeArg: true, call: func(input []item, args []node, e env) ([]item, error) {
+			name := args[0].(literalNode).value[0].value.(string)
+			var result []item
+			for _, it := range input {
+				if isType(it, name) {
+					result = append(result, it)
+				}
+			}
+			return result, nil
+		}},
+		"is": {minArgs: 1, maxArgs: 1, typeArg: true, call: func(input []item, args []node, e env) ([]item, error) {
+			return typeOperator("is", input, args[0].(literalNode).value[0].value.(string))
+		}},
+		"as": {minArgs: 1, maxArgs: 1, typeArg: true, call: func(input []item, args []node, e env) ([]item, error) {
+			return typeOperator("as", input, args[0].(literalNode).value[0].value.(string))
+		}},
+
+		// Subsetting and combining
+		"first": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[:1], nil
+		}},
+		"last": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[len(input)-1:], nil
+		}},
+		"tail": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			return input[1:], nil
+		}},
+		"single": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) > 1 {
+				return nil, fmt.Errorf("single() expects at most one item, got %d", len(input))
+			}
+			return input, nil
+		}},
+		"skip": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			n, err := evalInteger(args[0], e)
+			if err != nil || n == nil {
+				return nil, err
+			}
+			if *n <= 0 {
+				return input, nil
+			}
+			if *n >= int64(len(input)) {
+				return nil, nil
+			}
+			return input[*n:], nil
+		}},
+		"take": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			n, err := evalInteger(args[0], e)
+			if err != nil || n == nil || *n <= 0 {
+				return nil, err
+			}
+			if *n >= int64(len(input)) {
+				return input, nil
+			}
+			return input[:*n], nil
+		}},
+		"union": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			other, err := eval(args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			return union(input, other), nil
+		}},
+		"combine": {minArgs: 1, maxArgs: 1, call: func(input []item, args []node, e env) ([]item, error) {
+			other, err := eval(args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			return append(append([]item{}, input...), other...), nil
+		}},
+
+		// Boolean logic and conditionals
+		"not": {call: func(input []item, args []node, e env) ([]item, error) {
+			b, ok, err := toBoolean(input)
+			if err != nil || !ok {
+				return nil, err
+			}
+			return boolean(!b), nil
+		}},
+		"iif": {minArgs: 2, maxArgs: 3, call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) > 1 {
+				return nil, fmt.Errorf("iif() expects at most one input item")
+			}
+			if len(input) == 1 {
+				e.this = input
+			}
+			condition, err := eval(args[0], e)
+			if err != nil {
+				return nil, err
+			}
+			b, ok, err := toBoolean(condition)
+			if err != nil {
+				return nil, err
+			}
+			if ok && b {
+				return eval(args[1], e)
+			}
+			if len(args) == 3 {
+				return eval(args[2], e)
+			}
+			return nil, nil
+		}},
+
+		// Strings
+		"startsWith": {minArgs: 1, maxArgs: 1, call: stringFunction(func(s string, args []string) ([]item, error) {
+			return boolean(strings.HasPrefix(s, args[0])), nil
+		})},
+		"endsWith": {minArgs: 1, maxArgs: 1, call: stringFunction(func(s string, args []string) ([]item, error) {
+			return boolean(strings.HasSuffix(s, args[0])), nil
+		})},
+		"contains": {minArgs: 1, maxArgs: 1, call: stringFunction(func(s string, args []string) ([]item, error) {
+			return boolean(strings.Contains(s, args[0])), nil
+		})},
+		"indexOf": {minArgs: 1, maxArgs: 1, call: stringFunction(func(s string, args []string) ([]item, error) {
+			i := strings.Index(s, args[0])
+			if i > 0 {
+				i = utf8.RuneCountInString(s[:i])
+			}
+			return []item{{value: newInteger(int64(i))}}, nil
+		})},
+		"matches": {minArgs: 1, maxArgs: 1, call: stringFunction(func(s string, args []string) ([]item, error) {
+			re, err := regexp.Compile(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %w", args[0], err)
+			}
+			return boolean(re.MatchString(s)), nil
+		})},
+		"replace": {minArgs: 2, maxArgs: 2, call: stringFunction(func(s string, args []string) ([]item, error) {
+			return []item{{value: strings.ReplaceAll(s, args[0], args[1])}}, nil
+		})},
+		"length": {call: stringFunction(func(s string, args []string) ([]item, error) {
+			return []item{{value: newInteger(int64(utf8.RuneCountInString(s)))}}, nil
+		})},
+		"upper": {call: stringFunction(func(s string, args []string) ([]item, error) {
+			return []item{{value: strings.ToUpper(s)}}, nil
+		})},
+		"lower": {call: stringFunction(func(s string, args []string) ([]item, error) {
+			return []item{{value: strings.ToLower(s)}}, nil
+		})},
+		"trim": {call: stringFunction(func(s string, args []string) ([]item, error) {
+			return []item{{value: strings.TrimSpace(s)}}, nil
+		})},
+		"substring": {minArgs: 1, maxArgs: 2, call: func(input []item, args []node, e env) ([]item, error) {
+			s, ok, err := singleString(input)
+			if err != nil || !ok {
+				return nil, err
+			}
+			start, err := evalInteger(args[0], e)
+			if err != nil || start == nil {
+				return nil, err
+			}
+			runes := []rune(s)
+			if *start < 0 || *start >= int64(len(runes)) {
+				return nil, nil
+			}
+			end := int64(len(runes))
+			if len(args) == 2 {
+				length, err := evalInteger(args[1], e)
+				if err != nil {
+					return nil, err
+				}
+				if length != nil && *start+*length < end {
+					end = *start + *length
+				}
+			}
+			if end < *start {
+				end = *start
+			}
+			return []item{{value: string(runes[*start:end])}}, nil
+		}},
+
+		// Conversion
+		"toString": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			it, err := singleton(input)
+			if err != nil {
+				return nil, err
+			}
+			switch v := it.value.(type) {
+			case string:
+				return []item{{value: v}}, nil
+			case bool:
+				return []item{{value: strconv.FormatBool(v)}}, nil
+			case number:
+				return []item{{value: v.String()}}, nil
+			case temporal:
+				return []item{{value: v.String()}}, nil
+			case quantity:
+				return []item{{value: v.value.String() + " '" + v.unit + "'"}}, nil
+			}
+			return nil, nil
+		}},
+		"toInteger": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			it, err := singleton(input)
+			if err != nil {
+				return nil, err
+			}
+			switch v := it.value.(type) {
+			case number:
+				if v.r.IsInt() {
+					return []item{{value: number{r: v.r, integer: true}}}, nil
+				}
+			case string:
+				if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+					return []item{{value: newInteger(n)}}, nil
+				}
+			case bool:
+				if v {
+					return []item{{value: newInteger(1)}}, nil
+				}
+				return []item{{value: newInteger(0)}}, nil
+			}
+			return nil, nil
+		}},
+		"toDecimal": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			it, err := singleton(input)
+			if err != nil {
+				return nil, err
+			}
+			switch v := it.value.(type) {
+			case number:
+				return []item{{value: number{r: v.r}}}, nil
+			case string:
+				if n, ok := parseNumber(v); ok {
+					return []item{{value: number{r: n.r}}}, nil
+				}
+			}
+			return nil, nil
+		}},
+		"toDate":     {call: toTemporal(kindDate)},
+		"toDateTime": {call: toTemporal(kindDateTime)},
+
+		// Utility
+		"now": {call: func(input []item, args []node, e env) ([]item, error) {
+			_, offset := e.now.Zone()
+			v := temporal{kind: kindDateTime, t: e.now.UTC().Truncate(time.Millisecond), precision: precisionSecond, fraction: 3, zone: time.FixedZone("", offset)}
+			return []item{{value: v}}, nil
+		}},
+		"today": {call: func(input []item, args []node, e env) ([]item, error) {
+			y, m, d := e.now.Date()
+			v := temporal{kind: kindDate, t: time.Date(y, m, d, 0, 0, 0, 0, time.UTC), precision: precisionDay}
+			return []item{{value: v}}, nil
+		}},
+		"abs": {call: func(input []item, args []node, e env) ([]item, error) {
+			if len(input) == 0 {
+				return nil, nil
+			}
+			it, err := singleton(input)
+			if err != nil {
+				return nil, err
+			}
+			switch v := it.value.(type) {
+			case number:
+				return []item{{value: number{r: new(big.Rat).Abs(v.r), integer: v.integer}}}, nil
+			case quantity:
+				v.value = number{r: new(big.Rat).Abs(v.value.r), integer: v.value.integer}
+				return []item{{value: v}}, nil
+			}
+			return nil, fmt.Errorf("abs() expects a number, got %s", typeName(it))
+		}},
+	}
+}
+
+// filter returns the items for which a criterion is true
+func filter(input []item, criteria node, e env) ([]item, error) {
+	var result []item
+	for _, it := range input {
+		b, ok, err := criterion(it, criteria, e)
+		if err != nil {
+			return nil, err
+		}
+		if ok && b {
+			result = append(result, it)
+		}
+	}
+	return result, nil
+}
+
+// criterion evaluates a criterion with $this set to an item
+func criterion(it item, criteria node, e env) (result, ok bool, err error) {
+	e.this = []item{it}
+	items, err := eval(criteria, e)
+	if err != nil {
+		return false, false, err
+	}
+	return toBoolean(items)
+}
+
+// booleans builds allTrue() and the like from a test of the input booleans
+func booleans(test func([]bool) bool) func([]item, []node, env) ([]item, error) {
+	return func(input []item, args []node, e env) ([]item, error) {
+		values := make([]bool, 0, len(input))
+		for _, it := range input {
+			b, ok := it.value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("expected booleans, got %s", typeName(it))
+			}
+			values = append(values, b)
+		}
+		return boolean(test(values)), nil
+	}
+}
+
+// containsBool reports whether values has b
+func containsBool(values []bool, b bool) bool {
+	for _, v := range values {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+// singleString returns the only string of a collection; ok is false when
+// the collection is empty
+func singleString(input []item) (string, bool, error) {
+	if len(input) == 0 {
+		return "", false, nil
+	}
+	it, err := singleton(input)
+	if err != nil {
+		return "", false, err
+	}
+	s, ok := it.value.(string)
+	if !ok {
+		return "", false, fmt.Errorf("expected a string, got %s", typeName(it))
+	}
+	return s, true, nil
+}
+
+// stringFunction builds a function of a string input and string arguments;
+// an empty input or argument gives an empty result
+func stringFunction(fn func(s string, args []string) ([]item, error)) func([]item, []node, env) ([]item, error) {
+	return func(input []item, args []node, e env) ([]item, error) {
+		s, ok, err := singleString(input)
+		if err != nil || !ok {
+			return nil, err
+		}
+		values := make([]string, len(args))
+		for i, arg := range args {
+			items, err := eval(arg, e)
+			if err != nil {
+				return nil, err
+			}
+			if values[i], ok, err = singleString(items); err != nil || !ok {
+				return nil, err
+			}
+		}
+		return fn(s, values)
+	}
+}
+
+// toTemporal builds toDate() and toDateTime()
+func toTemporal(kind temporalKind) func([]item, []node, env) ([]item, error) {
+	return func(input []item, args []node, e env) ([]item, error) {
+		if len(input) == 0 {
+			return nil, nil
+		}
+		it, err := singleton(input)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := asTemporal(it.value)
+		if !ok || v.kind == kindTime {
+			return nil, nil
+		}
+		if kind == kindDate && v.precision > precisionDay {
+			v.precision, v.fraction, v.zone = precisionDay, 0, nil
+		}
+		v.kind = kind
+		return []item{{value: v}}, nil
+	}
+}
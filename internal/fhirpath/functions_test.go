@@ -0,0 +1,84 @@
+package fhirpath
+
+import (
+	"testing"
+)
+
+// TestFunctions tests the supported functions on the test patient
+func TestFunctions(t *testing.T) {
+	stubNow(t)
+	tests := []struct {
+		expr string
+		want string
+	}{
+		// Existence
+		{"gender.empty()", `[true]`},
+		{"name.exists(use = 'official')", `[true]`},
+		{"name.exists(use = 'maiden')", `[false]`},
+		{"name.all(given.exists())", `[true]`},
+		{"name.all(family.exists())", `[false]`},
+		{"telecom.select(system = 'phone').anyTrue()", `[true]`},
+		{"telecom.select(system = 'phone').allTrue()", `[false]`},
+		{"telecom.select(value.exists()).allFalse()", `[false]`},
+		{"{}.anyFalse()", `[false]`},
+		{"name.given.count()", `[3]`},
+		{"(1 | 1 | 2).count()", `[2]`},
+		{"(1).combine(1).distinct()", `[1]`},
+		{"name.use.isDistinct()", `[true]`},
+		{"id.hasValue()", `[true]`},
+		{"name.hasValue()", `[false]`},
+
+		// Filtering and subsetting
+		{"name.where(use = 'nickname').given", `["Annie"]`},
+		{"telecom.where(system = 'email').value", `["ann@example.org"]`},
+		{"name.select(given.first())", `["Ann","Annie"]`},
+		{"extension.value.ofType(Quantity).code", `["kg"]`},
+		{"extension.value.ofType(string)", `[]`},
+		{"name.given.first()", `["Ann"]`},
+		{"name.given.last()", `["Annie"]`},
+		{"name.given.tail()", `["Marie","Annie"]`},
+		{"name.given.skip(2)", `["Annie"]`},
+		{"name.given.take(2)", `["Ann","Marie"]`},
+		{"id.single()", `["PAT1"]`},
+		{"name.given.union(name.given)", `["Ann","Marie","Annie"]`},
+		{"name.given.combine('Ann').count()", `[4]`},
+		{"extension.value.is(Quantity)", `[true]`},
+		{"extension.value.as(Quantity).unit", `["kg"]`},
+
+		// Logic and conversion
+		{"active.not()", `[false]`},
+		{"iif(active, 'yes', 'no')", `["yes"]`},
+		{"iif(gender.exists(), gender, 'unknown')", `["unknown"]`},
+		{"gender.iif($this = 'female', 1)", `[]`},
+		{"5.toString()", `["5"]`},
+		{"'12'.toInteger() + 1", `[13]`},
+		{"'1.5'.toDecimal() * 2", `[3.0]`},
+		{"'x'.toInteger()", `[]`},
+		{"birthDate.toDateTime()", `["1980-05-17"]`},
+		{"'2024-03-15T10:30:00Z'.toDate()", `["2024-03-15"]`},
+		{"(-2.5).abs()", `[2.5]`},
+		{"today()", `["2024-03-15"]`},
+		{"now() > @2024-03-15T10:00:00Z", `[true]`},
+
+		// Strings
+		{"telecom.value.where($this.startsWith('555'))", `["555-0101"]`},
+		{"name.family.endsWith('th')", `[true]`},
+		{"name.family.contains('mi')", `[true]`},
+		{"name.family.matches('^S[a-z]+$')", `[true]`},
+		{"name.family.length()", `[5]`},
+		{"name.family.upper()", `["SMITH"]`},
+		{"name.family.lower()", `["smith"]`},
+		{"name.family.substring(1, 3)", `["mit"]`},
+		{"name.family.substring(3)", `["th"]`},
+		{"name.family.substring(9)", `[]`},
+		{"name.family.indexOf('th')", `[3]`},
+		{"name.family.replace('S', 'Sm')", `["Smmith"]`},
+		{"' x '.trim()", `["x"]`},
+		{"gender.upper()", `[]`},
+	}
+	for _, tt := range tests {
+		if got := evaluateJSON(t, tt.expr, patient); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package fhirpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenKind classifies the tokens of an expression
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenTemporal // @2024-01-15, without the @
+	tokenVariable // %resource, without the %
+	tokenSpecial  // $this, without the $
+	tokenSymbol
+)
+
+// token is a lexeme of an expression and its position
+type token struct {
+	kind   tokenKind
+	text   string
+	pos    int
+	quoted bool // A `delimited` identifier, never a keyword
+}
+
+// symbols lists the operators and punctuation, longest first
+var symbols = []string{"<=", ">=", "!=", "!~", "{}", ".", "[", "]", "(", ")", ",", "+", "-", "*", "/", "&", "|", "<", ">", "=", "~"}
+
+// lex splits an expression into tokens
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := strings.Index(string(runes[i+2:]), "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at %d", start)
+			}
+			i += 2 + len([]rune(string(runes[i+2:])[:end])) + 2
+			continue
+		case r == '\'' || r == '`':
+			text, n, err := readQuoted(runes[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at %d", err, start)
+			}
+			i += n
+			if r == '`' {
+				tokens = append(tokens, token{kind: tokenIdentifier, text: text, pos: start, quoted: true})
+			} else {
+				tokens = append(tokens, token{kind: tokenString, text: text, pos: start})
+			}
+			continue
+		case r == '@':
+			i++
+			hasTime := false
+		scan:
+			for ; i < len(runes); i++ {
+				c := runes[i]
+				switch {
+				case unicode.IsDigit(c), c == '-', c == ':', c == 'Z':
+				case c == 'T':
+					hasTime = true
+				case c == '+' && hasTime: // Time zone offset
+				case c == '.' && hasTime && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+				default:
+					break scan
+				}
+			}
+			tokens = append(tokens, token{kind: tokenTemporal, text: string(runes[start+1 : i]), pos: start})
+			continue
+		case r == '%' || r == '$':
+			i++
+			kind := tokenVariable
+			if r == '$' {
+				kind = tokenSpecial
+			}
+			if i < len(runes) && (runes[i] == '`' || runes[i] == '\'') {
+				text, n, err := readQuoted(runes[i:])
+				if err != nil {
+					return nil, fmt.Errorf("%v at %d", err, start)
+				}
+				i += n
+				tokens = append(tokens, token{kind: kind, text: text, pos: start})
+				continue
+			}
+			for i < len(runes) && isIdentifierRune(runes[i], i == start+1) {
+				i++
+			}
+			if i == start+1 {
+				return nil, fmt.Errorf("expected a name after %c at %d", r, start)
+			}
+			tokens = append(tokens, token{kind: kind, text: string(runes[start+1 : i]), pos: start})
+			continue
+		case unicode.IsDigit(r):
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			if i+1 < len(runes) && runes[i] == '.' && unicode.IsDigit(runes[i+1]) {
+				i++
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start})
+			continue
+		case isIdentifierRune(r, true):
+			for i < len(runes) && isIdentifierRune(runes[i], false) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, text: string(runes[start:i]), pos: start})
+			continue
+		}
+
+		matched := false
+		for _, symbol := range symbols {
+			if strings.HasPrefix(string(runes[i:]), symbol) {
+				tokens = append(tokens, token{kind: tokenSymbol, text: symbol, pos: start})
+				i += len(symbol)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("unexpected %q at %d", r, start)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
+
+// isIdentifierRune reports whether r may appear in an identifier
+func isIdentifierRune(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+}
+
+// readQuoted reads a string or delimited identifier with its escapes and
+// returns it with the number of runes read
+func readQuoted(runes []rune) (string, int, error) {
+	quote := runes[0]
+	var b strings.Builder
+	for i := 1; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == quote:
+			return b.String(), i + 1, nil
+		case r == '\\' && i+1 < len(runes):
+			i++
+			switch e := runes[i]; e {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case 'r':
+				b.WriteRune('\r')
+			case 'f':
+				b.WriteRune('\f')
+			case 'u':
+				if i+4 >= len(runes) {
+					return "", 0, fmt.Errorf("invalid escape")
+				}
+				code, err := strconv.ParseUint(string(runes[i+1:i+5]), 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape")
+				}
+				b.WriteRune(rune(code))
+				i += 4
+			default:
+				b.WriteRune(e)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c", quote)
+}
+
+// node is a parsed part of an expression
+type node interface{}
+
+type (
+	literalNode struct{ value []item }
+	memberNode  struct {
+		target node // nil at the start of an expression
+		name   string
+	}
+	functionNode struct {
+		target node // nil at the start of an expression
+		name   string
+		args   []node
+	}
+	indexNode    struct{ target, index node }
+	variableNode struct{ name string }
+	thisNode     struct{}
+	unaryNode    struct {
+		op      string
+		operand node
+	}
+	binaryNode struct {
+		op          string
+		left, right node
+	}
+	typeNode struct {
+		op       string // is or as
+		operand  node
+		typeName string
+	}
+)
+
+// precedences of the binary operators; higher binds tighter
+var precedences = map[string]int{
+	"implies": 1,
+	"or":      2, "xor": 2,
+	"and": 3,
+	"in":  4, "contains": 4,
+	"=": 5, "~": 5, "!=": 5, "!~": 5,
+	"<": 6, "<=": 6, ">": 6, ">=": 6,
+	"|":  7,
+	"is": 8, "as": 8,
+	"+": 9, "-": 9, "&": 9,
+	"*": 10, "/": 10, "div": 10, "mod": 10,
+}
+
+// isCalendarWord reports whether s is a calendar duration keyword, like
+// year or days; UCUM codes of units must be quoted
+func isCalendarWord(s string) bool {
+	word := calendarUnits[s]
+	return word != "" && (s == word || s == word+"s")
+}
+
+// parser builds nodes from tokens by precedence climbing
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a whole expression
+func parse(expr string) (node, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.expression(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// expect consumes a symbol
+func (p *parser) expect(symbol string) error {
+	t := p.next()
+	if t.kind != tokenSymbol || t.text != symbol {
+		if t.kind == tokenEOF {
+			return fmt.Errorf("expected %q at end of expression", symbol)
+		}
+		return fmt.Errorf("expected %q at %d, found %q", symbol, t.pos, t.text)
+	}
+	return nil
+}
+
+// operator returns the binary operator a token stands for, if any
+func operator(t token) (string, bool) {
+	if t.kind != tokenSymbol && (t.kind != tokenIdentifier || t.quoted) {
+		return "", false
+	}
+	_, ok := precedences[t.text]
+	return t.text, ok
+}
+
+// expression parses operators binding at least as tight as minPrecedence
+func (p *parser) expression(minPrecedence int) (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := operator(p.peek())
+		if !ok || precedences[op] < minPrecedence {
+			return left, nil
+		}
+		p.next()
+		if op == "is" || op == "as" {
+			name, err := p.typeSpecifier()
+			if err != nil {
+				return nil, err
+			}
+			left = typeNode{op: op, operand: left, typeName: name}
+			continue
+		}
+		right, err := p.expression(precedences[op] + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// typeSpecifier parses a type name such as Quantity or FHIR.dateTime
+func (p *parser) typeSpecifier() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier {
+		return "", fmt.Errorf("expected a type at %d", t.pos)
+	}
+	name := t.text
+	if next := p.peek(); next.kind == tokenSymbol && next.text == "." {
+		p.next()
+		t = p.next()
+		if t.kind != tokenIdentifier {
+			return "", fmt.Errorf("expected a type at %d", t.pos)
+		}
+		name += "." + t.text
+	}
+	return name, nil
+}
+
+// unary parses a term with its signs
+func (p *parser) unary() (node, error) {
+	if t := p.peek(); t.kind == tokenSymbol && (t.text == "+" || t.text == "-") {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{op: t.text, operand: operand}, nil
+	}
+	return p.postfix()
+}
+
+// postfix parses a term followed by invocations and indexers
+func (p *parser) postfix() (node, error) {
+	n, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokenSymbol && t.text == ".":
+			p.next()
+			if n, err = p.invocation(n); err != nil {
+				return nil, err
+			}
+		case t.kind == tokenSymbol && t.text == "[":
+			p.next()
+			index, err := p.expression(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = indexNode{target: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// term parses a literal, variable, parenthesized expression or invocation
+func (p *parser) term() (node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case tokenString:
+		p.next()
+		return literalNode{value: []item{{value: t.text}}}, nil
+	case tokenNumber:
+		p.next()
+		n, _ := parseNumber(t.text)
+		// A unit makes the number a quantity
+		if unit := p.peek(); unit.kind == tokenString || (unit.kind == tokenIdentifier && !unit.quoted && isCalendarWord(unit.text)) {
+			p.next()
+			return literalNode{value: []item{{value: quantity{value: n, unit: normalizeUnit(unit.text)}}}}, nil
+		}
+		return literalNode{value: []item{{value: n}}}, nil
+	case tokenTemporal:
+		p.next()
+		v, ok := parseTemporal(t.text)
+		if !ok {
+			return nil, fmt.Errorf("invalid date or time @%s at %d", t.text, t.pos)
+		}
+		return literalNode{value: []item{{value: v}}}, nil
+	case tokenVariable:
+		p.next()
+		return variableNode{name: t.text}, nil
+	case tokenSpecial:
+		p.next()
+		if t.text != "this" {
+			return nil, fmt.Errorf("unsupported $%s at %d", t.text, t.pos)
+		}
+		return thisNode{}, nil
+	case tokenSymbol:
+		switch t.text {
+		case "{}":
+			p.next()
+			return literalNode{}, nil
+		case "(":
+			p.next()
+			n, err := p.expression(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	case tokenIdentifier:
+		if !t.quoted && (t.text == "true" || t.text == "false") {
+			p.next()
+			return literalNode{value: []item{{value: t.text == "true"}}}, nil
+		}
+		return p.invocation(nil)
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// invocation parses a member or function invoked on target
+func (p *parser) invocation(target node) (node, error) {
+	t := p.next()
+	if t.kind == tokenSpecial && t.text == "this" {
+		return thisNode{}, nil
+	}
+	if t.kind != tokenIdentifier {
+		return nil, fmt.Errorf("expected a name at %d", t.pos)
+	}
+	if next := p.peek(); next.kind != tokenSymbol || next.text != "(" {
+		return memberNode{target: target, name: t.text}, nil
+	}
+
+	p.next()
+	var args []node
+	if next := p.peek(); next.kind == tokenSymbol && next.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.expression(1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if next := p.peek(); next.kind == tokenSymbol && next.text == "," {
+				p.next()
+				continue
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	f, ok := functions[t.text]
+	if !ok {
+		return nil, fmt.Errorf("unsupported function %s() at %d", t.text, t.pos)
+	}
+	if len(args) < f.minArgs || len(args) > f.maxArgs {
+		return nil, fmt.Errorf("%s() takes %s at %d", t.text, f.arity(), t.pos)
+	}
+	// The type argument of ofType(), is() and as() is a name, not an expression
+	if f.typeArg {
+		member, ok := args[0].(memberNode)
+		name := ""
+		switch {
+		case ok && member.target == nil:
+			name = member.name
+		case ok:
+			if inner, ok := member.target.(memberNode); ok && inner.target == nil {
+				name = inner.name + "." + member.name
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s() takes a type name at %d", t.text, t.pos)
+		}
+		args = []node{literalNode{value: []item{{value: name}}}}
+	}
+	return functionNode{target: target, name: t.text, args: args}, nil
+}
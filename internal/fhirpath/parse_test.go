@@ -0,0 +1,56 @@
+package fhirpath
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParse_Invalid tests that syntax errors and unknown functions are rejected
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "unexpected end"},
+		{"name.", "expected a name"},
+		{"name.given[0", `expected "]"`},
+		{"'unterminated", "unterminated '"},
+		{"name.foo()", "unsupported function foo()"},
+		{"name.where()", "where() takes 1 argument"},
+		{"name.first(1)", "first() takes no arguments"},
+		{"name.ofType(1)", "type name"},
+		{"@2024-13-01", "invalid date"},
+		{"1 +", "unexpected end"},
+		{"name given", "unexpected"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.expr)
+		if err == nil {
+			t.Errorf("Expected error for %q", tt.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected an error containing %q, got %v", tt.expr, tt.want, err)
+		}
+	}
+}
+
+// TestParse_Literals tests comments, escapes and quantity literals
+func TestParse_Literals(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"'it\\'s' // a comment", `["it's"]`},
+		{"/* block */ `id`", `["PAT1"]`},
+		{"4 weeks = 4 weeks", `[true]`},
+		{"4 'mg' = 4 'mg'", `[true]`},
+		{"@2024-03-15T10:30:00.250+02:00", `["2024-03-15T10:30:00.250+02:00"]`},
+		{"{}", `[]`},
+	}
+	for _, tt := range tests {
+		if got := evaluateJSON(t, tt.expr, patient); got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// item is a value of a collection with its FHIR type, when navigation told
+// it, e.g. dateTime for the value of effectiveDateTime reached as effective
+type item struct {
+	value interface{} // map[string]interface{}, string, bool, number, temporal or quantity
+	typ   string
+}
+
+// number is an Integer or Decimal
+type number struct {
+	r       *big.Rat
+	integer bool
+}
+
+// temporalKind tells dates, date-times and times apart
+type temporalKind int
+
+const (
+	kindDate temporalKind = iota
+	kindDateTime
+	kindTime
+)
+
+// Precisions of temporal values
+const (
+	precisionYear = iota + 1
+	precisionMonth
+	precisionDay
+	precisionHour
+	precisionMinute
+	precisionSecond // Seconds and milliseconds are compared as one precision
+)
+
+// temporal is a Date, DateTime or Time known to a precision
+type temporal struct {
+	kind      temporalKind
+	t         time.Time // In UTC; times are on 0000-01-01
+	precision int
+	fraction  int // Digits of the fraction of a second, kept for printing
+	zone      *time.Location
+}
+
+// quantity is a Quantity; calendar durations use the unit's singular word
+type quantity struct {
+	value number
+	unit  string
+}
+
+// newInteger returns an Integer
+func newInteger(n int64) number {
+	return number{r: new(big.Rat).SetInt64(n), integer: true}
+}
+
+// parseNumber reads a number literal or JSON number
+func parseNumber(s string) (number, bool) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return number{}, false
+	}
+	return number{r: r, integer: !strings.ContainsAny(s, ".eE")}, true
+}
+
+// String prints the number as FHIRPath would
+func (n number) String() string {
+	if n.r.IsInt() && n.integer {
+		return n.r.Num().String()
+	}
+	for digits := 1; digits < 18; digits++ {
+		s := n.r.FloatString(digits)
+		if r, _ := new(big.Rat).SetString(s); r.Cmp(n.r) == 0 {
+			return s
+		}
+	}
+	return n.r.FloatString(18)
+}
+
+// temporalPattern matches the date, date-time and time formats of FHIR and
+// of FHIRPath literals without the @
+var temporalPattern = regexp.MustCompile(`^(?:(\d{4})(?:-(\d{2})(?:-(\d{2}))?)?)?(T)?(?:(\d{2})(?::(\d{2})(?::(\d{2})(?:\.(\d+))?)?)?)?(Z|[+-]\d{2}:\d{2})?$`)
+
+// parseTemporal reads a date, date-time or time; times start with T
+func parseTemporal(s string) (temporal, bool) {
+	m := temporalPattern.FindStringSubmatch(s)
+	if m == nil || s == "" || s == "T" {
+		return temporal{}, false
+	}
+	year, month, day, tee, hour, minute, second, fraction, zone := m[1], m[2], m[3], m[4], m[5], m[6], m[7], m[8], m[9]
+
+	var v temporal
+	switch {
+	case year == "" && tee == "T" && hour != "" && zone == "":
+		v.kind = kindTime
+	case year != "" && tee == "" && hour == "" && zone == "":
+		v.kind = kindDate
+	case year != "" && tee == "T":
+		v.kind = kindDateTime
+	default:
+		return temporal{}, false
+	}
+
+	atoi := func(s string, fallback int) int {
+		if s == "" {
+			return fallback
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	for i, part := range []string{year, month, day, hour, minute, second} {
+		if part != "" {
+			v.precision = i + 1
+		}
+	}
+	nanos := 0
+	if fraction != "" {
+		v.fraction = len(fraction)
+		digits := (fraction + "000000000")[:9]
+		nanos = atoi(digits, 0)
+	}
+
+	loc := time.UTC
+	if zone != "" && zone != "Z" {
+		offset, _ := time.Parse("-07:00", zone)
+		_, seconds := offset.Zone()
+		loc = time.FixedZone(zone, seconds)
+	}
+	if zone != "" {
+		v.zone = loc
+	}
+	t := time.Date(atoi(year, 0), time.Month(atoi(month, 1)), atoi(day, 1),
+		atoi(hour, 0), atoi(minute, 0), atoi(second, 0), nanos, loc)
+	if v.kind != kindTime && (t.Month() != time.Month(atoi(month, 1)) || t.Day() != atoi(day, 1)) {
+		return temporal{}, false // e.g. 2023-02-30
+	}
+	v.t = t.UTC()
+	return v, true
+}
+
+// String prints the temporal in FHIR format
+func (v temporal) String() string {
+	t := v.t
+	if v.zone != nil {
+		t = t.In(v.zone)
+	}
+	layouts := []string{"", "2006", "2006-01", "2006-01-02", "2006-01-02T15", "2006-01-02T15:04", "2006-01-02T15:04:05"}
+	layout := layouts[v.precision]
+	if v.precision == precisionSecond && v.fraction > 0 {
+		layout += "." + strings.Repeat("0", v.fraction)
+	}
+	if v.kind == kindTime {
+		layout = strings.TrimPrefix(layout, "2006-01-02T")
+	}
+	s := t.Format(layout)
+	if v.kind == kindDateTime && v.zone != nil {
+		s += t.Format("Z07:00")
+	}
+	return s
+}
+
+// compareTemporal orders two temporals; ok is false when they are of
+// different kinds or differ only below the precision of one of them
+func compareTemporal(a, b temporal) (cmp int, ok bool) {
+	if (a.kind == kindTime) != (b.kind == kindTime) {
+		return 0, false
+	}
+	precision := a.precision
+	if b.precision < precision {
+		precision = b.precision
+	}
+	fields := func(v temporal) []int {
+		return []int{v.t.Year(), int(v.t.Month()), v.t.Day(), v.t.Hour(), v.t.Minute(), v.t.Second()*1e9 + v.t.Nanosecond()}
+	}
+	fa, fb := fields(a), fields(b)
+	start := 0
+	if a.kind == kindTime {
+		start = precisionHour - 1
+	}
+	for i := start; i < precision; i++ {
+		if fa[i] != fb[i] {
+			if fa[i] < fb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	if a.precision != b.precision {
+		return 0, false
+	}
+	return 0, true
+}
+
+// calendarUnits maps the units of calendar durations, including their UCUM
+// codes, to the singular word
+var calendarUnits = map[string]string{
+	"year": "year", "years": "year", "a": "year",
+	"month": "month", "months": "month", "mo": "month",
+	"week": "week", "weeks": "week", "wk": "week",
+	"day": "day", "days": "day", "d": "day",
+	"hour": "hour", "hours": "hour", "h": "hour",
+	"minute": "minute", "minutes": "minute", "min": "minute",
+	"second": "second", "seconds": "second", "s": "second",
+	"millisecond": "millisecond", "milliseconds": "millisecond", "ms": "millisecond",
+}
+
+// normalizeUnit returns the unit quantities are compared by
+func normalizeUnit(unit string) string {
+	if word, ok := calendarUnits[unit]; ok {
+		return word
+	}
+	return unit
+}
+
+// addDuration adds a calendar duration to a temporal
+func addDuration(v temporal, q quantity, sign int) (temporal, bool) {
+	unit := calendarUnits[q.unit]
+	if unit == "" {
+		return temporal{}, false
+	}
+	amount := new(big.Rat).Mul(q.value.r, big.NewRat(int64(sign), 1))
+	whole, _ := new(big.Float).SetRat(amount).Int64()
+	t := v.t
+	if v.zone != nil {
+		t = t.In(v.zone)
+	}
+	switch unit {
+	case "year":
+		t = addMonths(t, 12*int(whole))
+	case "month":
+		t = addMonths(t, int(whole))
+	case "week":
+		t = t.AddDate(0, 0, 7*int(whole))
+	case "day":
+		t = t.AddDate(0, 0, int(whole))
+	default:
+		seconds := map[string]float64{"hour": 3600, "minute": 60, "second": 1, "millisecond": 0.001}[unit]
+		f, _ := amount.Float64()
+		t = t.Add(time.Duration(f * seconds * float64(time.Second)))
+	}
+	v.t = t.UTC()
+	return v, true
+}
+
+// addMonths adds months to a time, keeping to the last day of a shorter
+// month as FHIRPath requires: @2024-01-31 + 1 month is @2024-02-29
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); t.Day() > last {
+		return first.AddDate(0, 0, last-1)
+	}
+	return first.AddDate(0, 0, t.Day()-1)
+}
+
+// fromJSON converts a decoded JSON value to the values of collections
+func fromJSON(value interface{}) interface{} {
+	if n, ok := value.(json.Number); ok {
+		if parsed, ok := parseNumber(n.String()); ok {
+			return parsed
+		}
+	}
+	return value
+}
+
+// toJSON converts a value of a collection to the JSON types Evaluate returns
+func toJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case number:
+		return json.Number(v.String())
+	case temporal:
+		return v.String()
+	case quantity:
+		return map[string]interface{}{"value": json.Number(v.value.String()), "unit": v.unit}
+	}
+	return value
+}
+
+// asQuantity reads a Quantity value or literal
+func asQuantity(value interface{}) (quantity, bool) {
+	switch v := value.(type) {
+	case quantity:
+		return v, true
+	case map[string]interface{}:
+		n, ok := v["value"].(json.Number)
+		if !ok {
+			return quantity{}, false
+		}
+		value, ok := parseNumber(n.String())
+		if !ok {
+			return quantity{}, false
+		}
+		unit, _ := v["code"].(string)
+		if unit == "" {
+			unit, _ = v["unit"].(string)
+		}
+		return quantity{value: value, unit: normalizeUnit(unit)}, true
+	}
+	return quantity{}, false
+}
+
+// asTemporal reads a temporal or a string in a temporal format
+func asTemporal(value interface{}) (temporal, bool) {
+	switch v := value.(type) {
+	case temporal:
+		return v, true
+	case string:
+		if len(v) >= 4 && v[0] >= '0' && v[0] <= '9' {
+			return parseTemporal(v)
+		}
+		if strings.HasPrefix(v, "T") {
+			return parseTemporal(v)
+		}
+		if len(v) >= 5 && v[2] == ':' {
+			return parseTemporal("T" + v)
+		}
+	}
+	return temporal{}, false
+}
+
+// equal compares two values for =; ok is false when the result is unknown,
+// as for temporals of different precisions
+func equal(a, b interface{}) (result, ok bool) {
+	switch av := a.(type) {
+	case number:
+		if bv, isNumber := b.(number); isNumber {
+			return av.r.Cmp(bv.r) == 0, true
+		}
+	case bool:
+		if bv, isBool := b.(bool); isBool {
+			return av == bv, true
+		}
+	case string:
+		if bv, isString := b.(string); isString {
+			return av == bv, true
+		}
+	}
+	_, aTemporal := a.(temporal)
+	_, bTemporal := b.(temporal)
+	if aTemporal || bTemporal {
+		at, aok := asTemporal(a)
+		bt, bok := asTemporal(b)
+		if !aok || !bok {
+			return false, true
+		}
+		cmp, ok := compareTemporal(at, bt)
+		return cmp == 0, ok
+	}
+	_, aQuantity := a.(quantity)
+	_, bQuantity := b.(quantity)
+	if aQuantity || bQuantity {
+		aq, aok := asQuantity(a)
+		bq, bok := asQuantity(b)
+		if !aok || !bok || aq.unit != bq.unit {
+			return false, true
+		}
+		return aq.value.r.Cmp(bq.value.r) == 0, true
+	}
+	return reflect.DeepEqual(a, b), true
+}
+
+// equivalent compares two values for ~: strings ignoring case and spacing,
+// temporals of different precisions as different
+func equivalent(a, b interface{}) bool {
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			normalize := func(s string) string { return strings.ToLower(strings.Join(strings.Fields(s), " ")) }
+			return normalize(as) == normalize(bs)
+		}
+	}
+	result, ok := equal(a, b)
+	return ok && result
+}
+
+// compare orders two values for < and the like; ok is false when they
+// can't be compared
+func compare(a, b interface{}) (cmp int, ok bool, err error) {
+	switch av := a.(type) {
+	case number:
+		if bv, isNumber := b.(number); isNumber {
+			return av.r.Cmp(bv.r), true, nil
+		}
+	case string:
+		if bv, isString := b.(string); isString {
+			// Dates in JSON are strings; compare them as dates when both are
+			at, aok := asTemporal(av)
+			bt, bok := asTemporal(bv)
+			if aok && bok {
+				cmp, ok := compareTemporal(at, bt)
+				return cmp, ok, nil
+			}
+			return strings.Compare(av, bv), true, nil
+		}
+	}
+	if at, ok := asTemporal(a); ok {
+		if bt, ok := asTemporal(b); ok {
+			cmp, ok := compareTemporal(at, bt)
+			return cmp, ok, nil
+		}
+	}
+	if aq, ok := asQuantity(a); ok {
+		if bq, ok := asQuantity(b); ok {
+			if aq.unit != bq.unit {
+				return 0, false, nil
+			}
+			return aq.value.r.Cmp(bq.value.r), true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("cannot compare %s with %s", typeName(item{value: a}), typeName(item{value: b}))
+}
+
+// typeName returns the type of an item, as in ofType() and is
+func typeName(it item) string {
+	if it.typ != "" {
+		return it.typ
+	}
+	switch v := it.value.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case number:
+		if v.integer {
+			return "integer"
+		}
+		return "decimal"
+	case temporal:
+		return []string{"date", "dateTime", "time"}[v.kind]
+	case quantity:
+		return "Quantity"
+	case map[string]interface{}:
+		if resourceType, ok := v["resourceType"].(string); ok {
+			return resourceType
+		}
+	}
+	return ""
+}
+
+// isType reports whether an item is of a type, as written after is or in
+// ofType(), e.g. Quantity, FHIR.dateTime or System.String
+func isType(it item, name string) bool {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "FHIR."), "System.")
+	actual := typeName(it)
+	if strings.EqualFold(actual, name) {
+		return true
+	}
+	// FHIR primitives specializing string and dateTime
+	switch strings.ToLower(name) {
+	case "string":
+		_, ok := it.value.(string)
+		return ok && (actual == "code" || actual == "id" || actual == "markdown" || actual == "uri" || actual == "url" || actual == "canonical")
+	case "datetime":
+		return actual == "instant"
+	}
+	return false
+}
@@ -0,0 +1,503 @@
+package fhirversion
+
+import "csv2fhir/internal/fhirjson"
+
+// r5Removed are the R4 resource types R5 no longer has, with what replaces them
+var r5Removed = map[string]string{
+	"Media": "map the data to DocumentReference instead",
+}
+
+// reason merges reasonCode and reasonReference into R5's reason
+var reason = codeableReference("reason", "reasonCode", "reasonReference", true)
+
+// r5Rules convert R4 resources to R5 by type. Types without rules, such as
+// Patient and Observation, are unchanged.
+var r5Rules = map[string][]rule{
+	"Encounter": {
+		mapCode("status", map[string]string{
+			"arrived":  "in-progress",
+			"triaged":  "in-progress",
+			"onleave":  "on-hold",
+			"finished": "completed",
+		}),
+		drop("statusHistory", "classHistory"),
+		codingToConcept("class"),
+		toList("class"),
+		codeableReference("serviceType", "serviceType", "", true),
+		each("participant", rename("individual", "actor")),
+		rename("period", "actualPeriod"),
+		encounterReason,
+		each("diagnosis",
+			codeableReference("condition", "", "condition", true),
+			toList("use"),
+			drop("rank")),
+		encounterAdmission,
+		each("location", rename("physicalType", "form")),
+		order("identifier", "status", "class", "priority", "type", "serviceType", "subject", "subjectStatus",
+			"episodeOfCare", "basedOn", "careTeam", "partOf", "serviceProvider", "participant", "appointment",
+			"virtualService", "actualPeriod", "plannedStartDate", "plannedEndDate", "length", "reason",
+			"diagnosis", "account", "dietPreference", "specialArrangement", "specialCourtesy", "admission",
+			"location"),
+	},
+	"Appointment": {
+		rename("cancelationReason", "cancellationReason"),
+		codeableReference("serviceType", "serviceType", "", true),
+		reason,
+		appointmentComment,
+		each("participant", appointmentRequired),
+		order("identifier", "status", "cancellationReason", "class", "serviceCategory", "serviceType",
+			"specialty", "appointmentType", "reason", "priority", "description", "replaces", "virtualService",
+			"supportingInformation", "previousAppointment", "originatingAppointment", "start", "end",
+			"minutesDuration", "requestedPeriod", "slot", "account", "created", "cancellationDate", "note",
+			"patientInstruction", "basedOn", "subject", "participant"),
+	},
+	"Schedule": {
+		codeableReference("serviceType", "serviceType", "", true),
+	},
+	"Slot": {
+		codeableReference("serviceType", "serviceType", "", true),
+		toList("appointmentType"),
+	},
+	"Task": {
+		reason,
+		codeableReference("requestedPerformer", "performerType", "", true),
+	},
+	"Practitioner": {
+		wrapItems("communication", "language"),
+	},
+	"Organization": {
+		organizationContact,
+	},
+	"Location": {
+		locationContact,
+		rename("physicalType", "form"),
+		drop("hoursOfOperation", "availabilityExceptions"),
+	},
+	"Condition": {
+		participants,
+		conditionEvidence,
+	},
+	"Procedure": {
+		renameChoice("performed", "occurrence"),
+		rename("asserter", "reportedReference"),
+		reason,
+		codeableReference("complication", "complication", "complicationDetail", true),
+		codeableReference("used", "usedCode", "usedReference", true),
+	},
+	"AllergyIntolerance": {
+		codeToConcept("type", "http://hl7.org/fhir/allergy-intolerance-type"),
+		participants,
+	},
+	"CarePlan": {
+		rename("author", "custodian"),
+		codeableReference("addresses", "", "addresses", true),
+		each("activity",
+			codeableReference("performedActivity", "outcomeCodeableConcept", "outcomeReference", true),
+			rename("reference", "plannedActivityReference"),
+			drop("detail")),
+	},
+	"Goal": {
+		rename("expressedBy", "source"),
+		codeableReference("outcome", "outcomeCode", "outcomeReference", true),
+	},
+	"RiskAssessment": {
+		reason,
+	},
+	"ServiceRequest": {
+		codeableReference("code", "code", "", false),
+		drop("orderDetail"),
+		codeableReference("location", "locationCode", "locationReference", true),
+		reason,
+		codeableReference("supportingInfo", "", "supportingInfo", true),
+		wrapItems("patientInstruction", "instructionMarkdown"),
+	},
+	"Medication": {
+		rename("manufacturer", "marketingAuthorizationHolder"),
+		rename("form", "doseForm"),
+		drop("amount"),
+		each("ingredient",
+			codeableReference("item", "itemCodeableConcept", "itemReference", false),
+			rename("strength", "strengthRatio")),
+	},
+	"MedicationRequest": {
+		drop("instantiatesCanonical", "instantiatesUri", "detectedIssue"),
+		codeableReference("medication", "medicationCodeableConcept", "medicationReference", false),
+		medicationRequestReported,
+		toList("performer"),
+		reason,
+		each("dispenseRequest", rename("performer", "dispenser")),
+		order("identifier", "basedOn", "priorPrescription", "groupIdentifier", "status", "statusReason",
+			"statusChanged", "intent", "category", "priority", "doNotPerform", "medication", "subject",
+			"informationSource", "encounter", "supportingInformation", "authoredOn", "requester", "reported",
+			"performerType", "performer", "device", "recorder", "reason", "courseOfTherapyType", "insurance",
+			"note", "renderedDosageInstruction", "effectiveDosePeriod", "dosageInstruction", "dispenseRequest",
+			"substitution", "eventHistory"),
+	},
+	"MedicationStatement": {
+		drop("basedOn", "statusReason"),
+		medicationStatementStatus,
+		toList("category"),
+		codeableReference("medication", "medicationCodeableConcept", "medicationReference", false),
+		rename("context", "encounter"),
+		toList("informationSource"),
+		reason,
+	},
+	"MedicationDispense": {
+		codeableReference("notPerformedReason", "statusReasonCodeableConcept", "statusReasonReference", false),
+		toList("category"),
+		codeableReference("medication", "medicationCodeableConcept", "medicationReference", false),
+		rename("context", "encounter"),
+	},
+	"MedicationAdministration": {
+		drop("instantiates"),
+		toList("category"),
+		codeableReference("medication", "medicationCodeableConcept", "medicationReference", false),
+		rename("context", "encounter"),
+		renameChoice("effective", "occurence"), // Sic, R5 misspells it
+		each("performer", codeableReference("actor", "", "actor", false)),
+		reason,
+		codeableReference("device", "", "device", true),
+	},
+	"Immunization": {
+		drop("recorded", "education", "programEligibility"),
+		codeableReference("manufacturer", "", "manufacturer", false),
+		codeableReference("informationSource", "reportOrigin", "", false),
+		reason,
+		each("reaction", codeableReference("manifestation", "", "detail", false)),
+		each("protocolApplied", choiceToString("doseNumber"), choiceToString("seriesDoses")),
+	},
+	"DiagnosticReport": {
+		rename("imagingStudy", "study"),
+	},
+	"Specimen": {
+		each("collection", codeableReference("bodySite", "bodySite", "", false)),
+		each("processing", rename("procedure", "method")),
+		each("container", drop("identifier", "description", "type", "capacity", "additive[x]")),
+	},
+	"ImagingStudy": {
+		codingToConcept("modality"),
+		drop("interpreter"),
+		codeableReference("procedure", "procedureCode", "procedureReference", true),
+		reason,
+		each("series",
+			codingToConcept("modality"),
+			codingToConcept("bodySite"),
+			codeableReference("bodySite", "bodySite", "", false),
+			codingToConcept("laterality")),
+	},
+	"DocumentReference": {
+		documentReferenceIdentifier,
+		documentReferenceContext,
+		documentReferenceAttester,
+		each("relatesTo", codeToConcept("code", "http://hl7.org/fhir/document-relationship-type")),
+		each("content", documentReferenceFormat),
+		order("identifier", "version", "basedOn", "status", "docStatus", "modality", "type", "category",
+			"subject", "context", "event", "bodySite", "facilityType", "practiceSetting", "period", "date",
+			"author", "attester", "custodian", "relatesTo", "description", "securityLabel", "content"),
+	},
+	"Coverage": {
+		coveragePayor,
+		each("class", wrapValue("value")),
+	},
+	"Claim": {
+		each("careTeam", rename("qualification", "specialty")),
+		each("item", itemBodySite),
+	},
+	"ExplanationOfBenefit": {
+		each("careTeam", rename("qualification", "specialty")),
+		each("item", itemBodySite),
+	},
+	"MessageHeader": {
+		each("destination", rename("endpoint", "endpointUrl")),
+		each("source", rename("endpoint", "endpointUrl")),
+	},
+}
+
+// encounterReason moves reasonCode and reasonReference into reason.value
+func encounterReason(c *conversion, o *fhirjson.Object, path string) {
+	at := o.Index("reasonCode")
+	if at < 0 {
+		at = o.Index("reasonReference")
+	}
+	codeableReference("value", "reasonCode", "reasonReference", true)(c, o, path)
+	if value := o.Remove("value"); value != nil {
+		o.Insert(at, "reason", []interface{}{fhirjson.NewObject("value", value)})
+	}
+}
+
+// encounterAdmission renames hospitalization to admission, moving the
+// elements that left it to the Encounter
+func encounterAdmission(c *conversion, o *fhirjson.Object, path string) {
+	admission, ok := o.Get("hospitalization").(*fhirjson.Object)
+	if !ok {
+		return
+	}
+	for _, field := range []string{"dietPreference", "specialArrangement", "specialCourtesy"} {
+		if value := admission.Remove(field); value != nil {
+			o.Set(field, value)
+		}
+	}
+	o.Replace("hospitalization", "admission", admission)
+}
+
+// appointmentComment turns comment into a note and patientInstruction into
+// a CodeableReference
+func appointmentComment(c *conversion, o *fhirjson.Object, path string) {
+	if comment, ok := o.Get("comment").(string); ok {
+		o.Replace("comment", "note", []interface{}{fhirjson.NewObject("text", comment)})
+	}
+	if instruction, ok := o.Get("patientInstruction").(string); ok {
+		o.Set("patientInstruction", []interface{}{fhirjson.NewObject("concept", fhirjson.NewObject("text", instruction))})
+	}
+}
+
+// appointmentRequired turns participant.required into a boolean
+func appointmentRequired(c *conversion, o *fhirjson.Object, path string) {
+	if required, ok := o.Get("required").(string); ok {
+		o.Set("required", required == "required")
+	}
+}
+
+// organizationContact moves the telecom and address of an Organization into
+// a contact, where the name of a contact becomes a list
+func organizationContact(c *conversion, o *fhirjson.Object, path string) {
+	for _, contact := range objects(o.Get("contact")) {
+		toList("name")(c, contact, path+".contact")
+	}
+	contact := fhirjson.NewObject()
+	at := -1
+	for _, field := range []string{"telecom", "address"} {
+		if value := o.Get(field); value != nil {
+			if at < 0 {
+				at = o.Index(field)
+			}
+			if field == "address" {
+				// ExtendedContactDetail has one address
+				list := items(value)
+				value = list[0]
+				if len(list) > 1 {
+					c.drop(path + ".address")
+				}
+			}
+			contact.Set(field, value)
+			o.Remove(field)
+		}
+	}
+	if contact.Len() > 0 {
+		o.Insert(at, "contact", append([]interface{}{contact}, items(o.Remove("contact"))...))
+	}
+}
+
+// locationContact moves the telecom of a Location into a contact
+func locationContact(c *conversion, o *fhirjson.Object, path string) {
+	if telecom := o.Get("telecom"); telecom != nil {
+		o.Replace("telecom", "contact", []interface{}{fhirjson.NewObject("telecom", telecom)})
+	}
+}
+
+// participants turns recorder and asserter into participants with their
+// function
+func participants(c *conversion, o *fhirjson.Object, path string) {
+	at := -1
+	var result []interface{}
+	for _, p := range []struct{ field, function, display string }{
+		{"recorder", "enterer", "Enterer"},
+		{"asserter", "informant", "Informant"},
+	} {
+		actor := o.Get(p.field)
+		if actor == nil {
+			continue
+		}
+		if i := o.Index(p.field); at < 0 || i < at {
+			at = i
+		}
+		function := fhirjson.NewObject("coding", []interface{}{fhirjson.NewObject(
+			"system", "http://terminology.hl7.org/CodeSystem/provenance-participant-type",
+			"code", p.function,
+			"display", p.display,
+		)})
+		result = append(result, fhirjson.NewObject("function", function, "actor", actor))
+	}
+	if at < 0 {
+		return
+	}
+	o.Remove("recorder")
+	o.Remove("asserter")
+	o.Insert(at, "participant", result)
+}
+
+// conditionEvidence flattens evidence.code and evidence.detail into
+// CodeableReferences
+func conditionEvidence(c *conversion, o *fhirjson.Object, path string) {
+	if !o.Has("evidence") {
+		return
+	}
+	var result []interface{}
+	for _, evidence := range objects(o.Get("evidence")) {
+		for _, code := range items(evidence.Get("code")) {
+			result = append(result, fhirjson.NewObject("concept", code))
+		}
+		for _, detail := range items(evidence.Get("detail")) {
+			result = append(result, fhirjson.NewObject("reference", detail))
+		}
+	}
+	o.Set("evidence", result)
+}
+
+// medicationRequestReported splits reported[x] into reported and
+// informationSource
+func medicationRequestReported(c *conversion, o *fhirjson.Object, path string) {
+	rename("reportedBoolean", "reported")(c, o, path)
+	if source := o.Get("reportedReference"); source != nil {
+		o.Replace("reportedReference", "reported", true)
+		o.Set("informationSource", []interface{}{source})
+	}
+}
+
+// medicationStatementAdherence maps R4 statuses, which mixed record status
+// and adherence, to R5 adherence codes
+var medicationStatementAdherence = map[string]string{
+	"active":    "taking",
+	"stopped":   "stopped",
+	"on-hold":   "on-hold",
+	"not-taken": "not-taking",
+	"unknown":   "unknown",
+}
+
+// medicationStatementStatus splits status into the record status and
+// adherence
+func medicationStatementStatus(c *conversion, o *fhirjson.Object, path string) {
+	status, ok := o.Get("status").(string)
+	if !ok || status == "entered-in-error" {
+		return
+	}
+	o.Set("status", "recorded")
+	code, ok := medicationStatementAdherence[status]
+	if !ok {
+		c.drop(path + ".status=" + status)
+		return
+	}
+	o.Set("adherence", fhirjson.NewObject("code", fhirjson.NewObject("coding", []interface{}{fhirjson.NewObject(
+		"system", "http://hl7.org/fhir/CodeSystem/medication-statement-adherence",
+		"code", code,
+	)})))
+}
+
+// documentReferenceIdentifier moves masterIdentifier into identifier
+func documentReferenceIdentifier(c *conversion, o *fhirjson.Object, path string) {
+	master := o.Get("masterIdentifier")
+	if master == nil {
+		return
+	}
+	identifiers := append([]interface{}{master}, items(o.Remove("identifier"))...)
+	o.Replace("masterIdentifier", "identifier", identifiers)
+}
+
+// documentReferenceContext spreads the elements of context over the
+// DocumentReference: encounters become context, events CodeableReferences
+func documentReferenceContext(c *conversion, o *fhirjson.Object, path string) {
+	context, ok := o.Get("context").(*fhirjson.Object)
+	if !ok {
+		return
+	}
+	at := o.Index("context")
+	o.Remove("context")
+	drop("sourcePatientInfo", "related")(c, context, path+".context")
+
+	var fields []string
+	values := map[string]interface{}{}
+	if encounter := context.Get("encounter"); encounter != nil {
+		fields = append(fields, "context")
+		values["context"] = encounter
+	}
+	if event := context.Get("event"); event != nil {
+		var events []interface{}
+		for _, concept := range items(event) {
+			events = append(events, fhirjson.NewObject("concept", concept))
+		}
+		fields = append(fields, "event")
+		values["event"] = events
+	}
+	for _, field := range []string{"facilityType", "practiceSetting", "period"} {
+		if value := context.Get(field); value != nil {
+			fields = append(fields, field)
+			values[field] = value
+		}
+	}
+	for i, field := range fields {
+		o.Insert(at+i, field, values[field])
+	}
+}
+
+// documentReferenceAttester turns authenticator into an official attester
+func documentReferenceAttester(c *conversion, o *fhirjson.Object, path string) {
+	party := o.Get("authenticator")
+	if party == nil {
+		return
+	}
+	mode := fhirjson.NewObject("coding", []interface{}{fhirjson.NewObject(
+		"system", "http://hl7.org/fhir/composition-attestation-mode",
+		"code", "official",
+	)})
+	o.Replace("authenticator", "attester", []interface{}{fhirjson.NewObject("mode", mode, "party", party)})
+}
+
+// documentReferenceFormat turns content.format into a content profile
+func documentReferenceFormat(c *conversion, o *fhirjson.Object, path string) {
+	if format := o.Get("format"); format != nil {
+		o.Replace("format", "profile", []interface{}{fhirjson.NewObject("valueCoding", format)})
+	}
+}
+
+// coveragePayor makes the first payor the insurer and any others paying
+// parties, and adds the kind R5 requires
+func coveragePayor(c *conversion, o *fhirjson.Object, path string) {
+	if !o.Has("kind") {
+		at := o.Index("status")
+		if at >= 0 {
+			at++
+		}
+		o.Insert(at, "kind", "insurance")
+	}
+	payors := items(o.Get("payor"))
+	if len(payors) == 0 {
+		return
+	}
+	o.Replace("payor", "insurer", payors[0])
+	if len(payors) > 1 {
+		var parties []interface{}
+		for _, payor := range payors[1:] {
+			parties = append(parties, fhirjson.NewObject("party", payor))
+		}
+		o.Set("paymentBy", parties)
+	}
+}
+
+// wrapValue turns a string element into an Identifier with that value
+func wrapValue(field string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		if value, ok := o.Get(field).(string); ok {
+			o.Set(field, fhirjson.NewObject("value", value))
+		}
+	}
+}
+
+// itemBodySite merges bodySite and subSite of a claim item into R5's
+// bodySite
+func itemBodySite(c *conversion, o *fhirjson.Object, path string) {
+	if !o.Has("bodySite") && !o.Has("subSite") {
+		return
+	}
+	at := o.Index("bodySite")
+	if at < 0 {
+		at = o.Index("subSite")
+	}
+	site := fhirjson.NewObject()
+	if bodySite := o.Remove("bodySite"); bodySite != nil {
+		site.Set("site", []interface{}{fhirjson.NewObject("concept", bodySite)})
+	}
+	if subSite := o.Remove("subSite"); subSite != nil {
+		site.Set("subSite", subSite)
+	}
+	o.Insert(at, "bodySite", []interface{}{site})
+}
@@ -0,0 +1,82 @@
+package fhirversion
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestR5 tests the conversion of resources to R5
+func TestR5(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		want        string
+		wantDropped []string
+	}{
+		{
+			name: "Encounter",
+			input: `{"id":"e1","status":"finished","classHistory":[{"class":{"code":"IMP"}}],` +
+				`"class":{"code":"AMB"},"subject":{"reference":"Patient/p1"},` +
+				`"participant":[{"individual":{"reference":"Practitioner/d1"}}],"period":{"start":"2024"},` +
+				`"reasonCode":[{"text":"check-up"}],"hospitalization":{"admitSource":{"text":"referral"}},` +
+				`"resourceType":"Encounter"}`,
+			want: `{"id":"e1","status":"completed","class":[{"coding":[{"code":"AMB"}]}],` +
+				`"subject":{"reference":"Patient/p1"},"participant":[{"actor":{"reference":"Practitioner/d1"}}],` +
+				`"actualPeriod":{"start":"2024"},"reason":[{"value":[{"concept":{"text":"check-up"}}]}],` +
+				`"admission":{"admitSource":{"text":"referral"}},"resourceType":"Encounter"}`,
+			wantDropped: []string{"Encounter.classHistory"},
+		},
+		{
+			name: "MedicationRequest",
+			input: `{"id":"m1","status":"active","intent":"order","reportedReference":{"reference":"Patient/p1"},` +
+				`"medicationReference":{"reference":"Medication/x"},"subject":{"reference":"Patient/p1"},` +
+				`"resourceType":"MedicationRequest"}`,
+			want: `{"id":"m1","status":"active","intent":"order","medication":{"reference":{"reference":"Medication/x"}},` +
+				`"subject":{"reference":"Patient/p1"},"informationSource":[{"reference":"Patient/p1"}],` +
+				`"reported":true,"resourceType":"MedicationRequest"}`,
+		},
+		{
+			name:        "MedicationStatement",
+			input:       `{"status":"intended","resourceType":"MedicationStatement"}`,
+			want:        `{"status":"recorded","resourceType":"MedicationStatement"}`,
+			wantDropped: []string{"MedicationStatement.status=intended"},
+		},
+		{
+			name: "DocumentReference",
+			input: `{"masterIdentifier":{"value":"d1"},"status":"current","authenticator":{"reference":"Practitioner/a"},` +
+				`"context":{"encounter":[{"reference":"Encounter/e1"}],"period":{"start":"2024"},"related":[{}]},` +
+				`"content":[{"attachment":{"url":"a.pdf"},"format":{"code":"urn:pdf"}}],"resourceType":"DocumentReference"}`,
+			want: `{"identifier":[{"value":"d1"}],"status":"current","context":[{"reference":"Encounter/e1"}],` +
+				`"period":{"start":"2024"},"attester":[{"mode":{"coding":[{"system":"http://hl7.org/fhir/composition-attestation-mode","code":"official"}]},` +
+				`"party":{"reference":"Practitioner/a"}}],"content":[{"attachment":{"url":"a.pdf"},` +
+				`"profile":[{"valueCoding":{"code":"urn:pdf"}}]}],"resourceType":"DocumentReference"}`,
+			wantDropped: []string{"DocumentReference.context.related"},
+		},
+		{
+			name:  "MessageHeader",
+			input: `{"eventCoding":{"code":"e"},"destination":[{"endpoint":"urn:a"}],"source":{"endpoint":"urn:b"},"resourceType":"MessageHeader"}`,
+			want:  `{"eventCoding":{"code":"e"},"destination":[{"endpointUrl":"urn:a"}],"source":{"endpointUrl":"urn:b"},"resourceType":"MessageHeader"}`,
+		},
+		{
+			name:  "Observation is unchanged",
+			input: `{"status":"final","code":{"text":"x"},"resourceType":"Observation"}`,
+			want:  `{"status":"final","code":{"text":"x"},"resourceType":"Observation"}`,
+		},
+	}
+
+	converter := NewConverter(R5)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped, err := converter.ConvertJSON([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("ConvertJSON failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("Dropped %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package fhirversion
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+
+	"csv2fhir/internal/fhirjson"
+)
+
+// each applies rules to a field holding an object or a list of objects
+func each(field string, rules ...rule) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		for _, child := range objects(o.Get(field)) {
+			for _, r := range rules {
+				r(c, child, path+"."+field)
+			}
+		}
+	}
+}
+
+// objects returns the objects of a value: the value itself or its items
+func objects(value interface{}) []*fhirjson.Object {
+	var result []*fhirjson.Object
+	for _, item := range items(value) {
+		if o, ok := item.(*fhirjson.Object); ok {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// items returns a value as a list: its items, the value itself or nothing
+func items(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{value}
+}
+
+// choiceKeys returns the keys of a choice element, e.g. performedDateTime
+// for performed, with their primitive extensions
+func choiceKeys(o *fhirjson.Object, base string) []string {
+	var keys []string
+	for _, key := range o.Keys() {
+		name := strings.TrimPrefix(key, "_")
+		if len(name) > len(base) && strings.HasPrefix(name, base) && unicode.IsUpper(rune(name[len(base)])) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// rename renames an element and its primitive extension
+func rename(from, to string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		for _, prefix := range []string{"", "_"} {
+			if o.Has(prefix + from) {
+				o.Replace(prefix+from, prefix+to, o.Get(prefix+from))
+			}
+		}
+	}
+}
+
+// renameChoice renames a choice element, e.g. performed[x] to occurrence[x]
+func renameChoice(from, to string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		for _, key := range choiceKeys(o, from) {
+			o.Replace(key, strings.Replace(key, from, to, 1), o.Get(key))
+		}
+	}
+}
+
+// drop removes elements that have no equivalent, reporting them. A name
+// ending in [x] drops every type of a choice element.
+func drop(fields ...string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		for _, field := range fields {
+			keys := []string{field, "_" + field}
+			if base := strings.TrimSuffix(field, "[x]"); base != field {
+				keys = choiceKeys(o, base)
+			}
+			for _, key := range keys {
+				if o.Has(key) {
+					o.Remove(key)
+					c.drop(path + "." + field)
+				}
+			}
+		}
+	}
+}
+
+// drop reports an element that could not be represented
+func (c *conversion) drop(path string) {
+	for _, dropped := range c.dropped {
+		if dropped == path {
+			return
+		}
+	}
+	c.dropped = append(c.dropped, path)
+}
+
+// toList turns a single value into a list of one
+func toList(field string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		if value := o.Get(field); value != nil {
+			if _, ok := value.([]interface{}); !ok {
+				o.Set(field, []interface{}{value})
+			}
+		}
+	}
+}
+
+// codingToConcept turns Codings, single or in a list, into CodeableConcepts
+func codingToConcept(field string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		value := o.Get(field)
+		if value == nil {
+			return
+		}
+		concepts := make([]interface{}, 0)
+		for _, coding := range items(value) {
+			concepts = append(concepts, fhirjson.NewObject("coding", []interface{}{coding}))
+		}
+		if _, ok := value.([]interface{}); ok {
+			o.Set(field, concepts)
+		} else {
+			o.Set(field, concepts[0])
+		}
+	}
+}
+
+// codeToConcept turns a code into a CodeableConcept of the given system
+func codeToConcept(field, system string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		if code, ok := o.Get(field).(string); ok {
+			o.Set(field, fhirjson.NewObject("coding", []interface{}{fhirjson.NewObject("system", system, "code", code)}))
+			o.Remove("_" + field)
+		}
+	}
+}
+
+// codeableReference merges a CodeableConcept element and a Reference element,
+// either of which may be empty or a list, into CodeableReferences. The result
+// takes the place of the first of them.
+func codeableReference(to, concept, reference string, list bool) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		at := -1
+		var result []interface{}
+		for _, source := range []struct{ field, kind string }{{concept, "concept"}, {reference, "reference"}} {
+			if source.field == "" || !o.Has(source.field) {
+				continue
+			}
+			if i := o.Index(source.field); at < 0 || i < at {
+				at = i
+			}
+			for _, item := range items(o.Get(source.field)) {
+				// The R4 models write some unset choices as {}
+				if item, ok := item.(*fhirjson.Object); ok && item.Len() == 0 {
+					continue
+				}
+				result = append(result, fhirjson.NewObject(source.kind, item))
+			}
+		}
+		if at < 0 {
+			return
+		}
+		o.Remove(concept)
+		o.Remove(reference)
+		if len(result) == 0 {
+			return
+		}
+		if list {
+			o.Insert(at, to, result)
+			return
+		}
+		o.Insert(at, to, result[0])
+		if len(result) > 1 {
+			c.drop(path + "." + reference)
+		}
+	}
+}
+
+// wrapItems turns each item of a list into an object holding it as key
+func wrapItems(field, key string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		if value := o.Get(field); value != nil {
+			var wrapped []interface{}
+			for _, item := range items(value) {
+				wrapped = append(wrapped, fhirjson.NewObject(key, item))
+			}
+			o.Set(field, wrapped)
+		}
+	}
+}
+
+// mapCode maps the values of a code element
+func mapCode(field string, codes map[string]string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		if code, ok := o.Get(field).(string); ok {
+			if mapped, ok := codes[code]; ok {
+				o.Set(field, mapped)
+			}
+		}
+	}
+}
+
+// choiceToString turns a choice element, e.g. doseNumber[x], into a string
+// element of the base name
+func choiceToString(base string) rule {
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		for _, key := range choiceKeys(o, base) {
+			value := o.Get(key)
+			if strings.HasPrefix(key, "_") {
+				o.Replace(key, "_"+base, value)
+				continue
+			}
+			if number, ok := value.(json.Number); ok {
+				value = number.String()
+			}
+			o.Replace(key, base, value)
+		}
+	}
+}
+
+// resourceElements are the elements every domain resource starts with
+var resourceElements = []string{"id", "meta", "implicitRules", "language", "text", "contained", "extension", "modifierExtension"}
+
+// order sorts the elements of a resource into the order of the target
+// release, which the XML formats require. Elements not listed keep their
+// place after the element preceding them; resourceType stays last.
+func order(elements ...string) rule {
+	rank := map[string]int{}
+	for i, element := range append(append([]string{}, resourceElements...), elements...) {
+		rank[element] = i + 1
+	}
+	return func(c *conversion, o *fhirjson.Object, path string) {
+		type ranked struct {
+			key  string
+			rank int
+		}
+		keys := make([]ranked, o.Len())
+		last := 0
+		for i, key := range o.Keys() {
+			name := strings.TrimPrefix(key, "_")
+			if r, ok := rank[name]; ok {
+				last = r
+			} else if name == "resourceType" {
+				last = len(rank) + 1
+			}
+			keys[i] = ranked{key, last}
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return keys[i].rank < keys[j].rank
+		})
+		sorted := make([]string, len(keys))
+		for i := range keys {
+			sorted[i] = keys[i].key
+		}
+		o.Reorder(sorted)
+	}
+}
@@ -0,0 +1,115 @@
+package fhirversion
+
+import (
+	"reflect"
+	"testing"
+
+	"csv2fhir/internal/fhirjson"
+)
+
+// apply runs rules on a JSON object and returns the result and what was dropped
+func apply(t *testing.T, input string, rules ...rule) (string, []string) {
+	t.Helper()
+	o, err := fhirjson.ParseObject([]byte(input))
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", input, err)
+	}
+	conv := &conversion{}
+	for _, r := range rules {
+		r(conv, o, "Test")
+	}
+	data, err := fhirjson.Marshal(o)
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	return string(data), conv.dropped
+}
+
+// TestRules tests the building blocks of conversions
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		rule        rule
+		want        string
+		wantDropped []string
+	}{
+		{
+			name:  "rename keeps position and extension",
+			input: `{"a":1,"period":{},"_period":{"id":"x"},"resourceType":"T"}`,
+			rule:  rename("period", "actualPeriod"),
+			want:  `{"a":1,"actualPeriod":{},"_actualPeriod":{"id":"x"},"resourceType":"T"}`,
+		},
+		{
+			name:  "rename choice",
+			input: `{"performedDateTime":"2024","_performedDateTime":{}}`,
+			rule:  renameChoice("performed", "occurrence"),
+			want:  `{"occurrenceDateTime":"2024","_occurrenceDateTime":{}}`,
+		},
+		{
+			name:        "drop choice",
+			input:       `{"additiveReference":{},"status":"a"}`,
+			rule:        drop("additive[x]", "missing"),
+			want:        `{"status":"a"}`,
+			wantDropped: []string{"Test.additive[x]"},
+		},
+		{
+			name:  "coding to list of concepts",
+			input: `{"class":{"code":"AMB"},"resourceType":"T"}`,
+			rule: func(c *conversion, o *fhirjson.Object, path string) {
+				codingToConcept("class")(c, o, path)
+				toList("class")(c, o, path)
+			},
+			want: `{"class":[{"coding":[{"code":"AMB"}]}],"resourceType":"T"}`,
+		},
+		{
+			name:  "codeable reference list",
+			input: `{"reasonCode":[{"text":"a"}],"note":"n","reasonReference":[{"reference":"Condition/1"}]}`,
+			rule:  reason,
+			want:  `{"reason":[{"concept":{"text":"a"}},{"reference":{"reference":"Condition/1"}}],"note":"n"}`,
+		},
+		{
+			name:  "codeable reference skips empty choices",
+			input: `{"medicationCodeableConcept":{"text":"a"},"medicationReference":{}}`,
+			rule:  codeableReference("medication", "medicationCodeableConcept", "medicationReference", false),
+			want:  `{"medication":{"concept":{"text":"a"}}}`,
+		},
+		{
+			name:        "codeable reference keeps one of a single element",
+			input:       `{"xCodeableConcept":{"text":"a"},"xReference":{"reference":"M/1"}}`,
+			rule:        codeableReference("x", "xCodeableConcept", "xReference", false),
+			want:        `{"x":{"concept":{"text":"a"}}}`,
+			wantDropped: []string{"Test.xReference"},
+		},
+		{
+			name:  "map code",
+			input: `{"status":"finished"}`,
+			rule:  mapCode("status", map[string]string{"finished": "completed"}),
+			want:  `{"status":"completed"}`,
+		},
+		{
+			name:  "choice to string",
+			input: `{"doseNumberPositiveInt":2}`,
+			rule:  choiceToString("doseNumber"),
+			want:  `{"doseNumber":"2"}`,
+		},
+		{
+			name:  "order",
+			input: `{"b":1,"x":2,"id":"i","a":3,"resourceType":"T"}`,
+			rule:  order("a", "b"),
+			want:  `{"id":"i","a":3,"b":1,"x":2,"resourceType":"T"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, dropped := apply(t, tt.input, tt.rule)
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("Dropped %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
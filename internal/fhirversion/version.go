@@ -0,0 +1,116 @@
+package fhirversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"csv2fhir/internal/fhirjson"
+)
+
+// Version is a FHIR release resources can be written in
+type Version string
+
+const (
+	R4  Version = "R4"  // 4.0.1, the release of the FHIR models
+	R4B Version = "R4B" // 4.3.0
+	R5  Version = "R5"  // 5.0.0
+)
+
+// ParseVersion parses a release name, e.g. r5, or its version number, e.g.
+// 5.0.0; patch versions of a release are the release
+func ParseVersion(s string) (Version, error) {
+	name := strings.ToUpper(s)
+	if parts := strings.Split(name, "."); len(parts) == 3 {
+		name = parts[0] + "." + parts[1]
+	}
+	switch name {
+	case "", "R4", "4.0":
+		return R4, nil
+	case "R4B", "4.3":
+		return R4B, nil
+	case "R5", "5.0":
+		return R5, nil
+	}
+	return "", fmt.Errorf("unsupported FHIR version: %s (supported: R4, R4B, R5)", s)
+}
+
+// Converter converts R4 resources to the shape of another release
+type Converter struct {
+	version Version
+	rules   map[string][]rule // By resource type
+}
+
+// NewConverter returns a converter to the given release, or nil for R4,
+// which needs no conversion
+func NewConverter(version Version) *Converter {
+	switch version {
+	case R4B:
+		// The resources csv2fhir builds did not change between R4 and R4B
+		return &Converter{version: version}
+	case R5:
+		return &Converter{version: version, rules: r5Rules}
+	}
+	return nil
+}
+
+// Version returns the release the converter converts to
+func (c *Converter) Version() Version {
+	return c.version
+}
+
+// Supports reports whether resources of the type exist in the target release
+func (c *Converter) Supports(resourceType string) error {
+	if c.version == R5 {
+		if replacement, ok := r5Removed[resourceType]; ok {
+			return fmt.Errorf("%s is not part of FHIR R5; %s", resourceType, replacement)
+		}
+	}
+	return nil
+}
+
+// Convert converts an R4 resource. It returns the converted resource as JSON
+// and the elements that could not be represented in the target release,
+// which were dropped, as messages like "Encounter.classHistory".
+func (c *Converter) Convert(resource interface{}) (json.RawMessage, []string, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	return c.ConvertJSON(data)
+}
+
+// ConvertJSON converts an R4 resource given as JSON, keeping the order of its
+// elements, which the XML formats depend on
+func (c *Converter) ConvertJSON(data []byte) (json.RawMessage, []string, error) {
+	resource, err := fhirjson.ParseObject(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse resource: %w", err)
+	}
+	resourceType, _ := resource.Get("resourceType").(string)
+	if err := c.Supports(resourceType); err != nil {
+		return nil, nil, err
+	}
+
+	conv := &conversion{}
+	for _, r := range c.rules[resourceType] {
+		r(conv, resource, resourceType)
+	}
+
+	converted, err := fhirjson.Marshal(resource)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(conv.dropped)
+	return converted, conv.dropped, nil
+}
+
+// conversion collects what converting one resource dropped
+type conversion struct {
+	dropped []string
+}
+
+// rule converts elements of an object; path names the object in messages,
+// e.g. Encounter.participant
+type rule func(c *conversion, o *fhirjson.Object, path string)
@@ -0,0 +1,75 @@
+package fhirversion
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestParseVersion tests release names and version numbers
+func TestParseVersion(t *testing.T) {
+	tests := map[string]Version{"r4": R4, "4.0.1": R4, "R4B": R4B, "4.3": R4B, "r5": R5, "5.0.0": R5, "4.0.0": R4}
+	for input, want := range tests {
+		if got, err := ParseVersion(input); err != nil || got != want {
+			t.Errorf("ParseVersion(%q) = %v, %v; want %v", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"r6", "3.0.2", "4.0.1.2"} {
+		if _, err := ParseVersion(input); err == nil {
+			t.Errorf("Expected an error for unsupported version %q", input)
+		}
+	}
+}
+
+// TestNewConverter tests that R4 needs no converter and R4B keeps resources
+func TestNewConverter(t *testing.T) {
+	if NewConverter(R4) != nil {
+		t.Error("Expected no converter for R4")
+	}
+
+	input := `{"id":"e1","status":"finished","class":{"code":"AMB"},"resourceType":"Encounter"}`
+	got, dropped, err := NewConverter(R4B).ConvertJSON([]byte(input))
+	if err != nil {
+		t.Fatalf("ConvertJSON failed: %v", err)
+	}
+	if string(got) != input || len(dropped) != 0 {
+		t.Errorf("Expected R4B to keep the resource, got %s, dropped %v", got, dropped)
+	}
+}
+
+// TestConverter_Supports tests resource types R5 removed
+func TestConverter_Supports(t *testing.T) {
+	converter := NewConverter(R5)
+	if err := converter.Supports("Media"); err == nil {
+		t.Error("Expected Media to be unsupported in R5")
+	}
+	if err := converter.Supports("Observation"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, _, err := converter.ConvertJSON([]byte(`{"resourceType":"Media"}`)); err == nil {
+		t.Error("Expected converting a Media to fail")
+	}
+	if _, _, err := converter.ConvertJSON([]byte(`[]`)); err == nil {
+		t.Error("Expected an error for JSON that is not a resource")
+	}
+}
+
+// TestConverter_Convert tests converting a model, keeping numbers and the
+// order of elements
+func TestConverter_Convert(t *testing.T) {
+	id, value := "o1", json.Number("1.50")
+	observation := &fhir.Observation{
+		Id:            &id,
+		Status:        fhir.ObservationStatusFinal,
+		ValueQuantity: &fhir.Quantity{Value: &value},
+	}
+	got, _, err := NewConverter(R5).Convert(observation)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	want := `{"id":"o1","status":"final","code":{},"valueQuantity":{"value":1.50},"resourceType":"Observation"}`
+	if string(got) != want {
+		t.Errorf("Convert() = %s\nwant %s", got, want)
+	}
+}
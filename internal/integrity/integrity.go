@@ -0,0 +1,224 @@
+package integrity
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Links identify a resource and list the references it makes
+type Links struct {
+	Key        string // "Type/id"; empty for resources without an id
+	References []Link
+}
+
+// Link is a literal reference made by a resource
+type Link struct {
+	Field  string // Path of the Reference, e.g. performer[1]
+	Target string // Reference as written, e.g. Patient/123
+}
+
+// Dangling is a reference to a resource that is neither in the output nor
+// known to exist
+type Dangling struct {
+	RowNumber int
+	Source    string // "Type/id" of the referencing resource, or its type
+	Link
+}
+
+// Checker collects the resources of a run and the references between them,
+// finding references that don't resolve once the run is complete
+type Checker struct {
+	baseURL    string
+	resources  map[string]bool // "Type/id" of resources in the output
+	known      map[string]bool // "Type/id" of resources known to exist elsewhere
+	pending    []Dangling      // References to resources not seen yet
+	references int
+}
+
+// keyPattern matches a "Type/id" key, the form of known ids
+var keyPattern = regexp.MustCompile(`^[A-Z][A-Za-z]+/[A-Za-z0-9\-.]{1,64}$`)
+
+// NewChecker creates a checker. References starting with baseURL, the
+// server the output is for, are resolved like relative references.
+func NewChecker(baseURL string) *Checker {
+	return &Checker{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		resources: map[string]bool{},
+		known:     map[string]bool{},
+	}
+}
+
+// LoadKnown reads ids of resources that exist on the server, one "Type/id"
+// per line. Blank lines and lines starting with # are skipped.
+func (c *Checker) LoadKnown(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open known ids: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if !keyPattern.MatchString(key) {
+			return fmt.Errorf("%s:%d: expected Type/id, got %q", path, line, key)
+		}
+		c.known[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read known ids: %w", err)
+	}
+	return nil
+}
+
+// Known returns the number of known ids loaded
+func (c *Checker) Known() int {
+	return len(c.known)
+}
+
+// Extract finds the identity of a resource and the literal references it
+// makes, in nested elements and lists. References to contained resources
+// that exist are left out; logical references without a reference string
+// and conditional references are not links.
+func Extract(resource interface{}) (Links, error) {
+	data, ok := resource.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(resource); err != nil {
+			return Links{}, fmt.Errorf("failed to marshal resource: %w", err)
+		}
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return Links{}, fmt.Errorf("failed to parse resource: %w", err)
+	}
+
+	var links Links
+	resourceType, _ := value["resourceType"].(string)
+	if id, _ := value["id"].(string); id != "" {
+		links.Key = resourceType + "/" + id
+	}
+	contained := map[string]bool{}
+	for _, item := range asList(value["contained"]) {
+		if resource, ok := item.(map[string]interface{}); ok {
+			if id, _ := resource["id"].(string); id != "" {
+				contained["#"+id] = true
+			}
+		}
+	}
+
+	var walk func(value interface{}, path string)
+	walk = func(value interface{}, path string) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if target, ok := v["reference"].(string); ok && path != "" {
+				if target != "" && !contained[target] && !strings.Contains(target, "?") {
+					links.References = append(links.References, Link{Field: path, Target: target})
+				}
+			}
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				field := key
+				if path != "" {
+					field = path + "." + key
+				}
+				walk(v[key], field)
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+	walk(value, "")
+	return links, nil
+}
+
+// Add records a resource of the output and its references
+func (c *Checker) Add(links Links, rowNumber int) {
+	if links.Key != "" {
+		c.resources[links.Key] = true
+	}
+	source := links.Key
+	if source == "" {
+		source = "resource"
+	}
+	for _, link := range links.References {
+		target, ok := c.key(link.Target)
+		if !ok {
+			continue
+		}
+		c.references++
+		if c.resources[target] || c.known[target] {
+			continue
+		}
+		c.pending = append(c.pending, Dangling{RowNumber: rowNumber, Source: source, Link: link})
+	}
+}
+
+// key returns the "Type/id" a reference resolves to within the output or
+// the known ids. References to other servers and urn:uuid references to
+// bundle entries can't be checked.
+func (c *Checker) key(target string) (string, bool) {
+	if strings.HasPrefix(target, "#") {
+		return target, true // A contained resource that doesn't exist
+	}
+	if c.baseURL != "" && strings.HasPrefix(target, c.baseURL+"/") {
+		target = strings.TrimPrefix(target, c.baseURL+"/")
+	}
+	if strings.Contains(target, ":") {
+		return "", false
+	}
+	target, _, _ = strings.Cut(target, "/_history/")
+	return target, true
+}
+
+// References returns the number of checked references seen so far
+func (c *Checker) References() int {
+	return c.references
+}
+
+// Dangling returns the references to resources missing from the output and
+// the known ids, in the order they were added
+func (c *Checker) Dangling() []Dangling {
+	var dangling []Dangling
+	for _, d := range c.pending {
+		target, _ := c.key(d.Target)
+		if !c.resources[target] {
+			dangling = append(dangling, d)
+		}
+	}
+	return dangling
+}
+
+// Error describes the dangling reference
+func (d Dangling) Error() string {
+	source := d.Source
+	if d.RowNumber > 0 {
+		source = fmt.Sprintf("row %d: %s", d.RowNumber, d.Source)
+	}
+	return fmt.Sprintf("%s %s refers to %s, which is neither in the output nor a known id", source, d.Field, d.Target)
+}
+
+// asList returns a value as a list: its items, the value itself or nothing
+func asList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{value}
+}
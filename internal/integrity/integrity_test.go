@@ -0,0 +1,115 @@
+package integrity
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// TestExtract tests that nested and list references are found with their paths
+func TestExtract(t *testing.T) {
+	resource := json.RawMessage(`{
+		"resourceType": "Observation",
+		"id": "OBS1",
+		"contained": [{"resourceType": "Specimen", "id": "sp1", "subject": {"reference": "Patient/P1"}}],
+		"subject": {"reference": "Patient/P1", "display": "Jane"},
+		"performer": [{"reference": "Practitioner/D1"}, {"display": "unknown"}, {"reference": "Organization?identifier=x|1"}],
+		"specimen": {"reference": "#sp1"},
+		"hasMember": [{"reference": "#missing"}],
+		"extension": [{"url": "http://example.org/ext", "valueReference": {"reference": "Device/DEV1"}}]
+	}`)
+	links, err := Extract(resource)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if links.Key != "Observation/OBS1" {
+		t.Errorf("Unexpected key %s", links.Key)
+	}
+	expected := []Link{
+		{Field: "contained[0].subject", Target: "Patient/P1"},
+		{Field: "extension[0].valueReference", Target: "Device/DEV1"},
+		{Field: "hasMember[0]", Target: "#missing"},
+		{Field: "performer[0]", Target: "Practitioner/D1"},
+		{Field: "subject", Target: "Patient/P1"},
+	}
+	if !reflect.DeepEqual(links.References, expected) {
+		t.Errorf("Expected %v, got %v", expected, links.References)
+	}
+
+	// Structs are read as they marshal
+	encounter := &fhir.Encounter{Subject: &fhir.Reference{Reference: strPtr("Patient/P2")}}
+	links, err = Extract(encounter)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if links.Key != "" || len(links.References) != 1 || links.References[0].Target != "Patient/P2" {
+		t.Errorf("Unexpected links %+v", links)
+	}
+}
+
+// TestChecker tests that references resolve against the whole output, in any
+// order, and against known ids
+func TestChecker(t *testing.T) {
+	known := filepath.Join(t.TempDir(), "known.txt")
+	if err := os.WriteFile(known, []byte("# on the server\nOrganization/ORG1\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewChecker("http://example.org/fhir/")
+	if err := c.LoadKnown(known); err != nil {
+		t.Fatalf("LoadKnown failed: %v", err)
+	}
+	if c.Known() != 1 {
+		t.Errorf("Expected 1 known id, got %d", c.Known())
+	}
+
+	c.Add(Links{Key: "Observation/O1", References: []Link{
+		{Field: "subject", Target: "Patient/P1"}, // Written later
+		{Field: "performer[0]", Target: "Organization/ORG1"},
+		{Field: "performer[1]", Target: "http://example.org/fhir/Practitioner/D1/_history/2"},
+		{Field: "device", Target: "http://elsewhere.org/Device/X"},
+		{Field: "focus[0]", Target: "urn:uuid:5b4f6e1c-0000-4000-8000-000000000000"},
+	}}, 2)
+	c.Add(Links{Key: "Patient/P1"}, 3)
+	c.Add(Links{Key: "Observation/O2", References: []Link{
+		{Field: "subject", Target: "Patient/P9"},
+	}}, 4)
+
+	dangling := c.Dangling()
+	if len(dangling) != 2 {
+		t.Fatalf("Expected 2 dangling references, got %v", dangling)
+	}
+	if dangling[0].Target != "http://example.org/fhir/Practitioner/D1/_history/2" || dangling[0].RowNumber != 2 {
+		t.Errorf("Unexpected dangling reference %+v", dangling[0])
+	}
+	if dangling[1].Target != "Patient/P9" || dangling[1].Source != "Observation/O2" {
+		t.Errorf("Unexpected dangling reference %+v", dangling[1])
+	}
+	if !strings.HasPrefix(dangling[1].Error(), "row 4: Observation/O2 subject refers to Patient/P9") {
+		t.Errorf("Unexpected message %s", dangling[1].Error())
+	}
+	if c.References() != 4 {
+		t.Errorf("Expected 4 checked references, got %d", c.References())
+	}
+}
+
+// TestLoadKnown_Invalid tests that malformed lines are reported with their number
+func TestLoadKnown_Invalid(t *testing.T) {
+	known := filepath.Join(t.TempDir(), "known.txt")
+	if err := os.WriteFile(known, []byte("Patient/P1\nP2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := NewChecker("").LoadKnown(known)
+	if err == nil || !strings.Contains(err.Error(), "known.txt:2") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BulkManifest is the manifest of a FHIR Bulk Data export
+type BulkManifest struct {
+	TransactionTime     string           `json:"transactionTime"`
+	Request             string           `json:"request"`
+	RequiresAccessToken bool             `json:"requiresAccessToken"`
+	Output              []BulkOutputFile `json:"output"`
+	Error               []BulkOutputFile `json:"error"`
+}
+
+// BulkOutputFile is one entry of a bulk manifest's output array
+type BulkOutputFile struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"` // Relative to the manifest
+	Count int    `json:"count"`
+}
+
+// BulkWriter writes resources in the FHIR Bulk Data export layout: one
+// <ResourceType>.ndjson file per resource type and a manifest.json. Closing
+// it replaces an earlier export in the directory, including the files of
+// types no longer written.
+type BulkWriter struct {
+	dir          string
+	request      string
+	opts         Options
+	writers      map[string]*Writer
+	count        int
+	maxResources int // Across all types; 0 means no limit
+	closed       bool
+	incomplete   bool
+	started      time.Time
+}
+
+// BulkManifestName is the file name of the manifest in a bulk output directory
+const BulkManifestName = "manifest.json"
+
+// NewBulkWriter creates a bulk writer for dir. request is recorded in the
+// manifest as the request that produced the export.
+func NewBulkWriter(dir string, request string, opts Options) (*BulkWriter, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("bulk output requires an output directory")
+	}
+	if opts.Compression != CompressionNone {
+		return nil, fmt.Errorf("bulk output cannot be compressed")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// The limit covers the run, not each type's file
+	maxResources := opts.MaxResources
+	opts.Format = FormatNDJSON
+	opts.MaxResources = 0
+	return &BulkWriter{
+		dir:          dir,
+		request:      request,
+		opts:         opts,
+		writers:      make(map[string]*Writer),
+		maxResources: maxResources,
+		started:      time.Now().UTC(),
+	}, nil
+}
+
+// Write routes a resource to the file for its type
+func (b *BulkWriter) Write(resource interface{}) error {
+	if b.closed {
+		return fmt.Errorf("writer is closed")
+	}
+	if b.maxResources > 0 && b.count >= b.maxResources {
+		return fmt.Errorf("resource limit exceeded (%d resources). Increase --max-resources", b.maxResources)
+	}
+
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	var info resourceInfo
+	if err := json.Unmarshal(data, &info); err != nil || info.ResourceType == "" {
+		return fmt.Errorf("failed to determine resource type")
+	}
+
+	writer, ok := b.writers[info.ResourceType]
+	if !ok {
+		writer, err = NewWriterWithOptions(filepath.Join(b.dir, info.ResourceType+".ndjson"), b.opts)
+		if err != nil {
+			return err
+		}
+		b.writers[info.ResourceType] = writer
+	}
+	if err := writer.Write(json.RawMessage(data)); err != nil {
+		return err
+	}
+	b.count++
+	return nil
+}
+
+// MarkIncomplete flags the output as the result of an interrupted run
+func (b *BulkWriter) MarkIncomplete() {
+	b.incomplete = true
+}
+
+// Close finalizes every resource file and writes the manifest
+func (b *BulkWriter) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	manifest := BulkManifest{
+		TransactionTime: b.started.Format(time.RFC3339),
+		Request:         b.request,
+		Output:          []BulkOutputFile{},
+		Error:           []BulkOutputFile{},
+	}
+
+	// The manifest of an earlier export no longer describes the files once
+	// they are replaced
+	manifestPath := filepath.Join(b.dir, BulkManifestName)
+	if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove earlier manifest: %w", err)
+	}
+
+	var firstErr error
+	for _, resourceType := range b.resourceTypes() {
+		writer := b.writers[resourceType]
+		if err := writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		manifest.Output = append(manifest.Output, BulkOutputFile{
+			Type:  resourceType,
+			URL:   resourceType + ".ndjson",
+			Count: writer.Count(),
+		})
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := b.removeStale(); err != nil {
+		return err
+	}
+
+	// The manifest is written last, so its presence marks a finished export.
+	// An interrupted export that is kept gets no manifest.
+	if b.incomplete {
+		return nil
+	}
+	if err := writeJSONFile(manifestPath, manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// removeStale removes the <ResourceType>.ndjson files of an earlier export
+// for types this run did not write
+func (b *BulkWriter) removeStale() error {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read output directory: %w", err)
+	}
+	for _, entry := range entries {
+		resourceType, ok := strings.CutSuffix(entry.Name(), ".ndjson")
+		if !ok || entry.IsDir() || !isResourceTypeName(resourceType) || b.writers[resourceType] != nil {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove earlier %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// isResourceTypeName reports whether s looks like a resource type, e.g.
+// Observation
+func isResourceTypeName(s string) bool {
+	if s == "" || s[0] < 'A' || s[0] > 'Z' {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Abort discards every resource file
+func (b *BulkWriter) Abort() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	var firstErr error
+	for _, writer := range b.writers {
+		if err := writer.Abort(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// resourceTypes returns the resource types written so far, sorted
+func (b *BulkWriter) resourceTypes() []string {
+	types := make([]string, 0, len(b.writers))
+	for resourceType := range b.writers {
+		types = append(types, resourceType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,147 @@
+package output
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestBulkWriter tests routing resources to one file per type
+func TestBulkWriter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "export")
+
+	writer, err := NewBulkWriter(dir, "file:///data/input.csv", Options{})
+	if err != nil {
+		t.Fatalf("Failed to create bulk writer: %v", err)
+	}
+	resources := []interface{}{
+		&fhir.Patient{Id: strPtr("PAT1")},
+		&fhir.Observation{Id: strPtr("OBS1")},
+		&fhir.Observation{Id: strPtr("OBS2")},
+	}
+	for _, resource := range resources {
+		if err := writer.Write(resource); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, BulkManifestName))
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var manifest BulkManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if manifest.Request != "file:///data/input.csv" || manifest.TransactionTime == "" {
+		t.Errorf("Unexpected manifest header: %+v", manifest)
+	}
+	if len(manifest.Output) != 2 {
+		t.Fatalf("Expected 2 output files, got %d", len(manifest.Output))
+	}
+
+	// Sorted by type
+	want := []BulkOutputFile{
+		{Type: "Observation", URL: "Observation.ndjson", Count: 2},
+		{Type: "Patient", URL: "Patient.ndjson", Count: 1},
+	}
+	for i, file := range manifest.Output {
+		if file != want[i] {
+			t.Errorf("Output %d: expected %+v, got %+v", i, want[i], file)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, file.URL))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file.URL, err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != file.Count {
+			t.Errorf("%s: expected %d lines, got %d", file.URL, file.Count, len(lines))
+		}
+		for _, line := range lines {
+			if !strings.Contains(line, `"resourceType":"`+file.Type+`"`) {
+				t.Errorf("%s: unexpected resource %s", file.URL, line)
+			}
+		}
+	}
+}
+
+// TestBulkWriter_Abort tests that aborting leaves no files or manifest
+func TestBulkWriter_Abort(t *testing.T) {
+	dir := t.TempDir()
+
+	writer, err := NewBulkWriter(dir, "", Options{})
+	if err != nil {
+		t.Fatalf("Failed to create bulk writer: %v", err)
+	}
+	writer.Write(&fhir.Patient{Id: strPtr("PAT1")})
+	if err := writer.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Expected empty directory after Abort, found %d entries", len(entries))
+	}
+}
+
+// TestBulkWriter_MaxResources tests that the limit covers all resource types
+func TestBulkWriter_MaxResources(t *testing.T) {
+	writer, err := NewBulkWriter(t.TempDir(), "", Options{MaxResources: 2})
+	if err != nil {
+		t.Fatalf("Failed to create bulk writer: %v", err)
+	}
+	defer writer.Abort()
+	if err := writer.Write(&fhir.Patient{Id: strPtr("PAT1")}); err != nil {
+		t.Fatalf("Failed to write resource: %v", err)
+	}
+	if err := writer.Write(&fhir.Observation{Id: strPtr("OBS1")}); err != nil {
+		t.Fatalf("Failed to write resource: %v", err)
+	}
+	if err := writer.Write(&fhir.Encounter{Id: strPtr("ENC1")}); err == nil {
+		t.Error("Expected the third resource to exceed the limit")
+	}
+}
+
+// TestBulkWriter_ReplacesExport tests that files of an earlier export are
+// replaced or removed
+func TestBulkWriter_ReplacesExport(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		BulkManifestName:   `{"output":[]}`,
+		"Patient.ndjson":   `{"resourceType":"Patient","id":"OLD"}`,
+		"Encounter.ndjson": `{"resourceType":"Encounter","id":"OLD"}`,
+		"notes.ndjson":     "kept",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer, err := NewBulkWriter(dir, "", Options{})
+	if err != nil {
+		t.Fatalf("Failed to create bulk writer: %v", err)
+	}
+	writer.Write(&fhir.Patient{Id: strPtr("PAT1")})
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	var names []string
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "Patient.ndjson,manifest.json,notes.ndjson" {
+		t.Errorf("Unexpected files: %v", names)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "Patient.ndjson")); !strings.Contains(string(data), "PAT1") {
+		t.Errorf("Expected Patient.ndjson to be replaced, got %s", data)
+	}
+}
@@ -0,0 +1,96 @@
+package output
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"csv2fhir/internal/fhirjson"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestCanonicalBundle tests that a canonical bundle is itself canonical JSON
+func TestCanonicalBundle(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "bundle.json")
+	writer, err := NewWriterWithOptions(outputPath, Options{Format: FormatBundle, Canonical: true})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, id := range []string{"PAT1", "PAT2"} {
+		id := id
+		if err := writer.Write(&fhir.Patient{Id: &id}); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	writer.MarkIncomplete()
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	canonical, err := fhirjson.Canonical(data)
+	if err != nil {
+		t.Fatalf("Output is not valid JSON: %v", err)
+	}
+	if string(data) != string(canonical)+"\n" {
+		t.Errorf("Bundle is not canonical:\n%s\nwant\n%s", data, canonical)
+	}
+	if !strings.HasPrefix(string(data), `{"entry":[{"resource":{"id":"PAT1","resourceType":"Patient"}}`) {
+		t.Errorf("Unexpected bundle start: %s", data)
+	}
+}
+
+// TestLayout tests compact bundles and pretty NDJSON
+func TestLayout(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		opts      Options
+		wantLines int
+	}{
+		{Options{Format: FormatBundle, Layout: LayoutCompact}, 1},
+		{Options{Format: FormatBundle, Layout: LayoutCompact, BundleType: BundleTransaction}, 1},
+		{Options{Format: FormatNDJSON, Layout: LayoutPretty}, 8},
+	}
+	for i, tt := range tests {
+		outputPath := filepath.Join(dir, "out"+string(rune('0'+i)))
+		writer, err := NewWriterWithOptions(outputPath, tt.opts)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for _, id := range []string{"PAT1", "PAT2"} {
+			id := id
+			if err := writer.Write(&fhir.Patient{Id: &id}); err != nil {
+				t.Fatalf("Failed to write resource: %v", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != tt.wantLines {
+			t.Errorf("%+v: expected %d lines, got %d:\n%s", tt.opts, tt.wantLines, lines, data)
+		}
+		if tt.opts.Format == FormatBundle {
+			var bundle fhir.Bundle
+			if err := json.Unmarshal(data, &bundle); err != nil {
+				t.Errorf("%+v: output is not a valid bundle: %v", tt.opts, err)
+			} else if len(bundle.Entry) != 2 {
+				t.Errorf("%+v: expected 2 entries, got %d", tt.opts, len(bundle.Entry))
+			}
+		}
+	}
+
+	if _, err := NewWriterWithOptions("", Options{Format: FormatNDJSON, Canonical: true, Layout: LayoutPretty}); err == nil {
+		t.Error("Expected error for pretty canonical output")
+	}
+}
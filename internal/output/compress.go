@@ -0,0 +1,77 @@
+package output
+
+import (
+	"compress/gzip"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Compression selects how output files are compressed
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+)
+
+// ParseCompression parses a compression name into a Compression
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	default:
+		return "", fmt.Errorf("unsupported compression: %s (supported: none, gzip)", s)
+	}
+}
+
+// compressedExts are file extensions that follow the format extension, as in
+// output.ndjson.gz
+var compressedExts = []string{".gz", ".zst"}
+
+// splitExt splits a path into its stem and extension, keeping a compression
+// suffix together with the format extension: output.ndjson.gz ->
+// (output, .ndjson.gz)
+func splitExt(path string) (string, string) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for _, compressed := range compressedExts {
+		if ext == compressed {
+			inner := filepath.Ext(stem)
+			return strings.TrimSuffix(stem, inner), inner + ext
+		}
+	}
+	return stem, ext
+}
+
+// outputSink passes compressed data on to the output, so the offset and
+// checksum of a Writer describe the compressed file
+type outputSink struct {
+	w *Writer
+}
+
+// Write writes compressed data to the output
+func (s outputSink) Write(p []byte) (int, error) {
+	return s.w.writeOutput(p)
+}
+
+// startCompression routes everything written from here on through the
+// compressor
+func (w *Writer) startCompression(compression Compression) {
+	if compression == CompressionGzip {
+		w.compressor = gzip.NewWriter(outputSink{w})
+	}
+}
+
+// finishCompression flushes the compressor and writes the gzip trailer
+func (w *Writer) finishCompression() error {
+	if w.compressor == nil {
+		return nil
+	}
+	if err := w.compressor.Close(); err != nil {
+		return fmt.Errorf("failed to finish compressed output: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package output
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestParseCompression tests parsing of compression names
+func TestParseCompression(t *testing.T) {
+	for input, want := range map[string]Compression{"": CompressionNone, "none": CompressionNone, "gzip": CompressionGzip} {
+		got, err := ParseCompression(input)
+		if err != nil || got != want {
+			t.Errorf("ParseCompression(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Error("Expected error for unsupported compression")
+	}
+}
+
+// TestGzipOutput tests that compressed output decompresses to the plain output
+// and that the checksum covers the compressed file
+func TestGzipOutput(t *testing.T) {
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.ndjson")
+	gzipPath := filepath.Join(dir, "out.ndjson.gz")
+
+	var gzipWriter *Writer
+	for _, path := range []string{plainPath, gzipPath} {
+		opts := Options{Format: FormatNDJSON}
+		if path == gzipPath {
+			opts.Compression = CompressionGzip
+		}
+		writer, err := NewWriterWithOptions(path, opts)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for _, id := range []string{"P1", "P2", "P3"} {
+			id := id
+			if err := writer.Write(&fhir.Patient{Id: &id}); err != nil {
+				t.Fatalf("Failed to write resource: %v", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Failed to close writer: %v", err)
+		}
+		gzipWriter = writer
+	}
+
+	plain, err := os.ReadFile(plainPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	compressed, err := os.ReadFile(gzipPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+
+	reader, err := gzip.NewReader(strings.NewReader(string(compressed)))
+	if err != nil {
+		t.Fatalf("Output is not gzip: %v", err)
+	}
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decompress output: %v", err)
+	}
+	if string(decompressed) != string(plain) {
+		t.Errorf("Decompressed output differs:\n%s\nwant\n%s", decompressed, plain)
+	}
+
+	sum := sha256.Sum256(compressed)
+	if gzipWriter.Checksum() != hex.EncodeToString(sum[:]) || gzipWriter.Offset() != int64(len(compressed)) {
+		t.Error("Expected offset and checksum of the compressed file")
+	}
+}
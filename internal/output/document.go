@@ -0,0 +1,199 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"csv2fhir/internal/uuid"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// BundleHeader describes the Composition that opens a document bundle or the
+// MessageHeader that opens a message bundle
+type BundleHeader struct {
+	// Document bundles
+	Title        string
+	Type         Code   // Composition.type, e.g. LOINC 11502-2
+	Author       string // Reference, e.g. Organization/LAB1
+	SectionTitle string
+
+	// Message bundles
+	Event        Code
+	Source       Endpoint
+	Destinations []Endpoint
+}
+
+// Code is a coded value of the bundle header
+type Code struct {
+	System  string
+	Code    string
+	Display string
+}
+
+// Endpoint is a message source or destination
+type Endpoint struct {
+	Endpoint string
+	Name     string
+}
+
+// validate checks that the header has what the bundle type requires
+func (h BundleHeader) validate(bundleType BundleType) error {
+	var missing []string
+	switch bundleType {
+	case BundleDocument:
+		if h.Title == "" {
+			missing = append(missing, "title")
+		}
+		if h.Type.Code == "" {
+			missing = append(missing, "type code")
+		}
+		if h.Author == "" {
+			missing = append(missing, "author")
+		}
+	case BundleMessage:
+		if h.Event.Code == "" {
+			missing = append(missing, "event code")
+		}
+		if h.Source.Endpoint == "" {
+			missing = append(missing, "source endpoint")
+		}
+		for i, destination := range h.Destinations {
+			if destination.Endpoint == "" {
+				missing = append(missing, fmt.Sprintf("destination %d endpoint", i+1))
+			}
+		}
+	default:
+		return nil
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s bundles require a bundle header with %s in the mapping", bundleType, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// size returns an upper bound of the bytes the header entry adds to a bundle,
+// not counting its references to the other entries
+func (h BundleHeader) size() int64 {
+	size := 1024 + len(h.Title) + len(h.Type.System) + len(h.Type.Code) + len(h.Type.Display) +
+		len(h.Author) + len(h.SectionTitle) + len(h.Event.System) + len(h.Event.Code) + len(h.Event.Display) +
+		len(h.Source.Endpoint) + len(h.Source.Name)
+	for _, destination := range h.Destinations {
+		size += 64 + len(destination.Endpoint) + len(destination.Name)
+	}
+	return int64(size)
+}
+
+// buildHeaderedEntry fills in the fullUrl of a document or message entry and
+// records it for the header entry
+func (w *Writer) buildHeaderedEntry(entry *fhir.BundleEntry) error {
+	var info resourceInfo
+	if err := json.Unmarshal(entry.Resource, &info); err != nil {
+		return fmt.Errorf("failed to read resource type and id: %w", err)
+	}
+	if info.ResourceType == "" {
+		return fmt.Errorf("resource has no resourceType")
+	}
+
+	fullURL, err := w.entryFullURL(&info)
+	if err != nil {
+		return err
+	}
+	entry.FullUrl = &fullURL
+	w.entryURLs = append(w.entryURLs, fullURL)
+	return nil
+}
+
+// messageHeader is a MessageHeader with eventCoding as its event, since
+// fhir.MessageHeader always marshals an empty eventUri as well
+type messageHeader struct {
+	Id           *string                         `json:"id,omitempty"`
+	EventCoding  fhir.Coding                     `json:"eventCoding"`
+	Destination  []fhir.MessageHeaderDestination `json:"destination,omitempty"`
+	Source       fhir.MessageHeaderSource        `json:"source"`
+	Focus        []fhir.Reference                `json:"focus,omitempty"`
+	ResourceType string                          `json:"resourceType"`
+}
+
+// headerEntry returns the compact Composition or MessageHeader entry that
+// must be the first entry of a document or message bundle. It references
+// every other entry, so it can only be built once they have all been written.
+func (w *Writer) headerEntry() ([]byte, error) {
+	header := w.opts.Header
+	references := make([]fhir.Reference, len(w.entryURLs))
+	for i := range w.entryURLs {
+		references[i] = fhir.Reference{Reference: &w.entryURLs[i]}
+	}
+
+	var resource interface{}
+	if w.opts.BundleType == BundleDocument {
+		author := header.Author
+		if fullURL, ok := w.fullURLs[author]; ok {
+			author = fullURL
+		}
+		composition := fhir.Composition{
+			Status: fhir.CompositionStatusFinal,
+			Type:   fhir.CodeableConcept{Coding: []fhir.Coding{header.Type.coding()}},
+			Date:   w.timestamp,
+			Author: []fhir.Reference{{Reference: &author}},
+			Title:  header.Title,
+		}
+		// A section must have entries, so an empty document has none
+		if len(references) > 0 {
+			section := fhir.CompositionSection{Entry: references}
+			if header.SectionTitle != "" {
+				section.Title = &header.SectionTitle
+			}
+			composition.Section = []fhir.CompositionSection{section}
+		}
+		resource = composition
+	} else {
+		message := messageHeader{
+			EventCoding:  header.Event.coding(),
+			Source:       fhir.MessageHeaderSource{Endpoint: header.Source.Endpoint, Name: optional(header.Source.Name)},
+			Focus:        references,
+			ResourceType: "MessageHeader",
+		}
+		for _, destination := range header.Destinations {
+			message.Destination = append(message.Destination, fhir.MessageHeaderDestination{
+				Endpoint: destination.Endpoint,
+				Name:     optional(destination.Name),
+			})
+		}
+		resource = message
+	}
+
+	resourceJSON, err := json.Marshal(resource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal bundle header: %w", err)
+	}
+	if w.opts.Converter != nil {
+		if resourceJSON, _, err = w.opts.Converter.ConvertJSON(resourceJSON); err != nil {
+			return nil, err
+		}
+	}
+	id, err := uuid.New()
+	if err != nil {
+		return nil, err
+	}
+	fullURL := "urn:uuid:" + id
+	data, err := json.Marshal(fhir.BundleEntry{FullUrl: &fullURL, Resource: resourceJSON})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal bundle header entry: %w", err)
+	}
+	return data, nil
+}
+
+// coding converts the code to a FHIR Coding
+func (c Code) coding() fhir.Coding {
+	return fhir.Coding{System: optional(c.System), Code: optional(c.Code), Display: optional(c.Display)}
+}
+
+// optional returns a pointer to s, or nil if s is empty
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
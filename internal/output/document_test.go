@@ -0,0 +1,205 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"csv2fhir/internal/fhirversion"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// labHeader is a header usable for both document and message bundles
+var labHeader = BundleHeader{
+	Title:        "Lab results",
+	Type:         Code{System: "http://loinc.org", Code: "11502-2", Display: "Laboratory report"},
+	Author:       "Organization/LAB1",
+	SectionTitle: "Results",
+	Event:        Code{System: "http://example.org/events", Code: "lab-result"},
+	Source:       Endpoint{Endpoint: "urn:lab:1", Name: "Main lab"},
+	Destinations: []Endpoint{{Endpoint: "https://ehr.example.org/fhir"}},
+}
+
+// writeLabResults writes a patient and an observation referencing it
+func writeLabResults(t *testing.T, path string, opts Options) {
+	t.Helper()
+	writer, err := NewWriterWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.Write(&fhir.Patient{Id: strPtr("PAT1")}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	observation := &fhir.Observation{Id: strPtr("OBS1"), Subject: &fhir.Reference{Reference: strPtr("Patient/PAT1")}}
+	if err := writer.Write(observation); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// checkHeaderedBundle checks the rules shared by document and message bundles
+// and returns the header entry's resource
+func checkHeaderedBundle(t *testing.T, bundle fhir.Bundle, resourceType string) json.RawMessage {
+	t.Helper()
+	if bundle.Identifier == nil || bundle.Identifier.Value == nil || !strings.HasPrefix(*bundle.Identifier.Value, "urn:uuid:") {
+		t.Errorf("Expected a urn:uuid identifier, got %+v", bundle.Identifier)
+	}
+	if bundle.Timestamp == nil || *bundle.Timestamp == "" {
+		t.Error("Expected a timestamp")
+	}
+	if bundle.Total != nil {
+		t.Error("Expected no total")
+	}
+	if len(bundle.Entry) != 3 {
+		t.Fatalf("Expected header and 2 entries, got %d", len(bundle.Entry))
+	}
+	for i, entry := range bundle.Entry {
+		if entry.FullUrl == nil || !strings.HasPrefix(*entry.FullUrl, "urn:uuid:") {
+			t.Errorf("Entry %d has no urn:uuid fullUrl", i)
+		}
+	}
+
+	var info resourceInfo
+	json.Unmarshal(bundle.Entry[0].Resource, &info)
+	if info.ResourceType != resourceType {
+		t.Fatalf("Expected %s as the first entry, got %s", resourceType, info.ResourceType)
+	}
+	if !bytes.Contains(bundle.Entry[2].Resource, []byte(*bundle.Entry[1].FullUrl)) {
+		t.Errorf("Expected the observation to reference the patient's fullUrl: %s", bundle.Entry[2].Resource)
+	}
+	return bundle.Entry[0].Resource
+}
+
+// TestDocumentBundle tests that the Composition comes first and lists the entries
+func TestDocumentBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	writeLabResults(t, path, Options{Format: FormatBundle, BundleType: BundleDocument, Header: labHeader})
+
+	bundle := readBundle(t, path)
+	if bundle.Type != fhir.BundleTypeDocument {
+		t.Errorf("Expected document bundle, got %s", bundle.Type.Code())
+	}
+	composition, err := fhir.UnmarshalComposition(checkHeaderedBundle(t, bundle, "Composition"))
+	if err != nil {
+		t.Fatalf("Failed to parse Composition: %v", err)
+	}
+	if composition.Title != "Lab results" || composition.Date != *bundle.Timestamp || *composition.Author[0].Reference != "Organization/LAB1" {
+		t.Errorf("Unexpected Composition: %+v", composition)
+	}
+	if *composition.Type.Coding[0].Code != "11502-2" || composition.Status != fhir.CompositionStatusFinal {
+		t.Errorf("Unexpected Composition type or status: %+v", composition)
+	}
+	section := composition.Section[0]
+	if *section.Title != "Results" || len(section.Entry) != 2 ||
+		*section.Entry[0].Reference != *bundle.Entry[1].FullUrl || *section.Entry[1].Reference != *bundle.Entry[2].FullUrl {
+		t.Errorf("Expected the section to reference both entries: %+v", section)
+	}
+}
+
+// TestMessageBundle tests that the MessageHeader comes first and focuses on the entries
+func TestMessageBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	writeLabResults(t, path, Options{Format: FormatBundle, BundleType: BundleMessage, Header: labHeader, Canonical: true})
+
+	bundle := readBundle(t, path)
+	if bundle.Type != fhir.BundleTypeMessage {
+		t.Errorf("Expected message bundle, got %s", bundle.Type.Code())
+	}
+	resource := checkHeaderedBundle(t, bundle, "MessageHeader")
+	if bytes.Contains(resource, []byte("eventUri")) {
+		t.Errorf("Expected no eventUri: %s", resource)
+	}
+	header, err := fhir.UnmarshalMessageHeader(resource)
+	if err != nil {
+		t.Fatalf("Failed to parse MessageHeader: %v", err)
+	}
+	if *header.EventCoding.Code != "lab-result" || header.Source.Endpoint != "urn:lab:1" || *header.Source.Name != "Main lab" {
+		t.Errorf("Unexpected MessageHeader: %+v", header)
+	}
+	if len(header.Destination) != 1 || len(header.Focus) != 2 || *header.Focus[1].Reference != *bundle.Entry[2].FullUrl {
+		t.Errorf("Unexpected destination or focus: %+v", header)
+	}
+}
+
+// TestMessageBundle_Converter tests that the MessageHeader is converted with
+// the resources
+func TestMessageBundle_Converter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	converter := fhirversion.NewConverter(fhirversion.R5)
+	writeLabResults(t, path, Options{Format: FormatBundle, BundleType: BundleMessage, Header: labHeader, Canonical: true, Converter: converter})
+
+	resource := checkHeaderedBundle(t, readBundle(t, path), "MessageHeader")
+	if !bytes.Contains(resource, []byte(`"endpointUrl":"urn:lab:1"`)) || bytes.Contains(resource, []byte(`"endpoint"`)) {
+		t.Errorf("Expected R5 endpoints: %s", resource)
+	}
+}
+
+// TestDocumentBundle_XML tests that the Composition comes first in XML
+func TestDocumentBundle_XML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.xml")
+	writeLabResults(t, path, Options{Format: FormatXML, BundleType: BundleDocument, Header: labHeader})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if err := checkWellFormed(data); err != nil {
+		t.Fatalf("Output is not well-formed XML: %v\n%s", err, data)
+	}
+	out := string(data)
+	for _, want := range []string{`<identifier>`, `<timestamp value="`, `<title value="Lab results"/>`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %s in output:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "<Composition") > strings.Index(out, "<Patient") {
+		t.Errorf("Expected the Composition before the Patient:\n%s", out)
+	}
+}
+
+// TestDocumentBundle_Empty tests a document without row resources
+func TestDocumentBundle_Empty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	writer, err := NewWriterWithOptions(path, Options{Format: FormatBundle, BundleType: BundleDocument, Header: labHeader})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	bundle := readBundle(t, path)
+	if len(bundle.Entry) != 1 || bytes.Contains(bundle.Entry[0].Resource, []byte("section")) {
+		t.Errorf("Expected only a Composition without sections, got %+v", bundle.Entry)
+	}
+}
+
+// TestBundleHeader_Validate tests that each bundle type requires its header elements
+func TestBundleHeader_Validate(t *testing.T) {
+	if err := (BundleHeader{}).validate(BundleCollection); err != nil {
+		t.Errorf("Collections need no header: %v", err)
+	}
+	if err := labHeader.validate(BundleDocument); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := labHeader.validate(BundleMessage); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	err := (BundleHeader{Title: "Lab results"}).validate(BundleDocument)
+	if err == nil || !strings.Contains(err.Error(), "type code, author") {
+		t.Errorf("Expected missing type code and author, got %v", err)
+	}
+	err = (BundleHeader{Event: labHeader.Event}).validate(BundleMessage)
+	if err == nil || !strings.Contains(err.Error(), "source endpoint") {
+		t.Errorf("Expected missing source endpoint, got %v", err)
+	}
+	if _, err := NewWriterWithOptions(filepath.Join(t.TempDir(), "out.json"), Options{Format: FormatBundle, BundleType: BundleMessage}); err == nil {
+		t.Error("Expected NewWriterWithOptions to reject a message bundle without header")
+	}
+}
@@ -0,0 +1,286 @@
+package output
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"csv2fhir/internal/uuid"
+)
+
+// PartitionOptions configures a PartitionWriter
+type PartitionOptions struct {
+	MaxOpenFiles int // Partition files kept open at once (default 64)
+}
+
+// PartitionInfo describes one partition of the output
+type PartitionInfo struct {
+	Key       string
+	Path      string
+	Resources int
+}
+
+// UnpartitionedName is the file name used for resources without a partition key
+const UnpartitionedName = "_unpartitioned"
+
+// PartitionWriter writes resources to one file per partition key in a
+// directory, e.g. out/PAT123.ndjson. Only the most recently used
+// MaxOpenFiles partitions keep their files open; the others are reopened for
+// appending when they receive their next resource.
+type PartitionWriter struct {
+	dir        string
+	opts       Options
+	maxOpen    int
+	partitions map[string]*partition
+	names      map[string]string // File name -> key, to keep names unique
+	open       *list.List        // Partitions with open files, most recently used first
+	closed     bool
+	incomplete bool
+}
+
+// partition is the writer of one partition and its place in the open list
+type partition struct {
+	key     string
+	path    string
+	writer  *Writer
+	element *list.Element // nil while the files are released
+}
+
+// NewPartitionWriter creates a writer partitioning output into dir
+func NewPartitionWriter(dir string, opts Options, partitionOpts PartitionOptions) (*PartitionWriter, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("partitioned output requires an output directory")
+	}
+	if opts.Format == FormatBulk {
+		return nil, fmt.Errorf("bulk output cannot be partitioned")
+	}
+	if opts.MaxResources > 0 {
+		return nil, fmt.Errorf("--max-resources cannot be combined with partitioned output")
+	}
+	if opts.Format.isBundle() {
+		if err := opts.Header.validate(opts.BundleType); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	maxOpen := partitionOpts.MaxOpenFiles
+	if maxOpen <= 0 {
+		maxOpen = 64
+	}
+	return &PartitionWriter{
+		dir:        dir,
+		opts:       opts,
+		maxOpen:    maxOpen,
+		partitions: make(map[string]*partition),
+		names:      make(map[string]string),
+		open:       list.New(),
+	}, nil
+}
+
+// Write adds a resource without a partition key
+func (p *PartitionWriter) Write(resource interface{}) error {
+	return p.WriteKey("", resource)
+}
+
+// WriteKey adds a resource to the partition for key
+func (p *PartitionWriter) WriteKey(key string, resource interface{}) error {
+	if p.closed {
+		return fmt.Errorf("writer is closed")
+	}
+
+	part, ok := p.partitions[key]
+	if !ok {
+		if err := p.makeRoom(); err != nil {
+			return err
+		}
+		path := filepath.Join(p.dir, p.fileName(key)+formatExt(p.opts))
+		opts := p.opts
+		if opts.BundleID != "" {
+			// Keys need not be valid ids, so each partition gets a UUID
+			opts.BundleID = uuid.NameBased(opts.BundleID + "/" + key)
+		}
+		writer, err := NewWriterWithOptions(path, opts)
+		if err != nil {
+			return err
+		}
+		part = &partition{key: key, path: path, writer: writer}
+		part.element = p.open.PushFront(part)
+		p.partitions[key] = part
+	} else if part.element == nil {
+		if err := p.makeRoom(); err != nil {
+			return err
+		}
+		if err := part.writer.reacquire(); err != nil {
+			return err
+		}
+		part.element = p.open.PushFront(part)
+	} else {
+		p.open.MoveToFront(part.element)
+	}
+
+	return part.writer.Write(resource)
+}
+
+// makeRoom releases the files of the least recently used partition if the
+// open file limit has been reached
+func (p *PartitionWriter) makeRoom() error {
+	if p.open.Len() < p.maxOpen {
+		return nil
+	}
+	oldest := p.open.Back()
+	part := oldest.Value.(*partition)
+	p.open.Remove(oldest)
+	part.element = nil
+	return part.writer.release()
+}
+
+// fileName returns a file name for key that is safe on any file system and
+// unique among the partitions
+func (p *PartitionWriter) fileName(key string) string {
+	name := key
+	if name == "" {
+		name = UnpartitionedName
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name
+	}
+
+	unique := name
+	for n := 2; ; n++ {
+		if _, taken := p.names[unique]; !taken {
+			break
+		}
+		unique = fmt.Sprintf("%s-%d", name, n)
+	}
+	p.names[unique] = key
+	return unique
+}
+
+// formatExt returns the file extension for the output format
+func formatExt(opts Options) string {
+	ext := ".json"
+	switch opts.Format {
+	case FormatNDJSON:
+		ext = ".ndjson"
+	case FormatXML, FormatXMLStream:
+		ext = ".xml"
+	}
+	if opts.Compression == CompressionGzip {
+		ext += ".gz"
+	}
+	return ext
+}
+
+// MarkIncomplete flags every partition as the result of an interrupted run
+func (p *PartitionWriter) MarkIncomplete() {
+	p.incomplete = true
+}
+
+// Close finalizes every partition file
+func (p *PartitionWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var firstErr error
+	for _, part := range p.partitions {
+		err := part.writer.reacquire()
+		if err == nil {
+			if p.incomplete {
+				part.writer.MarkIncomplete()
+			}
+			err = part.writer.Close()
+		} else {
+			part.writer.Abort()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to finalize partition %q: %w", part.key, err)
+		}
+	}
+	return firstErr
+}
+
+// Abort discards every partition file
+func (p *PartitionWriter) Abort() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var firstErr error
+	for _, part := range p.partitions {
+		if err := part.writer.Abort(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Partitions lists the partitions written, sorted by key
+func (p *PartitionWriter) Partitions() []PartitionInfo {
+	infos := make([]PartitionInfo, 0, len(p.partitions))
+	for _, part := range p.partitions {
+		infos = append(infos, PartitionInfo{Key: part.key, Path: part.path, Resources: part.writer.Count()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// release closes the output and spool files without finalizing them, so a
+// writer can be kept for later without holding file handles
+func (w *Writer) release() error {
+	if w.file == nil || w.released {
+		return nil
+	}
+	if w.spool != nil {
+		if err := w.spoolWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to flush bundle spool: %w", err)
+		}
+		if err := w.spool.Close(); err != nil {
+			return fmt.Errorf("failed to close bundle spool: %w", err)
+		}
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	w.released = true
+	return nil
+}
+
+// reacquire reopens the files closed by release for appending
+func (w *Writer) reacquire() error {
+	if !w.released {
+		return nil
+	}
+	file, err := os.OpenFile(PartialPath(w.outputPath), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("failed to reopen output file: %w", err)
+	}
+	if w.spool != nil {
+		spool, err := os.OpenFile(w.spool.Name(), os.O_RDWR|os.O_APPEND, 0)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to reopen bundle spool: %w", err)
+		}
+		w.spool = spool
+		w.spoolWriter = bufio.NewWriter(spool)
+	}
+	w.file = file
+	w.writer = file
+	w.released = false
+	return nil
+}
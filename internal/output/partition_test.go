@@ -0,0 +1,116 @@
+package output
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestPartitionWriter tests interleaved partitions with fewer open files than partitions
+func TestPartitionWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewPartitionWriter(dir, Options{Format: FormatBundle, BundleType: BundleTransaction}, PartitionOptions{MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	keys := []string{"PAT1", "PAT2", "Patient/PAT3", "PAT1", "", "PAT2", "PAT1"}
+	for i, key := range keys {
+		id := string(rune('A' + i))
+		if err := writer.WriteKey(key, &fhir.Observation{Id: &id}); err != nil {
+			t.Fatalf("WriteKey failed: %v", err)
+		}
+	}
+	if writer.open.Len() > 2 {
+		t.Errorf("Expected at most 2 open partitions, got %d", writer.open.Len())
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	want := map[string][]string{
+		"PAT1.json":           {"A", "D", "G"},
+		"PAT2.json":           {"B", "F"},
+		"Patient_PAT3.json":   {"C"},
+		"_unpartitioned.json": {"E"},
+	}
+	for name, ids := range want {
+		bundle := readBundle(t, filepath.Join(dir, name))
+		if len(bundle.Entry) != len(ids) {
+			t.Errorf("%s: expected %d entries, got %d", name, len(ids), len(bundle.Entry))
+			continue
+		}
+		for i, entry := range bundle.Entry {
+			var info resourceInfo
+			json.Unmarshal(entry.Resource, &info)
+			if info.Id != ids[i] {
+				t.Errorf("%s: entry %d is %s, want %s", name, i, info.Id, ids[i])
+			}
+		}
+	}
+
+	partitions := writer.Partitions()
+	if len(partitions) != 4 || partitions[0].Key != "" || partitions[1].Key != "PAT1" || partitions[1].Resources != 3 {
+		t.Errorf("Unexpected partitions: %+v", partitions)
+	}
+}
+
+// TestPartitionWriter_Gzip tests reopening compressed partitions
+func TestPartitionWriter_Gzip(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewPartitionWriter(dir, Options{Format: FormatNDJSON, Compression: CompressionGzip}, PartitionOptions{MaxOpenFiles: 1})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, key := range []string{"a", "b", "a", "b", "a"} {
+		if err := writer.WriteKey(key, &fhir.Patient{Id: &key}); err != nil {
+			t.Fatalf("WriteKey failed: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, "a.ndjson.gz"))
+	if err != nil {
+		t.Fatalf("Failed to open partition: %v", err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Partition is not gzip: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decompress partition: %v", err)
+	}
+	want := "{\"id\":\"a\",\"resourceType\":\"Patient\"}\n"
+	if string(data) != want+want+want {
+		t.Errorf("Unexpected partition content:\n%s", data)
+	}
+}
+
+// TestPartitionFileName tests that partition file names are safe and unique
+func TestPartitionFileName(t *testing.T) {
+	writer, err := NewPartitionWriter(t.TempDir(), Options{Format: FormatNDJSON}, PartitionOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	tests := []struct{ key, want string }{
+		{"PAT-1", "PAT-1"},
+		{"../etc", "_.._etc"},
+		{"a/b", "a_b"},
+		{"a_b", "a_b-2"},
+		{"", UnpartitionedName},
+	}
+	for _, tt := range tests {
+		if got := writer.fileName(tt.key); got != tt.want {
+			t.Errorf("fileName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerOptions configures a ServerWriter
+type ServerOptions struct {
+	URL          string        // Base URL of the FHIR server
+	BearerToken  string        // Sent as a bearer token when set
+	Username     string        // Basic auth user; basic auth is used when set
+	Password     string        // Basic auth password
+	ChunkSize    int           // Entries per request bundle (default 100)
+	Concurrency  int           // Requests in flight at once (default 4)
+	MaxRetries   int           // Retries of 429 and 5xx responses and network errors
+	RetryBackoff time.Duration // Delay before the first retry, doubled for each further retry (default 1s)
+	Client       *http.Client  // Default: a client with a 5 minute timeout
+}
+
+// maxRetryDelay caps the backoff between retries
+const maxRetryDelay = time.Minute
+
+// EntryFailure is a resource the server did not accept
+type EntryFailure struct {
+	RowNumber int    // CSV row the resource was converted from; 0 for generated resources
+	Status    string // HTTP status of the entry, or of the whole request
+	Message   string // Issues of the returned OperationOutcome, or the request error
+}
+
+// Error describes the failure
+func (f EntryFailure) Error() string {
+	source := fmt.Sprintf("row %d", f.RowNumber)
+	if f.RowNumber == 0 {
+		source = "generated resource"
+	}
+	if f.Status == "" {
+		return fmt.Sprintf("%s: %s", source, f.Message)
+	}
+	if f.Message == "" {
+		return fmt.Sprintf("%s: server responded %s", source, f.Status)
+	}
+	return fmt.Sprintf("%s: server responded %s: %s", source, f.Status, f.Message)
+}
+
+// ServerWriter posts resources to a FHIR server as transaction or batch
+// bundles of ServerOptions.ChunkSize entries. Bundles are sent by a pool of
+// ServerOptions.Concurrency senders while the next one is being filled.
+type ServerWriter struct {
+	opts    Options
+	server  ServerOptions
+	current *Writer
+	buf     *bytes.Buffer
+	rows    []int // Row numbers of the entries of the current bundle
+	bundles int   // Bundles started, numbering their ids
+
+	requests chan serverRequest
+	aborted  chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	failures []EntryFailure
+	accepted int
+	closed   bool
+}
+
+// serverRequest is one bundle to send and the rows its entries came from
+type serverRequest struct {
+	body []byte
+	rows []int
+}
+
+// NewServerWriter creates a writer sending resources to a FHIR server. The
+// bundle type of opts must be transaction or batch.
+func NewServerWriter(opts Options, server ServerOptions) (*ServerWriter, error) {
+	target, err := url.Parse(server.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid FHIR server URL: %s", server.URL)
+	}
+	if !opts.BundleType.HasRequests() {
+		return nil, fmt.Errorf("sending to a FHIR server requires a transaction or batch bundle type")
+	}
+	server.URL = strings.TrimSuffix(server.URL, "/")
+	if server.ChunkSize <= 0 {
+		server.ChunkSize = 100
+	}
+	if server.Concurrency <= 0 {
+		server.Concurrency = 4
+	}
+	if server.RetryBackoff <= 0 {
+		server.RetryBackoff = time.Second
+	}
+	if server.Client == nil {
+		server.Client = &http.Client{Timeout: 5 * time.Minute}
+	}
+
+	// Each request is a complete compact bundle
+	opts.Format = FormatBundle
+	opts.Layout = LayoutCompact
+	opts.Compression = CompressionNone
+	opts.MaxResources = 0
+
+	s := &ServerWriter{
+		opts:     opts,
+		server:   server,
+		requests: make(chan serverRequest),
+		aborted:  make(chan struct{}),
+	}
+	for i := 0; i < server.Concurrency; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for req := range s.requests {
+				s.send(req)
+			}
+		}()
+	}
+	return s, nil
+}
+
+// Write adds a resource without a known source row
+func (s *ServerWriter) Write(resource interface{}) error {
+	return s.WriteRow(resource, 0)
+}
+
+// WriteRow adds a resource converted from the given CSV row, sending the
+// current bundle once it is full
+func (s *ServerWriter) WriteRow(resource interface{}, rowNumber int) error {
+	if s.closed {
+		return fmt.Errorf("writer is closed")
+	}
+	if s.current == nil {
+		s.buf = &bytes.Buffer{}
+		s.bundles++
+		opts := s.opts
+		if opts.BundleID != "" {
+			opts.BundleID = fmt.Sprintf("%s-%04d", opts.BundleID, s.bundles)
+		}
+		current, err := newWriter(s.buf, nil, "", opts)
+		if err != nil {
+			return err
+		}
+		s.current = current
+	}
+
+	if err := s.current.Write(resource); err != nil {
+		return err
+	}
+	s.rows = append(s.rows, rowNumber)
+	if len(s.rows) >= s.server.ChunkSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush finishes the current bundle and queues it for sending, waiting for a
+// free sender
+func (s *ServerWriter) flush() error {
+	if s.current == nil {
+		return nil
+	}
+	writer, rows := s.current, s.rows
+	s.current, s.rows = nil, nil
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	select {
+	case s.requests <- serverRequest{body: s.buf.Bytes(), rows: rows}:
+	case <-s.aborted:
+	}
+	return nil
+}
+
+// MarkIncomplete is a no-op: every bundle sent is complete on its own
+func (s *ServerWriter) MarkIncomplete() {}
+
+// Close sends the last bundle and waits for all requests to finish.
+// Rejected entries are reported by Failures, not as an error.
+func (s *ServerWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	err := s.flush()
+	s.closed = true
+	close(s.requests)
+	s.wg.Wait()
+	return err
+}
+
+// Abort stops sending. Bundles already accepted by the server stay there.
+func (s *ServerWriter) Abort() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.aborted)
+	if s.current != nil {
+		s.current.Abort()
+		s.current = nil
+	}
+	close(s.requests)
+	s.wg.Wait()
+	return nil
+}
+
+// Failures returns the entries the server rejected, by row number
+func (s *ServerWriter) Failures() []EntryFailure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures := append([]EntryFailure(nil), s.failures...)
+	sort.SliceStable(failures, func(i, j int) bool { return failures[i].RowNumber < failures[j].RowNumber })
+	return failures
+}
+
+// Accepted returns the number of entries the server accepted
+func (s *ServerWriter) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// send posts a bundle, retrying rate limited and failed requests, and records
+// the outcome of each entry
+func (s *ServerWriter) send(req serverRequest) {
+	var status int
+	var body []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		status, body, retryAfter, err = s.post(req.body)
+		if err == nil && status != http.StatusTooManyRequests && status < 500 {
+			break
+		}
+		if attempt >= s.server.MaxRetries {
+			break
+		}
+
+		delay := retryAfter
+		if delay == 0 {
+			delay = backoff(s.server.RetryBackoff, attempt)
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.aborted:
+			return
+		}
+	}
+
+	switch {
+	case err != nil:
+		s.fail(req.rows, "", fmt.Sprintf("failed to send bundle: %v", err))
+	case status < 200 || status > 299:
+		// The whole bundle was rejected; for a transaction nothing was stored
+		s.fail(req.rows, fmt.Sprintf("%d %s", status, http.StatusText(status)), outcomeMessage(body))
+	default:
+		s.recordResponse(req.rows, body)
+	}
+}
+
+// post sends one bundle, returning the response status and body and the
+// delay asked for by a Retry-After header
+func (s *ServerWriter) post(bundle []byte) (int, []byte, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, s.server.URL, bytes.NewReader(bundle))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	req.Header.Set("Accept", "application/fhir+json")
+	if s.server.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.server.BearerToken)
+	} else if s.server.Username != "" {
+		req.SetBasicAuth(s.server.Username, s.server.Password)
+	}
+
+	resp, err := s.server.Client.Do(req)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return resp.StatusCode, body, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), nil
+}
+
+// backoff returns the delay before a retry: the first delay doubled for each
+// earlier retry, up to maxRetryDelay
+func backoff(first time.Duration, attempt int) time.Duration {
+	delay := first
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// parseRetryAfter returns the delay a Retry-After header asks for, given in
+// seconds or as an HTTP date, or 0 if there is none
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		if seconds > int(maxRetryDelay/time.Second) {
+			return maxRetryDelay
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// responseBundle holds the parts of a transaction or batch response needed
+// to account for each entry
+type responseBundle struct {
+	ResourceType string `json:"resourceType"`
+	Entry        []struct {
+		Response *struct {
+			Status  string          `json:"status"`
+			Outcome json.RawMessage `json:"outcome"`
+		} `json:"response"`
+	} `json:"entry"`
+}
+
+// recordResponse matches the entries of a response bundle to the rows of the
+// request, which are in the same order
+func (s *ServerWriter) recordResponse(rows []int, body []byte) {
+	var bundle responseBundle
+	if err := json.Unmarshal(body, &bundle); err != nil || bundle.ResourceType != "Bundle" || len(bundle.Entry) != len(rows) {
+		if s.opts.BundleType == BundleTransaction {
+			// A successful transaction stored every entry
+			s.accept(len(rows))
+			return
+		}
+		s.fail(rows, "", "server returned an unreadable batch response")
+		return
+	}
+
+	accepted := 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, entry := range bundle.Entry {
+		status := ""
+		var outcome json.RawMessage
+		if entry.Response != nil {
+			status, outcome = entry.Response.Status, entry.Response.Outcome
+		}
+		if strings.HasPrefix(status, "2") {
+			accepted++
+			continue
+		}
+		s.failures = append(s.failures, EntryFailure{
+			RowNumber: rows[i],
+			Status:    status,
+			Message:   outcomeMessage(outcome),
+		})
+	}
+	s.accepted += accepted
+}
+
+// accept counts accepted entries
+func (s *ServerWriter) accept(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accepted += n
+}
+
+// fail records the same failure for every row of a bundle
+func (s *ServerWriter) fail(rows []int, status, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range rows {
+		s.failures = append(s.failures, EntryFailure{RowNumber: row, Status: status, Message: message})
+	}
+}
+
+// outcomeInfo holds the parts of an OperationOutcome needed to describe it
+type outcomeInfo struct {
+	ResourceType string `json:"resourceType"`
+	Issue        []struct {
+		Severity    string `json:"severity"`
+		Code        string `json:"code"`
+		Diagnostics string `json:"diagnostics"`
+		Details     *struct {
+			Text string `json:"text"`
+		} `json:"details"`
+	} `json:"issue"`
+}
+
+// outcomeMessage summarizes the error and fatal issues of an
+// OperationOutcome, or returns "" if data is not one
+func outcomeMessage(data []byte) string {
+	var outcome outcomeInfo
+	if len(data) == 0 || json.Unmarshal(data, &outcome) != nil || outcome.ResourceType != "OperationOutcome" {
+		return ""
+	}
+
+	var messages []string
+	for _, issue := range outcome.Issue {
+		if issue.Severity != "error" && issue.Severity != "fatal" {
+			continue
+		}
+		text := issue.Diagnostics
+		if text == "" && issue.Details != nil {
+			text = issue.Details.Text
+		}
+		messages = append(messages, strings.TrimSpace(issue.Code+": "+text))
+	}
+	return strings.Join(messages, "; ")
+}
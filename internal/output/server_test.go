@@ -0,0 +1,226 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// stubServer answers transaction and batch bundles. reject returns the
+// entry status and outcome for a resource id, or "" to accept it.
+type stubServer struct {
+	mu       sync.Mutex
+	bundles  []fhir.Bundle
+	auth     []string
+	failures int // Requests to answer with 503 before accepting
+	reject   func(id string) (string, string)
+}
+
+func (s *stubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = append(s.auth, r.Header.Get("Authorization"))
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var bundle fhir.Bundle
+	if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.bundles = append(s.bundles, bundle)
+
+	var entries []string
+	for _, entry := range bundle.Entry {
+		var info resourceInfo
+		json.Unmarshal(entry.Resource, &info)
+		status, outcome := "201 Created", ""
+		if s.reject != nil {
+			if rejected, message := s.reject(info.Id); rejected != "" {
+				status = rejected
+				outcome = fmt.Sprintf(`,"outcome":{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"invalid","diagnostics":%q}]}`, message)
+			}
+		}
+		entries = append(entries, fmt.Sprintf(`{"response":{"status":%q%s}}`, status, outcome))
+	}
+	w.Header().Set("Content-Type", "application/fhir+json")
+	fmt.Fprintf(w, `{"resourceType":"Bundle","type":"batch-response","entry":[%s]}`, strings.Join(entries, ","))
+}
+
+// writeRows sends one patient per row, numbering rows from 2
+func writeRows(t *testing.T, writer *ServerWriter, ids ...string) {
+	t.Helper()
+	for i, id := range ids {
+		id := id
+		if err := writer.WriteRow(&fhir.Patient{Id: &id}, i+2); err != nil {
+			t.Fatalf("WriteRow failed: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+// TestServerWriter_Batch tests chunking, auth and per-entry failures
+func TestServerWriter_Batch(t *testing.T) {
+	stub := &stubServer{reject: func(id string) (string, string) {
+		if id == "P3" {
+			return "422 Unprocessable Entity", "Patient.birthDate: invalid date"
+		}
+		return "", ""
+	}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	writer, err := NewServerWriter(Options{BundleType: BundleBatch, BundleID: "run-1", Timestamp: "2024-06-01T02:00:00Z"}, ServerOptions{
+		URL:         server.URL + "/fhir/",
+		BearerToken: "secret",
+		ChunkSize:   2,
+		Concurrency: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWriter failed: %v", err)
+	}
+	writeRows(t, writer, "P1", "P2", "P3", "P4", "P5")
+
+	if len(stub.bundles) != 3 {
+		t.Fatalf("Expected 3 bundles of at most 2 entries, got %d", len(stub.bundles))
+	}
+	if stub.bundles[0].Type != fhir.BundleTypeBatch || len(stub.bundles[2].Entry) != 1 {
+		t.Errorf("Unexpected bundles: %+v", stub.bundles)
+	}
+	// Concurrency 1 sends the bundles in order
+	for i, bundle := range stub.bundles {
+		if want := fmt.Sprintf("run-1-%04d", i+1); bundle.Id == nil || *bundle.Id != want {
+			t.Errorf("Expected bundle id %s, got %v", want, bundle.Id)
+		}
+		if bundle.Timestamp == nil || *bundle.Timestamp != "2024-06-01T02:00:00Z" {
+			t.Errorf("Expected the run start as timestamp, got %v", bundle.Timestamp)
+		}
+	}
+	if stub.auth[0] != "Bearer secret" {
+		t.Errorf("Expected bearer token, got %q", stub.auth[0])
+	}
+
+	failures := writer.Failures()
+	if len(failures) != 1 || failures[0].RowNumber != 4 || failures[0].Status != "422 Unprocessable Entity" {
+		t.Fatalf("Expected row 4 to fail with 422, got %+v", failures)
+	}
+	if !strings.Contains(failures[0].Error(), "invalid: Patient.birthDate: invalid date") {
+		t.Errorf("Expected OperationOutcome diagnostics in %q", failures[0].Error())
+	}
+	if writer.Accepted() != 4 {
+		t.Errorf("Expected 4 accepted entries, got %d", writer.Accepted())
+	}
+}
+
+// TestServerWriter_Retry tests retrying unavailable servers with basic auth
+func TestServerWriter_Retry(t *testing.T) {
+	stub := &stubServer{failures: 2}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	writer, err := NewServerWriter(Options{BundleType: BundleTransaction}, ServerOptions{
+		URL:          server.URL,
+		Username:     "user",
+		Password:     "pass",
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWriter failed: %v", err)
+	}
+	writeRows(t, writer, "P1", "P2")
+
+	if len(stub.auth) != 3 || !strings.HasPrefix(stub.auth[2], "Basic ") {
+		t.Errorf("Expected 3 attempts with basic auth, got %v", stub.auth)
+	}
+	if len(writer.Failures()) != 0 || writer.Accepted() != 2 {
+		t.Errorf("Expected all entries accepted, got %+v", writer.Failures())
+	}
+}
+
+// TestServerWriter_RejectedTransaction tests that a rejected transaction fails every row
+func TestServerWriter_RejectedTransaction(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"processing","diagnostics":"Duplicate identifier"}]}`)
+	}))
+	defer server.Close()
+
+	writer, err := NewServerWriter(Options{BundleType: BundleTransaction}, ServerOptions{URL: server.URL, MaxRetries: 3})
+	if err != nil {
+		t.Fatalf("NewServerWriter failed: %v", err)
+	}
+	writeRows(t, writer, "P1", "P2")
+
+	failures := writer.Failures()
+	if len(failures) != 2 || failures[0].RowNumber != 2 || failures[1].RowNumber != 3 {
+		t.Fatalf("Expected rows 2 and 3 to fail, got %+v", failures)
+	}
+	if failures[0].Status != "400 Bad Request" || failures[0].Message != "processing: Duplicate identifier" {
+		t.Errorf("Unexpected failure %+v", failures[0])
+	}
+}
+
+// TestNewServerWriter_Invalid tests option validation
+func TestNewServerWriter_Invalid(t *testing.T) {
+	if _, err := NewServerWriter(Options{BundleType: BundleBatch}, ServerOptions{URL: "ftp://example.org"}); err == nil {
+		t.Error("Expected error for non-HTTP URL")
+	}
+	if _, err := NewServerWriter(Options{BundleType: BundleCollection}, ServerOptions{URL: "http://example.org"}); err == nil {
+		t.Error("Expected error for collection bundles")
+	}
+}
+
+// TestBackoff tests that retry delays double up to the cap without overflowing
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{3, 8 * time.Second},
+		{6, maxRetryDelay},
+		{40, maxRetryDelay},
+		{1000, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := backoff(time.Second, tt.attempt); got != tt.want {
+			t.Errorf("backoff(1s, %d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// TestParseRetryAfter tests both forms of Retry-After
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"99999999999", maxRetryDelay},
+		{"9223372037", maxRetryDelay},
+		{"Mon, 15 Jan 2024 10:30:20 GMT", 20 * time.Second},
+		{"Mon, 15 Jan 2024 10:29:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
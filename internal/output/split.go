@@ -0,0 +1,355 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"csv2fhir/internal/fhirjson"
+)
+
+// SplitOptions controls when a SplitWriter rolls over to a new file
+type SplitOptions struct {
+	MaxEntries int   // Resources per file (0 means no limit)
+	MaxBytes   int64 // Bytes per file before compression (0 means no limit)
+}
+
+// Enabled reports whether any split limit is set
+func (s SplitOptions) Enabled() bool {
+	return s.MaxEntries > 0 || s.MaxBytes > 0
+}
+
+// Manifest describes the files written by a SplitWriter
+type Manifest struct {
+	TransactionTime string         `json:"transactionTime"`
+	Format          Format         `json:"format"`
+	Complete        bool           `json:"complete"`
+	TotalEntries    int            `json:"totalEntries"`
+	Files           []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes one output file
+type ManifestFile struct {
+	Path    string `json:"path"` // Relative to the manifest
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// SplitWriter writes resources to a numbered series of files
+// (output-0001.json, output-0002.json, ...) and a manifest listing them
+type SplitWriter struct {
+	basePath   string
+	opts       Options
+	split      SplitOptions
+	current    *Writer
+	currentNum int
+	size       int64 // Upper bound of the bytes in the current file
+	done       []ManifestFile
+	total      int
+	closed     bool
+	incomplete bool
+	started    time.Time
+}
+
+// NewSplitWriter creates a writer that rolls over to a new file whenever the
+// current one would exceed the split limits
+func NewSplitWriter(outputPath string, opts Options, split SplitOptions) (*SplitWriter, error) {
+	if outputPath == "" || outputPath == "-" {
+		return nil, fmt.Errorf("splitting output requires an output file")
+	}
+	if !split.Enabled() {
+		return nil, fmt.Errorf("no split limit given")
+	}
+	if opts.MaxResources > 0 {
+		return nil, fmt.Errorf("--max-resources cannot be combined with split output")
+	}
+	if opts.Format.isBundle() {
+		if err := opts.Header.validate(opts.BundleType); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SplitWriter{
+		basePath: outputPath,
+		opts:     opts,
+		split:    split,
+		started:  time.Now().UTC(),
+	}, nil
+}
+
+// SplitPath returns the path of the numbered file n for an output path,
+// e.g. output.json -> output-0001.json, output.ndjson.gz -> output-0001.ndjson.gz
+func SplitPath(outputPath string, n int) string {
+	stem, ext := splitExt(outputPath)
+	return fmt.Sprintf("%s-%04d%s", stem, n, ext)
+}
+
+// ManifestPath returns the path of the manifest for an output path,
+// e.g. output.json -> output-manifest.json
+func ManifestPath(outputPath string) string {
+	stem, _ := splitExt(outputPath)
+	return stem + "-manifest.json"
+}
+
+// Write writes a resource, first rolling over if it would not fit
+func (s *SplitWriter) Write(resource interface{}) error {
+	if s.closed {
+		return fmt.Errorf("writer is closed")
+	}
+
+	var size int64
+	if s.split.MaxBytes > 0 {
+		var err error
+		size, err = s.estimateSize(resource)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.current != nil && s.full(size) {
+		if err := s.finishCurrent(); err != nil {
+			return err
+		}
+	}
+	if s.current == nil {
+		if err := s.startNext(); err != nil {
+			return err
+		}
+		if s.split.MaxBytes > 0 && size+s.overhead() > s.split.MaxBytes {
+			return fmt.Errorf("resource of about %d bytes does not fit in --max-file-bytes %d", size, s.split.MaxBytes)
+		}
+	}
+
+	if err := s.current.Write(resource); err != nil {
+		return err
+	}
+	s.size += size
+	s.total++
+	return nil
+}
+
+// bundleOverhead is reserved for the bundle header and trailer
+const bundleOverhead = 256
+
+// headerReferenceSize is reserved per entry of document and message bundles
+// for its fullUrl and the header entry's reference to it
+const headerReferenceSize = 192
+
+// full reports whether the current file cannot take another resource of size bytes
+func (s *SplitWriter) full(size int64) bool {
+	if s.split.MaxEntries > 0 && s.current.Count() >= s.split.MaxEntries {
+		return true
+	}
+	if s.split.MaxBytes > 0 && s.size+size+s.overhead() > s.split.MaxBytes {
+		return true
+	}
+	return false
+}
+
+// overhead returns the bytes reserved in each file for the bundle header and trailer
+func (s *SplitWriter) overhead() int64 {
+	if !s.opts.Format.isBundle() {
+		return 0
+	}
+	overhead := int64(bundleOverhead)
+	if s.opts.BundleType.hasHeader() {
+		overhead += s.opts.Header.size()
+	}
+	if s.opts.BundleID != "" {
+		// id, identifier and timestamp
+		overhead += 192 + int64(len(s.opts.BundleID))
+	}
+	return overhead
+}
+
+// estimateSize returns an upper bound of the bytes a resource adds to a file
+func (s *SplitWriter) estimateSize(resource interface{}) (int64, error) {
+	if deletion, ok := resource.(Deletion); ok {
+		// The entry holds only the request
+		return 128 + int64(len(deletion.ResourceType)+len(deletion.ID)), nil
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	if s.opts.Canonical {
+		// Normalized numbers can be longer than the marshaled ones
+		if data, err = fhirjson.Canonical(data); err != nil {
+			return 0, err
+		}
+	}
+	switch s.opts.Format {
+	case FormatNDJSON:
+		if s.opts.pretty() {
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, data, "", "  "); err != nil {
+				return 0, fmt.Errorf("failed to format resource: %w", err)
+			}
+			return int64(indented.Len()) + 1, nil
+		}
+		return int64(len(data)) + 1, nil
+	case FormatXMLStream, FormatXML:
+		xmlData, err := resourceToXML(data)
+		if err != nil {
+			return 0, err
+		}
+		// An XML bundle entry adds the entry and resource wrappers, fullUrl
+		// and request
+		size := int64(len(xmlData)) + 1
+		if s.opts.Format == FormatXML {
+			size += 512 + int64(len(s.opts.BaseURL)) + 2*int64(len(s.opts.IfNoneExistSystem))
+			size += int64(bytes.Count(data, referencePrefix)) * 48
+			if s.opts.BundleType.hasHeader() {
+				size += headerReferenceSize + 2*int64(len(s.opts.BaseURL))
+			}
+		}
+		return size, nil
+	}
+
+	// Bundle entries are indented inside the entry array, with room for the
+	// entry wrapper, fullUrl and request, and for references rewritten to
+	// urn:uuids
+	size := int64(len(data)) + 32
+	if s.opts.pretty() {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "      ", "  "); err != nil {
+			return 0, fmt.Errorf("failed to format resource: %w", err)
+		}
+		size = int64(indented.Len()) + 32
+	}
+	if s.opts.BundleType.HasRequests() {
+		size += 256 + int64(len(s.opts.BaseURL))
+		if s.opts.IfNoneExistSystem != "" {
+			size += 2*int64(len(s.opts.IfNoneExistSystem)) + 128
+		}
+	}
+	if s.opts.BundleType == BundleTransaction || s.opts.BundleType.hasHeader() {
+		size += int64(bytes.Count(data, referencePrefix)) * 48
+	}
+	if s.opts.BundleType.hasHeader() {
+		size += headerReferenceSize + 2*int64(len(s.opts.BaseURL))
+	}
+	return size, nil
+}
+
+// startNext opens the next numbered file
+func (s *SplitWriter) startNext() error {
+	s.currentNum++
+	opts := s.opts
+	if opts.BundleID != "" {
+		opts.BundleID = fmt.Sprintf("%s-%04d", opts.BundleID, s.currentNum)
+	}
+	writer, err := NewWriterWithOptions(SplitPath(s.basePath, s.currentNum), opts)
+	if err != nil {
+		return err
+	}
+	s.current = writer
+	s.size = 0
+	return nil
+}
+
+// finishCurrent closes the current file and records it in the manifest
+func (s *SplitWriter) finishCurrent() error {
+	writer := s.current
+	s.current = nil
+	if s.incomplete {
+		writer.MarkIncomplete()
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	s.done = append(s.done, ManifestFile{
+		Path:    filepath.Base(SplitPath(s.basePath, s.currentNum)),
+		Entries: writer.Count(),
+		Bytes:   writer.Offset(),
+		SHA256:  writer.Checksum(),
+	})
+	return nil
+}
+
+// MarkIncomplete flags the output as the result of an interrupted run
+func (s *SplitWriter) MarkIncomplete() {
+	s.incomplete = true
+}
+
+// Close finishes the last file and writes the manifest
+func (s *SplitWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+
+	// Always produce at least one file, even without resources
+	if s.current == nil && len(s.done) == 0 {
+		if err := s.startNext(); err != nil {
+			s.closed = true
+			return err
+		}
+	}
+	if s.current != nil {
+		if err := s.finishCurrent(); err != nil {
+			s.closed = true
+			s.removeDone()
+			return err
+		}
+	}
+	s.closed = true
+
+	manifest := Manifest{
+		TransactionTime: s.started.Format(time.RFC3339),
+		Format:          s.opts.Format,
+		Complete:        !s.incomplete,
+		TotalEntries:    s.total,
+		Files:           s.done,
+	}
+	if err := writeJSONFile(ManifestPath(s.basePath), manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the current file and every file already finished
+func (s *SplitWriter) Abort() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.current != nil {
+		err = s.current.Abort()
+		s.current = nil
+	}
+	s.removeDone()
+	return err
+}
+
+// removeDone deletes the files already finished by this writer
+func (s *SplitWriter) removeDone() {
+	dir := filepath.Dir(s.basePath)
+	for _, file := range s.done {
+		os.Remove(filepath.Join(dir, file.Path))
+	}
+	s.done = nil
+}
+
+// writeJSONFile writes v as indented JSON, atomically replacing path
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := PartialPath(path)
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
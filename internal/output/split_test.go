@@ -0,0 +1,201 @@
+package output
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestSplitPath tests numbered file and manifest names
+func TestSplitPath(t *testing.T) {
+	if got := SplitPath("out/output.json", 1); got != "out/output-0001.json" {
+		t.Errorf("Unexpected split path %s", got)
+	}
+	if got := SplitPath("data.ndjson", 12); got != "data-0012.ndjson" {
+		t.Errorf("Unexpected split path %s", got)
+	}
+	if got := ManifestPath("out/output.json"); got != "out/output-manifest.json" {
+		t.Errorf("Unexpected manifest path %s", got)
+	}
+	if got := SplitPath("data.ndjson.gz", 3); got != "data-0003.ndjson.gz" {
+		t.Errorf("Unexpected split path %s", got)
+	}
+	if got := ManifestPath("data.ndjson.gz"); got != "data-manifest.json" {
+		t.Errorf("Unexpected manifest path %s", got)
+	}
+}
+
+// TestSplitWriter_Entries tests rolling over by entry count
+func TestSplitWriter_Entries(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "output.json")
+
+	writer, err := NewSplitWriter(outputPath, Options{Format: FormatBundle}, SplitOptions{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("Failed to create split writer: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := writer.Write(&fhir.Observation{Id: strPtr("OBS")}); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	manifest := readManifest(t, ManifestPath(outputPath))
+	if manifest.TotalEntries != 5 || !manifest.Complete {
+		t.Errorf("Unexpected manifest: %+v", manifest)
+	}
+	wantEntries := []int{2, 2, 1}
+	if len(manifest.Files) != len(wantEntries) {
+		t.Fatalf("Expected %d files, got %d", len(wantEntries), len(manifest.Files))
+	}
+	for i, file := range manifest.Files {
+		path := filepath.Join(dir, file.Path)
+		bundle := readBundle(t, path)
+		if len(bundle.Entry) != wantEntries[i] || file.Entries != wantEntries[i] {
+			t.Errorf("File %s: expected %d entries, got %d (manifest %d)", file.Path, wantEntries[i], len(bundle.Entry), file.Entries)
+		}
+
+		data, _ := os.ReadFile(path)
+		sum := sha256.Sum256(data)
+		if file.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("File %s: manifest checksum does not match content", file.Path)
+		}
+		if file.Bytes != int64(len(data)) {
+			t.Errorf("File %s: expected %d bytes in manifest, got %d", file.Path, len(data), file.Bytes)
+		}
+	}
+}
+
+// TestSplitWriter_BundleID tests that numbered files get numbered, identified bundles
+func TestSplitWriter_BundleID(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "output.json")
+	writer, err := NewSplitWriter(outputPath, Options{Format: FormatBundle, BundleID: "run-1", Timestamp: "2024-06-01T02:00:00Z", Canonical: true}, SplitOptions{MaxEntries: 1})
+	if err != nil {
+		t.Fatalf("Failed to create split writer: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := writer.Write(&fhir.Observation{Id: strPtr("OBS")}); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	identifiers := map[string]bool{}
+	for n, want := range []string{"run-1-0001", "run-1-0002"} {
+		bundle := readBundle(t, SplitPath(outputPath, n+1))
+		if bundle.Id == nil || *bundle.Id != want {
+			t.Errorf("Expected bundle id %s, got %v", want, bundle.Id)
+		}
+		if bundle.Identifier == nil || bundle.Identifier.Value == nil || bundle.Timestamp == nil {
+			t.Fatalf("Expected identifier and timestamp on bundle %d", n+1)
+		}
+		if *bundle.Timestamp != "2024-06-01T02:00:00Z" {
+			t.Errorf("Expected the given timestamp, got %s", *bundle.Timestamp)
+		}
+		identifiers[*bundle.Identifier.Value] = true
+	}
+	if len(identifiers) != 2 {
+		t.Error("Expected a distinct identifier per bundle")
+	}
+}
+
+// TestSplitWriter_Bytes tests rolling over by file size
+func TestSplitWriter_Bytes(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "output.ndjson")
+
+	const maxBytes = 200
+	writer, err := NewSplitWriter(outputPath, Options{Format: FormatNDJSON}, SplitOptions{MaxBytes: maxBytes})
+	if err != nil {
+		t.Fatalf("Failed to create split writer: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := writer.Write(&fhir.Observation{Id: strPtr("OBS-0123456789")}); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	manifest := readManifest(t, ManifestPath(outputPath))
+	if len(manifest.Files) < 2 {
+		t.Fatalf("Expected output to be split, got %d files", len(manifest.Files))
+	}
+	lines := 0
+	for _, file := range manifest.Files {
+		if file.Bytes > maxBytes {
+			t.Errorf("File %s has %d bytes, over the %d limit", file.Path, file.Bytes, maxBytes)
+		}
+		f, err := os.Open(filepath.Join(dir, file.Path))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Path, err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines++
+		}
+		f.Close()
+	}
+	if lines != 10 {
+		t.Errorf("Expected 10 resources across files, got %d", lines)
+	}
+}
+
+// TestSplitWriter_TooLarge tests a resource that can never fit
+func TestSplitWriter_TooLarge(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "output.ndjson")
+	writer, err := NewSplitWriter(outputPath, Options{Format: FormatNDJSON}, SplitOptions{MaxBytes: 10})
+	if err != nil {
+		t.Fatalf("Failed to create split writer: %v", err)
+	}
+	defer writer.Abort()
+
+	if err := writer.Write(&fhir.Observation{Id: strPtr("OBS1")}); err == nil {
+		t.Error("Expected error for a resource larger than --max-file-bytes")
+	}
+}
+
+// TestSplitWriter_Abort tests that aborting removes every file
+func TestSplitWriter_Abort(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewSplitWriter(filepath.Join(dir, "output.ndjson"), Options{Format: FormatNDJSON}, SplitOptions{MaxEntries: 1})
+	if err != nil {
+		t.Fatalf("Failed to create split writer: %v", err)
+	}
+	writer.Write(&fhir.Observation{Id: strPtr("OBS1")})
+	writer.Write(&fhir.Observation{Id: strPtr("OBS2")})
+	if err := writer.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Expected no files after Abort, found %d", len(entries))
+	}
+}
+
+// readManifest reads and parses a manifest file
+func readManifest(t *testing.T, path string) Manifest {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	return manifest
+}
@@ -0,0 +1,318 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"csv2fhir/internal/uuid"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// BundleType selects the kind of Bundle written for FormatBundle
+type BundleType string
+
+const (
+	BundleCollection  BundleType = "collection"
+	BundleTransaction BundleType = "transaction"
+	BundleBatch       BundleType = "batch"
+	BundleDocument    BundleType = "document" // Composition first, built from the mapping's bundle header
+	BundleMessage     BundleType = "message"  // MessageHeader first, built from the mapping's bundle header
+)
+
+// ParseBundleType parses a bundle type string into a BundleType
+func ParseBundleType(s string) (BundleType, error) {
+	switch s {
+	case "collection", "":
+		return BundleCollection, nil
+	case "transaction":
+		return BundleTransaction, nil
+	case "batch":
+		return BundleBatch, nil
+	case "document":
+		return BundleDocument, nil
+	case "message":
+		return BundleMessage, nil
+	default:
+		return "", fmt.Errorf("unsupported bundle type: %s (supported: collection, transaction, batch, document, message)", s)
+	}
+}
+
+// fhirType returns the FHIR code for the bundle type
+func (b BundleType) fhirType() fhir.BundleType {
+	switch b {
+	case BundleTransaction:
+		return fhir.BundleTypeTransaction
+	case BundleBatch:
+		return fhir.BundleTypeBatch
+	case BundleDocument:
+		return fhir.BundleTypeDocument
+	case BundleMessage:
+		return fhir.BundleTypeMessage
+	default:
+		return fhir.BundleTypeCollection
+	}
+}
+
+// HasRequests reports whether entries of this bundle type carry a request
+func (b BundleType) HasRequests() bool {
+	return b == BundleTransaction || b == BundleBatch
+}
+
+// hasHeader reports whether bundles of this type open with a generated
+// Composition or MessageHeader entry
+func (b BundleType) hasHeader() bool {
+	return b == BundleDocument || b == BundleMessage
+}
+
+// resourceInfo holds the parts of a marshaled resource needed to build its
+// bundle entry
+type resourceInfo struct {
+	ResourceType string `json:"resourceType"`
+	Id           string `json:"id"`
+	Identifier   []struct {
+		System string `json:"system"`
+		Value  string `json:"value"`
+	} `json:"identifier"`
+}
+
+// identifierValue returns the value of the identifier with the given system
+func (r *resourceInfo) identifierValue(system string) (string, bool) {
+	for _, identifier := range r.Identifier {
+		if identifier.System == system && identifier.Value != "" {
+			return identifier.Value, true
+		}
+	}
+	return "", false
+}
+
+// Deletion is written as a DELETE entry of a transaction or batch bundle,
+// e.g. for a resource that disappeared from the input
+type Deletion struct {
+	ResourceType string
+	ID           string
+}
+
+// deleteEntry returns the bundle entry deleting a resource
+func deleteEntry(deletion Deletion) fhir.BundleEntry {
+	return fhir.BundleEntry{Request: &fhir.BundleEntryRequest{
+		Method: fhir.HTTPVerbDELETE,
+		Url:    deletion.ResourceType + "/" + deletion.ID,
+	}}
+}
+
+// buildRequestEntry fills in fullUrl and request for a transaction or batch
+// entry. Resources with an id are upserted with PUT; resources without one
+// are created with POST. When ifNoneExistSystem is set and the resource has
+// an identifier with that system, the resource is created conditionally.
+func (w *Writer) buildRequestEntry(entry *fhir.BundleEntry) error {
+	var info resourceInfo
+	if err := json.Unmarshal(entry.Resource, &info); err != nil {
+		return fmt.Errorf("failed to read resource type and id: %w", err)
+	}
+	if info.ResourceType == "" {
+		return fmt.Errorf("resource has no resourceType")
+	}
+
+	fullURL, err := w.entryFullURL(&info)
+	if err != nil {
+		return err
+	}
+	entry.FullUrl = &fullURL
+
+	request := &fhir.BundleEntryRequest{}
+	if value, ok := info.identifierValue(w.opts.IfNoneExistSystem); ok && w.opts.IfNoneExistSystem != "" {
+		// Escaped for the search syntax, then for the query string
+		ifNoneExist := "identifier=" + url.QueryEscape(escapeSearchValue(w.opts.IfNoneExistSystem)) +
+			"|" + url.QueryEscape(escapeSearchValue(value))
+		request.Method = fhir.HTTPVerbPOST
+		request.Url = info.ResourceType
+		request.IfNoneExist = &ifNoneExist
+	} else if info.Id != "" {
+		request.Method = fhir.HTTPVerbPUT
+		request.Url = info.ResourceType + "/" + info.Id
+	} else {
+		request.Method = fhir.HTTPVerbPOST
+		request.Url = info.ResourceType
+	}
+	entry.Request = request
+
+	return nil
+}
+
+// entryFullURL returns the fullUrl of a bundle entry: the server URL of the
+// resource when a base URL is set, otherwise a urn:uuid
+func (w *Writer) entryFullURL(info *resourceInfo) (string, error) {
+	switch {
+	case info.Id != "" && w.opts.BaseURL != "":
+		return strings.TrimSuffix(w.opts.BaseURL, "/") + "/" + info.ResourceType + "/" + info.Id, nil
+	case info.Id != "":
+		// Name-based UUIDs keep fullUrls stable across runs
+		fullURL := "urn:uuid:" + uuid.NameBased(info.ResourceType+"/"+info.Id)
+		if w.fullURLs != nil {
+			w.fullURLs[info.ResourceType+"/"+info.Id] = fullURL
+		}
+		return fullURL, nil
+	default:
+		id, err := uuid.New()
+		if err != nil {
+			return "", err
+		}
+		return "urn:uuid:" + id, nil
+	}
+}
+
+// escapeSearchValue escapes the characters that are special in FHIR search
+// parameter values
+func escapeSearchValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `|`, `\|`, `,`, `\,`, `$`, `\$`)
+	return replacer.Replace(value)
+}
+
+// spoolEntry stores a compact entry until the bundle is finished
+func (w *Writer) spoolEntry(entry fhir.BundleEntry) error {
+	if w.spool == nil {
+		spool, err := os.CreateTemp(w.spoolDir(), "csv2fhir-*.spool")
+		if err != nil {
+			return fmt.Errorf("failed to create bundle spool file: %w", err)
+		}
+		w.spool = spool
+		w.spoolWriter = bufio.NewWriter(spool)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle entry: %w", err)
+	}
+	if _, err := w.spoolWriter.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to spool bundle entry: %w", err)
+	}
+	return nil
+}
+
+// spoolDir returns the directory used for the spool file
+func (w *Writer) spoolDir() string {
+	if w.outputPath == "" {
+		return "" // System temp directory
+	}
+	return filepath.Dir(w.outputPath)
+}
+
+// writeSpooledEntries copies the header entry, if any, and the spooled
+// entries into the JSON bundle
+func (w *Writer) writeSpooledEntries() error {
+	return w.forEachBundleEntry(func(entry []byte, first bool) error {
+		formatted, err := w.formatJSON(entry, "    ")
+		if err != nil {
+			return fmt.Errorf("failed to format bundle entry: %w", err)
+		}
+		if err := w.write(append([]byte(w.entrySeparator(first)), formatted...)); err != nil {
+			return fmt.Errorf("failed to write bundle entry: %w", err)
+		}
+		return nil
+	})
+}
+
+// forEachBundleEntry calls fn with the header entry of document and message
+// bundles and then each spooled entry in order, with references to other
+// entries of the bundle pointed at their urn:uuid fullUrls
+func (w *Writer) forEachBundleEntry(fn func(entry []byte, first bool) error) error {
+	first := true
+	if w.opts.BundleType.hasHeader() {
+		entry, err := w.headerEntry()
+		if err != nil {
+			return err
+		}
+		if err := fn(entry, true); err != nil {
+			return err
+		}
+		first = false
+	}
+
+	if w.spool == nil {
+		return nil
+	}
+	if err := w.spoolWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush bundle spool: %w", err)
+	}
+	if _, err := w.spool.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to rewind bundle spool: %w", err)
+	}
+
+	scanner := bufio.NewScanner(w.spool)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if err := fn(rewriteReferences(scanner.Bytes(), w.fullURLs), first); err != nil {
+			return err
+		}
+		first = false
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read bundle spool: %w", err)
+	}
+	return nil
+}
+
+// removeSpool closes and deletes the spool file, if any
+func (w *Writer) removeSpool() {
+	if w.spool == nil {
+		return
+	}
+	w.spool.Close()
+	os.Remove(w.spool.Name())
+	w.spool = nil
+}
+
+// referencePrefix is how a Reference.reference value starts in compact JSON
+var referencePrefix = []byte(`"reference":"`)
+
+// rewriteReferences replaces "reference" values found in fullURLs. It works on
+// the compact JSON directly so the key order of the resource is preserved.
+func rewriteReferences(data []byte, fullURLs map[string]string) []byte {
+	if len(fullURLs) == 0 || !bytes.Contains(data, referencePrefix) {
+		return data
+	}
+
+	var out bytes.Buffer
+	for {
+		idx := bytes.Index(data, referencePrefix)
+		if idx < 0 {
+			out.Write(data)
+			return out.Bytes()
+		}
+
+		// Find the end of the JSON string value
+		valueStart := idx + len(referencePrefix) - 1
+		end := valueStart + 1
+		for end < len(data) && data[end] != '"' {
+			if data[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(data) {
+			out.Write(data)
+			return out.Bytes()
+		}
+
+		out.Write(data[:valueStart])
+		var ref string
+		if err := json.Unmarshal(data[valueStart:end+1], &ref); err == nil {
+			if fullURL, ok := fullURLs[ref]; ok {
+				quoted, _ := json.Marshal(fullURL)
+				out.Write(quoted)
+			} else {
+				out.Write(data[valueStart : end+1])
+			}
+		} else {
+			out.Write(data[valueStart : end+1])
+		}
+		data = data[end+1:]
+	}
+}
@@ -0,0 +1,215 @@
+package output
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"csv2fhir/internal/uuid"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestParseBundleType tests parsing of bundle type names
+func TestParseBundleType(t *testing.T) {
+	tests := []struct {
+		input string
+		want  BundleType
+	}{
+		{"", BundleCollection},
+		{"collection", BundleCollection},
+		{"transaction", BundleTransaction},
+		{"batch", BundleBatch},
+		{"document", BundleDocument},
+		{"message", BundleMessage},
+	}
+	for _, tt := range tests {
+		got, err := ParseBundleType(tt.input)
+		if err != nil {
+			t.Errorf("ParseBundleType(%q) failed: %v", tt.input, err)
+		}
+		if got != tt.want {
+			t.Errorf("ParseBundleType(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+
+	if _, err := ParseBundleType("searchset"); err == nil {
+		t.Error("Expected error for unsupported bundle type")
+	}
+}
+
+// TestTransactionBundle tests request entries and reference rewriting
+func TestTransactionBundle(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "tx.json")
+	writer, err := NewWriterWithOptions(outputPath, Options{
+		Format:            FormatBundle,
+		BundleType:        BundleTransaction,
+		IfNoneExistSystem: "http://hospital.org/mrn",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	system := "http://hospital.org/mrn"
+	mrn := "M|1 &#+"
+	resources := []interface{}{
+		// References a patient written later in the bundle
+		&fhir.Observation{Id: strPtr("OBS1"), Subject: &fhir.Reference{Reference: strPtr("Patient/PAT1")}},
+		&fhir.Patient{Id: strPtr("PAT1")},
+		&fhir.Patient{Id: strPtr("PAT2"), Identifier: []fhir.Identifier{{System: &system, Value: &mrn}}},
+		&fhir.Observation{Subject: &fhir.Reference{Reference: strPtr("Patient/OTHER")}},
+	}
+	for _, resource := range resources {
+		if err := writer.Write(resource); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	bundle := readBundle(t, outputPath)
+	if bundle.Type != fhir.BundleTypeTransaction {
+		t.Errorf("Expected transaction bundle, got %s", bundle.Type)
+	}
+	if bundle.Total != nil {
+		t.Error("Expected no total on a transaction bundle")
+	}
+	if len(bundle.Entry) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(bundle.Entry))
+	}
+
+	// PUT for resources with an id
+	patient := bundle.Entry[1]
+	if patient.Request.Method != fhir.HTTPVerbPUT || patient.Request.Url != "Patient/PAT1" {
+		t.Errorf("Expected PUT Patient/PAT1, got %s %s", patient.Request.Method, patient.Request.Url)
+	}
+	if *patient.FullUrl != "urn:uuid:"+uuid.NameBased("Patient/PAT1") {
+		t.Errorf("Unexpected fullUrl %s", *patient.FullUrl)
+	}
+
+	// Forward reference rewritten to the patient's fullUrl
+	var obs fhir.Observation
+	json.Unmarshal(bundle.Entry[0].Resource, &obs)
+	if *obs.Subject.Reference != *patient.FullUrl {
+		t.Errorf("Expected subject to reference %s, got %s", *patient.FullUrl, *obs.Subject.Reference)
+	}
+
+	// Conditional create from the identifier
+	conditional := bundle.Entry[2].Request
+	if conditional.Method != fhir.HTTPVerbPOST || conditional.Url != "Patient" {
+		t.Errorf("Expected POST Patient, got %s %s", conditional.Method, conditional.Url)
+	}
+	if conditional.IfNoneExist == nil || *conditional.IfNoneExist != `identifier=http%3A%2F%2Fhospital.org%2Fmrn|M%5C%7C1+%26%23%2B` {
+		t.Errorf("Unexpected ifNoneExist: %v", conditional.IfNoneExist)
+	}
+
+	// POST without id; reference outside the bundle untouched
+	last := bundle.Entry[3]
+	if last.Request.Method != fhir.HTTPVerbPOST || last.Request.Url != "Observation" {
+		t.Errorf("Expected POST Observation, got %s %s", last.Request.Method, last.Request.Url)
+	}
+	json.Unmarshal(last.Resource, &obs)
+	if *obs.Subject.Reference != "Patient/OTHER" {
+		t.Errorf("Expected reference outside the bundle to be kept, got %s", *obs.Subject.Reference)
+	}
+
+	// Spool file must be cleaned up
+	entries, _ := os.ReadDir(filepath.Dir(outputPath))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the output file, found %d entries", len(entries))
+	}
+}
+
+// TestBatchBundle tests server-relative fullUrls in a batch
+func TestBatchBundle(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "batch.json")
+	writer, err := NewWriterWithOptions(outputPath, Options{
+		Format:     FormatBundle,
+		BundleType: BundleBatch,
+		BaseURL:    "http://example.org/fhir/",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Write(&fhir.Patient{Id: strPtr("PAT1")})
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	bundle := readBundle(t, outputPath)
+	if bundle.Type != fhir.BundleTypeBatch {
+		t.Errorf("Expected batch bundle, got %s", bundle.Type)
+	}
+	if *bundle.Entry[0].FullUrl != "http://example.org/fhir/Patient/PAT1" {
+		t.Errorf("Unexpected fullUrl %s", *bundle.Entry[0].FullUrl)
+	}
+}
+
+// TestDeletionEntry tests DELETE entries and their restriction to bundles
+// with requests
+func TestDeletionEntry(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "tx.json")
+	writer, err := NewWriterWithOptions(outputPath, Options{Format: FormatBundle, BundleType: BundleTransaction})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Write(&fhir.Patient{Id: strPtr("PAT1")})
+	if err := writer.Write(Deletion{ResourceType: "Patient", ID: "PAT2"}); err != nil {
+		t.Fatalf("Failed to write deletion: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	bundle := readBundle(t, outputPath)
+	if len(bundle.Entry) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(bundle.Entry))
+	}
+	deletion := bundle.Entry[1]
+	if deletion.Request.Method != fhir.HTTPVerbDELETE || deletion.Request.Url != "Patient/PAT2" || deletion.Resource != nil {
+		t.Errorf("Unexpected deletion entry: %+v", deletion)
+	}
+
+	ndjson, err := NewWriterWithOptions(filepath.Join(t.TempDir(), "out.ndjson"), Options{Format: FormatNDJSON})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer ndjson.Abort()
+	if err := ndjson.Write(Deletion{ResourceType: "Patient", ID: "PAT2"}); err == nil {
+		t.Error("Expected error for a deletion in NDJSON output")
+	}
+}
+
+// TestRewriteReferences tests reference rewriting on compact JSON
+func TestRewriteReferences(t *testing.T) {
+	fullURLs := map[string]string{"Patient/1": "urn:uuid:abc"}
+
+	input := `{"subject":{"reference":"Patient/1"},"note":[{"text":"\"reference\":\"Patient/1\""}],"performer":[{"reference":"Patient/2"}]}`
+	want := `{"subject":{"reference":"urn:uuid:abc"},"note":[{"text":"\"reference\":\"Patient/1\""}],"performer":[{"reference":"Patient/2"}]}`
+
+	got := string(rewriteReferences([]byte(input), fullURLs))
+	if got != want {
+		t.Errorf("rewriteReferences:\n got  %s\n want %s", got, want)
+	}
+}
+
+// readBundle reads and parses a bundle file
+func readBundle(t *testing.T, path string) fhir.Bundle {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	var bundle fhir.Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("Failed to parse bundle: %v", err)
+	}
+	return bundle
+}
+
+// Helper function to create string pointer
+func strPtr(s string) *string {
+	return &s
+}
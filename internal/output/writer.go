@@ -1,10 +1,23 @@
 package output
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"csv2fhir/internal/fhirjson"
+	"csv2fhir/internal/fhirversion"
+	"csv2fhir/internal/uuid"
 
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 )
@@ -15,96 +28,357 @@ type Format string
 const (
 	FormatBundle Format = "bundle"
 	FormatNDJSON Format = "ndjson"
+	FormatBulk   Format = "bulk" // Bulk Data directory of NDJSON files per type
+
+	FormatXML       Format = "xml"        // Bundle in FHIR XML
+	FormatXMLStream Format = "xml-stream" // One FHIR XML resource per line
 )
 
-// Writer handles writing FHIR resources to output
+// isBundle reports whether the format wraps resources in a Bundle
+func (f Format) isBundle() bool {
+	return f == FormatBundle || f == FormatXML
+}
+
+// Layout selects the whitespace of JSON output
+type Layout int
+
+const (
+	LayoutDefault Layout = iota // Indented bundles, compact NDJSON
+	LayoutPretty                // Indented
+	LayoutCompact               // No insignificant whitespace
+)
+
+// Writer handles writing FHIR resources to output. Both formats are
+// streamed: bundle entries are written as they arrive and the bundle is
+// closed off with its total when the writer is closed.
 type Writer struct {
 	writer       io.Writer
 	format       Format
+	opts         Options
 	file         *os.File
-	resources    []interface{}
-	firstWrite   bool
-	maxResources int
+	count        int  // Resources written so far
+	started      bool // Bundle header has been written
+	maxResources int  // 0 means no limit
 	closed       bool
-	warnedLimit  bool
+	offset       int64        // Bytes written to the output so far
+	outputPath   string       // Final output path (empty for stdout)
+	incomplete   bool         // Mark the finalized output as incomplete
+	hash         hash.Hash    // SHA-256 of everything written
+	compressor   *gzip.Writer // Set when the output is compressed
+	pretty       bool         // Indent JSON output
+	released     bool         // Files closed by release until reacquire
+
+	// Transaction bundles are spooled so references to entries written
+	// later in the bundle can be rewritten to their fullUrls
+	spool       *os.File
+	spoolWriter *bufio.Writer
+	fullURLs    map[string]string // "Type/id" -> urn:uuid fullUrl
+
+	// Document and message bundles, and bundles with a BundleID
+	identifier string   // Bundle.identifier value
+	timestamp  string   // Bundle.timestamp, also the Composition date
+	entryURLs  []string // fullUrls of the entries, referenced by the header entry
+}
+
+// ResourceWriter is implemented by every output destination
+type ResourceWriter interface {
+	// Write adds a resource to the output
+	Write(resource interface{}) error
+	// MarkIncomplete flags the output as the result of an interrupted run
+	MarkIncomplete()
+	// Close finalizes the output and moves it into place
+	Close() error
+	// Abort discards the output
+	Abort() error
+}
+
+// Options configures a Writer
+type Options struct {
+	Format       Format
+	MaxResources int // 0 means no limit
+
+	// Bundle settings (FormatBundle and FormatXML only)
+	BundleType        BundleType   // Default: collection
+	BaseURL           string       // Server base for fullUrls of resources with an id; urn:uuid when empty
+	IfNoneExistSystem string       // Identifier system used for conditional creates
+	Header            BundleHeader // Composition or MessageHeader of document and message bundles
+	BundleID          string       // Bundle.id; also gives every bundle an identifier and timestamp
+	Timestamp         string       // Bundle.timestamp, e.g. the run start; default: when the writer is created
+
+	// Converts the header to another FHIR release; resources are written as
+	// given, so callers convert them first. nil writes R4.
+	Converter *fhirversion.Converter
+
+	Compression Compression // Compress the output file
+
+	// JSON encoding
+	Canonical bool   // Sorted keys, normalized exponents, no whitespace (RFC 8785)
+	Layout    Layout // Indentation; canonical output is always compact
+}
+
+// pretty reports whether JSON output is indented
+func (o Options) pretty() bool {
+	switch o.Layout {
+	case LayoutPretty:
+		return true
+	case LayoutCompact:
+		return false
+	}
+	return o.Format == FormatBundle && !o.Canonical
+}
+
+// PartialPath returns the temporary path output is written to until the
+// writer is closed successfully
+func PartialPath(outputPath string) string {
+	return outputPath + ".partial"
+}
+
+// IncompletePath returns the path of the file marking the output of an
+// interrupted run in a format that has no bundle to tag, e.g. NDJSON
+func IncompletePath(outputPath string) string {
+	return outputPath + ".incomplete"
 }
 
 // NewWriter creates a new output writer
 func NewWriter(outputPath string, format Format) (*Writer, error) {
-	return NewWriterWithLimit(outputPath, format, 10000) // Default 10k resources
+	return NewWriterWithLimit(outputPath, format, 0)
 }
 
-// NewWriterWithLimit creates a new output writer with a configurable resource limit
+// NewWriterWithLimit creates a new output writer that refuses to write more
+// than maxResources resources (0 means no limit)
 func NewWriterWithLimit(outputPath string, format Format, maxResources int) (*Writer, error) {
+	return NewWriterWithOptions(outputPath, Options{Format: format, MaxResources: maxResources})
+}
+
+// NewWriterWithOptions creates a new output writer with the given options
+func NewWriterWithOptions(outputPath string, opts Options) (*Writer, error) {
+	if opts.Canonical && opts.Layout == LayoutPretty {
+		return nil, fmt.Errorf("canonical output cannot be pretty-printed")
+	}
+	if opts.Format.isBundle() {
+		if err := opts.Header.validate(opts.BundleType); err != nil {
+			return nil, err
+		}
+	}
+
 	var writer io.Writer
 	var file *os.File
 	var err error
 
 	if outputPath == "" || outputPath == "-" {
 		writer = os.Stdout
+		outputPath = ""
 	} else {
-		file, err = os.Create(outputPath)
+		// Write to a temporary file next to the output and rename it into
+		// place on Close, so an interrupted run never leaves a truncated file
+		// that looks like real output
+		file, err = os.Create(PartialPath(outputPath))
 		if err != nil {
 			return nil, fmt.Errorf("failed to create output file: %w", err)
 		}
 		writer = file
 	}
 
+	w, err := newWriter(writer, file, outputPath, opts)
+	if err != nil {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return nil, err
+	}
+	w.startCompression(opts.Compression)
+	return w, nil
+}
+
+// newWriter creates a Writer writing to writer. file and outputPath are set
+// when writer is the partial output file.
+func newWriter(writer io.Writer, file *os.File, outputPath string, opts Options) (*Writer, error) {
+	format := opts.Format
+	maxResources := opts.MaxResources
+	if opts.BundleType == "" {
+		opts.BundleType = BundleCollection
+	}
+
 	// Validate max resources
-	if maxResources <= 0 {
-		maxResources = 10000 // Sensible default
+	if maxResources < 0 {
+		maxResources = 0
 	}
 
-	return &Writer{
+	w := &Writer{
 		writer:       writer,
 		format:       format,
+		opts:         opts,
 		file:         file,
-		resources:    []interface{}{},
-		firstWrite:   true,
 		maxResources: maxResources,
 		closed:       false,
-		warnedLimit:  false,
+		outputPath:   outputPath,
+		hash:         sha256.New(),
+		pretty:       opts.pretty(),
+	}
+	if format.isBundle() && (opts.BundleType == BundleTransaction || opts.BundleType.hasHeader()) {
+		w.fullURLs = make(map[string]string)
+	}
+	if format.isBundle() && (opts.BundleType.hasHeader() || opts.BundleID != "") {
+		id, err := uuid.New()
+		if err != nil {
+			return nil, err
+		}
+		w.identifier = "urn:uuid:" + id
+		w.timestamp = opts.Timestamp
+		if w.timestamp == "" {
+			w.timestamp = time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	return w, nil
+}
+
+// NewWriterForResume reopens the partial NDJSON output of an interrupted run
+// for appending, discarding anything written past offset. opts must encode
+// resources the way the interrupted run did.
+func NewWriterForResume(outputPath string, opts Options, offset int64) (*Writer, error) {
+	if opts.Format != FormatNDJSON {
+		return nil, fmt.Errorf("resume is only supported for ndjson output")
+	}
+	if outputPath == "" || outputPath == "-" {
+		return nil, fmt.Errorf("resume requires an output file")
+	}
+	if opts.Compression != CompressionNone {
+		return nil, fmt.Errorf("resume is not supported for compressed output")
+	}
+
+	file, err := os.OpenFile(PartialPath(outputPath), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial output file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat output file: %w", err)
+	}
+	if info.Size() < offset {
+		file.Close()
+		return nil, fmt.Errorf("output file is shorter (%d bytes) than the checkpoint offset (%d bytes)", info.Size(), offset)
+	}
+
+	// Drop partial output written after the checkpoint
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate output file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek output file: %w", err)
+	}
+
+	return &Writer{
+		writer:       file,
+		format:       opts.Format,
+		opts:         opts,
+		file:         file,
+		maxResources: opts.MaxResources,
+		offset:       offset,
+		outputPath:   outputPath,
+		hash:         sha256.New(), // Covers only what this run appends
+		pretty:       opts.pretty(),
 	}, nil
 }
 
+// Offset returns the number of bytes written to the output so far. For
+// compressed output this lags behind until the writer is closed.
+func (w *Writer) Offset() int64 {
+	return w.offset
+}
+
+// Count returns the number of resources written so far
+func (w *Writer) Count() int {
+	return w.count
+}
+
+// Checksum returns the hex-encoded SHA-256 of the bytes written so far
+func (w *Writer) Checksum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// Sync flushes written data to stable storage (no-op for stdout)
+func (w *Writer) Sync() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync output file: %w", err)
+	}
+	return nil
+}
+
 // Write writes a FHIR resource to the output
 func (w *Writer) Write(resource interface{}) error {
+	if w.maxResources > 0 && w.count >= w.maxResources {
+		return fmt.Errorf("resource limit exceeded (%d resources). Increase --max-resources", w.maxResources)
+	}
+	if _, ok := resource.(Deletion); ok && !(w.format.isBundle() && w.opts.BundleType.HasRequests()) {
+		return fmt.Errorf("deletions can only be written to transaction and batch bundles")
+	}
+
 	if w.format == FormatNDJSON {
 		// Write immediately as newline-delimited JSON
+		data, err := w.encode(resource, "")
+		if err != nil {
+			return err
+		}
+		if err := w.write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to write resource: %w", err)
+		}
+	} else if w.format == FormatXMLStream {
 		data, err := json.Marshal(resource)
 		if err != nil {
 			return fmt.Errorf("failed to marshal resource: %w", err)
 		}
-		if _, err := w.writer.Write(data); err != nil {
-			return fmt.Errorf("failed to write resource: %w", err)
+		xmlData, err := resourceToXML(data)
+		if err != nil {
+			return err
 		}
-		if _, err := w.writer.Write([]byte("\n")); err != nil {
-			return fmt.Errorf("failed to write newline: %w", err)
+		if err := w.write(append(xmlData, '\n')); err != nil {
+			return fmt.Errorf("failed to write resource: %w", err)
 		}
 	} else {
-		// Check memory limit before collecting resources for bundle
-		currentCount := len(w.resources)
-
-		// Warn when approaching limit (at 90%)
-		if !w.warnedLimit && currentCount >= int(float64(w.maxResources)*0.9) {
-			fmt.Fprintf(os.Stderr, "Warning: Approaching memory limit (%d/%d resources). Consider using NDJSON format for large files.\n",
-				currentCount, w.maxResources)
-			w.warnedLimit = true
+		if err := w.writeBundleEntry(resource); err != nil {
+			return err
 		}
+	}
 
-		// Auto-switch to streaming if limit exceeded
-		if currentCount >= w.maxResources {
-			return fmt.Errorf("resource limit exceeded (%d resources). Use --format ndjson for large files or increase --max-resources", w.maxResources)
-		}
+	w.count++
+	return nil
+}
 
-		// Collect resources for bundle
-		w.resources = append(w.resources, resource)
+// write writes raw bytes to the output, compressing them if enabled
+func (w *Writer) write(data []byte) error {
+	if w.compressor != nil {
+		_, err := w.compressor.Write(data)
+		return err
 	}
+	_, err := w.writeOutput(data)
+	return err
+}
 
-	return nil
+// writeOutput writes bytes to the output, tracking the output offset
+func (w *Writer) writeOutput(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	w.offset += int64(n)
+	w.hash.Write(data[:n])
+	return n, err
+}
+
+// MarkIncomplete flags the output as the result of an interrupted run.
+// Bundles are tagged as incomplete when they are finalized; other formats
+// get a file at IncompletePath next to the output.
+func (w *Writer) MarkIncomplete() {
+	w.incomplete = true
 }
 
-// Close finalizes the output (creates bundle if needed) and closes the file
+// Close finalizes the output (creates bundle if needed), closes the file and
+// moves it into place. If finalizing fails the temporary file is removed.
 func (w *Writer) Close() error {
 	// Prevent double-close
 	if w.closed {
@@ -114,9 +388,15 @@ func (w *Writer) Close() error {
 
 	// Ensure file is closed even if bundle writing fails
 	var bundleErr error
-	if w.format == FormatBundle && len(w.resources) > 0 {
-		bundleErr = w.writeBundle()
+	if w.format == FormatBundle {
+		bundleErr = w.finishBundle()
+	} else if w.format == FormatXML {
+		bundleErr = w.finishXMLBundle()
 	}
+	if bundleErr == nil {
+		bundleErr = w.finishCompression()
+	}
+	w.removeSpool()
 
 	// Always attempt to close the file
 	var closeErr error
@@ -127,55 +407,314 @@ func (w *Writer) Close() error {
 
 	// Return the first error encountered
 	if bundleErr != nil {
+		w.removePartial()
 		return fmt.Errorf("failed to write bundle: %w", bundleErr)
 	}
 	if closeErr != nil {
+		w.removePartial()
 		return fmt.Errorf("failed to close file: %w", closeErr)
 	}
 
+	if w.outputPath != "" {
+		// The marker goes first, so incomplete output never looks complete
+		marked := w.incomplete && !w.format.isBundle()
+		if marked {
+			if err := w.writeIncompleteMarker(); err != nil {
+				w.removePartial()
+				return err
+			}
+		}
+		if err := os.Rename(PartialPath(w.outputPath), w.outputPath); err != nil {
+			w.removePartial()
+			return fmt.Errorf("failed to move output into place: %w", err)
+		}
+		// An earlier interrupted run's marker no longer describes the output
+		if !marked {
+			if err := os.Remove(IncompletePath(w.outputPath)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove incomplete marker: %w", err)
+			}
+		}
+	}
+
 	return nil
 }
 
-// writeBundle creates and writes a FHIR Bundle containing all resources
-func (w *Writer) writeBundle() error {
-	bundle := &fhir.Bundle{
-		Type: fhir.BundleTypeCollection,
+// writeIncompleteMarker writes the file marking the output as incomplete
+func (w *Writer) writeIncompleteMarker() error {
+	content := fmt.Sprintf("%s is incomplete: the run was interrupted after writing %d resources\n",
+		filepath.Base(w.outputPath), w.count)
+	if err := os.WriteFile(IncompletePath(w.outputPath), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write incomplete marker: %w", err)
+	}
+	return nil
+}
+
+// Abort closes the writer without finalizing and removes the temporary file
+func (w *Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.removeSpool()
+
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.removePartial()
+}
+
+// Suspend closes the writer without finalizing, leaving the temporary file in
+// place so a checkpointed run can be resumed
+func (w *Writer) Suspend() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.removeSpool()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return nil
+}
+
+// removePartial deletes the temporary output file, if any
+func (w *Writer) removePartial() error {
+	if w.outputPath == "" {
+		return nil
+	}
+	if err := os.Remove(PartialPath(w.outputPath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove partial output: %w", err)
+	}
+	return nil
+}
+
+// encode marshals a value for the output. prefix is the indentation of the
+// line the value starts on, used when the output is pretty-printed.
+func (w *Writer) encode(v interface{}, prefix string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	return w.formatJSON(data, prefix)
+}
+
+// formatJSON lays out compact JSON according to the writer's options
+func (w *Writer) formatJSON(data []byte, prefix string) ([]byte, error) {
+	if w.opts.Canonical {
+		return fhirjson.Canonical(data)
+	}
+	if !w.pretty {
+		return data, nil
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, prefix, "  "); err != nil {
+		return nil, fmt.Errorf("failed to format JSON: %w", err)
+	}
+	return indented.Bytes(), nil
+}
+
+// layout strips the whitespace from a bundle separator unless the output is
+// pretty-printed
+func (w *Writer) layout(s string) string {
+	if w.pretty {
+		return s
+	}
+	return strings.NewReplacer("\n", "", " ", "").Replace(s)
+}
+
+// startBundle writes the bundle header and opens the entry array. The header
+// is the marshaled Bundle without its closing brace, so it is laid out exactly
+// as json.MarshalIndent would lay out the complete bundle. Canonical bundles
+// start with the entry array, since "entry" sorts first; their other
+// elements are all written by finishBundle.
+func (w *Writer) startBundle() error {
+	var header []byte
+	if w.opts.Canonical {
+		header = []byte("{")
+	} else {
+		data, err := w.encode(w.newBundle(), "")
+		if err != nil {
+			return fmt.Errorf("failed to marshal bundle: %w", err)
+		}
+		header = bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("}")), []byte("\n"))
+	}
+
+	if err := w.write(header); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
 	}
+	w.started = true
+	return nil
+}
 
-	// Create bundle entries
-	entries := make([]fhir.BundleEntry, 0, len(w.resources))
-	for _, resource := range w.resources {
+// writeBundleEntry appends a resource to the bundle's entry array
+func (w *Writer) writeBundleEntry(resource interface{}) error {
+	if !w.started && w.format == FormatBundle {
+		if err := w.startBundle(); err != nil {
+			return err
+		}
+	}
+
+	var entry fhir.BundleEntry
+	if deletion, ok := resource.(Deletion); ok {
+		entry = deleteEntry(deletion)
+	} else {
 		// Marshal resource to JSON for BundleEntry
 		resourceJSON, err := json.Marshal(resource)
 		if err != nil {
 			return fmt.Errorf("failed to marshal resource: %w", err)
 		}
 
-		entry := fhir.BundleEntry{
+		entry = fhir.BundleEntry{
 			Resource: resourceJSON,
 		}
-		entries = append(entries, entry)
+		if w.opts.BundleType.HasRequests() {
+			if err := w.buildRequestEntry(&entry); err != nil {
+				return err
+			}
+		} else if w.fullURLs != nil {
+			if err := w.buildHeaderedEntry(&entry); err != nil {
+				return err
+			}
+		}
+	}
+	// XML bundles are spooled because total precedes the entries in XML
+	if w.fullURLs != nil || w.format == FormatXML {
+		return w.spoolEntry(entry)
 	}
 
-	bundle.Entry = entries
+	data, err := w.encode(entry, "    ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle entry: %w", err)
+	}
 
-	// Set bundle metadata
-	total := len(entries)
-	bundle.Total = &total
+	if err := w.write(append([]byte(w.entrySeparator(w.count == 0)), data...)); err != nil {
+		return fmt.Errorf("failed to write bundle entry: %w", err)
+	}
+	return nil
+}
 
-	// Marshal and write bundle
-	data, err := json.MarshalIndent(bundle, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal bundle: %w", err)
+// entrySeparator returns what precedes an entry in the bundle: the opening of
+// the entry array for the first entry, a comma otherwise
+func (w *Writer) entrySeparator(first bool) string {
+	switch {
+	case first && w.opts.Canonical:
+		return `"entry":[`
+	case first:
+		return w.layout(",\n  \"entry\": [\n    ")
+	}
+	return w.layout(",\n    ")
+}
+
+// finishBundle closes the entry array and writes the trailing bundle
+// metadata. A bundle is written even when there are no resources.
+func (w *Writer) finishBundle() error {
+	if !w.started {
+		if err := w.startBundle(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writeSpooledEntries(); err != nil {
+		return err
+	}
+	if w.opts.Canonical {
+		return w.finishCanonicalBundle()
+	}
+
+	var trailer bytes.Buffer
+	if w.entryCount() > 0 {
+		trailer.WriteString(w.layout("\n  ]"))
+	}
+	if w.incomplete {
+		meta, err := w.encode(fhir.Meta{Tag: []fhir.Coding{incompleteTag()}}, "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal bundle meta: %w", err)
+		}
+		trailer.WriteString(w.layout(",\n  \"meta\": "))
+		trailer.Write(meta)
 	}
+	// FHIR only allows total on search and history bundles; it is kept on
+	// collections for compatibility but left off transactions and batches
+	if w.opts.BundleType == BundleCollection {
+		fmt.Fprintf(&trailer, w.layout(",\n  \"total\": %d"), w.count)
+	}
+	trailer.WriteString(w.layout("\n}") + "\n")
 
-	if _, err := w.writer.Write(data); err != nil {
+	if err := w.write(trailer.Bytes()); err != nil {
 		return fmt.Errorf("failed to write bundle: %w", err)
 	}
+	return nil
+}
 
+// finishCanonicalBundle closes the entry array and writes the remaining
+// bundle elements, which all sort after "entry"
+func (w *Writer) finishCanonicalBundle() error {
+	bundle := w.newBundle()
+	if w.incomplete {
+		bundle.Meta = &fhir.Meta{Tag: []fhir.Coding{incompleteTag()}}
+	}
+	if w.opts.BundleType == BundleCollection {
+		total := w.count
+		bundle.Total = &total
+	}
+
+	data, err := w.encode(bundle, "")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle: %w", err)
+	}
+	trailer := bytes.TrimPrefix(data, []byte("{"))
+	if w.entryCount() > 0 {
+		trailer = append([]byte("],"), trailer...)
+	}
+	if err := w.write(append(trailer, '\n')); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
 	return nil
 }
 
+// newBundle returns the Bundle elements that precede the entries
+func (w *Writer) newBundle() *fhir.Bundle {
+	bundle := &fhir.Bundle{
+		Type: w.opts.BundleType.fhirType(),
+	}
+	if w.opts.BundleID != "" {
+		id := w.opts.BundleID
+		bundle.Id = &id
+	}
+	if w.identifier != "" {
+		system := "urn:ietf:rfc:3986"
+		value := w.identifier
+		bundle.Identifier = &fhir.Identifier{System: &system, Value: &value}
+		timestamp := w.timestamp
+		bundle.Timestamp = &timestamp
+	}
+	return bundle
+}
+
+// entryCount returns the number of entries in the bundle, including the
+// header entry of document and message bundles
+func (w *Writer) entryCount() int {
+	if w.opts.BundleType.hasHeader() {
+		return w.count + 1
+	}
+	return w.count
+}
+
+// incompleteTag returns the meta tag marking output of an interrupted run
+func incompleteTag() fhir.Coding {
+	system := "https://github.com/lemmack/csv2fhir/tags"
+	code := "incomplete"
+	display := "Conversion was interrupted before all rows were processed"
+	return fhir.Coding{System: &system, Code: &code, Display: &display}
+}
+
 // ParseFormat parses a format string into a Format type
 func ParseFormat(s string) (Format, error) {
 	switch s {
@@ -183,7 +722,13 @@ func ParseFormat(s string) (Format, error) {
 		return FormatBundle, nil
 	case "ndjson":
 		return FormatNDJSON, nil
+	case "bulk":
+		return FormatBulk, nil
+	case "xml":
+		return FormatXML, nil
+	case "xml-stream":
+		return FormatXMLStream, nil
 	default:
-		return "", fmt.Errorf("unsupported format: %s (supported: bundle, ndjson)", s)
+		return "", fmt.Errorf("unsupported format: %s (supported: bundle, ndjson, bulk, xml, xml-stream)", s)
 	}
 }
@@ -0,0 +1,267 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"csv2fhir/internal/fhirjson"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// FHIR and XHTML namespaces used by the XML formats
+const (
+	fhirNamespace  = "http://hl7.org/fhir"
+	xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+)
+
+// resourceToXML converts a resource in FHIR JSON to FHIR XML. The root element
+// carries the FHIR namespace. Elements are written in the order of the JSON,
+// which for the FHIR models is the order of the specification.
+func resourceToXML(data []byte) ([]byte, error) {
+	resource, err := fhirjson.ParseObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse resource JSON: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := writeResourceXML(&buf, resource, true); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeResourceXML writes a resource element named after its resourceType
+func writeResourceXML(buf *bytes.Buffer, resource *fhirjson.Object, root bool) error {
+	resourceType, ok := resource.Get("resourceType").(string)
+	if !ok {
+		return fmt.Errorf("resource has no resourceType")
+	}
+
+	buf.WriteString("<" + resourceType)
+	if root {
+		buf.WriteString(` xmlns="` + fhirNamespace + `"`)
+	}
+	buf.WriteString(">")
+	if err := writeChildrenXML(buf, resource, true, false); err != nil {
+		return err
+	}
+	buf.WriteString("</" + resourceType + ">")
+	return nil
+}
+
+// writeChildrenXML writes the child elements of an object in key order.
+// Primitive extensions ("_name" keys) are merged into their element.
+func writeChildrenXML(buf *bytes.Buffer, o *fhirjson.Object, isResource, isExtension bool) error {
+	for _, key := range o.Keys() {
+		value := o.Get(key)
+
+		if key == "resourceType" {
+			continue
+		}
+		// id is an attribute on elements, but an element on resources;
+		// url is an attribute on extensions
+		if _, primitive := fhirjson.Text(value); !isResource && key == "id" && primitive {
+			continue
+		}
+		if isExtension && key == "url" {
+			continue
+		}
+		if strings.HasPrefix(key, "_") {
+			// Extensions of a primitive without a value
+			if !o.Has(key[1:]) {
+				if err := writeElementXML(buf, key[1:], nil, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := writeElementXML(buf, key, value, o.Get("_"+key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeElementXML writes one element (repeated for arrays). ext holds the
+// primitive extension object ("_name" in JSON), if any.
+func writeElementXML(buf *bytes.Buffer, name string, value, ext interface{}) error {
+	// Repeating elements, with primitive extensions matched by position
+	if items, ok := value.([]interface{}); ok {
+		extItems, _ := ext.([]interface{})
+		for i, item := range items {
+			var itemExt interface{}
+			if i < len(extItems) {
+				itemExt = extItems[i]
+			}
+			if err := writeElementXML(buf, name, item, itemExt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if extItems, ok := ext.([]interface{}); ok && value == nil {
+		for _, item := range extItems {
+			if err := writeElementXML(buf, name, nil, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	extension, _ := ext.(*fhirjson.Object)
+	if value == nil && extension == nil {
+		return nil
+	}
+
+	// Narrative XHTML is embedded as is, in the XHTML namespace
+	if div, ok := value.(string); ok && name == "div" {
+		return writeXHTML(buf, div)
+	}
+
+	// Contained and bundled resources are wrapped in an element named after
+	// their type
+	element, complex := value.(*fhirjson.Object)
+	if complex && element.Has("resourceType") {
+		buf.WriteString("<" + name + ">")
+		if err := writeResourceXML(buf, element, false); err != nil {
+			return err
+		}
+		buf.WriteString("</" + name + ">")
+		return nil
+	}
+
+	buf.WriteString("<" + name)
+
+	// Primitive: id attribute from its extension object, then value
+	if !complex {
+		if extension != nil {
+			if id, ok := fhirjson.Text(extension.Get("id")); ok {
+				writeAttrXML(buf, "id", id)
+			}
+		}
+		if text, ok := fhirjson.Text(value); ok {
+			writeAttrXML(buf, "value", text)
+		}
+		if extension == nil || extension.Get("extension") == nil {
+			buf.WriteString("/>")
+			return nil
+		}
+		buf.WriteString(">")
+		if err := writeElementXML(buf, "extension", extension.Get("extension"), nil); err != nil {
+			return err
+		}
+		buf.WriteString("</" + name + ">")
+		return nil
+	}
+
+	// Complex element
+	if id, ok := fhirjson.Text(element.Get("id")); ok {
+		writeAttrXML(buf, "id", id)
+	}
+	isExtension := name == "extension" || name == "modifierExtension"
+	if url, ok := fhirjson.Text(element.Get("url")); isExtension && ok {
+		writeAttrXML(buf, "url", url)
+	}
+
+	var children bytes.Buffer
+	if err := writeChildrenXML(&children, element, false, isExtension); err != nil {
+		return err
+	}
+	if children.Len() == 0 {
+		buf.WriteString("/>")
+		return nil
+	}
+	buf.WriteString(">")
+	buf.Write(children.Bytes())
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// writeAttrXML writes an escaped attribute
+func writeAttrXML(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(" " + name + `="`)
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteString(`"`)
+}
+
+// writeXHTML embeds a narrative div after checking it is well-formed,
+// adding the XHTML namespace when it is missing
+func writeXHTML(buf *bytes.Buffer, div string) error {
+	decoder := xml.NewDecoder(strings.NewReader(div))
+	for {
+		if _, err := decoder.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("narrative div is not well-formed XHTML: %w", err)
+		}
+	}
+
+	trimmed := strings.TrimSpace(div)
+	if !strings.HasPrefix(trimmed, "<div") {
+		return fmt.Errorf("narrative must be a single div element")
+	}
+	if !strings.Contains(trimmed[:strings.Index(trimmed, ">")+1], "xmlns") {
+		trimmed = `<div xmlns="` + xhtmlNamespace + `"` + strings.TrimPrefix(trimmed, "<div")
+	}
+	buf.WriteString(trimmed)
+	return nil
+}
+
+// xmlDeclaration starts every XML bundle
+const xmlDeclaration = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+// finishXMLBundle writes the XML bundle from the spooled entries. Unlike
+// JSON, XML requires total to precede the entries, so nothing is written
+// until all entries are known.
+func (w *Writer) finishXMLBundle() error {
+	bundle := w.newBundle()
+	if w.incomplete {
+		bundle.Meta = &fhir.Meta{Tag: []fhir.Coding{incompleteTag()}}
+	}
+	if w.opts.BundleType == BundleCollection {
+		total := w.count
+		bundle.Total = &total
+	}
+
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle: %w", err)
+	}
+	header, err := resourceToXML(data)
+	if err != nil {
+		return err
+	}
+	header = bytes.TrimSuffix(header, []byte("</Bundle>"))
+	if err := w.write(append([]byte(xmlDeclaration), append(header, '\n')...)); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	err = w.forEachBundleEntry(func(entry []byte, first bool) error {
+		node, err := fhirjson.ParseObject(entry)
+		if err != nil {
+			return fmt.Errorf("failed to parse bundle entry: %w", err)
+		}
+		var buf bytes.Buffer
+		buf.WriteString("  ")
+		if err := writeElementXML(&buf, "entry", node, nil); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		if err := w.write(buf.Bytes()); err != nil {
+			return fmt.Errorf("failed to write bundle entry: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.write([]byte("</Bundle>\n")); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
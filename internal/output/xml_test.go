@@ -0,0 +1,126 @@
+package output
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestResourceToXML tests element order, value attributes and primitive extensions
+func TestResourceToXML(t *testing.T) {
+	input := `{"resourceType":"Patient","id":"PAT1","extension":[{"url":"http://example.org/ext","valueString":"x"}],` +
+		`"name":[{"family":"O'Brien & Sons","given":["Ann",null],"_given":[null,{"extension":[{"url":"http://example.org/absent","valueCode":"unknown"}]}]}],` +
+		`"birthDate":"1980-01-01","_birthDate":{"id":"bd","extension":[{"url":"http://example.org/time","valueTime":"10:00:00"}]}}`
+
+	got, err := resourceToXML([]byte(input))
+	if err != nil {
+		t.Fatalf("resourceToXML failed: %v", err)
+	}
+
+	want := `<Patient xmlns="http://hl7.org/fhir"><id value="PAT1"/>` +
+		`<extension url="http://example.org/ext"><valueString value="x"/></extension>` +
+		`<name><family value="O&#39;Brien &amp; Sons"/><given value="Ann"/>` +
+		`<given><extension url="http://example.org/absent"><valueCode value="unknown"/></extension></given></name>` +
+		`<birthDate id="bd" value="1980-01-01"><extension url="http://example.org/time"><valueTime value="10:00:00"/></extension></birthDate>` +
+		`</Patient>`
+	if string(got) != want {
+		t.Errorf("resourceToXML:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+// TestResourceToXML_Narrative tests that narrative is embedded in the XHTML namespace
+func TestResourceToXML_Narrative(t *testing.T) {
+	input := `{"resourceType":"Observation","text":{"status":"generated","div":"<div><p>Glucose &lt; 100</p></div>"},"status":"final"}`
+
+	got, err := resourceToXML([]byte(input))
+	if err != nil {
+		t.Fatalf("resourceToXML failed: %v", err)
+	}
+	if !strings.Contains(string(got), `<div xmlns="http://www.w3.org/1999/xhtml"><p>Glucose &lt; 100</p></div>`) {
+		t.Errorf("Expected narrative div in XHTML namespace, got %s", got)
+	}
+	if err := checkWellFormed(got); err != nil {
+		t.Errorf("Output is not well-formed: %v", err)
+	}
+
+	bad := `{"resourceType":"Observation","text":{"status":"generated","div":"<div><p>unclosed</div>"}}`
+	if _, err := resourceToXML([]byte(bad)); err == nil {
+		t.Error("Expected error for malformed narrative")
+	}
+}
+
+// TestXMLBundle tests that the XML bundle lists total before its entries
+func TestXMLBundle(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "bundle.xml")
+	writer, err := NewWriterWithOptions(outputPath, Options{Format: FormatXML})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, id := range []string{"OBS1", "OBS2"} {
+		id := id
+		if err := writer.Write(&fhir.Observation{Id: &id, Status: fhir.ObservationStatusFinal}); err != nil {
+			t.Fatalf("Failed to write resource: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if err := checkWellFormed(data); err != nil {
+		t.Fatalf("Output is not well-formed: %v", err)
+	}
+
+	var bundle struct {
+		XMLName xml.Name
+		Type    struct {
+			Value string `xml:"value,attr"`
+		} `xml:"type"`
+		Total struct {
+			Value string `xml:"value,attr"`
+		} `xml:"total"`
+		Entry []struct {
+			Observation struct {
+				Id struct {
+					Value string `xml:"value,attr"`
+				} `xml:"id"`
+			} `xml:"resource>Observation"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("Failed to parse bundle: %v", err)
+	}
+	if bundle.XMLName.Space != fhirNamespace || bundle.XMLName.Local != "Bundle" {
+		t.Errorf("Expected Bundle in FHIR namespace, got %v", bundle.XMLName)
+	}
+	if bundle.Type.Value != "collection" || bundle.Total.Value != "2" {
+		t.Errorf("Expected collection with total 2, got %s/%s", bundle.Type.Value, bundle.Total.Value)
+	}
+	if len(bundle.Entry) != 2 || bundle.Entry[1].Observation.Id.Value != "OBS2" {
+		t.Errorf("Unexpected entries: %+v", bundle.Entry)
+	}
+	if bytes.Index(data, []byte("<total")) > bytes.Index(data, []byte("<entry")) {
+		t.Error("Expected total before the entries")
+	}
+}
+
+// checkWellFormed reads every token of an XML document
+func checkWellFormed(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		if _, err := decoder.Token(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package provenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	"csv2fhir/internal/uuid"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// ChecksumSystem is the identifier system of SHA-256 file checksums
+const ChecksumSystem = "https://github.com/lemmack/csv2fhir/sha256"
+
+// Source describes the run a Provenance records
+type Source struct {
+	RunID           string // Provenance ids are derived from it
+	Recorded        string // Run start time
+	Version         string // csv2fhir version
+	InputName       string
+	InputChecksum   string // Empty when the input could not be checksummed, e.g. stdin
+	MappingName     string
+	MappingChecksum string
+}
+
+// DefaultEvery is the number of targets per Provenance by default. A
+// Provenance holds its targets until it is written, so a run of millions of
+// resources is split into Provenance resources of bounded size.
+const DefaultEvery = 10000
+
+// Recorder collects the resources written by a run and builds the Provenance
+// resources targeting them
+type Recorder struct {
+	source     Source
+	every      int      // Targets per Provenance
+	targets    []string // "Type/id" of the resources since the last Provenance
+	count      int      // Provenance resources built so far
+	untargeted int      // Resources without an id, which cannot be targeted
+}
+
+// NewRecorder creates a recorder building a Provenance for every `every`
+// resources (0 means DefaultEvery)
+func NewRecorder(source Source, every int) *Recorder {
+	if every <= 0 {
+		every = DefaultEvery
+	}
+	return &Recorder{source: source, every: every}
+}
+
+// Add records a written resource. It returns a Provenance when the resource
+// completes a group of targets, otherwise nil.
+func (r *Recorder) Add(resource interface{}) *fhir.Provenance {
+	target, ok := reference(resource)
+	if !ok {
+		r.untargeted++
+		return nil
+	}
+	r.targets = append(r.targets, target)
+	if len(r.targets) >= r.every {
+		return r.build()
+	}
+	return nil
+}
+
+// Finish returns a Provenance for the resources added since the last one, or
+// nil if there are none
+func (r *Recorder) Finish() *fhir.Provenance {
+	if len(r.targets) == 0 {
+		return nil
+	}
+	return r.build()
+}
+
+// Untargeted returns the number of resources left out of every Provenance
+// because they have no id
+func (r *Recorder) Untargeted() int {
+	return r.untargeted
+}
+
+// build returns a Provenance targeting the collected resources
+func (r *Recorder) build() *fhir.Provenance {
+	r.count++
+	id := uuid.NameBased(r.source.RunID + "/provenance/" + strconv.Itoa(r.count))
+
+	targets := make([]fhir.Reference, len(r.targets))
+	for i := range r.targets {
+		targets[i] = fhir.Reference{Reference: &r.targets[i]}
+	}
+	r.targets = nil
+
+	agentType := "assembler"
+	agentSystem := "http://terminology.hl7.org/CodeSystem/provenance-participant-type"
+	software := fmt.Sprintf("csv2fhir %s with mapping %s", r.source.Version, r.source.MappingName)
+	device := "Device"
+
+	input := r.source.InputName
+	entity := fhir.ProvenanceEntity{
+		Role: fhir.ProvenanceEntityRoleSource,
+		What: fhir.Reference{Display: &input, Identifier: checksumIdentifier(r.source.InputChecksum)},
+	}
+
+	return &fhir.Provenance{
+		Id:       &id,
+		Target:   targets,
+		Recorded: r.source.Recorded,
+		Agent: []fhir.ProvenanceAgent{{
+			Type: &fhir.CodeableConcept{Coding: []fhir.Coding{{System: &agentSystem, Code: &agentType}}},
+			Who:  fhir.Reference{Type: &device, Display: &software, Identifier: checksumIdentifier(r.source.MappingChecksum)},
+		}},
+		Entity: []fhir.ProvenanceEntity{entity},
+	}
+}
+
+// checksumIdentifier returns an identifier holding a file checksum, or nil if
+// the checksum is unknown
+func checksumIdentifier(checksum string) *fhir.Identifier {
+	if checksum == "" {
+		return nil
+	}
+	system := ChecksumSystem
+	return &fhir.Identifier{System: &system, Value: &checksum}
+}
+
+// reference returns the "Type/id" reference of a resource, a model struct or
+// JSON, e.g. converted to another FHIR release
+func reference(resource interface{}) (string, bool) {
+	if data, ok := resource.(json.RawMessage); ok {
+		var info struct {
+			ResourceType string `json:"resourceType"`
+			Id           string `json:"id"`
+		}
+		if err := json.Unmarshal(data, &info); err != nil || info.ResourceType == "" || info.Id == "" {
+			return "", false
+		}
+		return info.ResourceType + "/" + info.Id, true
+	}
+	v := reflect.ValueOf(resource)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return "", false
+	}
+	id := v.FieldByName("Id")
+	if !id.IsValid() || id.Kind() != reflect.Ptr || id.IsNil() || id.Elem().String() == "" {
+		return "", false
+	}
+	return v.Type().Name() + "/" + id.Elem().String(), true
+}
+
+// Recover restores the state of an interrupted run from the NDJSON output it
+// wrote: the number of Provenance resources and the resources written after
+// the last one
+func (r *Recorder) Recover(output io.Reader) error {
+	decoder := json.NewDecoder(output)
+	for {
+		var info struct {
+			ResourceType string `json:"resourceType"`
+			Id           string `json:"id"`
+		}
+		if err := decoder.Decode(&info); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read previous output: %w", err)
+		}
+
+		switch {
+		case info.ResourceType == "Provenance":
+			r.count++
+			r.targets = nil
+		case info.Id == "":
+			r.untargeted++
+		default:
+			r.targets = append(r.targets, info.ResourceType+"/"+info.Id)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package provenance
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+var source = Source{
+	RunID:           "run-1",
+	Recorded:        "2026-01-02T03:04:05Z",
+	Version:         "1.2.3",
+	InputName:       "labs.csv",
+	InputChecksum:   "abc123",
+	MappingName:     "labs.yaml",
+	MappingChecksum: "def456",
+}
+
+func observation(id string) *fhir.Observation {
+	return &fhir.Observation{Id: &id}
+}
+
+// TestRecorder_Finish tests the Provenance of the resources left at the end
+// of the run
+func TestRecorder_Finish(t *testing.T) {
+	recorder := NewRecorder(source, 0)
+	for _, id := range []string{"OBS1", "OBS2"} {
+		if record := recorder.Add(observation(id)); record != nil {
+			t.Fatal("Expected no Provenance before Finish")
+		}
+	}
+	recorder.Add(&fhir.Observation{})
+	recorder.Add(json.RawMessage(`{"id":"OBS3","resourceType":"Observation"}`))
+
+	record := recorder.Finish()
+	if record == nil {
+		t.Fatal("Expected a Provenance")
+	}
+	if len(record.Target) != 3 || *record.Target[1].Reference != "Observation/OBS2" || *record.Target[2].Reference != "Observation/OBS3" {
+		t.Errorf("Unexpected targets: %+v", record.Target)
+	}
+	if record.Recorded != source.Recorded || record.Id == nil {
+		t.Errorf("Unexpected Provenance: %+v", record)
+	}
+	entity := record.Entity[0]
+	if entity.Role != fhir.ProvenanceEntityRoleSource || *entity.What.Display != "labs.csv" || *entity.What.Identifier.Value != "abc123" {
+		t.Errorf("Unexpected entity: %+v", entity)
+	}
+	who := record.Agent[0].Who
+	if !strings.Contains(*who.Display, "csv2fhir 1.2.3") || !strings.Contains(*who.Display, "labs.yaml") || *who.Identifier.Value != "def456" {
+		t.Errorf("Unexpected agent: %+v", who)
+	}
+	if recorder.Untargeted() != 1 {
+		t.Errorf("Expected 1 untargeted resource, got %d", recorder.Untargeted())
+	}
+	if recorder.Finish() != nil {
+		t.Error("Expected no Provenance without new resources")
+	}
+}
+
+// TestRecorder_DefaultEvery tests that Provenance resources stay bounded by default
+func TestRecorder_DefaultEvery(t *testing.T) {
+	recorder := NewRecorder(source, 0)
+	records := 0
+	for i := 0; i < DefaultEvery*2+1; i++ {
+		if recorder.Add(observation(strconv.Itoa(i))) != nil {
+			records++
+		}
+	}
+	if records != 2 {
+		t.Errorf("Expected 2 Provenance resources of %d targets, got %d", DefaultEvery, records)
+	}
+	if record := recorder.Finish(); record == nil || len(record.Target) != 1 {
+		t.Errorf("Expected a last Provenance of 1 target, got %+v", record)
+	}
+}
+
+// TestRecorder_Every tests a Provenance per group of resources with distinct ids
+func TestRecorder_Every(t *testing.T) {
+	recorder := NewRecorder(source, 2)
+	var records []*fhir.Provenance
+	for _, id := range []string{"A", "B", "C", "D", "E"} {
+		if record := recorder.Add(observation(id)); record != nil {
+			records = append(records, record)
+		}
+	}
+	if record := recorder.Finish(); record != nil {
+		records = append(records, record)
+	}
+	if len(records) != 3 || len(records[2].Target) != 1 {
+		t.Fatalf("Expected groups of 2, 2 and 1, got %d Provenance resources", len(records))
+	}
+	if *records[0].Id == *records[1].Id {
+		t.Error("Expected distinct Provenance ids")
+	}
+}
+
+// TestRecorder_Recover tests continuing a run from its previous output
+func TestRecorder_Recover(t *testing.T) {
+	previous := NewRecorder(source, 2)
+	var out strings.Builder
+	write := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		out.Write(append(data, '\n'))
+	}
+	for _, id := range []string{"A", "B", "C"} {
+		write(observation(id))
+		if record := previous.Add(observation(id)); record != nil {
+			write(record)
+		}
+	}
+
+	recorder := NewRecorder(source, 2)
+	if err := recorder.Recover(strings.NewReader(out.String())); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	record := recorder.Add(observation("D"))
+	want := previous.Add(observation("D"))
+	if record == nil || *record.Id != *want.Id {
+		t.Fatalf("Expected the recovered recorder to continue like the original")
+	}
+	if len(record.Target) != 2 || *record.Target[0].Reference != "Observation/C" {
+		t.Errorf("Unexpected targets: %+v", record.Target)
+	}
+}
@@ -0,0 +1,136 @@
+package transform
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"csv2fhir/internal/config"
+	"csv2fhir/internal/uuid"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// DefaultAttachmentMaxSize is the largest file embedded by default. Every
+// row in flight holds its files in memory, base64-encoded.
+const DefaultAttachmentMaxSize = 16 << 20
+
+// SetAttachmentOptions sets the directory attachment paths are resolved
+// against and must stay within (default: the working directory) and the
+// largest file embedded (0 means DefaultAttachmentMaxSize)
+func (t *Transformer) SetAttachmentOptions(dir string, maxSize int64) {
+	t.attachmentDir = dir
+	t.attachmentMaxSize = maxSize
+}
+
+// applyAttachments embeds the files named by the row into the resource's
+// attachments. It returns the Binary resources of binary attachments.
+func (t *Transformer) applyAttachments(resource interface{}, row map[string]string) ([]interface{}, error) {
+	var binaries []interface{}
+	for i, attachment := range t.config.Attachments {
+		path, err := config.SubstituteVariables(attachment.File, row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to substitute variables in attachment %s: %w", attachment.Path, err)
+		}
+		if path == "" {
+			continue // No file for this row
+		}
+		contentType, err := config.SubstituteVariables(attachment.ContentType, row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to substitute variables in attachment %s: %w", attachment.Path, err)
+		}
+
+		data, err := t.readAttachment(path)
+		if err != nil {
+			return nil, err
+		}
+		if contentType == "" {
+			contentType = sniffContentType(path, data)
+		}
+		hash := sha1.Sum(data)
+		encoded := base64.StdEncoding.EncodeToString(data)
+
+		values := map[string]string{
+			"contentType": contentType,
+			"size":        strconv.Itoa(len(data)),
+			"hash":        base64.StdEncoding.EncodeToString(hash[:]),
+		}
+		if attachment.Binary {
+			id, err := binaryID(resource, i)
+			if err != nil {
+				return nil, err
+			}
+			binaries = append(binaries, &fhir.Binary{Id: &id, ContentType: contentType, Data: &encoded})
+			values["url"] = "Binary/" + id
+		} else {
+			values["data"] = encoded
+		}
+		for element, value := range values {
+			if err := t.setFieldValue(resource, attachment.Path+"."+element, value); err != nil {
+				return nil, fmt.Errorf("failed to set attachment %s: %w", attachment.Path, err)
+			}
+		}
+	}
+	return binaries, nil
+}
+
+// readAttachment reads a file to embed, refusing files outside the attachment
+// directory and files over the size limit
+func (t *Transformer) readAttachment(path string) ([]byte, error) {
+	// Paths come from the CSV, so they must not reach other files, whether by
+	// an absolute path, .. or a symbolic link
+	if !filepath.IsLocal(path) {
+		return nil, fmt.Errorf("attachment %s is not a relative path within the attachment directory", path)
+	}
+	dir := t.attachmentDir
+	if dir == "" {
+		dir = "."
+	}
+	maxSize := t.attachmentMaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultAttachmentMaxSize
+	}
+
+	file, err := os.OpenInRoot(dir, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open attachment: %w", err)
+	}
+	defer file.Close()
+
+	// The limit is checked while reading, as the file may grow after a stat
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment %s: %w", path, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("attachment %s is larger than the limit of %d bytes", path, maxSize)
+	}
+	return data, nil
+}
+
+// sniffContentType returns the MIME type of a file from its extension, or
+// else from its content
+func sniffContentType(path string, data []byte) string {
+	if contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(data)
+}
+
+// binaryID returns the id of the Binary holding a resource's attachment,
+// derived from the resource id so reruns update the same Binary
+func binaryID(resource interface{}, index int) (string, error) {
+	v := reflect.ValueOf(resource).Elem()
+	if id, ok := v.FieldByName("Id").Interface().(*string); ok && id != nil {
+		return uuid.NameBased(fmt.Sprintf("%s/%s/attachment/%d", v.Type().Name(), *id, index)), nil
+	}
+	return uuid.New()
+}
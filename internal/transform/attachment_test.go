@@ -0,0 +1,129 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"csv2fhir/internal/config"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestTransform_Attachment tests embedding a file into an attachment
+func TestTransform_Attachment(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("%PDF-1.4\nhello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.MappingConfig{
+		Resource: "DocumentReference",
+		Mappings: map[string]string{"status": "current", "content[0].attachment.title": "Report"},
+		Attachments: []config.AttachmentConfig{
+			{Path: "content[0].attachment", File: "${file_path}"},
+		},
+	}
+	transformer := NewTransformer(cfg)
+	transformer.SetAttachmentOptions(dir, 0)
+
+	resource, binaries, err := transformer.TransformRow(map[string]string{"file_path": "report.pdf"}, 2)
+	if err != nil {
+		t.Fatalf("TransformRow failed: %v", err)
+	}
+	if len(binaries) != 0 {
+		t.Errorf("Expected no Binary resources, got %d", len(binaries))
+	}
+	attachment := resource.(*fhir.DocumentReference).Content[0].Attachment
+	if *attachment.ContentType != "application/pdf" || *attachment.Data != "JVBERi0xLjQKaGVsbG8K" {
+		t.Errorf("Unexpected content type or data: %s %s", *attachment.ContentType, *attachment.Data)
+	}
+	if *attachment.Size != 15 || *attachment.Hash != "1L2LHZrJN+zg60hyzgUCTtZm8pQ=" || *attachment.Title != "Report" {
+		t.Errorf("Unexpected size, hash or title: %d %s %s", *attachment.Size, *attachment.Hash, *attachment.Title)
+	}
+
+	// Rows without a file keep the attachment empty
+	resource, _, err = transformer.TransformRow(map[string]string{"file_path": ""}, 3)
+	if err != nil {
+		t.Fatalf("TransformRow failed: %v", err)
+	}
+	if attachment := resource.(*fhir.DocumentReference).Content[0].Attachment; attachment.Data != nil {
+		t.Error("Expected no data for a row without a file")
+	}
+
+	// Files over the limit are refused
+	transformer.SetAttachmentOptions(dir, 10)
+	if _, _, err := transformer.TransformRow(map[string]string{"file_path": "report.pdf"}, 4); err == nil {
+		t.Error("Expected error for a file over the size limit")
+	}
+}
+
+// TestTransform_BinaryAttachment tests storing a file in a Binary resource
+func TestTransform_BinaryAttachment(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "scan"), []byte("\x89PNG\r\n\x1a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.MappingConfig{
+		Resource: "DocumentReference",
+		IDColumn: "id",
+		Mappings: map[string]string{"status": "current"},
+		Attachments: []config.AttachmentConfig{
+			{Path: "content[0].attachment", File: "${file_path}", Binary: true},
+		},
+	}
+
+	transformer := NewTransformer(cfg)
+	transformer.SetAttachmentOptions(dir, 0)
+
+	resource, binaries, err := transformer.TransformRow(map[string]string{"id": "D1", "file_path": "scan"}, 2)
+	if err != nil {
+		t.Fatalf("TransformRow failed: %v", err)
+	}
+	if len(binaries) != 1 {
+		t.Fatalf("Expected 1 Binary resource, got %d", len(binaries))
+	}
+	binary := binaries[0].(*fhir.Binary)
+	if binary.ContentType != "image/png" || *binary.Data != "iVBORw0KGgo=" {
+		t.Errorf("Unexpected Binary: %s %s", binary.ContentType, *binary.Data)
+	}
+	attachment := resource.(*fhir.DocumentReference).Content[0].Attachment
+	if attachment.Data != nil || *attachment.Url != "Binary/"+*binary.Id {
+		t.Errorf("Expected the attachment to reference the Binary, got %+v", attachment)
+	}
+
+	// The Binary id follows the resource id
+	_, again, _ := transformer.TransformRow(map[string]string{"id": "D1", "file_path": "scan"}, 2)
+	if *again[0].(*fhir.Binary).Id != *binary.Id {
+		t.Error("Expected the same Binary id for the same resource")
+	}
+}
+
+// TestTransform_AttachmentOutsideDir tests that files outside the attachment
+// directory are refused
+func TestTransform_AttachmentOutsideDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "attachments")
+	secret := filepath.Join(root, "secret.txt")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.MappingConfig{
+		Resource:    "DocumentReference",
+		Mappings:    map[string]string{"status": "current"},
+		Attachments: []config.AttachmentConfig{{Path: "content[0].attachment", File: "${file_path}"}},
+	}
+	transformer := NewTransformer(cfg)
+	transformer.SetAttachmentOptions(dir, 0)
+
+	for _, path := range []string{secret, "../secret.txt", "sub/../../secret.txt", "link.txt"} {
+		if _, _, err := transformer.TransformRow(map[string]string{"file_path": path}, 2); err == nil {
+			t.Errorf("Expected error for attachment %s", path)
+		}
+	}
+}
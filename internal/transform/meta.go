@@ -0,0 +1,129 @@
+package transform
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"csv2fhir/internal/config"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// StampMeta stamps the mapping's meta elements on a resource that belongs to
+// no row, e.g. a Provenance: its tags, source and lastUpdated, but none of
+// its profiles, which are of the mapped resource type. Values taken from row
+// columns are left out.
+func (t *Transformer) StampMeta(resource interface{}) error {
+	return t.applyMeta(resource, nil, false)
+}
+
+// applyMeta stamps the mapping's meta elements on a resource. Profiles and
+// tags are added unless the mapping already set them; source and lastUpdated
+// only fill in values the mapping left empty. Profiles are only stamped with
+// withProfiles, as they are of the mapped resource type and not of the
+// Binary resources holding its attachments.
+func (t *Transformer) applyMeta(resource interface{}, row map[string]string, withProfiles bool) error {
+	meta := t.config.Meta
+	if !withProfiles {
+		meta.Profile = nil
+	}
+	if meta.IsZero() {
+		return nil
+	}
+
+	v := reflect.ValueOf(resource)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	field := v.FieldByName("Meta")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(&fhir.Meta{}) {
+		return fmt.Errorf("resource has no Meta field")
+	}
+	if field.IsNil() {
+		field.Set(reflect.ValueOf(&fhir.Meta{}))
+	}
+	target := field.Interface().(*fhir.Meta)
+
+	substitute := func(template string) (string, error) {
+		if !strings.Contains(template, "${") {
+			return template, nil
+		}
+		if row == nil {
+			return "", nil // Not of any row, so nothing is stamped
+		}
+		return config.SubstituteVariables(template, row)
+	}
+
+	for _, template := range meta.Profile {
+		profile, err := substitute(template)
+		if err != nil {
+			return fmt.Errorf("failed to substitute variables in meta profile: %w", err)
+		}
+		if profile != "" && !containsString(target.Profile, profile) {
+			target.Profile = append(target.Profile, profile)
+		}
+	}
+
+	for _, tag := range meta.Tag {
+		var values [3]string
+		for i, template := range []string{tag.System, tag.Code, tag.Display} {
+			value, err := substitute(template)
+			if err != nil {
+				return fmt.Errorf("failed to substitute variables in meta tag: %w", err)
+			}
+			values[i] = value
+		}
+		if values[1] != "" && !hasTag(target.Tag, values[0], values[1]) {
+			target.Tag = append(target.Tag, fhir.Coding{
+				System:  optional(values[0]),
+				Code:    optional(values[1]),
+				Display: optional(values[2]),
+			})
+		}
+	}
+
+	if target.Source == nil && meta.Source != "" {
+		source, err := substitute(meta.Source)
+		if err != nil {
+			return fmt.Errorf("failed to substitute variables in meta source: %w", err)
+		}
+		target.Source = optional(source)
+	}
+	if target.LastUpdated == nil && meta.LastUpdated != "" {
+		lastUpdated, err := substitute(meta.LastUpdated)
+		if err != nil {
+			return fmt.Errorf("failed to substitute variables in meta lastUpdated: %w", err)
+		}
+		target.LastUpdated = optional(lastUpdated)
+	}
+	return nil
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag reports whether tags contains a tag with the given system and code
+func hasTag(tags []fhir.Coding, system, code string) bool {
+	for _, tag := range tags {
+		if tag.Code != nil && *tag.Code == code && (tag.System == nil && system == "" || tag.System != nil && *tag.System == system) {
+			return true
+		}
+	}
+	return false
+}
+
+// optional returns a pointer to s, or nil if s is empty
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
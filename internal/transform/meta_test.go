@@ -0,0 +1,144 @@
+package transform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"csv2fhir/internal/config"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestTransform_Meta tests stamping profiles, tags, source and lastUpdated
+func TestTransform_Meta(t *testing.T) {
+	cfg := &config.MappingConfig{
+		Resource: "Patient",
+		Mappings: map[string]string{
+			"meta.profile[0]": "http://example.org/StructureDefinition/local-patient",
+			"meta.source":     "${feed}",
+		},
+		Meta: config.MetaConfig{
+			Profile:     []string{"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient", "http://example.org/StructureDefinition/local-patient"},
+			Source:      "urn:feed:default",
+			Tag:         []config.CodingConfig{{System: "http://example.org/batch", Code: "batch-${batch}"}},
+			LastUpdated: "2026-01-02T03:04:05Z",
+		},
+	}
+
+	resource, err := NewTransformer(cfg).Transform(map[string]string{"feed": "urn:feed:ehr", "batch": "7"}, 2)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	meta := resource.(*fhir.Patient).Meta
+	if meta == nil {
+		t.Fatal("Expected meta to be set")
+	}
+	if len(meta.Profile) != 2 || meta.Profile[1] != "http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient" {
+		t.Errorf("Expected the mapped profile and US Core once each, got %v", meta.Profile)
+	}
+	if *meta.Source != "urn:feed:ehr" {
+		t.Errorf("Expected the mapped source to win, got %s", *meta.Source)
+	}
+	if len(meta.Tag) != 1 || *meta.Tag[0].Code != "batch-7" || *meta.Tag[0].System != "http://example.org/batch" {
+		t.Errorf("Unexpected tags: %+v", meta.Tag)
+	}
+	if *meta.LastUpdated != "2026-01-02T03:04:05Z" {
+		t.Errorf("Unexpected lastUpdated: %s", *meta.LastUpdated)
+	}
+}
+
+// TestTransform_MetaMissingColumn tests that meta variables must resolve
+func TestTransform_MetaMissingColumn(t *testing.T) {
+	cfg := &config.MappingConfig{
+		Resource: "Patient",
+		Mappings: map[string]string{},
+		Meta:     config.MetaConfig{Source: "${feed}"},
+	}
+	if _, err := NewTransformer(cfg).Transform(map[string]string{}, 2); err == nil {
+		t.Error("Expected error for missing meta column")
+	}
+}
+
+// TestTransform_BinaryMeta tests that Binary resources get the run's source
+// and tags but not the profiles of the mapped resource
+func TestTransform_BinaryMeta(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "scan.pdf"), []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	profile := "http://example.org/StructureDefinition/local-document"
+	cfg := &config.MappingConfig{
+		Resource: "DocumentReference",
+		IDColumn: "id",
+		Mappings: map[string]string{"status": "current"},
+		Attachments: []config.AttachmentConfig{
+			{Path: "content[0].attachment", File: "${file}", Binary: true},
+		},
+		Meta: config.MetaConfig{
+			Profile: []string{profile},
+			Source:  "urn:feed:ehr",
+			Tag:     []config.CodingConfig{{System: "http://example.org/batch", Code: "7"}},
+		},
+	}
+	transformer := NewTransformer(cfg)
+	transformer.SetAttachmentOptions(dir, 0)
+
+	resource, binaries, err := transformer.TransformRow(map[string]string{"id": "D1", "file": "scan.pdf"}, 2)
+	if err != nil {
+		t.Fatalf("TransformRow failed: %v", err)
+	}
+	if meta := resource.(*fhir.DocumentReference).Meta; meta == nil || len(meta.Profile) != 1 || meta.Profile[0] != profile {
+		t.Errorf("Expected the DocumentReference profile, got %+v", meta)
+	}
+	meta := binaries[0].(*fhir.Binary).Meta
+	if meta == nil || len(meta.Profile) != 0 {
+		t.Fatalf("Expected a Binary meta without profiles, got %+v", meta)
+	}
+	if *meta.Source != "urn:feed:ehr" || len(meta.Tag) != 1 || *meta.Tag[0].Code != "7" {
+		t.Errorf("Expected the run's source and tag on the Binary, got %+v", meta)
+	}
+
+	// Profiles alone leave the Binary without meta
+	cfg.Meta = config.MetaConfig{Profile: []string{profile}}
+	transformer = NewTransformer(cfg)
+	transformer.SetAttachmentOptions(dir, 0)
+	_, binaries, err = transformer.TransformRow(map[string]string{"id": "D1", "file": "scan.pdf"}, 2)
+	if err != nil {
+		t.Fatalf("TransformRow failed: %v", err)
+	}
+	if meta := binaries[0].(*fhir.Binary).Meta; meta != nil {
+		t.Errorf("Expected no Binary meta, got %+v", meta)
+	}
+}
+
+// TestStampMeta tests stamping a resource of no row, e.g. a Provenance
+func TestStampMeta(t *testing.T) {
+	cfg := &config.MappingConfig{
+		Resource: "Patient",
+		Mappings: map[string]string{},
+		Meta: config.MetaConfig{
+			Profile: []string{"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient"},
+			Source:  "urn:feed:ehr",
+			Tag: []config.CodingConfig{
+				{System: "http://example.org/run", Code: "nightly"},
+				{System: "http://example.org/batch", Code: "batch-${batch}"},
+			},
+		},
+	}
+
+	provenance := &fhir.Provenance{}
+	if err := NewTransformer(cfg).StampMeta(provenance); err != nil {
+		t.Fatalf("StampMeta failed: %v", err)
+	}
+	meta := provenance.Meta
+	if meta == nil || meta.Source == nil || *meta.Source != "urn:feed:ehr" {
+		t.Fatalf("Expected the source to be stamped, got %+v", meta)
+	}
+	if len(meta.Profile) != 0 {
+		t.Errorf("Expected no profiles of the mapped type, got %v", meta.Profile)
+	}
+	if len(meta.Tag) != 1 || *meta.Tag[0].Code != "nightly" {
+		t.Errorf("Expected only the tag without row variables, got %+v", meta.Tag)
+	}
+}
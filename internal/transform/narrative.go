@@ -0,0 +1,303 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// defaultNarratives are the built-in narrative templates used when the
+// mapping has none
+var defaultNarratives = map[string]string{
+	"Patient": `<p><b>{{humanName (first .Resource.name)}}</b>` +
+		`{{with .Resource.gender}} ({{.}}){{end}}</p>` +
+		`{{with .Resource.birthDate}}<p>Born {{.}}</p>{{end}}` +
+		`{{range .Resource.identifier}}<p>Identifier {{.value}}{{with .system}} ({{.}}){{end}}</p>{{end}}`,
+	"Observation": `<p><b>{{concept .Resource.code}}</b>` +
+		`{{with .Resource.valueQuantity}}: {{quantity .}}{{end}}` +
+		`{{with .Resource.valueCodeableConcept}}: {{concept .}}{{end}}` +
+		`{{with .Resource.valueString}}: {{.}}{{end}}</p>` +
+		`<p>Status: {{.Resource.status}}{{with .Resource.effectiveDateTime}}, effective {{.}}{{end}}</p>` +
+		`{{with .Resource.subject}}<p>Subject: {{.reference}}</p>{{end}}`,
+	"Condition": `<p><b>{{concept .Resource.code}}</b></p>` +
+		`{{with .Resource.clinicalStatus}}<p>Clinical status: {{concept .}}</p>{{end}}` +
+		`{{with .Resource.onsetDateTime}}<p>Onset {{.}}</p>{{end}}` +
+		`{{with .Resource.subject}}<p>Subject: {{.reference}}</p>{{end}}`,
+}
+
+// narrativeFuncs are the functions available to narrative templates
+var narrativeFuncs = template.FuncMap{
+	// first returns the first element of a list, or nil
+	"first": func(list interface{}) interface{} {
+		if values, ok := list.([]interface{}); ok && len(values) > 0 {
+			return values[0]
+		}
+		return nil
+	},
+	// join joins the elements of a list with a separator
+	"join": func(list interface{}, sep string) string {
+		values, _ := list.([]interface{})
+		parts := make([]string, len(values))
+		for i, value := range values {
+			parts[i] = fmt.Sprint(value)
+		}
+		return strings.Join(parts, sep)
+	},
+	// concept returns the text of a CodeableConcept, or its first coding's
+	// display or code
+	"concept": func(value interface{}) string {
+		concept, _ := value.(map[string]interface{})
+		if text, ok := concept["text"].(string); ok {
+			return text
+		}
+		codings, _ := concept["coding"].([]interface{})
+		for _, c := range codings {
+			coding, _ := c.(map[string]interface{})
+			if display, ok := coding["display"].(string); ok {
+				return display
+			}
+			if code, ok := coding["code"].(string); ok {
+				return code
+			}
+		}
+		return ""
+	},
+	// humanName returns the text of a HumanName, or its given names and family
+	"humanName": func(value interface{}) string {
+		name, _ := value.(map[string]interface{})
+		if text, ok := name["text"].(string); ok {
+			return text
+		}
+		var parts []string
+		given, _ := name["given"].([]interface{})
+		for _, g := range given {
+			parts = append(parts, fmt.Sprint(g))
+		}
+		if family, ok := name["family"].(string); ok {
+			parts = append(parts, family)
+		}
+		return strings.Join(parts, " ")
+	},
+	// quantity formats a Quantity as "value unit"
+	"quantity": func(value interface{}) string {
+		quantity, _ := value.(map[string]interface{})
+		text := fmt.Sprint(quantity["value"])
+		if quantity["value"] == nil {
+			text = ""
+		}
+		if unit, ok := quantity["unit"].(string); ok {
+			text = strings.TrimSpace(text + " " + unit)
+		}
+		return text
+	},
+}
+
+// narrativeData is what narrative templates render against: the built
+// resource as JSON elements, e.g. .Resource.code.text, and the CSV row
+type narrativeData struct {
+	Resource map[string]interface{}
+	Row      map[string]string
+}
+
+// SetNarrative enables narrative generation from a Go template. Values are
+// HTML-escaped and the rendered markup is sanitized into XHTML. An empty
+// template selects the built-in narrative of the resource type.
+func (t *Transformer) SetNarrative(text string) error {
+	if text == "" {
+		resourceType, ok := GetResourceType(t.config.Resource)
+		if !ok {
+			return fmt.Errorf("unsupported resource type: %s", t.config.Resource)
+		}
+		if text, ok = defaultNarratives[resourceType.Name()]; !ok {
+			return fmt.Errorf("no built-in narrative for %s; add a narrative template to the mapping", resourceType.Name())
+		}
+	}
+
+	tmpl, err := template.New("narrative").Funcs(narrativeFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse narrative template: %w", err)
+	}
+	t.narrative = tmpl
+	return nil
+}
+
+// applyNarrative renders the narrative of a resource into its text element,
+// unless the mapping already set one
+func (t *Transformer) applyNarrative(resource interface{}, row map[string]string) error {
+	if t.narrative == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(resource)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	field := v.FieldByName("Text")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(&fhir.Narrative{}) {
+		return fmt.Errorf("resource has no Text field")
+	}
+	if !field.IsNil() {
+		return nil
+	}
+
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return fmt.Errorf("failed to marshal resource for narrative: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var elements map[string]interface{}
+	if err := decoder.Decode(&elements); err != nil {
+		return fmt.Errorf("failed to read resource for narrative: %w", err)
+	}
+
+	var rendered bytes.Buffer
+	if err := t.narrative.Execute(&rendered, narrativeData{Resource: elements, Row: row}); err != nil {
+		return fmt.Errorf("failed to render narrative: %w", err)
+	}
+	div, err := sanitizeXHTML(rendered.String())
+	if err != nil {
+		return err
+	}
+	if div == "" {
+		return nil // A narrative must have content
+	}
+
+	field.Set(reflect.ValueOf(&fhir.Narrative{Status: fhir.NarrativeStatusGenerated, Div: div}))
+	return nil
+}
+
+// xhtmlNamespace is the namespace of narrative divs
+const xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+
+// allowedElements are the XHTML elements FHIR permits in narratives
+var allowedElements = map[string]bool{
+	"a": true, "abbr": true, "acronym": true, "b": true, "big": true, "blockquote": true, "br": true,
+	"caption": true, "cite": true, "code": true, "col": true, "colgroup": true, "dd": true, "dfn": true,
+	"div": true, "dl": true, "dt": true, "em": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "hr": true, "i": true, "img": true, "li": true, "ol": true, "p": true,
+	"pre": true, "q": true, "samp": true, "small": true, "span": true, "strong": true, "sub": true,
+	"sup": true, "table": true, "tbody": true, "td": true, "tfoot": true, "th": true, "thead": true,
+	"tr": true, "tt": true, "ul": true, "var": true,
+}
+
+// voidElements have no content and are written self-closed
+var voidElements = map[string]bool{"br": true, "hr": true, "img": true, "col": true}
+
+// droppedElements are removed together with their content
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true, "form": true,
+	"head": true, "title": true, "base": true, "link": true, "meta": true,
+}
+
+// allowedAttributes are the attributes kept on narrative elements
+var allowedAttributes = map[string]bool{
+	"id": true, "class": true, "style": true, "title": true, "lang": true, "dir": true,
+	"href": true, "name": true, "src": true, "alt": true, "width": true, "height": true,
+	"colspan": true, "rowspan": true, "span": true, "align": true, "valign": true, "border": true,
+	"cellpadding": true, "cellspacing": true, "summary": true, "scope": true, "abbr": true,
+	"start": true, "type": true, "value": true,
+}
+
+// sanitizeXHTML converts rendered HTML into a narrative div: markup outside
+// the FHIR narrative subset is removed, script links are dropped and the
+// result is well-formed XHTML. It returns "" if nothing but whitespace is left.
+func sanitizeXHTML(html string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader("<div>" + html + "</div>"))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var out bytes.Buffer
+	var open []string // Elements written and not yet closed
+	dropDepth := 0    // Depth inside a dropped element
+	depth := 0
+	hasText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("narrative is not valid XHTML: %w", err)
+		}
+
+		switch tok := token.(type) {
+		case xml.StartElement:
+			depth++
+			name := strings.ToLower(tok.Name.Local)
+			if dropDepth > 0 || droppedElements[name] {
+				dropDepth++
+				continue
+			}
+			if depth == 1 {
+				continue // The wrapper div is written below
+			}
+			if !allowedElements[name] {
+				open = append(open, "")
+				continue
+			}
+			out.WriteString("<" + name)
+			for _, attr := range tok.Attr {
+				attrName := strings.ToLower(attr.Name.Local)
+				if !allowedAttributes[attrName] || attr.Name.Space != "" && attr.Name.Space != "xml" {
+					continue
+				}
+				if (attrName == "href" || attrName == "src") && unsafeURL(attr.Value) {
+					continue
+				}
+				out.WriteString(" " + attrName + `="` + xhtmlEscaper.Replace(attr.Value) + `"`)
+			}
+			if voidElements[name] {
+				out.WriteString("/>")
+				open = append(open, "")
+				continue
+			}
+			out.WriteString(">")
+			open = append(open, name)
+		case xml.EndElement:
+			depth--
+			if dropDepth > 0 {
+				dropDepth--
+				continue
+			}
+			if depth == 0 {
+				continue
+			}
+			name := open[len(open)-1]
+			open = open[:len(open)-1]
+			if name != "" {
+				out.WriteString("</" + name + ">")
+			}
+		case xml.CharData:
+			if dropDepth > 0 {
+				continue
+			}
+			if strings.TrimSpace(string(tok)) != "" {
+				hasText = true
+			}
+			out.WriteString(xhtmlEscaper.Replace(string(tok)))
+		}
+	}
+
+	if !hasText && !strings.Contains(out.String(), "<img") {
+		return "", nil
+	}
+	return `<div xmlns="` + xhtmlNamespace + `">` + strings.TrimSpace(out.String()) + "</div>", nil
+}
+
+// xhtmlEscaper escapes text and attribute values, keeping line breaks
+var xhtmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// unsafeURL reports whether a link would run script or embed content
+func unsafeURL(value string) bool {
+	scheme := strings.ToLower(strings.TrimSpace(value))
+	return strings.HasPrefix(scheme, "javascript:") || strings.HasPrefix(scheme, "vbscript:") || strings.HasPrefix(scheme, "data:")
+}
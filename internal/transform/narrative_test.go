@@ -0,0 +1,118 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+
+	"csv2fhir/internal/config"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestTransform_NarrativeTemplate tests rendering a mapping template
+func TestTransform_NarrativeTemplate(t *testing.T) {
+	cfg := &config.MappingConfig{
+		Resource: "Observation",
+		Mappings: map[string]string{
+			"status":              "final",
+			"code.text":           "${test}",
+			"valueQuantity.value": "${value}",
+			"valueQuantity.unit":  "mg/dL",
+		},
+	}
+	transformer := NewTransformer(cfg)
+	err := transformer.SetNarrative(`<p>{{concept .Resource.code}} = {{quantity .Resource.valueQuantity}}</p><p>{{.Row.comment}}{{.Resource.missing}}</p>`)
+	if err != nil {
+		t.Fatalf("SetNarrative failed: %v", err)
+	}
+
+	row := map[string]string{"test": "Glucose", "value": "95", "comment": `<script>alert(1)</script>fasting & "calm"`}
+	resource, err := transformer.Transform(row, 2)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	text := resource.(*fhir.Observation).Text
+	if text == nil || text.Status != fhir.NarrativeStatusGenerated {
+		t.Fatalf("Expected a generated narrative, got %+v", text)
+	}
+	want := `<div xmlns="http://www.w3.org/1999/xhtml"><p>Glucose = 95 mg/dL</p><p>&lt;script&gt;alert(1)&lt;/script&gt;fasting &amp; &quot;calm&quot;</p></div>`
+	if text.Div != want {
+		t.Errorf("Unexpected div:\n got  %s\n want %s", text.Div, want)
+	}
+}
+
+// TestTransform_NarrativeDefault tests the built-in narratives
+func TestTransform_NarrativeDefault(t *testing.T) {
+	cfg := &config.MappingConfig{
+		Resource: "patient",
+		Mappings: map[string]string{
+			"name[0].family":      "${last}",
+			"name[0].given[0]":    "${first}",
+			"gender":              "female",
+			"identifier[0].value": "${mrn}",
+		},
+	}
+	transformer := NewTransformer(cfg)
+	if err := transformer.SetNarrative(""); err != nil {
+		t.Fatalf("SetNarrative failed: %v", err)
+	}
+	resource, err := transformer.Transform(map[string]string{"first": "Ada", "last": "Lovelace", "mrn": "M1"}, 2)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	div := resource.(*fhir.Patient).Text.Div
+	for _, part := range []string{"<b>Ada Lovelace</b> (female)", "Identifier M1"} {
+		if !strings.Contains(div, part) {
+			t.Errorf("Expected %q in %s", part, div)
+		}
+	}
+
+	if err := NewTransformer(&config.MappingConfig{Resource: "Encounter"}).SetNarrative(""); err == nil {
+		t.Error("Expected error for a type without a built-in narrative")
+	}
+}
+
+// TestTransform_NarrativeKeepsMappedText tests that mapped text is kept
+func TestTransform_NarrativeKeepsMappedText(t *testing.T) {
+	cfg := &config.MappingConfig{
+		Resource: "Condition",
+		Mappings: map[string]string{
+			"text.status": "additional",
+			"text.div":    `<div xmlns="http://www.w3.org/1999/xhtml">Mapped</div>`,
+		},
+	}
+	transformer := NewTransformer(cfg)
+	transformer.SetNarrative("")
+	resource, err := transformer.Transform(map[string]string{}, 2)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	if text := resource.(*fhir.Condition).Text; text.Status != fhir.NarrativeStatusAdditional {
+		t.Errorf("Expected the mapped text to be kept, got %+v", text)
+	}
+}
+
+// TestSanitizeXHTML tests removing markup outside the narrative subset
+func TestSanitizeXHTML(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"plain", `<div xmlns="http://www.w3.org/1999/xhtml">plain</div>`},
+		{"<p>a<br>b</p>", `<div xmlns="http://www.w3.org/1999/xhtml"><p>a<br/>b</p></div>`},
+		{`<p onclick="x()" class="c">a</p><script>bad()</script>`, `<div xmlns="http://www.w3.org/1999/xhtml"><p class="c">a</p></div>`},
+		{`<a href="javascript:bad()">x</a><a href="http://ok">y</a>`, `<div xmlns="http://www.w3.org/1999/xhtml"><a>x</a><a href="http://ok">y</a></div>`},
+		{`<font color="red"><b>x</b></font> &nbsp;`, `<div xmlns="http://www.w3.org/1999/xhtml"><b>x</b></div>`},
+		{"  <p> </p>", ""},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeXHTML(tt.input)
+		if err != nil {
+			t.Errorf("sanitizeXHTML(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("sanitizeXHTML(%q):\n got  %s\n want %s", tt.input, got, tt.want)
+		}
+	}
+}
@@ -44,6 +44,10 @@ var ResourceRegistry = map[string]reflect.Type{
 	"ImagingStudy":     reflect.TypeOf(fhir.ImagingStudy{}),
 	"Media":            reflect.TypeOf(fhir.Media{}),
 
+	// Documents
+	"DocumentReference": reflect.TypeOf(fhir.DocumentReference{}),
+	"Binary":            reflect.TypeOf(fhir.Binary{}),
+
 	// Financial
 	"Claim":            reflect.TypeOf(fhir.Claim{}),
 	"ClaimResponse":    reflect.TypeOf(fhir.ClaimResponse{}),
@@ -3,6 +3,7 @@ package transform
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"reflect"
 	"strconv"
 	"strings"
@@ -15,6 +16,10 @@ import (
 type Transformer struct {
 	config    *config.MappingConfig
 	validator validation.Validator
+	narrative *template.Template // Optional, see SetNarrative
+
+	attachmentDir     string
+	attachmentMaxSize int64
 }
 
 // NewTransformer creates a new transformer with the given mapping config
@@ -33,12 +38,20 @@ func NewTransformerWithValidator(cfg *config.MappingConfig, validator validation
 	}
 }
 
-// Transform converts a CSV row to a FHIR resource
+// Transform converts a CSV row to a FHIR resource. Mappings with binary
+// attachments need TransformRow, which also returns the Binary resources.
 func (t *Transformer) Transform(row map[string]string, rowNumber int) (interface{}, error) {
+	resource, _, err := t.TransformRow(row, rowNumber)
+	return resource, err
+}
+
+// TransformRow converts a CSV row to a FHIR resource and the Binary resources
+// holding the files of its binary attachments
+func (t *Transformer) TransformRow(row map[string]string, rowNumber int) (interface{}, []interface{}, error) {
 	// Create the appropriate FHIR resource based on config
 	resource, err := t.createResource()
 	if err != nil {
-		return nil, fmt.Errorf("row %d: failed to create resource: %w", rowNumber, err)
+		return nil, nil, fmt.Errorf("row %d: failed to create resource: %w", rowNumber, err)
 	}
 
 	// Apply defaults first
@@ -48,11 +61,11 @@ func (t *Transformer) Transform(row map[string]string, rowNumber int) (interface
 			// For defaults, log warning but continue (defaults might be literal values)
 			// Only warn if the original value contained variables
 			if strings.Contains(value, "${") {
-				return nil, fmt.Errorf("row %d: failed to substitute variables in default %s: %w", rowNumber, path, err)
+				return nil, nil, fmt.Errorf("row %d: failed to substitute variables in default %s: %w", rowNumber, path, err)
 			}
 		}
 		if err := t.setFieldValue(resource, path, substituted); err != nil {
-			return nil, fmt.Errorf("row %d: failed to set default %s: %w", rowNumber, path, err)
+			return nil, nil, fmt.Errorf("row %d: failed to set default %s: %w", rowNumber, path, err)
 		}
 	}
 
@@ -60,14 +73,14 @@ func (t *Transformer) Transform(row map[string]string, rowNumber int) (interface
 	for path, value := range t.config.Mappings {
 		substituted, err := config.SubstituteVariables(value, row)
 		if err != nil {
-			return nil, fmt.Errorf("row %d: failed to substitute variables in mapping %s: %w", rowNumber, path, err)
+			return nil, nil, fmt.Errorf("row %d: failed to substitute variables in mapping %s: %w", rowNumber, path, err)
 		}
 		// Skip empty values
 		if substituted == "" {
 			continue
 		}
 		if err := t.setFieldValue(resource, path, substituted); err != nil {
-			return nil, fmt.Errorf("row %d: failed to set mapping %s: %w", rowNumber, path, err)
+			return nil, nil, fmt.Errorf("row %d: failed to set mapping %s: %w", rowNumber, path, err)
 		}
 	}
 
@@ -75,12 +88,28 @@ func (t *Transformer) Transform(row map[string]string, rowNumber int) (interface
 	if t.config.IDColumn != "" {
 		if id, ok := row[t.config.IDColumn]; ok && id != "" {
 			if err := t.setResourceID(resource, id); err != nil {
-				return nil, fmt.Errorf("row %d: failed to set resource ID: %w", rowNumber, err)
+				return nil, nil, fmt.Errorf("row %d: failed to set resource ID: %w", rowNumber, err)
 			}
 		}
 	}
 
-	return resource, nil
+	binaries, err := t.applyAttachments(resource, row)
+	if err != nil {
+		return nil, nil, fmt.Errorf("row %d: %w", rowNumber, err)
+	}
+	for _, binary := range binaries {
+		if err := t.applyMeta(binary, row, false); err != nil {
+			return nil, nil, fmt.Errorf("row %d: %w", rowNumber, err)
+		}
+	}
+	if err := t.applyMeta(resource, row, true); err != nil {
+		return nil, nil, fmt.Errorf("row %d: %w", rowNumber, err)
+	}
+	if err := t.applyNarrative(resource, row); err != nil {
+		return nil, nil, fmt.Errorf("row %d: %w", rowNumber, err)
+	}
+
+	return resource, binaries, nil
 }
 
 // TransformWithValidation converts a CSV row to a FHIR resource and validates it
@@ -91,13 +120,15 @@ func (t *Transformer) TransformWithValidation(row map[string]string, rowNumber i
 		return nil, nil, err
 	}
 
-	// Validate if validator is set
-	var validationErrors []validation.ValidationError
-	if t.validator != nil {
-		validationErrors = t.validator.Validate(resource)
-	}
+	return resource, t.Validate(resource), nil
+}
 
-	return resource, validationErrors, nil
+// Validate checks a resource with the validator, if one is set
+func (t *Transformer) Validate(resource interface{}) []validation.ValidationError {
+	if t.validator == nil {
+		return nil
+	}
+	return t.validator.Validate(resource)
 }
 
 // createResource creates a new FHIR resource of the configured type
@@ -0,0 +1,34 @@
+package uuid
+
+import (
+	"testing"
+)
+
+// TestNameBased tests that name-based UUIDs are stable and well-formed
+func TestNameBased(t *testing.T) {
+	a := NameBased("Patient/1")
+	if a != NameBased("Patient/1") {
+		t.Error("Expected the same UUID for the same name")
+	}
+	if a == NameBased("Patient/2") {
+		t.Error("Expected different UUIDs for different names")
+	}
+	if len(a) != 36 || a[14] != '5' {
+		t.Errorf("Expected a version 5 UUID, got %s", a)
+	}
+}
+
+// TestNew tests that random UUIDs are unique and well-formed
+func TestNew(t *testing.T) {
+	a, err := New()
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	b, _ := New()
+	if a == b {
+		t.Error("Expected different random UUIDs")
+	}
+	if len(a) != 36 || a[14] != '4' {
+		t.Errorf("Expected a version 4 UUID, got %s", a)
+	}
+}
@@ -0,0 +1,96 @@
+package validation
+
+import "fmt"
+
+// BindingValidator checks that coded elements use codes of the ValueSets
+// they are bound to in a resource's profiles, or in the core definition of
+// its type. Codes outside a required binding are errors, outside an
+// extensible one warnings. Bindings to ValueSets that weren't loaded are not
+// checked.
+type BindingValidator struct {
+	profiles    *Profiles
+	terminology *Terminology
+}
+
+// NewBindingValidator creates a validator taking bindings from the profiles
+// and codes from the terminology
+func NewBindingValidator(profiles *Profiles, terminology *Terminology) *BindingValidator {
+	return &BindingValidator{profiles: profiles, terminology: terminology}
+}
+
+// Validate checks the codes of a resource. Unusable profiles are left to
+// ProfileValidator to report.
+func (v *BindingValidator) Validate(resource interface{}) []ValidationError {
+	obj, profiles, _ := v.profiles.resolve(resource)
+	var errors []ValidationError
+	for _, p := range profiles {
+		c := &profileCheck{profiles: v.profiles, profile: p, terminology: v.terminology}
+		c.children(obj, p.root, "")
+		errors = append(errors, c.errors...)
+	}
+	return errors
+}
+
+// binding checks a value of type code, Coding or CodeableConcept against
+// the required or extensible binding of its element
+func (c *profileCheck) binding(it item, node *elementNode) {
+	binding := node.def.Binding
+	if binding == nil || binding.ValueSet == "" || (binding.Strength != "required" && binding.Strength != "extensible") {
+		return
+	}
+
+	var codings []map[string]interface{}
+	switch typ := node.typeOf(it); typ {
+	case "code":
+		code, _ := it.value.(string)
+		codings = append(codings, map[string]interface{}{"code": code})
+	case "Coding":
+		if coding, ok := it.value.(map[string]interface{}); ok {
+			codings = append(codings, coding)
+		}
+	case "CodeableConcept":
+		concept, _ := it.value.(map[string]interface{})
+		for _, coding := range asList(concept["coding"]) {
+			if coding, ok := coding.(map[string]interface{}); ok {
+				codings = append(codings, coding)
+			}
+		}
+	default:
+		return
+	}
+
+	var codes []string
+	for _, coding := range codings {
+		code, _ := coding["code"].(string)
+		if code == "" {
+			continue
+		}
+		system, _ := coding["system"].(string)
+		contains, known := c.terminology.Contains(binding.ValueSet, system, code)
+		if !known || contains {
+			return
+		}
+		if system != "" {
+			code = system + "|" + code
+		}
+		codes = append(codes, code)
+	}
+
+	// A CodeableConcept with only text meets an extensible binding
+	var message string
+	switch {
+	case len(codes) == 1:
+		message = fmt.Sprintf("Code %s is not in ValueSet %s", codes[0], binding.ValueSet)
+	case len(codes) > 1:
+		message = fmt.Sprintf("None of the codes %v is in ValueSet %s", codes, binding.ValueSet)
+	case binding.Strength == "required":
+		message = fmt.Sprintf("No code from ValueSet %s", binding.ValueSet)
+	default:
+		return
+	}
+	if binding.Strength == "required" {
+		c.fail("binding", it.field, "%s (required binding)", message)
+	} else {
+		c.warn("binding", it.field, "%s (extensible binding)", message)
+	}
+}
@@ -0,0 +1,112 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// boundProfile is an Observation profile binding its coded elements to the
+// ValueSets of testTerminology
+const boundProfile = `{
+  "resourceType": "StructureDefinition",
+  "url": "http://example.org/fhir/StructureDefinition/pet-observation",
+  "name": "PetObservation",
+  "kind": "resource",
+  "type": "Observation",
+  "snapshot": {
+    "element": [
+      {"id": "Observation", "path": "Observation", "min": 0, "max": "*"},
+      {"id": "Observation.meta", "path": "Observation.meta", "min": 0, "max": "1", "type": [{"code": "Meta"}]},
+      {
+        "id": "Observation.status", "path": "Observation.status", "min": 1, "max": "1", "type": [{"code": "code"}],
+        "binding": {"strength": "required", "valueSet": "urn:vs:status"}
+      },
+      {
+        "id": "Observation.category", "path": "Observation.category", "min": 0, "max": "*", "type": [{"code": "CodeableConcept"}],
+        "binding": {"strength": "extensible", "valueSet": "urn:vs:birds"}
+      },
+      {
+        "id": "Observation.code", "path": "Observation.code", "min": 1, "max": "1", "type": [{"code": "CodeableConcept"}],
+        "binding": {"strength": "required", "valueSet": "urn:vs:pets|1.0"}
+      },
+      {
+        "id": "Observation.value[x]", "path": "Observation.value[x]", "min": 0, "max": "1", "type": [{"code": "CodeableConcept"}, {"code": "string"}],
+        "binding": {"strength": "required", "valueSet": "urn:vs:unknown"}
+      },
+      {
+        "id": "Observation.method", "path": "Observation.method", "min": 0, "max": "1", "type": [{"code": "CodeableConcept"}],
+        "binding": {"strength": "example", "valueSet": "urn:vs:all"}
+      }
+    ]
+  }
+}`
+
+// statusValueSet lists the statuses the profile allows
+const statusValueSet = `{"resourceType": "ValueSet", "url": "urn:vs:status", "compose": {"include": [{
+  "system": "http://hl7.org/fhir/observation-status", "concept": [{"code": "final"}, {"code": "amended"}]
+}]}}`
+
+// TestBindingValidator tests required and extensible bindings
+func TestBindingValidator(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"profile.json": boundProfile, "terminology.json": testTerminology, "status.json": statusValueSet}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	profiles, err := LoadProfiles(dir)
+	if err != nil {
+		t.Fatalf("LoadProfiles failed: %v", err)
+	}
+	terminology, err := LoadTerminology(dir)
+	if err != nil {
+		t.Fatalf("LoadTerminology failed: %v", err)
+	}
+	validator := NewBindingValidator(profiles, terminology)
+
+	animal := func(code string) fhir.CodeableConcept {
+		return fhir.CodeableConcept{Coding: []fhir.Coding{{System: strPtr("urn:cs:animals"), Code: strPtr(code)}}}
+	}
+	observation := func() *fhir.Observation {
+		return &fhir.Observation{
+			Meta:                 &fhir.Meta{Profile: []string{"http://example.org/fhir/StructureDefinition/pet-observation"}},
+			Status:               fhir.ObservationStatusFinal,
+			Category:             []fhir.CodeableConcept{animal("parrot"), {Text: strPtr("pets")}},
+			Code:                 fhir.CodeableConcept{Coding: []fhir.Coding{{Code: strPtr("x")}, animal("dog").Coding[0]}},
+			ValueCodeableConcept: &fhir.CodeableConcept{Coding: []fhir.Coding{{Code: strPtr("anything")}}},
+			Method:               &fhir.CodeableConcept{Coding: []fhir.Coding{{Code: strPtr("anything")}}},
+		}
+	}
+	if errors := validator.Validate(observation()); len(errors) > 0 {
+		t.Errorf("Expected no errors, got %v", errors)
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(*fhir.Observation)
+		field    string
+		severity string
+		text     string
+	}{
+		{"required code", func(o *fhir.Observation) { o.Status = fhir.ObservationStatusPreliminary }, "status", "error", "Code preliminary is not in ValueSet urn:vs:status"},
+		{"required concept", func(o *fhir.Observation) { o.Code = animal("cat") }, "code", "error", "urn:cs:animals|cat"},
+		{"required concept without code", func(o *fhir.Observation) { o.Code = fhir.CodeableConcept{Text: strPtr("dog")} }, "code", "error", "No code from ValueSet"},
+		{"extensible", func(o *fhir.Observation) { o.Category[0] = animal("dog") }, "category[0]", "warning", "extensible binding"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := observation()
+			tt.modify(o)
+			errors := validator.Validate(o)
+			if len(errors) != 1 || errors[0].Field != tt.field || errors[0].Severity != tt.severity ||
+				!strings.Contains(errors[0].Message, tt.text) {
+				t.Errorf("Expected a %s %q on %s, got %v", tt.severity, tt.text, tt.field, errors)
+			}
+		})
+	}
+}
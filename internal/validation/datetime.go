@@ -49,7 +49,7 @@ func (v *DateTimeValidator) Validate(resource interface{}) []ValidationError {
 		}
 
 		if !isValidDateTime(strValue) {
-			errors = append(errors, CreateError(field, "Invalid ISO 8601 datetime format"))
+			errors = append(errors, CreateError(field, "Invalid ISO 8601 datetime format").withRule("datetime-format"))
 		}
 	}
 
@@ -0,0 +1,72 @@
+package validation
+
+import (
+	"strings"
+)
+
+// Override changes the severity of the issues it matches, or suppresses them
+type Override struct {
+	Rule         string // Rule id; any rule when empty
+	ResourceType string // Any resource type when empty
+	Field        string // The element or any of its children; any field when empty
+	Severity     string // "error", "warning" or "information"; empty suppresses the issues
+}
+
+// matches reports whether an override applies to an issue of a resource
+func (o Override) matches(err ValidationError, resourceType string) bool {
+	if o.Rule != "" && o.Rule != err.Rule {
+		return false
+	}
+	if o.ResourceType != "" && o.ResourceType != resourceType {
+		return false
+	}
+	return o.Field == "" || withinField(err.Field, o.Field)
+}
+
+// withinField reports whether field is element or one of its children,
+// including slices like category:Laboratory of category
+func withinField(field, element string) bool {
+	if !strings.HasPrefix(field, element) {
+		return false
+	}
+	rest := field[len(element):]
+	return rest == "" || rest[0] == '.' || rest[0] == '[' || rest[0] == ':'
+}
+
+// OverrideValidator applies overrides to the issues of a validator. The
+// last override matching an issue applies.
+type OverrideValidator struct {
+	validator Validator
+	overrides []Override
+}
+
+// NewOverrideValidator creates a validator adjusting the issues of another
+func NewOverrideValidator(validator Validator, overrides []Override) *OverrideValidator {
+	return &OverrideValidator{validator: validator, overrides: overrides}
+}
+
+// Validate validates a resource and applies the overrides to its issues
+func (v *OverrideValidator) Validate(resource interface{}) []ValidationError {
+	errors := v.validator.Validate(resource)
+	if len(errors) == 0 {
+		return errors
+	}
+
+	resourceType := getResourceType(resource)
+	kept := errors[:0]
+	for _, err := range errors {
+		suppressed := false
+		for _, override := range v.overrides {
+			if override.matches(err, resourceType) {
+				suppressed = override.Severity == ""
+				if !suppressed {
+					err.Severity = override.Severity
+				}
+			}
+		}
+		if !suppressed {
+			kept = append(kept, err)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,47 @@
+package validation
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// fixedValidator reports the same issues for every resource
+type fixedValidator []ValidationError
+
+func (v fixedValidator) Validate(resource interface{}) []ValidationError {
+	return append([]ValidationError(nil), v...)
+}
+
+// TestOverrideValidator tests severity changes and suppressions by rule, resource type and field
+func TestOverrideValidator(t *testing.T) {
+	issues := fixedValidator{
+		CreateError("effectiveDateTime", "Invalid ISO 8601 datetime format").withRule("datetime-format"),
+		CreateError("subject", "Required field is missing or empty").withRule("required-field"),
+		CreateError("category:Laboratory", "Required field is missing (profile Lab)").withRule("profile-min"),
+		CreateWarning("code.coding[0]", "Code is not in ValueSet (extensible binding)").withRule("binding"),
+		CreateError("valueQuantity.code", "Value is longer than 8 characters").withRule("profile-max-length"),
+	}
+	overrides := []Override{
+		{Rule: "datetime-format", Severity: "warning"},
+		{Rule: "required-field", ResourceType: "Patient", Severity: "information"},
+		{Field: "category", Severity: "warning"},
+		{Rule: "profile-min", Field: "category", Severity: "information"},
+		{Rule: "binding", Field: "code"},
+		{Rule: "profile-max-length", Field: "valueQuantity.co"},
+	}
+	validator := NewOverrideValidator(issues, overrides)
+
+	var severities []string
+	for _, err := range validator.Validate(&fhir.Observation{}) {
+		severities = append(severities, err.Rule+":"+err.Severity)
+	}
+	expected := []string{"datetime-format:warning", "required-field:error", "profile-min:information", "profile-max-length:error"}
+	if !reflect.DeepEqual(severities, expected) {
+		t.Errorf("Expected %v, got %v", expected, severities)
+	}
+	if !HasErrors(validator.Validate(&fhir.Patient{})) {
+		t.Error("Expected the unmatched profile-max-length error to remain")
+	}
+}
@@ -0,0 +1,575 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ProfileValidator validates resources against the snapshots of the profiles
+// in their meta.profile, or the core definition of their type when they
+// declare none and it was loaded. It checks cardinality, types, reference
+// targets, fixed and pattern values, maximum lengths and slicing.
+type ProfileValidator struct {
+	profiles *Profiles
+}
+
+// NewProfileValidator creates a validator using the given profiles
+func NewProfileValidator(profiles *Profiles) *ProfileValidator {
+	return &ProfileValidator{profiles: profiles}
+}
+
+// Validate checks a resource against its profiles
+func (v *ProfileValidator) Validate(resource interface{}) []ValidationError {
+	obj, profiles, errors := v.profiles.resolve(resource)
+	for _, p := range profiles {
+		c := &profileCheck{profiles: v.profiles, profile: p, constraints: true}
+		c.children(obj, p.root, "")
+		errors = append(errors, c.errors...)
+	}
+	return errors
+}
+
+// resolve decodes a resource and returns the profiles it is validated
+// against, with errors for declared profiles that can't be used
+func (p *Profiles) resolve(resource interface{}) (map[string]interface{}, []*profile, []ValidationError) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, nil, []ValidationError{CreateError("", fmt.Sprintf("Resource cannot be serialized: %v", err)).withRule("resource-encoding")}
+	}
+	value, err := decodeJSON(data)
+	if err != nil {
+		return nil, nil, []ValidationError{CreateError("", fmt.Sprintf("Resource cannot be parsed: %v", err)).withRule("resource-encoding")}
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, nil, nil
+	}
+	resourceType, _ := obj["resourceType"].(string)
+
+	var urls []string
+	if meta, ok := obj["meta"].(map[string]interface{}); ok {
+		for _, url := range asList(meta["profile"]) {
+			if url, ok := url.(string); ok {
+				urls = append(urls, url)
+			}
+		}
+	}
+	if len(urls) == 0 {
+		urls = []string{coreProfileBase + resourceType}
+		if !p.Has(urls[0]) {
+			return obj, nil, nil
+		}
+	}
+
+	var profiles []*profile
+	var errors []ValidationError
+	for _, url := range urls {
+		found := p.get(url)
+		switch {
+		case found == nil:
+			errors = append(errors, CreateError("meta.profile", fmt.Sprintf("Profile %s is not among the loaded StructureDefinitions", url)).withRule("profile-unknown"))
+		case found.resourceType != resourceType:
+			errors = append(errors, CreateError("meta.profile", fmt.Sprintf("Profile %s constrains %s, not %s", url, found.resourceType, resourceType)).withRule("profile-mismatch"))
+		default:
+			profiles = append(profiles, found)
+		}
+	}
+	return obj, profiles, errors
+}
+
+// profileCheck collects the errors of checking one resource against a
+// profile: its constraints, the bindings of its elements, or both
+type profileCheck struct {
+	profiles    *Profiles
+	profile     *profile
+	constraints bool         // Check cardinality, types, values and slicing
+	terminology *Terminology // Check bindings when set
+	errors      []ValidationError
+}
+
+// item is a value of an element with the path it is reported under
+type item struct {
+	field string // e.g. code.coding[0]
+	key   string // JSON key, e.g. valueQuantity for value[x]
+	value interface{}
+}
+
+// fail records an error of a rule naming the profile
+func (c *profileCheck) fail(rule, field, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...) + " (profile " + c.profile.name + ")"
+	c.errors = append(c.errors, CreateError(field, message).withRule(rule))
+}
+
+// warn records a warning of a rule naming the profile
+func (c *profileCheck) warn(rule, field, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...) + " (profile " + c.profile.name + ")"
+	c.errors = append(c.errors, CreateWarning(field, message).withRule(rule))
+}
+
+// children checks the child elements of an object
+func (c *profileCheck) children(obj map[string]interface{}, node *elementNode, path string) {
+	if node.ref != nil {
+		node = node.ref
+	}
+	for _, child := range node.children {
+		items := elementItems(obj, child, path)
+		field := joinField(path, child.name)
+		if base := strings.TrimSuffix(child.name, "[x]"); base != child.name && c.constraints {
+			for _, it := range items {
+				if typ := it.key[len(base):]; !child.allowsType(typ) {
+					c.fail("profile-type", it.field, "Type %s is not allowed", typ)
+				}
+			}
+		}
+		if c.constraints {
+			c.cardinality(child.def, field, len(items))
+		}
+		if len(child.slices) > 0 {
+			c.slices(child, items, field)
+			continue
+		}
+		for _, it := range items {
+			c.value(it, child)
+		}
+	}
+}
+
+// elementItems returns the values of an element in an object. Empty objects,
+// which the FHIR models write for some unset elements, are not values.
+func elementItems(obj map[string]interface{}, node *elementNode, path string) []item {
+	var keys []string
+	if base := strings.TrimSuffix(node.name, "[x]"); base != node.name {
+		for key := range obj {
+			if isChoiceKey(key, base) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	} else if _, ok := obj[node.name]; ok {
+		keys = []string{node.name}
+	}
+
+	var items []item
+	for _, key := range keys {
+		values, isList := obj[key].([]interface{})
+		if !isList {
+			values = []interface{}{obj[key]}
+		}
+		for i, value := range values {
+			if value == nil || isEmptyObject(value) {
+				continue
+			}
+			field := joinField(path, key)
+			if isList {
+				field = fmt.Sprintf("%s[%d]", field, i)
+			}
+			items = append(items, item{field: field, key: key, value: value})
+		}
+	}
+	return items
+}
+
+// cardinality checks the number of values of an element or slice
+func (c *profileCheck) cardinality(def *elementDefinition, field string, n int) {
+	switch max := def.maxCount(); {
+	case n < def.Min && n == 0:
+		c.fail("profile-min", field, "Required field is missing")
+	case n < def.Min:
+		c.fail("profile-min", field, "Expected at least %d values, found %d", def.Min, n)
+	case max == 0 && n > 0:
+		c.fail("profile-max", field, "Field is not allowed")
+	case max >= 0 && n > max:
+		c.fail("profile-max", field, "Expected at most %d values, found %d", max, n)
+	}
+}
+
+// value checks a single value of an element and its children
+func (c *profileCheck) value(it item, node *elementNode) {
+	if c.terminology != nil {
+		c.binding(it, node)
+	}
+	obj, isObject := it.value.(map[string]interface{})
+	if c.constraints {
+		c.constrain(it, node)
+	}
+	if isObject {
+		c.children(obj, node, it.field)
+	}
+}
+
+// constrain checks a value against the fixed value, pattern, maximum length
+// and types of its element
+func (c *profileCheck) constrain(it item, node *elementNode) {
+	def := node.def
+	if def.fixed != nil && !reflect.DeepEqual(it.value, def.fixed) {
+		c.fail("profile-fixed", it.field, "Value must be %s", compactJSON(def.fixed))
+	}
+	if def.pattern != nil && !matchesPattern(it.value, def.pattern) {
+		c.fail("profile-pattern", it.field, "Value must match %s", compactJSON(def.pattern))
+	}
+	if s, ok := it.value.(string); ok && def.MaxLength > 0 && utf8.RuneCountInString(s) > def.MaxLength {
+		c.fail("profile-max-length", it.field, "Value is longer than %d characters", def.MaxLength)
+	}
+
+	typ := node.typeOf(it)
+	obj, isObject := it.value.(map[string]interface{})
+	switch {
+	case typ == "":
+	case isPrimitiveType(typ) && (isObject || isList(it.value)):
+		c.fail("profile-type", it.field, "Expected a %s value", typ)
+	case !isPrimitiveType(typ) && !isObject:
+		c.fail("profile-type", it.field, "Expected a %s", typ)
+	case typ == "Reference":
+		c.reference(it.field, obj, node)
+	}
+}
+
+// referencePattern matches relative and absolute literal references,
+// capturing the resource type
+var referencePattern = regexp.MustCompile(`(?:^|/)([A-Z][A-Za-z]+)/[A-Za-z0-9\-.]{1,64}(?:/_history/[A-Za-z0-9\-.]{1,64})?$`)
+
+// reference checks that a literal reference points to a resource type the
+// element's target profiles allow
+func (c *profileCheck) reference(field string, obj map[string]interface{}, node *elementNode) {
+	var targets []string
+	for _, t := range node.def.Type {
+		for _, url := range t.TargetProfile {
+			target := strings.TrimPrefix(url, coreProfileBase)
+			if p := c.profiles.get(url); p != nil {
+				target = p.resourceType
+			}
+			if target == "Resource" || strings.Contains(target, "/") {
+				return // Any type, or an unknown profile
+			}
+			targets = append(targets, target)
+		}
+	}
+	ref, _ := obj["reference"].(string)
+	match := referencePattern.FindStringSubmatch(ref)
+	if len(targets) == 0 || match == nil {
+		return
+	}
+	for _, target := range targets {
+		if match[1] == target {
+			return
+		}
+	}
+	c.fail("profile-reference", field+".reference", "Must reference %s, not %s", strings.Join(targets, " or "), match[1])
+}
+
+// slices assigns the values of a sliced element to its slices, checking
+// each value against its slice and the number of values in each slice
+func (c *profileCheck) slices(node *elementNode, items []item, field string) {
+	slicing := node.def.Slicing
+	if slicing == nil {
+		// Type slices of choice elements, e.g. value[x]:valueQuantity
+		slicing = &elementSlicing{Discriminator: []discriminator{{Type: "type", Path: "$this"}}, Rules: "open"}
+	}
+	if !supportedSlicing(slicing) {
+		for _, it := range items {
+			c.value(it, node)
+		}
+		return
+	}
+
+	counts := make([]int, len(node.slices))
+	for _, it := range items {
+		matched := -1
+		for i, slice := range node.slices {
+			if c.matchesSlice(it, node, slice, slicing) {
+				matched = i
+				break
+			}
+		}
+		if matched < 0 {
+			if slicing.Rules == "closed" && c.constraints {
+				c.fail("profile-slicing", it.field, "Value matches no slice of %s, which is closed", field)
+			}
+			c.value(it, node)
+			continue
+		}
+		counts[matched]++
+		c.value(it, node.slices[matched])
+	}
+	if !c.constraints {
+		return
+	}
+	for i, slice := range node.slices {
+		c.cardinality(slice.def, field+":"+slice.def.SliceName, counts[i])
+	}
+}
+
+// supportedSlicing reports whether every discriminator can be evaluated:
+// value, pattern and exists discriminators on plain paths, and type
+// discriminators on the value itself
+func supportedSlicing(slicing *elementSlicing) bool {
+	if len(slicing.Discriminator) == 0 {
+		return false
+	}
+	for _, d := range slicing.Discriminator {
+		switch {
+		case strings.Contains(d.Path, "("):
+			return false
+		case d.Type == "value" || d.Type == "pattern" || d.Type == "exists":
+		case d.Type == "type" && d.Path == "$this":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchesSlice reports whether a value meets every discriminator of a slice
+func (c *profileCheck) matchesSlice(it item, base, slice *elementNode, slicing *elementSlicing) bool {
+	for _, d := range slicing.Discriminator {
+		segments := splitPath(d.Path)
+		switch d.Type {
+		case "value", "pattern":
+			expected := sliceValues(slice, segments)
+			if len(expected) == 0 {
+				return false
+			}
+			actual := navigate(it.value, segments)
+			for _, want := range expected {
+				found := false
+				for _, value := range actual {
+					if matchesPattern(value, want) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+		case "exists":
+			present := len(navigate(it.value, segments)) > 0
+			if element := descend(slice, segments); element != nil {
+				if element.def.Min > 0 && !present || element.def.maxCount() == 0 && present {
+					return false
+				}
+			}
+		case "type":
+			typ := base.typeOf(it)
+			if obj, ok := it.value.(map[string]interface{}); ok && typ == "Resource" {
+				typ, _ = obj["resourceType"].(string)
+			}
+			if !slice.allowsType(typ) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sliceValues returns the fixed or pattern values a slice requires at a
+// discriminator path. A pattern on an element above the path, e.g. a
+// patternCodeableConcept for coding.code, is followed into. The url of an
+// extension slice is its profile.
+func sliceValues(slice *elementNode, segments []string) []interface{} {
+	node := slice
+	for i, segment := range segments {
+		if required := node.required(); required != nil {
+			return navigate(required, segments[i:])
+		}
+		next := node.child(segment)
+		if next == nil {
+			if segment == "url" && i == len(segments)-1 {
+				var urls []interface{}
+				for _, t := range node.def.Type {
+					if t.Code == "Extension" && len(t.Profile) == 1 {
+						urls = append(urls, t.Profile[0])
+					}
+				}
+				return urls
+			}
+			return nil
+		}
+		node = next
+	}
+	if required := node.required(); required != nil {
+		return []interface{}{required}
+	}
+	return nil
+}
+
+// descend returns the element at a path below a node, or nil
+func descend(node *elementNode, segments []string) *elementNode {
+	for _, segment := range segments {
+		if node = node.child(segment); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// child returns the child element of a name, or nil
+func (n *elementNode) child(name string) *elementNode {
+	if n.ref != nil {
+		n = n.ref
+	}
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// required returns the fixed or pattern value of an element, or nil
+func (n *elementNode) required() interface{} {
+	if n.def.fixed != nil {
+		return n.def.fixed
+	}
+	return n.def.pattern
+}
+
+// allowsType reports whether an element allows a type, given as it appears
+// in choice keys, e.g. Quantity or DateTime
+func (n *elementNode) allowsType(typ string) bool {
+	for _, t := range n.def.Type {
+		if upperFirst(t.Code) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the type of a value of the element: the type in its choice
+// key, or the element's only type
+func (n *elementNode) typeOf(it item) string {
+	if base := strings.TrimSuffix(n.name, "[x]"); base != n.name {
+		return it.key[len(base):]
+	}
+	if len(n.def.Type) != 1 {
+		return ""
+	}
+	return n.def.Type[0].Code
+}
+
+// navigate returns the values at a path below a value, flattening lists
+func navigate(value interface{}, segments []string) []interface{} {
+	current := []interface{}{value}
+	for _, segment := range segments {
+		var next []interface{}
+		for _, v := range current {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if base := strings.TrimSuffix(segment, "[x]"); base != segment {
+				for key, child := range obj {
+					if isChoiceKey(key, base) {
+						next = append(next, asList(child)...)
+					}
+				}
+				continue
+			}
+			next = append(next, asList(obj[segment])...)
+		}
+		current = next
+	}
+	return current
+}
+
+// matchesPattern reports whether a value has at least the content of a
+// pattern: every element of a pattern object, and for each item of a pattern
+// list a matching item
+func matchesPattern(value, pattern interface{}) bool {
+	switch p := pattern.(type) {
+	case map[string]interface{}:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, want := range p {
+			if !matchesPattern(obj[key], want) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		values := asList(value)
+		for _, want := range p {
+			found := false
+			for _, v := range values {
+				if matchesPattern(v, want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(value, pattern)
+}
+
+// splitPath splits a discriminator path; $this is the value itself
+func splitPath(path string) []string {
+	if path == "" || path == "$this" {
+		return nil
+	}
+	return strings.Split(strings.TrimPrefix(path, "$this."), ".")
+}
+
+// asList returns a value as a list: its items, the value itself or nothing
+func asList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{value}
+}
+
+// isList reports whether a value is a JSON array
+func isList(value interface{}) bool {
+	_, ok := value.([]interface{})
+	return ok
+}
+
+// isEmptyObject reports whether a value is {}
+func isEmptyObject(value interface{}) bool {
+	obj, ok := value.(map[string]interface{})
+	return ok && len(obj) == 0
+}
+
+// isPrimitiveType reports whether a type code names a primitive type, like
+// string or the System.String of id elements
+func isPrimitiveType(code string) bool {
+	return strings.HasPrefix(code, "http://hl7.org/fhirpath/System.") || code != "" && code[0] >= 'a' && code[0] <= 'z'
+}
+
+// upperFirst capitalizes a type code as in choice keys
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// joinField appends an element name to a field path
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// compactJSON formats a fixed or pattern value for messages
+func compactJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
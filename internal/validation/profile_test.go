@@ -0,0 +1,249 @@
+package validation
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// vitalSignsProfile is an Observation profile with pattern, type and
+// fixed value constraints
+const vitalSignsProfile = `{
+  "resourceType": "StructureDefinition",
+  "url": "http://example.org/fhir/StructureDefinition/vital-signs-observation",
+  "name": "VitalSignsObservation",
+  "fhirVersion": "4.0.1",
+  "kind": "resource",
+  "type": "Observation",
+  "snapshot": {
+    "element": [
+      {"id": "Observation", "path": "Observation", "min": 0, "max": "*"},
+      {"id": "Observation.id", "path": "Observation.id", "min": 0, "max": "1", "type": [{"code": "http://hl7.org/fhirpath/System.String"}]},
+      {"id": "Observation.meta", "path": "Observation.meta", "min": 0, "max": "1", "type": [{"code": "Meta"}]},
+      {"id": "Observation.status", "path": "Observation.status", "min": 1, "max": "1", "type": [{"code": "code"}]},
+      {
+        "id": "Observation.category", "path": "Observation.category", "min": 1, "max": "*", "type": [{"code": "CodeableConcept"}],
+        "slicing": {"discriminator": [{"type": "pattern", "path": "$this"}], "rules": "open"}
+      },
+      {
+        "id": "Observation.category:VSCat", "path": "Observation.category", "sliceName": "VSCat", "min": 1, "max": "1", "type": [{"code": "CodeableConcept"}],
+        "patternCodeableConcept": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/observation-category", "code": "vital-signs"}]}
+      },
+      {
+        "id": "Observation.code", "path": "Observation.code", "min": 1, "max": "1", "type": [{"code": "CodeableConcept"}],
+        "patternCodeableConcept": {"coding": [{"system": "http://loinc.org"}]}
+      },
+      {
+        "id": "Observation.subject", "path": "Observation.subject", "min": 1, "max": "1",
+        "type": [{"code": "Reference", "targetProfile": ["http://hl7.org/fhir/StructureDefinition/Patient"]}]
+      },
+      {"id": "Observation.value[x]", "path": "Observation.value[x]", "min": 0, "max": "1", "type": [{"code": "Quantity"}, {"code": "string"}]},
+      {"id": "Observation.value[x]:valueQuantity", "path": "Observation.value[x]", "sliceName": "valueQuantity", "min": 0, "max": "1", "type": [{"code": "Quantity"}]},
+      {"id": "Observation.value[x]:valueQuantity.value", "path": "Observation.value[x].value", "min": 1, "max": "1", "type": [{"code": "decimal"}]},
+      {"id": "Observation.value[x]:valueQuantity.system", "path": "Observation.value[x].system", "min": 1, "max": "1", "type": [{"code": "uri"}], "fixedUri": "http://unitsofmeasure.org"},
+      {"id": "Observation.value[x]:valueQuantity.code", "path": "Observation.value[x].code", "min": 1, "max": "1", "type": [{"code": "code"}], "maxLength": 8},
+      {"id": "Observation.note", "path": "Observation.note", "min": 0, "max": "0", "type": [{"code": "Annotation"}]}
+    ]
+  }
+}`
+
+// profileBundle holds a Patient profile with extension and identifier slices
+// among definitions that are not resource profiles
+const profileBundle = `{
+  "resourceType": "Bundle",
+  "type": "collection",
+  "entry": [
+    {"resource": {"resourceType": "ValueSet", "url": "http://example.org/fhir/ValueSet/unused"}},
+    {"resource": {"resourceType": "StructureDefinition", "url": "http://example.org/fhir/StructureDefinition/type", "kind": "complex-type", "type": "Address"}},
+    {
+      "resource": {
+        "resourceType": "StructureDefinition",
+        "url": "http://example.org/fhir/StructureDefinition/raced-patient",
+        "name": "RacedPatient",
+        "kind": "resource",
+        "type": "Patient",
+        "snapshot": {
+          "element": [
+            {"id": "Patient", "path": "Patient", "min": 0, "max": "*"},
+            {"id": "Patient.meta", "path": "Patient.meta", "min": 0, "max": "1", "type": [{"code": "Meta"}]},
+            {
+              "id": "Patient.extension", "path": "Patient.extension", "min": 0, "max": "*", "type": [{"code": "Extension"}],
+              "slicing": {"discriminator": [{"type": "value", "path": "url"}], "rules": "open"}
+            },
+            {
+              "id": "Patient.extension:race", "path": "Patient.extension", "sliceName": "race", "min": 1, "max": "1",
+              "type": [{"code": "Extension", "profile": ["http://example.org/fhir/StructureDefinition/race"]}]
+            },
+            {
+              "id": "Patient.identifier", "path": "Patient.identifier", "min": 1, "max": "*", "type": [{"code": "Identifier"}],
+              "slicing": {"discriminator": [{"type": "value", "path": "system"}], "rules": "closed"}
+            },
+            {"id": "Patient.identifier:mrn", "path": "Patient.identifier", "sliceName": "mrn", "min": 1, "max": "1", "type": [{"code": "Identifier"}]},
+            {"id": "Patient.identifier:mrn.system", "path": "Patient.identifier.system", "min": 1, "max": "1", "type": [{"code": "uri"}], "fixedUri": "urn:mrn"},
+            {"id": "Patient.identifier:mrn.value", "path": "Patient.identifier.value", "min": 1, "max": "1", "type": [{"code": "string"}]}
+          ]
+        }
+      }
+    }
+  ]
+}`
+
+const (
+	vitalSignsURL   = "http://example.org/fhir/StructureDefinition/vital-signs-observation"
+	racedPatientURL = "http://example.org/fhir/StructureDefinition/raced-patient"
+)
+
+// loadTestProfiles writes the test profiles to a directory and loads them
+func loadTestProfiles(t *testing.T) *Profiles {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"vital-signs.json": vitalSignsProfile,
+		"ig/bundle.json":   profileBundle,
+		"ig/package.json":  `{"name": "example.profiles"}`,
+		"ig/README.md":     "not a definition",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	profiles, err := LoadProfiles(dir)
+	if err != nil {
+		t.Fatalf("LoadProfiles failed: %v", err)
+	}
+	return profiles
+}
+
+// vitalSign returns an Observation valid against the vital signs profile
+func vitalSign() *fhir.Observation {
+	value := json.Number("72")
+	return &fhir.Observation{
+		Meta:   &fhir.Meta{Profile: []string{vitalSignsURL}},
+		Status: fhir.ObservationStatusFinal,
+		Category: []fhir.CodeableConcept{{Coding: []fhir.Coding{{
+			System: strPtr("http://terminology.hl7.org/CodeSystem/observation-category"),
+			Code:   strPtr("vital-signs"),
+		}}}},
+		Code:    fhir.CodeableConcept{Coding: []fhir.Coding{{System: strPtr("http://loinc.org"), Code: strPtr("8867-4")}}},
+		Subject: &fhir.Reference{Reference: strPtr("Patient/PAT1")},
+		ValueQuantity: &fhir.Quantity{
+			Value:  &value,
+			System: strPtr("http://unitsofmeasure.org"),
+			Code:   strPtr("/min"),
+		},
+	}
+}
+
+// TestLoadProfiles tests loading definitions from files and bundles
+func TestLoadProfiles(t *testing.T) {
+	profiles := loadTestProfiles(t)
+	if profiles.Len() != 2 {
+		t.Errorf("Expected 2 resource profiles, got %d", profiles.Len())
+	}
+	if !profiles.Has(vitalSignsURL+"|1.0.0") || !profiles.Has(racedPatientURL) {
+		t.Error("Expected both profiles to be loaded")
+	}
+	if profiles.Has("http://example.org/fhir/StructureDefinition/type") {
+		t.Error("Expected data type definitions to be skipped")
+	}
+	if versions := profiles.FHIRVersions(); len(versions) != 1 || versions["4.0.1"] != vitalSignsURL {
+		t.Errorf("Expected the vital signs profile's fhirVersion, got %v", versions)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "sd.json"), []byte(`{"resourceType": "StructureDefinition", "url": "x", "kind": "resource"}`), 0644)
+	if _, err := LoadProfiles(dir); err == nil || !strings.Contains(err.Error(), "no snapshot") {
+		t.Errorf("Expected an error for a profile without snapshot, got %v", err)
+	}
+	if _, err := LoadProfiles(t.TempDir()); err == nil {
+		t.Error("Expected an error for a directory without profiles")
+	}
+}
+
+// TestProfileValidator tests the constraints of a profile
+func TestProfileValidator(t *testing.T) {
+	validator := NewProfileValidator(loadTestProfiles(t))
+
+	if errors := validator.Validate(vitalSign()); len(errors) > 0 {
+		t.Errorf("Expected no errors, got %v", errors)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*fhir.Observation)
+		field  string
+		text   string
+		rule   string
+	}{
+		{"missing element", func(o *fhir.Observation) { o.Subject = nil }, "subject", "Required field is missing", "profile-min"},
+		{"pattern", func(o *fhir.Observation) { o.Code.Coding[0].System = strPtr("http://snomed.info/sct") }, "code", "must match", "profile-pattern"},
+		{"missing slice", func(o *fhir.Observation) { o.Category[0].Coding[0].Code = strPtr("laboratory") }, "category:VSCat", "Required field is missing", "profile-min"},
+		{"too many in slice", func(o *fhir.Observation) { o.Category = append(o.Category, o.Category[0]) }, "category:VSCat", "at most 1", "profile-max"},
+		{"prohibited element", func(o *fhir.Observation) { o.Note = []fhir.Annotation{{Text: "n"}} }, "note", "not allowed", "profile-max"},
+		{"reference target", func(o *fhir.Observation) { o.Subject.Reference = strPtr("Group/G1") }, "subject.reference", "Must reference Patient, not Group", "profile-reference"},
+		{"choice type", func(o *fhir.Observation) { o.ValueBoolean = new(bool) }, "valueBoolean", "Type Boolean is not allowed", "profile-type"},
+		{"fixed value in type slice", func(o *fhir.Observation) { o.ValueQuantity.System = strPtr("urn:units") }, "valueQuantity.system", "Value must be", "profile-fixed"},
+		{"max length", func(o *fhir.Observation) { o.ValueQuantity.Code = strPtr("beats/minute") }, "valueQuantity.code", "longer than 8", "profile-max-length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observation := vitalSign()
+			tt.modify(observation)
+			errors := validator.Validate(observation)
+			for _, err := range errors {
+				if err.Field == tt.field && strings.Contains(err.Message, tt.text) && err.Rule == tt.rule && err.Code == BuiltinRules[tt.rule] {
+					return
+				}
+			}
+			t.Errorf("Expected %q (%s) on %s, got %v", tt.text, tt.rule, tt.field, errors)
+		})
+	}
+}
+
+// TestProfileValidator_Slicing tests value discriminators and closed slicing
+func TestProfileValidator_Slicing(t *testing.T) {
+	validator := NewProfileValidator(loadTestProfiles(t))
+	patient := &fhir.Patient{
+		Meta: &fhir.Meta{Profile: []string{racedPatientURL}},
+		Extension: []fhir.Extension{
+			{Url: "http://example.org/fhir/StructureDefinition/other"},
+			{Url: "http://example.org/fhir/StructureDefinition/race"},
+		},
+		Identifier: []fhir.Identifier{{System: strPtr("urn:mrn"), Value: strPtr("M1")}},
+	}
+	if errors := validator.Validate(patient); len(errors) > 0 {
+		t.Errorf("Expected no errors, got %v", errors)
+	}
+
+	patient.Extension = patient.Extension[:1]
+	patient.Identifier = append(patient.Identifier, fhir.Identifier{System: strPtr("urn:ssn"), Value: strPtr("1")})
+	errors := validator.Validate(patient)
+	if len(errors) != 2 || errors[0].Field != "extension:race" || errors[1].Field != "identifier[1]" ||
+		!strings.Contains(errors[1].Message, "closed") {
+		t.Errorf("Unexpected errors: %v", errors)
+	}
+}
+
+// TestProfileValidator_DeclaredProfiles tests which profiles apply
+func TestProfileValidator_DeclaredProfiles(t *testing.T) {
+	validator := NewProfileValidator(loadTestProfiles(t))
+
+	// No declared profile and no core definition loaded
+	if errors := validator.Validate(&fhir.Observation{}); len(errors) > 0 {
+		t.Errorf("Expected no errors without a profile, got %v", errors)
+	}
+
+	observation := vitalSign()
+	observation.Meta.Profile = []string{"http://example.org/fhir/StructureDefinition/unknown", racedPatientURL}
+	errors := validator.Validate(observation)
+	if len(errors) != 2 || !strings.Contains(errors[0].Message, "not among") || !strings.Contains(errors[1].Message, "constrains Patient") {
+		t.Errorf("Unexpected errors: %v", errors)
+	}
+}
@@ -49,7 +49,7 @@ func (v *ReferenceValidator) Validate(resource interface{}) []ValidationError {
 
 		if !isValidReference(refString) {
 			errors = append(errors, CreateError(field+".reference",
-				"Invalid reference format (expected 'ResourceType/id', '#id', or full URL)"))
+				"Invalid reference format (expected 'ResourceType/id', '#id', or full URL)").withRule("reference-format"))
 		}
 	}
 
@@ -0,0 +1,244 @@
+package validation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RuleSystem is the code system of rule ids in the details of issues
+const RuleSystem = "https://github.com/lemmack/csv2fhir/validation-rule"
+
+// ReportFormat selects how a Report writes validation issues
+type ReportFormat string
+
+const (
+	ReportOutcomes  ReportFormat = "outcome"   // An OperationOutcome per failing row, one per line
+	ReportAggregate ReportFormat = "aggregate" // One OperationOutcome holding every issue
+	ReportLines     ReportFormat = "jsonl"     // A JSON object per issue, one per line
+)
+
+// ParseReportFormat parses a report format name
+func ParseReportFormat(s string) (ReportFormat, error) {
+	switch format := ReportFormat(s); format {
+	case ReportOutcomes, ReportAggregate, ReportLines:
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported validation report format: %s (supported: outcome, aggregate, jsonl)", s)
+}
+
+// Report writes the validation issues of a run to a file. Issues name the
+// row and the CSV columns their element was mapped from. The file is
+// replaced atomically when the report is closed.
+type Report struct {
+	path         string
+	format       ReportFormat
+	resourceType string
+	columns      func(field string) []string // Source columns of an element
+	file         *os.File                    // Temporary file renamed to path
+	w            *bufio.Writer
+	issues       int
+}
+
+// outcome is an OperationOutcome resource
+type outcome struct {
+	ResourceType string         `json:"resourceType"`
+	Issue        []outcomeIssue `json:"issue"`
+}
+
+// outcomeIssue is an issue of an OperationOutcome
+type outcomeIssue struct {
+	Severity    string          `json:"severity"`
+	Code        string          `json:"code"`
+	Details     *outcomeDetails `json:"details,omitempty"`
+	Diagnostics string          `json:"diagnostics"`
+	Expression  []string        `json:"expression,omitempty"`
+}
+
+// outcomeDetails is the CodeableConcept of an issue's rule id
+type outcomeDetails struct {
+	Coding []outcomeCoding `json:"coding"`
+}
+
+// outcomeCoding is a Coding of a rule id
+type outcomeCoding struct {
+	System string `json:"system"`
+	Code   string `json:"code"`
+}
+
+// reportLine is an issue of a JSON-lines report
+type reportLine struct {
+	Row        int      `json:"row"`
+	Severity   string   `json:"severity"`
+	Code       string   `json:"code"`
+	Rule       string   `json:"rule,omitempty"`
+	Expression string   `json:"expression,omitempty"`
+	Columns    []string `json:"columns,omitempty"`
+	Message    string   `json:"message"`
+}
+
+// CreateReport creates a report of resources of a type; columns returns the
+// CSV columns an element is mapped from
+func CreateReport(path string, format ReportFormat, resourceType string, columns func(field string) []string) (*Report, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create validation report: %w", err)
+	}
+	r := &Report{path: path, format: format, resourceType: resourceType, columns: columns, file: file, w: bufio.NewWriter(file)}
+	if format == ReportAggregate {
+		r.w.WriteString(`{"resourceType":"OperationOutcome","issue":[`)
+	}
+	return r, nil
+}
+
+// Issues returns the number of issues written
+func (r *Report) Issues() int {
+	return r.issues
+}
+
+// Add writes the issues of a row
+func (r *Report) Add(rowNumber int, errors []ValidationError) error {
+	if len(errors) == 0 {
+		return nil
+	}
+	var lines [][]byte
+	switch r.format {
+	case ReportOutcomes:
+		oo := outcome{ResourceType: "OperationOutcome"}
+		for _, err := range errors {
+			oo.Issue = append(oo.Issue, r.issue(rowNumber, err))
+		}
+		data, err := encode(oo)
+		if err != nil {
+			return fmt.Errorf("failed to encode validation report: %w", err)
+		}
+		lines = append(lines, data)
+	case ReportAggregate:
+		for _, err := range errors {
+			data, err := encode(r.issue(rowNumber, err))
+			if err != nil {
+				return fmt.Errorf("failed to encode validation report: %w", err)
+			}
+			lines = append(lines, data)
+		}
+	case ReportLines:
+		for _, err := range errors {
+			line := reportLine{
+				Row:        rowNumber,
+				Severity:   err.Severity,
+				Code:       issueCode(err),
+				Rule:       err.Rule,
+				Expression: r.expression(err.Field),
+				Columns:    r.columns(err.Field),
+				Message:    err.Message,
+			}
+			data, err := encode(line)
+			if err != nil {
+				return fmt.Errorf("failed to encode validation report: %w", err)
+			}
+			lines = append(lines, data)
+		}
+	}
+
+	for i, line := range lines {
+		if r.format == ReportAggregate && (r.issues > 0 || i > 0) {
+			r.w.WriteByte(',')
+		}
+		r.w.Write(line)
+		if r.format != ReportAggregate {
+			r.w.WriteByte('\n')
+		}
+	}
+	r.issues += len(errors)
+	return nil
+}
+
+// issue builds the OperationOutcome issue of a validation error
+func (r *Report) issue(rowNumber int, err ValidationError) outcomeIssue {
+	issue := outcomeIssue{
+		Severity:    err.Severity,
+		Code:        issueCode(err),
+		Diagnostics: fmt.Sprintf("Row %d: %s", rowNumber, err.Message),
+	}
+	switch columns := r.columns(err.Field); len(columns) {
+	case 0:
+	case 1:
+		issue.Diagnostics = fmt.Sprintf("Row %d, column %s: %s", rowNumber, columns[0], err.Message)
+	default:
+		issue.Diagnostics = fmt.Sprintf("Row %d, columns %s: %s", rowNumber, strings.Join(columns, ", "), err.Message)
+	}
+	if err.Rule != "" {
+		issue.Details = &outcomeDetails{Coding: []outcomeCoding{{System: RuleSystem, Code: err.Rule}}}
+	}
+	if expression := r.expression(err.Field); expression != "" {
+		issue.Expression = []string{expression}
+	}
+	return issue
+}
+
+// expression returns the FHIR path of a field, starting at the resource type
+func (r *Report) expression(field string) string {
+	switch field {
+	case "":
+		return ""
+	case r.resourceType:
+		return field
+	}
+	return r.resourceType + "." + field
+}
+
+// encode encodes a value as JSON, leaving characters like < of messages and
+// expressions unescaped
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// issueCode returns the issue type of a validation error
+func issueCode(err ValidationError) string {
+	if err.Code == "" {
+		return "invalid"
+	}
+	return err.Code
+}
+
+// Close finishes the report and moves it into place
+func (r *Report) Close() error {
+	if r.format == ReportAggregate {
+		// An OperationOutcome needs an issue; none found is reported as one
+		if r.issues == 0 {
+			r.w.WriteString(`{"severity":"information","code":"informational","diagnostics":"No issues found"}`)
+		}
+		r.w.WriteString("]}\n")
+	}
+	err := r.w.Flush()
+	if err == nil {
+		err = r.file.Sync()
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(r.file.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(r.file.Name())
+		return fmt.Errorf("failed to write validation report: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the report; it does nothing after Close
+func (r *Report) Abort() {
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
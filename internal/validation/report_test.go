@@ -0,0 +1,98 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testColumns maps the fields of the test issues to CSV columns
+func testColumns(field string) []string {
+	return map[string][]string{
+		"status":              {"status"},
+		"valueQuantity":       {"result_value", "unit"},
+		"valueQuantity.value": {"result_value"},
+	}[field]
+}
+
+// writeReport writes the test issues in a format and returns the report
+func writeReport(t *testing.T, format ReportFormat, rows map[int][]ValidationError) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "report.json")
+	report, err := CreateReport(path, format, "Observation", testColumns)
+	if err != nil {
+		t.Fatalf("CreateReport failed: %v", err)
+	}
+	for _, row := range []int{2, 3, 4} {
+		if err := report.Add(row, rows[row]); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := report.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	report.Abort()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(path + ".*.tmp")
+	if len(matches) != 0 {
+		t.Errorf("Temporary files left: %v", matches)
+	}
+	return string(data)
+}
+
+// TestReport tests the issues written in each format
+func TestReport(t *testing.T) {
+	rows := map[int][]ValidationError{
+		2: {CreateError("status", "Required field is missing or empty").withRule("required-field")},
+		4: {
+			{Field: "valueQuantity", Message: "Quantities need a unit", Severity: "warning", Code: "invariant", Rule: "quantity-unit"},
+			CreateError("valueQuantity.value", "Value must be positive"),
+			CreateError("Observation", "Rule failed: effective <= now()"),
+		},
+	}
+	tests := []struct {
+		format ReportFormat
+		want   string
+	}{
+		{ReportOutcomes, `{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"required","details":{"coding":[{"system":"https://github.com/lemmack/csv2fhir/validation-rule","code":"required-field"}]},"diagnostics":"Row 2, column status: Required field is missing or empty","expression":["Observation.status"]}]}
+{"resourceType":"OperationOutcome","issue":[` +
+			`{"severity":"warning","code":"invariant","details":{"coding":[{"system":"https://github.com/lemmack/csv2fhir/validation-rule","code":"quantity-unit"}]},"diagnostics":"Row 4, columns result_value, unit: Quantities need a unit","expression":["Observation.valueQuantity"]},` +
+			`{"severity":"error","code":"invalid","diagnostics":"Row 4, column result_value: Value must be positive","expression":["Observation.valueQuantity.value"]},` +
+			`{"severity":"error","code":"invalid","diagnostics":"Row 4: Rule failed: effective <= now()","expression":["Observation"]}]}
+`},
+		{ReportAggregate, `{"resourceType":"OperationOutcome","issue":[` +
+			`{"severity":"error","code":"required","details":{"coding":[{"system":"https://github.com/lemmack/csv2fhir/validation-rule","code":"required-field"}]},"diagnostics":"Row 2, column status: Required field is missing or empty","expression":["Observation.status"]},` +
+			`{"severity":"warning","code":"invariant","details":{"coding":[{"system":"https://github.com/lemmack/csv2fhir/validation-rule","code":"quantity-unit"}]},"diagnostics":"Row 4, columns result_value, unit: Quantities need a unit","expression":["Observation.valueQuantity"]},` +
+			`{"severity":"error","code":"invalid","diagnostics":"Row 4, column result_value: Value must be positive","expression":["Observation.valueQuantity.value"]},` +
+			`{"severity":"error","code":"invalid","diagnostics":"Row 4: Rule failed: effective <= now()","expression":["Observation"]}]}
+`},
+		{ReportLines, `{"row":2,"severity":"error","code":"required","rule":"required-field","expression":"Observation.status","columns":["status"],"message":"Required field is missing or empty"}
+{"row":4,"severity":"warning","code":"invariant","rule":"quantity-unit","expression":"Observation.valueQuantity","columns":["result_value","unit"],"message":"Quantities need a unit"}
+{"row":4,"severity":"error","code":"invalid","expression":"Observation.valueQuantity.value","columns":["result_value"],"message":"Value must be positive"}
+{"row":4,"severity":"error","code":"invalid","expression":"Observation","message":"Rule failed: effective <= now()"}
+`},
+	}
+	for _, tt := range tests {
+		if got := writeReport(t, tt.format, rows); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+}
+
+// TestReport_Empty tests that an aggregate report without issues is valid
+func TestReport_Empty(t *testing.T) {
+	got := writeReport(t, ReportAggregate, nil)
+	if !strings.Contains(got, `"issue":[{"severity":"information","code":"informational"`) {
+		t.Errorf("Unexpected report: %s", got)
+	}
+	if got := writeReport(t, ReportLines, nil); got != "" {
+		t.Errorf("Expected an empty report, got %s", got)
+	}
+	if _, err := ParseReportFormat("xml"); err == nil {
+		t.Error("Expected error for an unsupported format")
+	}
+}
@@ -17,7 +17,7 @@ func (v *RequiredFieldsValidator) Validate(resource interface{}) []ValidationErr
 	for _, field := range requiredFields {
 		value, exists := getFieldValue(resource, field)
 		if !exists || isFieldEmpty(value) {
-			errors = append(errors, CreateError(field, "Required field is missing or empty"))
+			errors = append(errors, CreateError(field, "Required field is missing or empty").withRule("required-field"))
 		}
 	}
 
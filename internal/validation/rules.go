@@ -0,0 +1,105 @@
+package validation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"csv2fhir/internal/fhirpath"
+)
+
+// Rule is a FHIRPath invariant declared in a mapping
+type Rule struct {
+	ID         string // Rule id for overrides; derived from the expression by default
+	Expression string
+	Severity   string // "error" (default), "warning" or "information"
+	Message    string // Reported when the expression is false; the expression by default
+	Field      string // Reported field; the resource type by default
+}
+
+// RuleValidator checks resources against FHIRPath rules. A rule fails when
+// its expression is false; an empty result passes, like invariants on
+// elements that are absent.
+type RuleValidator struct {
+	rules       []Rule
+	expressions []*fhirpath.Expression
+}
+
+// NewRuleValidator compiles the expressions of the rules
+func NewRuleValidator(rules []Rule) (*RuleValidator, error) {
+	v := &RuleValidator{}
+	ids := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.ID == "" {
+			rule.ID = DefaultRuleID(rule.Expression)
+			if ids[rule.ID] {
+				return nil, fmt.Errorf("rule %d repeats the expression of another rule without an id", i+1)
+			}
+		}
+		if ids[rule.ID] || BuiltinRules[rule.ID] != "" {
+			return nil, fmt.Errorf("rule %d: id %s is already used", i+1, rule.ID)
+		}
+		ids[rule.ID] = true
+		expr, err := fhirpath.Parse(rule.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile rule %s: %w", rule.ID, err)
+		}
+		v.rules = append(v.rules, rule)
+		v.expressions = append(v.expressions, expr)
+	}
+	return v, nil
+}
+
+// DefaultRuleID returns the id of a rule without one, derived from its
+// expression so that it stays the same when rules are added or reordered
+func DefaultRuleID(expression string) string {
+	sum := sha256.Sum256([]byte(expression))
+	return "rule-" + hex.EncodeToString(sum[:4])
+}
+
+// IDs returns the ids of the rules
+func (v *RuleValidator) IDs() []string {
+	ids := make([]string, len(v.rules))
+	for i, rule := range v.rules {
+		ids[i] = rule.ID
+	}
+	return ids
+}
+
+// Validate evaluates every rule on a resource
+func (v *RuleValidator) Validate(resource interface{}) []ValidationError {
+	doc, err := fhirpath.Decode(resource)
+	if err != nil {
+		return []ValidationError{CreateError("", fmt.Sprintf("Resource could not be decoded: %v", err)).withRule("resource-encoding")}
+	}
+
+	var errors []ValidationError
+	for i, rule := range v.rules {
+		field := rule.Field
+		if field == "" {
+			field = doc.ResourceType()
+		}
+		result, ok, err := v.expressions[i].EvaluateBool(doc)
+		switch {
+		case err != nil:
+			issue := CreateError(field, fmt.Sprintf("Rule could not be evaluated: %v", err))
+			issue.Rule, issue.Code = rule.ID, "exception"
+			errors = append(errors, issue)
+		case ok && !result:
+			message := rule.Message
+			if message == "" {
+				message = "Rule failed: " + rule.Expression
+			}
+			issue := CreateError(field, message)
+			switch rule.Severity {
+			case "warning":
+				issue = CreateWarning(field, message)
+			case "information":
+				issue = CreateInformation(field, message)
+			}
+			issue.Rule, issue.Code = rule.ID, "invariant"
+			errors = append(errors, issue)
+		}
+	}
+	return errors
+}
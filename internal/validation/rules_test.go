@@ -0,0 +1,85 @@
+package validation
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// TestRuleValidator tests that false rules are reported and empty ones pass
+func TestRuleValidator(t *testing.T) {
+	v, err := NewRuleValidator([]Rule{
+		{ID: "quantity-unit", Expression: "valueQuantity.exists() implies valueQuantity.unit.exists()", Message: "Quantities need a unit"},
+		{Expression: "effectiveDateTime <= @2024-01-01", Severity: "warning", Field: "effectiveDateTime"},
+		{Expression: "issued.exists().not() or issued > effective"},
+		{Expression: "status = 'final'"},
+	})
+	if err != nil {
+		t.Fatalf("NewRuleValidator failed: %v", err)
+	}
+
+	value := json.Number("95")
+	effective := "2025-02-01"
+	observation := &fhir.Observation{
+		Status:            fhir.ObservationStatusFinal,
+		EffectiveDateTime: &effective,
+		ValueQuantity:     &fhir.Quantity{Value: &value},
+	}
+
+	errors := v.Validate(observation)
+	if len(errors) != 2 {
+		t.Fatalf("Expected 2 issues, got %v", errors)
+	}
+	expected := ValidationError{Field: "Observation", Message: "Quantities need a unit", Severity: "error", Code: "invariant", Rule: "quantity-unit"}
+	if errors[0] != expected {
+		t.Errorf("Unexpected issue: %+v", errors[0])
+	}
+	expected = ValidationError{Field: "effectiveDateTime", Message: "Rule failed: effectiveDateTime <= @2024-01-01", Severity: "warning", Code: "invariant", Rule: "rule-ec5b1996"}
+	if errors[1] != expected {
+		t.Errorf("Unexpected issue: %+v", errors[1])
+	}
+}
+
+// TestRuleValidator_DefaultIDs tests that default ids don't depend on the
+// position of a rule
+func TestRuleValidator_DefaultIDs(t *testing.T) {
+	first, err := NewRuleValidator([]Rule{{Expression: "status.exists()"}, {Expression: "code.exists()"}})
+	if err != nil {
+		t.Fatalf("NewRuleValidator failed: %v", err)
+	}
+	reordered, err := NewRuleValidator([]Rule{{ID: "subject", Expression: "subject.exists()"}, {Expression: "code.exists()"}, {Expression: "status.exists()"}})
+	if err != nil {
+		t.Fatalf("NewRuleValidator failed: %v", err)
+	}
+	ids, again := first.IDs(), reordered.IDs()
+	if ids[0] != again[2] || ids[1] != again[1] || ids[0] == ids[1] {
+		t.Errorf("Expected the same ids after reordering, got %v and %v", ids, again)
+	}
+}
+
+// TestRuleValidator_Errors tests that invalid and failing expressions are reported
+func TestRuleValidator_Errors(t *testing.T) {
+	if _, err := NewRuleValidator([]Rule{{Expression: "status ="}}); err == nil {
+		t.Error("Expected error for an invalid expression")
+	}
+	if _, err := NewRuleValidator([]Rule{{ID: "binding", Expression: "status.exists()"}}); err == nil {
+		t.Error("Expected error for the id of a built-in rule")
+	}
+	if _, err := NewRuleValidator([]Rule{{Expression: "status.exists()"}, {ID: DefaultRuleID("status.exists()"), Expression: "code.exists()"}}); err == nil {
+		t.Error("Expected error for a repeated id")
+	}
+	if _, err := NewRuleValidator([]Rule{{Expression: "status.exists()"}, {Expression: "status.exists()", Severity: "warning"}}); err == nil {
+		t.Error("Expected error for a repeated expression without an id")
+	}
+
+	v, err := NewRuleValidator([]Rule{{Expression: "code.coding.code = 'x' and true"}, {Expression: "code.coding.code.single() = 'x'"}})
+	if err != nil {
+		t.Fatalf("NewRuleValidator failed: %v", err)
+	}
+	resource := json.RawMessage(`{"resourceType":"Observation","code":{"coding":[{"code":"x"},{"code":"y"}]}}`)
+	errors := v.Validate(resource)
+	if len(errors) != 2 || errors[0].Message != "Rule failed: code.coding.code = 'x' and true" || errors[1].Severity != "error" {
+		t.Errorf("Unexpected issues: %v", errors)
+	}
+}
@@ -0,0 +1,317 @@
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// coreProfileBase is the canonical URL prefix of the core resource definitions
+const coreProfileBase = "http://hl7.org/fhir/StructureDefinition/"
+
+// Profiles holds the StructureDefinitions of resource profiles, by canonical URL
+type Profiles struct {
+	byURL    map[string]*profile
+	versions map[string]string // fhirVersion -> URL of a profile declaring it
+}
+
+// profile is the snapshot of a StructureDefinition as a tree of elements
+type profile struct {
+	url          string
+	name         string
+	resourceType string
+	root         *elementNode
+}
+
+// elementNode is an element of a snapshot with its child elements and slices
+type elementNode struct {
+	def      *elementDefinition
+	name     string         // Last part of the path, e.g. value[x]
+	children []*elementNode // In snapshot order
+	slices   []*elementNode
+	ref      *elementNode // Element whose children a contentReference reuses
+}
+
+// structureDefinition holds the parts of a StructureDefinition needed for validation
+type structureDefinition struct {
+	ResourceType string `json:"resourceType"`
+	URL          string `json:"url"`
+	Name         string `json:"name"`
+	Kind         string `json:"kind"`
+	Type         string `json:"type"`
+	FHIRVersion  string `json:"fhirVersion"`
+	Snapshot     *struct {
+		Element []elementDefinition `json:"element"`
+	} `json:"snapshot"`
+}
+
+// elementDefinition holds the parts of an ElementDefinition needed for validation
+type elementDefinition struct {
+	ID               string          `json:"id"`
+	Path             string          `json:"path"`
+	SliceName        string          `json:"sliceName"`
+	Min              int             `json:"min"`
+	Max              string          `json:"max"`
+	MaxLength        int             `json:"maxLength"`
+	ContentReference string          `json:"contentReference"`
+	Type             []elementType   `json:"type"`
+	Slicing          *elementSlicing `json:"slicing"`
+	Binding          *elementBinding `json:"binding"`
+	fixed            interface{}     // fixed[x], decoded like resources
+	pattern          interface{}     // pattern[x]
+}
+
+// elementType is an allowed type of an element
+type elementType struct {
+	Code          string   `json:"code"`
+	Profile       []string `json:"profile"`
+	TargetProfile []string `json:"targetProfile"`
+}
+
+// elementSlicing describes how the values of an element are divided into slices
+type elementSlicing struct {
+	Discriminator []discriminator `json:"discriminator"`
+	Rules         string          `json:"rules"` // closed, open or openAtEnd
+}
+
+// elementBinding names the ValueSet codes of an element are taken from
+type elementBinding struct {
+	Strength string `json:"strength"` // required, extensible, preferred or example
+	ValueSet string `json:"valueSet"`
+}
+
+// discriminator names what tells the slices of an element apart
+type discriminator struct {
+	Type string `json:"type"` // value, pattern, exists, type or profile
+	Path string `json:"path"` // FHIRPath below the sliced element, e.g. coding.code
+}
+
+// UnmarshalJSON reads an ElementDefinition, including its fixed[x] and
+// pattern[x] values of any type
+func (e *elementDefinition) UnmarshalJSON(data []byte) error {
+	type plain elementDefinition
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for key, raw := range fields {
+		for _, prefix := range []string{"fixed", "pattern"} {
+			if !isChoiceKey(key, prefix) {
+				continue
+			}
+			value, err := decodeJSON(raw)
+			if err != nil {
+				return err
+			}
+			if prefix == "fixed" {
+				e.fixed = value
+			} else {
+				e.pattern = value
+			}
+		}
+	}
+	return nil
+}
+
+// maxCount returns the maximum cardinality, or -1 for *
+func (e *elementDefinition) maxCount() int {
+	if e.Max == "" || e.Max == "*" {
+		return -1
+	}
+	n, err := strconv.Atoi(e.Max)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// LoadProfiles loads the resource StructureDefinitions in the JSON files
+// under dir, including those in Bundles like the core definitions. Other
+// files are ignored.
+func LoadProfiles(dir string) (*Profiles, error) {
+	profiles := &Profiles{byURL: map[string]*profile{}, versions: map[string]string{}}
+	err := walkResources(dir, func(resourceType string, data []byte, path string) error {
+		if resourceType != "StructureDefinition" {
+			return nil
+		}
+		return profiles.add(data, path)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load profiles: %w", err)
+	}
+	if len(profiles.byURL) == 0 {
+		return nil, fmt.Errorf("no resource StructureDefinitions found in %s", dir)
+	}
+	return profiles, nil
+}
+
+// walkResources calls fn for each resource in the JSON files under dir,
+// including the entries of Bundles. Files that are not FHIR resources, like
+// package.json, are skipped.
+func walkResources(dir string, fn func(resourceType string, data []byte, path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var file struct {
+			ResourceType string `json:"resourceType"`
+			Entry        []struct {
+				Resource json.RawMessage `json:"resource"`
+			} `json:"entry"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if file.ResourceType != "Bundle" {
+			if file.ResourceType == "" {
+				return nil
+			}
+			return fn(file.ResourceType, data, path)
+		}
+		for _, entry := range file.Entry {
+			var resource struct {
+				ResourceType string `json:"resourceType"`
+			}
+			if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+			if err := fn(resource.ResourceType, entry.Resource, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// add adds a StructureDefinition if it defines a resource or resource profile
+func (p *Profiles) add(data []byte, path string) error {
+	var sd structureDefinition
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return fmt.Errorf("failed to parse StructureDefinition in %s: %w", path, err)
+	}
+	if sd.Kind != "resource" {
+		return nil
+	}
+	if sd.Snapshot == nil || len(sd.Snapshot.Element) == 0 {
+		return fmt.Errorf("StructureDefinition %s in %s has no snapshot", sd.URL, path)
+	}
+	root, err := buildElementTree(sd.Snapshot.Element)
+	if err != nil {
+		return fmt.Errorf("StructureDefinition %s in %s: %w", sd.URL, path, err)
+	}
+	name := sd.Name
+	if name == "" {
+		name = sd.URL
+	}
+	p.byURL[sd.URL] = &profile{url: sd.URL, name: name, resourceType: sd.Type, root: root}
+	if sd.FHIRVersion != "" {
+		p.versions[sd.FHIRVersion] = sd.URL
+	}
+	return nil
+}
+
+// FHIRVersions returns the fhirVersions the profiles declare, each with the
+// URL of a profile declaring it
+func (p *Profiles) FHIRVersions() map[string]string {
+	return p.versions
+}
+
+// Has reports whether a profile was loaded. A version suffix, as in
+// url|1.0.0, is ignored.
+func (p *Profiles) Has(url string) bool {
+	return p.get(url) != nil
+}
+
+// Len returns the number of profiles loaded
+func (p *Profiles) Len() int {
+	return len(p.byURL)
+}
+
+// get returns a profile by canonical URL, or nil
+func (p *Profiles) get(url string) *profile {
+	url, _, _ = strings.Cut(url, "|")
+	return p.byURL[url]
+}
+
+// buildElementTree arranges snapshot elements by their ids, e.g.
+// Observation.category:VSCat.coding is a child of the VSCat slice of
+// Observation.category
+func buildElementTree(elements []elementDefinition) (*elementNode, error) {
+	nodes := map[string]*elementNode{}
+	var root *elementNode
+	for i := range elements {
+		def := &elements[i]
+		id := def.ID
+		if id == "" {
+			id = def.Path
+		}
+		node := &elementNode{def: def, name: id}
+		nodes[id] = node
+		if root == nil {
+			root = node
+			continue
+		}
+
+		cut := strings.LastIndex(id, ".")
+		if cut < 0 {
+			return nil, fmt.Errorf("element %s is outside %s", id, root.name)
+		}
+		parentID, segment := id[:cut], id[cut+1:]
+		name, _, isSlice := strings.Cut(segment, ":")
+		node.name = name
+		if isSlice {
+			base := nodes[parentID+"."+name]
+			if base == nil {
+				return nil, fmt.Errorf("slice %s precedes its element", id)
+			}
+			base.slices = append(base.slices, node)
+			continue
+		}
+		parent := nodes[parentID]
+		if parent == nil {
+			return nil, fmt.Errorf("element %s precedes its parent", id)
+		}
+		parent.children = append(parent.children, node)
+	}
+
+	for _, node := range nodes {
+		if ref := node.def.ContentReference; ref != "" {
+			_, target, _ := strings.Cut(ref, "#")
+			node.ref = nodes[target]
+		}
+	}
+	return root, nil
+}
+
+// decodeJSON decodes JSON into maps, slices and json.Number
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// isChoiceKey reports whether key is a typed name of a choice element, e.g.
+// valueQuantity for value
+func isChoiceKey(key, base string) bool {
+	return len(key) > len(base) && strings.HasPrefix(key, base) &&
+		key[len(base)] >= 'A' && key[len(base)] <= 'Z'
+}
@@ -0,0 +1,383 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Terminology holds ValueSets and CodeSystems loaded from a directory and
+// expands the ValueSets locally, without a terminology server
+type Terminology struct {
+	valueSets   map[string]*valueSet
+	codeSystems map[string]*codeSystem
+
+	mu         sync.Mutex
+	expansions map[string]*expansion // By ValueSet URL, filled on first use
+}
+
+// codeSystem holds the codes of a CodeSystem and their hierarchy
+type codeSystem struct {
+	URL      string    `json:"url"`
+	Content  string    `json:"content"` // complete, fragment, example or not-present
+	Concept  []concept `json:"concept"`
+	codes    []string
+	children map[string][]string // Codes directly below a code
+}
+
+// concept is a code of a CodeSystem with the codes nested below it
+type concept struct {
+	Code     string    `json:"code"`
+	Concept  []concept `json:"concept"`
+	Property []struct {
+		Code      string `json:"code"`
+		ValueCode string `json:"valueCode"`
+	} `json:"property"`
+}
+
+// valueSet holds the definition or expansion of a ValueSet
+type valueSet struct {
+	URL     string `json:"url"`
+	Compose *struct {
+		Include []valueSetInclude `json:"include"`
+		Exclude []valueSetInclude `json:"exclude"`
+	} `json:"compose"`
+	Expansion *struct {
+		Contains []valueSetContains `json:"contains"`
+	} `json:"expansion"`
+}
+
+// valueSetInclude selects codes of a system, of other ValueSets, or both
+type valueSetInclude struct {
+	System  string `json:"system"`
+	Concept []struct {
+		Code string `json:"code"`
+	} `json:"concept"`
+	Filter []struct {
+		Property string `json:"property"`
+		Op       string `json:"op"`
+		Value    string `json:"value"`
+	} `json:"filter"`
+	ValueSet []string `json:"valueSet"`
+}
+
+// valueSetContains is a code of an expansion with the codes nested below it
+type valueSetContains struct {
+	System   string             `json:"system"`
+	Code     string             `json:"code"`
+	Contains []valueSetContains `json:"contains"`
+}
+
+// expansion is the set of codes of a ValueSet. Systems whose codes cannot be
+// listed, because the CodeSystem is not loaded or a filter is not supported,
+// allow any of their codes.
+type expansion struct {
+	codes   map[string]map[string]bool // System -> codes
+	anyCode map[string]bool            // Systems allowing any code
+}
+
+// LoadTerminology loads the ValueSets and CodeSystems in the JSON files under
+// dir, including those in Bundles like the core valuesets.json
+func LoadTerminology(dir string) (*Terminology, error) {
+	t := &Terminology{
+		valueSets:   map[string]*valueSet{},
+		codeSystems: map[string]*codeSystem{},
+		expansions:  map[string]*expansion{},
+	}
+	err := walkResources(dir, func(resourceType string, data []byte, path string) error {
+		switch resourceType {
+		case "ValueSet":
+			var vs valueSet
+			if err := json.Unmarshal(data, &vs); err != nil {
+				return fmt.Errorf("failed to parse ValueSet in %s: %w", path, err)
+			}
+			t.valueSets[vs.URL] = &vs
+		case "CodeSystem":
+			var cs codeSystem
+			if err := json.Unmarshal(data, &cs); err != nil {
+				return fmt.Errorf("failed to parse CodeSystem in %s: %w", path, err)
+			}
+			cs.index()
+			t.codeSystems[cs.URL] = &cs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load terminology: %w", err)
+	}
+	if len(t.valueSets) == 0 {
+		return nil, fmt.Errorf("no ValueSets found in %s", dir)
+	}
+	return t, nil
+}
+
+// Counts returns the number of ValueSets and CodeSystems loaded
+func (t *Terminology) Counts() (valueSets, codeSystems int) {
+	return len(t.valueSets), len(t.codeSystems)
+}
+
+// index lists the codes of a CodeSystem and the hierarchy given by nesting
+// and parent properties
+func (cs *codeSystem) index() {
+	cs.children = map[string][]string{}
+	var walk func(concepts []concept, parent string)
+	walk = func(concepts []concept, parent string) {
+		for _, c := range concepts {
+			cs.codes = append(cs.codes, c.Code)
+			if parent != "" {
+				cs.children[parent] = append(cs.children[parent], c.Code)
+			}
+			for _, p := range c.Property {
+				if (p.Code == "parent" || p.Code == "subsumedBy") && p.ValueCode != "" {
+					cs.children[p.ValueCode] = append(cs.children[p.ValueCode], c.Code)
+				}
+			}
+			walk(c.Concept, c.Code)
+		}
+	}
+	walk(cs.Concept, "")
+}
+
+// complete reports whether the CodeSystem lists all its codes
+func (cs *codeSystem) complete() bool {
+	return cs.Content == "" || cs.Content == "complete"
+}
+
+// descendants returns the codes below a code, at any depth
+func (cs *codeSystem) descendants(code string) []string {
+	var result []string
+	seen := map[string]bool{code: true}
+	queue := []string{code}
+	for len(queue) > 0 {
+		for _, child := range cs.children[queue[0]] {
+			if !seen[child] {
+				seen[child] = true
+				result = append(result, child)
+				queue = append(queue, child)
+			}
+		}
+		queue = queue[1:]
+	}
+	return result
+}
+
+// Contains reports whether a ValueSet contains a code. An empty system
+// matches the code in any system of the ValueSet, for elements of type code.
+// known is false when the ValueSet was not loaded.
+func (t *Terminology) Contains(url, system, code string) (contains, known bool) {
+	e := t.expand(url)
+	if e == nil {
+		return false, false
+	}
+	return e.contains(system, code), true
+}
+
+// expand returns the expansion of a ValueSet, or nil if it is not loaded
+func (t *Terminology) expand(url string) *expansion {
+	url, _, _ = strings.Cut(url, "|")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expandLocked(url, map[string]bool{})
+}
+
+// expandLocked expands a ValueSet; visiting guards against cycles between
+// ValueSets including each other
+func (t *Terminology) expandLocked(url string, visiting map[string]bool) *expansion {
+	if e, ok := t.expansions[url]; ok {
+		return e
+	}
+	vs := t.valueSets[url]
+	if vs == nil || visiting[url] {
+		return nil
+	}
+	visiting[url] = true
+	defer delete(visiting, url)
+
+	e := newExpansion()
+	switch {
+	case vs.Compose != nil:
+		for _, include := range vs.Compose.Include {
+			e.add(t.includeLocked(include, visiting))
+		}
+		for _, exclude := range vs.Compose.Exclude {
+			e.remove(t.includeLocked(exclude, visiting))
+		}
+	case vs.Expansion != nil:
+		var walk func(contains []valueSetContains)
+		walk = func(contains []valueSetContains) {
+			for _, c := range contains {
+				if c.Code != "" {
+					e.addCode(c.System, c.Code)
+				}
+				walk(c.Contains)
+			}
+		}
+		walk(vs.Expansion.Contains)
+	}
+	t.expansions[url] = e
+	return e
+}
+
+// includeLocked returns the codes an include or exclude selects
+func (t *Terminology) includeLocked(include valueSetInclude, visiting map[string]bool) *expansion {
+	var result *expansion
+	if include.System != "" {
+		result = t.systemCodes(include)
+	}
+	// Codes must be in every referenced ValueSet
+	for _, url := range include.ValueSet {
+		url, _, _ = strings.Cut(url, "|")
+		other := t.expandLocked(url, visiting)
+		if other == nil {
+			// An unknown ValueSet can't narrow the codes down
+			other = newExpansion()
+			other.anyCode[""] = true
+		}
+		if result == nil {
+			result = other
+		} else {
+			result = result.intersect(other)
+		}
+	}
+	if result == nil {
+		return newExpansion()
+	}
+	return result
+}
+
+// systemCodes returns the codes of a system an include selects by listing
+// them or by filters
+func (t *Terminology) systemCodes(include valueSetInclude) *expansion {
+	e := newExpansion()
+	if len(include.Concept) > 0 {
+		for _, c := range include.Concept {
+			e.addCode(include.System, c.Code)
+		}
+		return e
+	}
+
+	cs := t.codeSystems[include.System]
+	if cs == nil || !cs.complete() {
+		e.anyCode[include.System] = true
+		return e
+	}
+	if len(include.Filter) == 0 {
+		for _, code := range cs.codes {
+			e.addCode(include.System, code)
+		}
+		return e
+	}
+
+	var codes map[string]bool
+	for _, filter := range include.Filter {
+		var selected []string
+		switch {
+		case filter.Property == "concept" && filter.Op == "is-a":
+			selected = append([]string{filter.Value}, cs.descendants(filter.Value)...)
+		case filter.Property == "concept" && filter.Op == "descendent-of":
+			selected = cs.descendants(filter.Value)
+		case filter.Property == "concept" && filter.Op == "=":
+			selected = []string{filter.Value}
+		case filter.Property == "concept" && filter.Op == "in":
+			selected = strings.Split(filter.Value, ",")
+		default:
+			// Other filters need properties this loader doesn't evaluate
+			e.anyCode[include.System] = true
+			return e
+		}
+		next := map[string]bool{}
+		for _, code := range selected {
+			if codes == nil || codes[code] {
+				next[code] = true
+			}
+		}
+		codes = next
+	}
+	for code := range codes {
+		e.addCode(include.System, code)
+	}
+	return e
+}
+
+// newExpansion creates an empty expansion
+func newExpansion() *expansion {
+	return &expansion{codes: map[string]map[string]bool{}, anyCode: map[string]bool{}}
+}
+
+// addCode adds a code of a system
+func (e *expansion) addCode(system, code string) {
+	if e.codes[system] == nil {
+		e.codes[system] = map[string]bool{}
+	}
+	e.codes[system][code] = true
+}
+
+// add adds the codes of another expansion
+func (e *expansion) add(other *expansion) {
+	for system := range other.anyCode {
+		e.anyCode[system] = true
+	}
+	for system, codes := range other.codes {
+		for code := range codes {
+			e.addCode(system, code)
+		}
+	}
+}
+
+// remove removes the codes of another expansion. Systems allowing any code
+// are those an exclude could not list, so like includes they are lenient and
+// remove nothing.
+func (e *expansion) remove(other *expansion) {
+	for system, codes := range other.codes {
+		for code := range codes {
+			delete(e.codes[system], code)
+		}
+	}
+}
+
+// intersect returns the codes in both expansions. The system "" in anyCode
+// stands for any system.
+func (e *expansion) intersect(other *expansion) *expansion {
+	result := newExpansion()
+	for system := range e.anyCode {
+		if other.anyCode[system] || other.anyCode[""] {
+			result.anyCode[system] = true
+		}
+	}
+	for system := range other.anyCode {
+		if e.anyCode[""] {
+			result.anyCode[system] = true
+		}
+	}
+	for _, pair := range []struct{ a, b *expansion }{{e, other}, {other, e}} {
+		for system, codes := range pair.a.codes {
+			for code := range codes {
+				if pair.b.contains(system, code) {
+					result.addCode(system, code)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// contains reports whether the expansion has a code. An empty system matches
+// any system.
+func (e *expansion) contains(system, code string) bool {
+	if e.anyCode[""] {
+		return true
+	}
+	if system != "" {
+		return e.anyCode[system] || e.codes[system][code]
+	}
+	if len(e.anyCode) > 0 {
+		return true
+	}
+	for _, codes := range e.codes {
+		if codes[code] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTerminology is a small hierarchy of codes and ValueSets over it
+const testTerminology = `{
+  "resourceType": "Bundle",
+  "type": "collection",
+  "entry": [
+    {"resource": {
+      "resourceType": "CodeSystem",
+      "url": "urn:cs:animals",
+      "content": "complete",
+      "concept": [
+        {"code": "animal", "concept": [
+          {"code": "mammal", "concept": [{"code": "dog"}, {"code": "cat"}]},
+          {"code": "bird"}
+        ]},
+        {"code": "parrot", "property": [{"code": "parent", "valueCode": "bird"}]},
+        {"code": "rock"}
+      ]
+    }},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:all", "compose": {"include": [{"system": "urn:cs:animals"}]}}},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:mammals", "compose": {"include": [
+      {"system": "urn:cs:animals", "filter": [{"property": "concept", "op": "is-a", "value": "mammal"}]}
+    ]}}},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:birds", "compose": {"include": [
+      {"system": "urn:cs:animals", "filter": [{"property": "concept", "op": "descendent-of", "value": "bird"}]}
+    ]}}},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:pets", "compose": {
+      "include": [{"valueSet": ["urn:vs:mammals"]}, {"system": "urn:cs:animals", "concept": [{"code": "parrot"}]}],
+      "exclude": [{"system": "urn:cs:animals", "concept": [{"code": "cat"}]}]
+    }}},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:tame", "compose": {
+      "include": [{"system": "urn:cs:animals"}],
+      "exclude": [
+        {"system": "urn:cs:animals", "filter": [{"property": "habitat", "op": "=", "value": "wild"}]},
+        {"valueSet": ["urn:vs:missing"]},
+        {"system": "urn:cs:animals", "concept": [{"code": "rock"}]}
+      ]
+    }}},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:lab", "compose": {"include": [{"system": "http://loinc.org"}]}}},
+    {"resource": {"resourceType": "ValueSet", "url": "urn:vs:expanded", "expansion": {"contains": [
+      {"system": "urn:cs:other", "code": "a", "contains": [{"system": "urn:cs:other", "code": "b"}]}
+    ]}}}
+  ]
+}`
+
+// loadTestTerminology writes the test terminology to a directory and loads it
+func loadTestTerminology(t *testing.T) *Terminology {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "terminology.json"), []byte(testTerminology), 0644); err != nil {
+		t.Fatal(err)
+	}
+	terminology, err := LoadTerminology(dir)
+	if err != nil {
+		t.Fatalf("LoadTerminology failed: %v", err)
+	}
+	return terminology
+}
+
+// TestTerminology_Contains tests local expansion of ValueSets
+func TestTerminology_Contains(t *testing.T) {
+	terminology := loadTestTerminology(t)
+	if valueSets, codeSystems := terminology.Counts(); valueSets != 7 || codeSystems != 1 {
+		t.Errorf("Expected 7 ValueSets and 1 CodeSystem, got %d and %d", valueSets, codeSystems)
+	}
+
+	tests := []struct {
+		valueSet, system, code string
+		want                   bool
+	}{
+		{"urn:vs:all", "urn:cs:animals", "rock", true},
+		{"urn:vs:all", "urn:cs:animals", "unicorn", false},
+		{"urn:vs:all", "urn:cs:plants", "rock", false},
+		{"urn:vs:mammals", "urn:cs:animals", "mammal", true},
+		{"urn:vs:mammals", "urn:cs:animals", "dog", true},
+		{"urn:vs:mammals", "urn:cs:animals", "bird", false},
+		{"urn:vs:birds", "urn:cs:animals", "bird", false},
+		{"urn:vs:birds", "urn:cs:animals", "parrot", true},
+		{"urn:vs:pets", "urn:cs:animals", "dog", true},
+		{"urn:vs:pets", "urn:cs:animals", "parrot", true},
+		{"urn:vs:pets", "urn:cs:animals", "cat", false},
+		{"urn:vs:pets", "", "dog", true},
+		{"urn:vs:pets|1.0", "", "rock", false},
+		{"urn:vs:tame", "urn:cs:animals", "dog", true},
+		{"urn:vs:tame", "urn:cs:animals", "rock", false},
+		{"urn:vs:lab", "http://loinc.org", "8867-4", true},
+		{"urn:vs:lab", "urn:cs:animals", "dog", false},
+		{"urn:vs:expanded", "urn:cs:other", "b", true},
+	}
+	for _, tt := range tests {
+		contains, known := terminology.Contains(tt.valueSet, tt.system, tt.code)
+		if !known || contains != tt.want {
+			t.Errorf("Contains(%s, %s, %s) = %v, %v; want %v", tt.valueSet, tt.system, tt.code, contains, known, tt.want)
+		}
+	}
+	if _, known := terminology.Contains("urn:vs:missing", "", "x"); known {
+		t.Error("Expected an unknown ValueSet")
+	}
+}
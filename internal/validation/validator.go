@@ -10,7 +10,29 @@ import (
 type ValidationError struct {
 	Field    string // FHIR path (e.g., "status", "code.coding[0].system")
 	Message  string // Error description
-	Severity string // "error" or "warning"
+	Severity string // "error", "warning" or "information"
+	Code     string // OperationOutcome issue type, e.g. "required"; "invalid" when empty
+	Rule     string // Stable id of the check, e.g. "required-field", for overrides
+}
+
+// BuiltinRules are the ids of the built-in checks and the OperationOutcome
+// issue types they report
+var BuiltinRules = map[string]string{
+	"required-field":     "required",      // --validate: required fields by resource type
+	"datetime-format":    "value",         // --validate: ISO 8601 dates and times
+	"reference-format":   "value",         // --validate: literal reference formats
+	"resource-encoding":  "exception",     // Resources that cannot be encoded for checking
+	"profile-unknown":    "not-supported", // meta.profile not among the loaded profiles
+	"profile-mismatch":   "invalid",       // meta.profile constraining another resource type
+	"profile-min":        "required",      // Minimum cardinality
+	"profile-max":        "structure",     // Maximum cardinality, including prohibited elements
+	"profile-type":       "structure",     // Types of elements and choice elements
+	"profile-fixed":      "value",         // Fixed values
+	"profile-pattern":    "value",         // Pattern values
+	"profile-max-length": "too-long",      // Maximum lengths of strings
+	"profile-reference":  "value",         // Target types of references
+	"profile-slicing":    "structure",     // Values matching no slice of a closed slicing
+	"binding":            "code-invalid",  // Codes outside the ValueSet of a binding
 }
 
 // Validator validates FHIR resources
@@ -112,16 +134,59 @@ func CreateWarning(field, message string) ValidationError {
 	}
 }
 
+// CreateInformation creates an informational validation issue
+func CreateInformation(field, message string) ValidationError {
+	return ValidationError{
+		Field:    field,
+		Message:  message,
+		Severity: "information",
+	}
+}
+
+// withRule sets the rule id of a validation error and the issue type of
+// the built-in rule
+func (e ValidationError) withRule(rule string) ValidationError {
+	e.Rule = rule
+	e.Code = BuiltinRules[rule]
+	return e
+}
+
+// HasErrors reports whether any of the validation errors is an error rather
+// than a warning or information
+func HasErrors(errors []ValidationError) bool {
+	for _, err := range errors {
+		if err.Severity == "error" {
+			return true
+		}
+	}
+	return false
+}
+
 // FormatErrors formats validation errors for display
 func FormatErrors(errors []ValidationError, rowNumber int) string {
+	return formatErrors(errors, fmt.Sprintf("Row %d", rowNumber))
+}
+
+// FormatResourceErrors formats validation errors of a resource that belongs
+// to no row, e.g. a Provenance, for display
+func FormatResourceErrors(errors []ValidationError, resourceType string) string {
+	return formatErrors(errors, resourceType)
+}
+
+// formatErrors formats validation errors, each line starting with prefix
+func formatErrors(errors []ValidationError, prefix string) string {
 	if len(errors) == 0 {
 		return ""
 	}
 
 	var lines []string
 	for _, err := range errors {
-		lines = append(lines, fmt.Sprintf("Row %d: Validation %s in field '%s': %s",
-			rowNumber, err.Severity, err.Field, err.Message))
+		line := fmt.Sprintf("%s: Validation %s in field '%s': %s",
+			prefix, err.Severity, err.Field, err.Message)
+		if err.Rule != "" {
+			line += " [" + err.Rule + "]"
+		}
+		lines = append(lines, line)
 	}
 	return strings.Join(lines, "\n")
 }
@@ -269,6 +269,24 @@ func TestFormatErrors(t *testing.T) {
 	}
 }
 
+// TestFormatErrors_Rule tests that rule ids follow the message
+func TestFormatErrors_Rule(t *testing.T) {
+	formatted := FormatErrors([]ValidationError{CreateInformation("status", "Missing").withRule("required-field")}, 3)
+	expected := "Row 3: Validation information in field 'status': Missing [required-field]"
+	if formatted != expected {
+		t.Errorf("Expected %q, got %q", expected, formatted)
+	}
+}
+
+// TestFormatResourceErrors tests formatting errors of a resource without a row
+func TestFormatResourceErrors(t *testing.T) {
+	formatted := FormatResourceErrors([]ValidationError{CreateError("recorded", "Required field is missing")}, "Provenance")
+	expected := "Provenance: Validation error in field 'recorded': Required field is missing"
+	if formatted != expected {
+		t.Errorf("Expected %q, got %q", expected, formatted)
+	}
+}
+
 // TestCreateError tests error creation
 func TestCreateError(t *testing.T) {
 	err := CreateError("testField", "Test message")
@@ -293,6 +311,17 @@ func TestCreateWarning(t *testing.T) {
 	}
 }
 
+// TestHasErrors tests that warnings alone are not errors
+func TestHasErrors(t *testing.T) {
+	warning := CreateWarning("category", "Not in ValueSet")
+	if HasErrors([]ValidationError{warning}) {
+		t.Error("Expected warnings not to count as errors")
+	}
+	if !HasErrors([]ValidationError{warning, CreateError("code", "Required field is missing")}) {
+		t.Error("Expected an error")
+	}
+}
+
 // Helper functions
 func strPtr(s string) *string {
 	return &s
@@ -1,35 +1,144 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"csv2fhir/internal/baseline"
+	"csv2fhir/internal/checkpoint"
 	"csv2fhir/internal/config"
 	"csv2fhir/internal/csv"
+	"csv2fhir/internal/dedupe"
+	"csv2fhir/internal/fhirpath"
+	"csv2fhir/internal/fhirversion"
+	"csv2fhir/internal/integrity"
 	"csv2fhir/internal/output"
+	"csv2fhir/internal/provenance"
 	"csv2fhir/internal/transform"
+	"csv2fhir/internal/uuid"
 	"csv2fhir/internal/validation"
 )
 
+// version is the csv2fhir version recorded in Provenance resources, set at
+// build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// runOptions holds the settings for a single conversion run
+type runOptions struct {
+	inputPath          string // "-" reads stdin
+	inputMember        string // File to read from a zip input
+	mappingPath        string
+	outputPath         string
+	outputDir          string
+	format             output.Format
+	bundleType         output.BundleType
+	baseURL            string
+	split              output.SplitOptions
+	compression        output.Compression
+	canonical          bool
+	layout             output.Layout
+	server             output.ServerOptions // Sink used when server.URL is set
+	partitionBy        string               // CSV column or FHIRPath giving each resource's partition
+	partition          output.PartitionOptions
+	meta               config.MetaConfig // Overrides of the mapping's meta section
+	runID              string            // Generated when empty
+	provenance         bool              // Emit Provenance resources targeting the output
+	provenanceEvery    int               // Resources per Provenance
+	narrative          bool              // Render the built-in narrative when the mapping has none
+	attachmentDir      string            // Directory attachment paths are resolved against and kept within
+	attachmentMaxSize  int64             // Largest file embedded as an attachment
+	baselinePath       string            // Previous output or hash index to detect changes against
+	writeBaseline      string            // Hash index of this run's resources for the next run
+	emitDeletes        bool              // Delete resources missing from this run's input
+	checkReferences    bool              // Report references to resources missing from the output
+	knownIDs           string            // Type/id lines of resources on the server references may use
+	fhirVersion        fhirversion.Version
+	delimiter          rune
+	maxResources       int
+	enableValidation   bool
+	validationLevel    string
+	profilesDir        string // StructureDefinitions to validate against
+	terminologyDir     string // ValueSets and CodeSystems for the profiles' bindings
+	validationReport   string // File the validation issues are written to
+	validationConfig   string // Severity overrides and suppressions besides the mapping's
+	reportFormat       validation.ReportFormat
+	checkpointPath     string // Empty disables checkpointing
+	checkpointInterval int    // Rows between checkpoint writes
+	resume             bool
+	onInterrupt        string // "discard" or "keep"
+}
+
 func main() {
 	// Define CLI flags
-	inputFile := flag.String("input", "", "Input CSV file path (required)")
+	inputFile := flag.String("input", "", "Input CSV file path, - for stdin; .gz, .zst and .zip inputs are decompressed (required)")
 	inputFileShort := flag.String("i", "", "Input CSV file path (short)")
+	inputMember := flag.String("input-member", "", "File to read from a zip input (default: the only file in the archive)")
 	mappingFile := flag.String("mapping", "", "YAML mapping file path (required)")
 	mappingFileShort := flag.String("m", "", "YAML mapping file path (short)")
-	outputFile := flag.String("output", "", "Output file path (default: stdout)")
+	outputFile := flag.String("output", "", "Output file path, - for stdout (default: stdout)")
 	outputFileShort := flag.String("o", "", "Output file path (short)")
-	formatStr := flag.String("format", "bundle", "Output format: bundle or ndjson")
+	outputDir := flag.String("output-dir", "", "Output directory for bulk format and --partition-by")
+	formatStr := flag.String("format", "bundle", "Output format: bundle, ndjson, bulk, xml or xml-stream")
 	formatStrShort := flag.String("f", "", "Output format (short)")
+	bundleTypeStr := flag.String("bundle-type", "collection", "Bundle type: collection, transaction, batch, document or message")
+	baseURL := flag.String("base-url", "", "Server base URL for fullUrls of resources with an id (default: urn:uuid)")
 	delimiter := flag.String("delimiter", ",", "CSV delimiter")
 	delimiterShort := flag.String("d", "", "CSV delimiter (short)")
-	maxResources := flag.Int("max-resources", 10000, "Maximum resources in memory for bundle format (default: 10000)")
+	bundleSize := flag.Int("bundle-size", 0, "Maximum resources per output file; rolls over to output-0001.json, output-0002.json, ... (0 means no limit)")
+	maxFileBytes := flag.Int64("max-file-bytes", 0, "Maximum bytes per output file before compression; rolls over like --bundle-size (0 means no limit)")
+	compress := flag.String("compress", "none", "Output compression: none or gzip")
+	canonical := flag.Bool("canonical", false, "Canonical JSON output: sorted keys, normalized exponents, no whitespace; decimals keep their precision")
+	pretty := flag.Bool("pretty", false, "Indent JSON output; --pretty=false writes compact bundles (default: indented bundles, compact ndjson)")
+	maxResources := flag.Int("max-resources", 0, "Maximum resources to write (0 means no limit)")
 	validate := flag.Bool("validate", false, "Enable FHIR validation")
+	profilesDir := flag.String("profiles", "", "Directory of StructureDefinition JSON files (core and IGs) to validate resources against their meta.profile; implies --validate")
+	terminologyDir := flag.String("terminology", "", "Directory of ValueSet and CodeSystem JSON files to check coded elements against the bindings of --profiles")
 	validationLevel := flag.String("validation-level", "error", "Validation level: error (fail on errors) or warn (log warnings)")
+	validationReport := flag.String("validation-report", "", "Write validation issues to a file as OperationOutcome resources")
+	validationConfig := flag.String("validation-config", "", "YAML file of severity overrides and suppressions of validation issues by rule id, resource type and field")
+	reportFormatStr := flag.String("validation-report-format", "outcome", "Format of --validation-report: outcome (an OperationOutcome per failing row, ndjson), aggregate (one OperationOutcome) or jsonl (a JSON object per issue)")
+	checkpointFile := flag.String("checkpoint", "", "Checkpoint file path for ndjson output (default: <output>.checkpoint)")
+	checkpointInterval := flag.Int("checkpoint-interval", 10000, "Rows between checkpoint writes for ndjson output (0 disables checkpointing)")
+	resume := flag.Bool("resume", false, "Resume an interrupted ndjson conversion from its checkpoint")
+	target := flag.String("target", "", "FHIR server base URL to send transaction or batch bundles to instead of writing output")
+	bearerToken := flag.String("bearer-token", "", "Bearer token for --target (default: $CSV2FHIR_BEARER_TOKEN)")
+	basicAuth := flag.String("basic-auth", "", "user:password for basic auth with --target (default: $CSV2FHIR_BASIC_AUTH)")
+	concurrency := flag.Int("concurrency", 4, "Bundles sent to --target at once")
+	maxRetries := flag.Int("max-retries", 5, "Retries of bundles sent to --target on 429, 5xx and network errors")
+	partitionBy := flag.String("partition-by", "", "CSV column or FHIRPath (e.g. Observation.subject.reference) whose value selects the file in --output-dir for each resource")
+	maxOpenFiles := flag.Int("max-open-files", 64, "Partition files kept open at once with --partition-by")
+	var metaProfiles, metaTags stringList
+	flag.Var(&metaProfiles, "meta-profile", "Profile URL added to meta.profile of every resource; repeatable, replaces the mapping's meta.profile")
+	metaSource := flag.String("meta-source", "", "meta.source of every resource, e.g. urn:feed:${input_file} (overrides the mapping)")
+	flag.Var(&metaTags, "meta-tag", "system|code added to meta.tag of every resource; repeatable, replaces the mapping's meta.tag")
+	metaLastUpdated := flag.String("meta-last-updated", "", "meta.lastUpdated of every resource, e.g. ${timestamp} (overrides the mapping)")
+	provenanceFlag := flag.Bool("provenance", false, "Emit a Provenance resource recording the input, mapping and run for the resources written")
+	provenanceEvery := flag.Int("provenance-every", provenance.DefaultEvery, "Resources per Provenance with --provenance")
+	narrative := flag.Bool("narrative", false, "Generate text.div from the built-in narrative of Patient, Observation and Condition when the mapping has no narrative template")
+	attachmentDir := flag.String("attachment-dir", "", "Directory attachment file paths are resolved against and must stay within (default: the working directory)")
+	attachmentMaxSize := flag.Int64("attachment-max-size", transform.DefaultAttachmentMaxSize, "Largest file in bytes embedded by the mapping's attachments")
+	baselinePath := flag.String("baseline", "", "Previous ndjson output or --write-baseline index; only resources added or changed since are written")
+	writeBaseline := flag.String("write-baseline", "", "Write a hash index of this run's resources, the --baseline of the next run")
+	emitDeletes := flag.Bool("emit-deletes", false, "Add DELETE entries for resources of the --baseline missing from this run (transaction and batch bundles)")
+	checkReferences := flag.Bool("check-references", false, "Report references to resources that are not in the output")
+	knownIDs := flag.String("known-ids", "", "File of Type/id lines of resources already on the server that references may use; implies --check-references")
+	fhirVersionStr := flag.String("fhir-version", "R4", "FHIR release of the output: R4, R4B or R5; resources are built in R4 and converted")
+	runID := flag.String("run-id", "", "Id of this run for ${run_id} and the id of output bundles (default: a random UUID)")
+	onInterrupt := flag.String("on-interrupt", "discard", "On SIGINT/SIGTERM without a checkpoint: discard (remove partial output) or keep (finalize output marked incomplete)")
 
 	flag.Parse()
 
@@ -69,6 +178,14 @@ func main() {
 		log.Fatalf("Error: %v", err)
 	}
 
+	bundleType, err := output.ParseBundleType(*bundleTypeStr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if bundleType != output.BundleCollection && format != output.FormatBundle && format != output.FormatXML {
+		log.Fatalf("Error: --bundle-type %s requires --format bundle or xml", bundleType)
+	}
+
 	// Get delimiter rune
 	var delimiterRune rune
 	if len(*delimiter) > 0 {
@@ -77,23 +194,240 @@ func main() {
 		delimiterRune = ','
 	}
 
+	server := output.ServerOptions{
+		URL:         *target,
+		BearerToken: *bearerToken,
+		ChunkSize:   *bundleSize,
+		Concurrency: *concurrency,
+		MaxRetries:  *maxRetries,
+	}
+	if *target != "" {
+		if !bundleType.HasRequests() {
+			log.Fatalf("Error: --target requires --bundle-type transaction or batch")
+		}
+		if format != output.FormatBundle || *outputFile != "" || *outputDir != "" || *maxFileBytes > 0 {
+			log.Fatalf("Error: --target sends bundles instead of writing output; it cannot be combined with --format, --output, --output-dir or --max-file-bytes")
+		}
+		if server.BearerToken == "" {
+			server.BearerToken = os.Getenv("CSV2FHIR_BEARER_TOKEN")
+		}
+		credentials := *basicAuth
+		if credentials == "" {
+			credentials = os.Getenv("CSV2FHIR_BASIC_AUTH")
+		}
+		if credentials != "" {
+			user, password, ok := strings.Cut(credentials, ":")
+			if !ok {
+				log.Fatalf("Error: --basic-auth must be user:password")
+			}
+			server.Username, server.Password = user, password
+		}
+	}
+
+	if format == output.FormatBulk {
+		if *outputDir == "" || *outputFile != "" {
+			log.Fatalf("Error: --format bulk writes to --output-dir instead of --output")
+		}
+	} else if *partitionBy != "" {
+		if *outputDir == "" || *outputFile != "" || *target != "" {
+			log.Fatalf("Error: --partition-by writes to --output-dir instead of --output or --target")
+		}
+	} else if *outputDir != "" {
+		log.Fatalf("Error: --output-dir requires --format bulk or --partition-by")
+	}
+	if *partitionBy != "" && format == output.FormatBulk {
+		log.Fatalf("Error: --partition-by cannot be used with --format bulk")
+	}
+
+	// With --target, --bundle-size is the number of entries per request
+	split := output.SplitOptions{MaxEntries: *bundleSize, MaxBytes: *maxFileBytes}
+	if *target != "" {
+		split = output.SplitOptions{}
+	}
+	if split.Enabled() && format == output.FormatBulk {
+		log.Fatalf("Error: --bundle-size and --max-file-bytes cannot be used with --format bulk")
+	}
+	if split.Enabled() && *partitionBy != "" {
+		log.Fatalf("Error: --bundle-size and --max-file-bytes cannot be used with --partition-by")
+	}
+	toFile := *outputFile != "" && *outputFile != "-"
+	if split.Enabled() && !toFile {
+		log.Fatalf("Error: --bundle-size and --max-file-bytes require an --output file")
+	}
+
+	compression, err := output.ParseCompression(*compress)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if compression != output.CompressionNone && format == output.FormatBulk {
+		log.Fatalf("Error: --compress cannot be used with --format bulk")
+	}
+
+	// --pretty only overrides the per-format default when given
+	layout := output.LayoutDefault
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "pretty" {
+			layout = output.LayoutCompact
+			if *pretty {
+				layout = output.LayoutPretty
+			}
+		}
+	})
+	isJSON := format == output.FormatBundle || format == output.FormatNDJSON || format == output.FormatBulk
+	if (*canonical || layout != output.LayoutDefault) && !isJSON {
+		log.Fatalf("Error: --canonical and --pretty require a JSON format")
+	}
+	if *canonical && layout == output.LayoutPretty {
+		log.Fatalf("Error: --canonical output cannot be combined with --pretty")
+	}
+	if layout == output.LayoutPretty && format == output.FormatBulk {
+		log.Fatalf("Error: --pretty cannot be used with --format bulk")
+	}
+
+	// Checkpoints are only written for uncompressed NDJSON output to a single
+	// file, since a partially written bundle or gzip stream can't be appended
+	// to, and for inputs that can be read again
+	checkpointPath := ""
+	if format == output.FormatNDJSON && toFile && !split.Enabled() && compression == output.CompressionNone &&
+		*inputFile != csv.StdinPath && *checkpointInterval > 0 {
+		checkpointPath = *checkpointFile
+		if checkpointPath == "" {
+			checkpointPath = checkpoint.DefaultPath(*outputFile)
+		}
+	}
+	if *resume && checkpointPath == "" {
+		log.Fatalf("Error: --resume requires --format ndjson, a single uncompressed --output file, an input file and checkpointing enabled")
+	}
+
+	if *runID != "" && !runIDPattern.MatchString(*runID) {
+		log.Fatalf("Error: --run-id must be 1-58 letters, digits, '-' or '.', so numbered bundle ids remain valid FHIR ids")
+	}
+	if *emitDeletes && (*baselinePath == "" || !bundleType.HasRequests()) {
+		log.Fatalf("Error: --emit-deletes requires --baseline and --bundle-type transaction or batch")
+	}
+	if *resume && (*baselinePath != "" || *writeBaseline != "") {
+		log.Fatalf("Error: --baseline and --write-baseline need a complete run and cannot be used with --resume")
+	}
+	if *resume && (*checkReferences || *knownIDs != "") {
+		log.Fatalf("Error: --check-references needs a complete run and cannot be used with --resume")
+	}
+	if *resume && *validationReport != "" {
+		log.Fatalf("Error: --validation-report needs a complete run and cannot be used with --resume")
+	}
+	reportFormat, err := validation.ParseReportFormat(*reportFormatStr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *terminologyDir != "" && *profilesDir == "" {
+		log.Fatalf("Error: --terminology checks the bindings of --profiles, which is required with it")
+	}
+	if *attachmentMaxSize <= 0 {
+		log.Fatalf("Error: --attachment-max-size must be positive")
+	}
+	if *provenanceEvery <= 0 {
+		log.Fatalf("Error: --provenance-every must be positive")
+	}
+	meta := config.MetaConfig{
+		Profile:     metaProfiles,
+		Source:      *metaSource,
+		LastUpdated: *metaLastUpdated,
+	}
+	for _, tag := range metaTags {
+		system, code, ok := strings.Cut(tag, "|")
+		if !ok {
+			system, code = "", tag
+		}
+		if code == "" {
+			log.Fatalf("Error: --meta-tag %q has no code", tag)
+		}
+		meta.Tag = append(meta.Tag, config.CodingConfig{System: system, Code: code})
+	}
+
+	fhirVersion, err := fhirversion.ParseVersion(*fhirVersionStr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if *onInterrupt != "discard" && *onInterrupt != "keep" {
+		log.Fatalf("Error: unsupported --on-interrupt value: %s (supported: discard, keep)", *onInterrupt)
+	}
+
+	opts := runOptions{
+		inputPath:          *inputFile,
+		inputMember:        *inputMember,
+		mappingPath:        *mappingFile,
+		outputPath:         *outputFile,
+		outputDir:          *outputDir,
+		format:             format,
+		bundleType:         bundleType,
+		baseURL:            *baseURL,
+		split:              split,
+		compression:        compression,
+		canonical:          *canonical,
+		layout:             layout,
+		server:             server,
+		partitionBy:        *partitionBy,
+		partition:          output.PartitionOptions{MaxOpenFiles: *maxOpenFiles},
+		meta:               meta,
+		runID:              *runID,
+		provenance:         *provenanceFlag,
+		provenanceEvery:    *provenanceEvery,
+		narrative:          *narrative,
+		attachmentDir:      *attachmentDir,
+		attachmentMaxSize:  *attachmentMaxSize,
+		baselinePath:       *baselinePath,
+		writeBaseline:      *writeBaseline,
+		emitDeletes:        *emitDeletes,
+		checkReferences:    *checkReferences || *knownIDs != "",
+		knownIDs:           *knownIDs,
+		fhirVersion:        fhirVersion,
+		delimiter:          delimiterRune,
+		maxResources:       *maxResources,
+		enableValidation:   *validate || *profilesDir != "",
+		validationLevel:    *validationLevel,
+		profilesDir:        *profilesDir,
+		terminologyDir:     *terminologyDir,
+		validationReport:   *validationReport,
+		validationConfig:   *validationConfig,
+		reportFormat:       reportFormat,
+		checkpointPath:     checkpointPath,
+		checkpointInterval: *checkpointInterval,
+		resume:             *resume,
+		onInterrupt:        *onInterrupt,
+	}
+
 	// Run the conversion
-	if err := run(*inputFile, *mappingFile, *outputFile, format, delimiterRune, *maxResources, *validate, *validationLevel); err != nil {
+	if err := run(opts); err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 }
 
-func run(inputPath, mappingPath, outputPath string, format output.Format, delimiter rune, maxResources int, enableValidation bool, validationLevel string) error {
+func run(opts runOptions) error {
 	// Load mapping configuration
-	fmt.Fprintf(os.Stderr, "Loading mapping configuration from %s...\n", mappingPath)
-	cfg, err := config.LoadMapping(mappingPath)
+	fmt.Fprintf(os.Stderr, "Loading mapping configuration from %s...\n", opts.mappingPath)
+	cfg, err := config.LoadMapping(opts.mappingPath)
 	if err != nil {
 		return fmt.Errorf("failed to load mapping: %w", err)
 	}
+	if len(opts.meta.Profile) > 0 {
+		cfg.Meta.Profile = opts.meta.Profile
+	}
+	if len(opts.meta.Tag) > 0 {
+		cfg.Meta.Tag = opts.meta.Tag
+	}
+	if opts.meta.Source != "" {
+		cfg.Meta.Source = opts.meta.Source
+	}
+	if opts.meta.LastUpdated != "" {
+		cfg.Meta.LastUpdated = opts.meta.LastUpdated
+	}
 
 	// Open CSV file
-	fmt.Fprintf(os.Stderr, "Opening CSV file %s...\n", inputPath)
-	csvReader, err := csv.NewReader(inputPath, delimiter)
+	fmt.Fprintf(os.Stderr, "Opening CSV file %s...\n", opts.inputPath)
+	csvReader, err := csv.NewReaderWithOptions(opts.inputPath, csv.Options{
+		Delimiter: opts.delimiter,
+		Member:    opts.inputMember,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to open CSV: %w", err)
 	}
@@ -107,45 +441,423 @@ func run(inputPath, mappingPath, outputPath string, format output.Format, delimi
 
 	fmt.Fprintf(os.Stderr, "CSV headers: %v\n", csvReader.Headers())
 	fmt.Fprintf(os.Stderr, "Resource type: %s\n", cfg.Resource)
-	fmt.Fprintf(os.Stderr, "Output format: %s\n", format)
+	fmt.Fprintf(os.Stderr, "Output format: %s\n", opts.format)
+
+	// Resources are built with the R4 models and converted when written
+	converter := fhirversion.NewConverter(opts.fhirVersion)
+	if converter != nil {
+		if err := converter.Supports(cfg.Resource); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "FHIR version: %s\n", converter.Version())
+	}
+
+	// Partition by a CSV column if one has that name, otherwise by a FHIRPath
+	partitionColumn := ""
+	var partitionPath *fhirpath.Expression
+	if opts.partitionBy != "" {
+		for _, header := range csvReader.Headers() {
+			if header == opts.partitionBy {
+				partitionColumn = header
+			}
+		}
+		if partitionColumn == "" {
+			partitionPath, err = fhirpath.Parse(opts.partitionBy)
+			if err != nil {
+				return fmt.Errorf("--partition-by %s is not a CSV column: %w", opts.partitionBy, err)
+			}
+			fmt.Fprintf(os.Stderr, "Partitioning by FHIRPath %s\n", partitionPath)
+		} else {
+			fmt.Fprintf(os.Stderr, "Partitioning by column %s\n", partitionColumn)
+		}
+	}
+
+	// Duplicates of earlier rows are found by id and identifiers. Policies
+	// that may replace an earlier row hold the output until the end of the
+	// run, which a checkpoint can't cover.
+	policy := dedupe.Policy(cfg.Duplicates)
+	if policy == "" {
+		policy = dedupe.Warn
+	}
+	if policy.Defers() && opts.checkpointPath != "" {
+		if opts.resume {
+			return fmt.Errorf("cannot resume: duplicates: %s writes all resources at the end of the run", policy)
+		}
+		fmt.Fprintf(os.Stderr, "Checkpointing disabled: duplicates: %s writes all resources at the end of the run\n", policy)
+		opts.checkpointPath = ""
+	}
+	detector, err := dedupe.NewDetector(policy)
+	if err != nil {
+		return err
+	}
+	defer detector.Close()
+	duplicateCount := 0
 
-	// Create transformer with optional validation
+	// Checksums tie a checkpoint to the exact input and mapping it was written
+	// for, and identify them in Provenance resources
+	var inputChecksum, mappingChecksum string
+	if opts.checkpointPath != "" || opts.provenance {
+		if opts.inputPath != csv.StdinPath {
+			if inputChecksum, err = checkpoint.FileChecksum(opts.inputPath); err != nil {
+				return fmt.Errorf("failed to checksum input: %w", err)
+			}
+		}
+		if mappingChecksum, err = checkpoint.FileChecksum(opts.mappingPath); err != nil {
+			return fmt.Errorf("failed to checksum mapping: %w", err)
+		}
+	}
+
+	var cp *checkpoint.Checkpoint
+	if opts.checkpointPath != "" {
+		if opts.resume {
+			cp, err = checkpoint.Load(opts.checkpointPath)
+			if err != nil {
+				return fmt.Errorf("cannot resume: %w", err)
+			}
+			if err := cp.Verify(inputChecksum, mappingChecksum); err != nil {
+				return fmt.Errorf("cannot resume: %w", err)
+			}
+			if err := csvReader.ResumeAt(cp.InputOffset, cp.RowNumber); err != nil {
+				return fmt.Errorf("cannot resume: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "Resuming after row %d (%d resources already written)\n", cp.RowNumber, cp.Resources)
+			fmt.Fprintf(os.Stderr, "Warning: duplicates of rows before row %d are not detected\n", cp.RowNumber+1)
+		} else {
+			cp = &checkpoint.Checkpoint{
+				InputPath:       opts.inputPath,
+				InputChecksum:   inputChecksum,
+				MappingChecksum: mappingChecksum,
+				RowNumber:       1, // Header row
+				InputOffset:     csvReader.Offset(),
+			}
+		}
+	}
+
+	// A resumed run stamps the interrupted run's id and start time, so its
+	// output matches what the interrupted run would have written
+	runID, started := opts.runID, time.Now().UTC().Format(time.RFC3339)
+	if opts.resume && cp.RunID != "" {
+		if runID != "" && runID != cp.RunID {
+			return fmt.Errorf("cannot resume: --run-id %s differs from the interrupted run's id %s", runID, cp.RunID)
+		}
+		runID, started = cp.RunID, cp.RunStarted
+	}
+	if runID == "" {
+		if runID, err = uuid.New(); err != nil {
+			return err
+		}
+	}
+	if cp != nil {
+		cp.RunID, cp.RunStarted = runID, started
+	}
+	inputName := filepath.Base(opts.inputPath)
+	if opts.inputPath == csv.StdinPath {
+		inputName = "stdin"
+	}
+	cfg.Meta = cfg.Meta.Resolve(map[string]string{
+		"input_file": inputName,
+		"run_id":     runID,
+		"timestamp":  started,
+	})
+
+	// Only resources added or changed since the baseline are written
+	var index *baseline.Index
+	switch {
+	case opts.baselinePath != "":
+		if index, err = baseline.Load(opts.baselinePath); err != nil {
+			return err
+		}
+	case opts.writeBaseline != "":
+		index = baseline.New()
+	}
+	changes := map[baseline.Status]int{}
+	dropped := map[string]int{} // Resources each element was dropped from by the converter
+
+	// References are checked once all resources are written
+	var checker *integrity.Checker
+	if opts.checkReferences {
+		checker = integrity.NewChecker(opts.baseURL)
+		if opts.knownIDs != "" {
+			if err := checker.LoadKnown(opts.knownIDs); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Loaded %d known ids from %s\n", checker.Known(), opts.knownIDs)
+		}
+	}
+
+	var recorder *provenance.Recorder
+	if opts.provenance {
+		recorder = provenance.NewRecorder(provenance.Source{
+			RunID:           runID,
+			Recorded:        started,
+			Version:         version,
+			InputName:       inputName,
+			InputChecksum:   inputChecksum,
+			MappingName:     filepath.Base(opts.mappingPath),
+			MappingChecksum: mappingChecksum,
+		}, opts.provenanceEvery)
+		// Resources written before the interruption still need their Provenance
+		if opts.resume {
+			if err := recoverProvenance(recorder, opts.outputPath, cp.OutputOffset); err != nil {
+				return fmt.Errorf("cannot resume: %w", err)
+			}
+		}
+	}
+
+	// Create transformer with optional validation. The mapping's rules are
+	// checked even without --validate.
 	var transformer *transform.Transformer
-	if enableValidation {
-		fmt.Fprintf(os.Stderr, "FHIR validation enabled (level: %s)\n", validationLevel)
-		validator := validation.NewCompositeValidator(
+	var validators []validation.Validator
+	// Profiles and bindings describe the resources as written, so they check
+	// them after conversion to the output's FHIR version
+	var outputValidators []validation.Validator
+	if opts.enableValidation {
+		fmt.Fprintf(os.Stderr, "FHIR validation enabled (level: %s)\n", opts.validationLevel)
+		validators = append(validators,
 			validation.NewRequiredFieldsValidator(),
 			validation.NewDateTimeValidator(),
 			validation.NewReferenceValidator(),
 		)
+		if opts.profilesDir != "" {
+			profiles, err := validation.LoadProfiles(opts.profilesDir)
+			if err != nil {
+				return err
+			}
+			// Profiles stamped on every resource must be known up front
+			for _, url := range cfg.Meta.Profile {
+				if !strings.Contains(url, "${") && !profiles.Has(url) {
+					return fmt.Errorf("profile %s is not among the StructureDefinitions in %s", url, opts.profilesDir)
+				}
+			}
+			versions := profiles.FHIRVersions()
+			declared := make([]string, 0, len(versions))
+			for version := range versions {
+				declared = append(declared, version)
+			}
+			sort.Strings(declared)
+			for _, version := range declared {
+				if v, err := fhirversion.ParseVersion(version); err != nil || v != opts.fhirVersion {
+					return fmt.Errorf("profile %s is for FHIR %s, but the output is FHIR %s (--fhir-version)", versions[version], version, opts.fhirVersion)
+				}
+			}
+			fmt.Fprintf(os.Stderr, "Loaded %d profiles from %s\n", profiles.Len(), opts.profilesDir)
+			outputValidators = append(outputValidators, validation.NewProfileValidator(profiles))
+
+			if opts.terminologyDir != "" {
+				terminology, err := validation.LoadTerminology(opts.terminologyDir)
+				if err != nil {
+					return err
+				}
+				valueSets, codeSystems := terminology.Counts()
+				fmt.Fprintf(os.Stderr, "Loaded %d ValueSets and %d CodeSystems from %s\n", valueSets, codeSystems, opts.terminologyDir)
+				outputValidators = append(outputValidators, validation.NewBindingValidator(profiles, terminology))
+			}
+		}
+	}
+	knownRules := make(map[string]bool)
+	for rule := range validation.BuiltinRules {
+		knownRules[rule] = true
+	}
+	if len(cfg.Rules) > 0 {
+		rules := make([]validation.Rule, len(cfg.Rules))
+		for i, rule := range cfg.Rules {
+			rules[i] = validation.Rule{ID: rule.ID, Expression: rule.Expression, Severity: rule.Severity, Message: rule.Message, Field: rule.Field}
+		}
+		ruleValidator, err := validation.NewRuleValidator(rules)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Loaded %d rules from the mapping\n", len(rules))
+		validators = append(validators, ruleValidator)
+		for _, id := range ruleValidator.IDs() {
+			knownRules[id] = true
+		}
+	}
+	validating := len(validators) > 0 || len(outputValidators) > 0
+
+	// Severity overrides and suppressions of the mapping's validation section
+	// and --validation-config; the file's take precedence, and suppressions
+	// over overrides
+	adjustments := []config.ValidationConfig{cfg.Validation}
+	if opts.validationConfig != "" {
+		if !validating {
+			return fmt.Errorf("--validation-config requires --validate, --profiles or rules in the mapping")
+		}
+		fileConfig, err := config.LoadValidationConfig(opts.validationConfig)
+		if err != nil {
+			return err
+		}
+		adjustments = append(adjustments, *fileConfig)
+	}
+	var overrides []validation.Override
+	for _, adjustment := range adjustments {
+		for _, o := range adjustment.Overrides {
+			overrides = append(overrides, validation.Override{Rule: o.Rule, ResourceType: o.Resource, Field: o.Field, Severity: o.Severity})
+		}
+	}
+	severityOverrides := len(overrides)
+	for _, adjustment := range adjustments {
+		for _, m := range adjustment.Suppress {
+			overrides = append(overrides, validation.Override{Rule: m.Rule, ResourceType: m.Resource, Field: m.Field})
+		}
+	}
+	for _, override := range overrides {
+		if override.Rule != "" && !knownRules[override.Rule] {
+			return fmt.Errorf("unknown validation rule id %s in overrides or suppressions", override.Rule)
+		}
+	}
+
+	// Issues are also written to the report for QA tooling
+	var report *validation.Report
+	if opts.validationReport != "" {
+		if !validating {
+			return fmt.Errorf("--validation-report requires --validate, --profiles or rules in the mapping")
+		}
+		if report, err = validation.CreateReport(opts.validationReport, opts.reportFormat, cfg.Resource, cfg.SourceColumns); err != nil {
+			return err
+		}
+		defer report.Abort()
+	}
+	var outputValidator validation.Validator
+	if len(outputValidators) > 0 {
+		outputValidator = validation.NewCompositeValidator(outputValidators...)
+	}
+	if len(overrides) > 0 && validating {
+		fmt.Fprintf(os.Stderr, "Applying %d severity overrides and %d suppressions\n", severityOverrides, len(overrides)-severityOverrides)
+		if outputValidator != nil {
+			outputValidator = validation.NewOverrideValidator(outputValidator, overrides)
+		}
+	}
+	if len(validators) > 0 {
+		var validator validation.Validator = validation.NewCompositeValidator(validators...)
+		if len(overrides) > 0 {
+			validator = validation.NewOverrideValidator(validator, overrides)
+		}
 		transformer = transform.NewTransformerWithValidator(cfg, validator)
 	} else {
 		transformer = transform.NewTransformer(cfg)
 	}
+	transformer.SetAttachmentOptions(opts.attachmentDir, opts.attachmentMaxSize)
+	if cfg.Narrative != "" || opts.narrative {
+		if err := transformer.SetNarrative(cfg.Narrative); err != nil {
+			return err
+		}
+	}
 
-	// Create output writer with memory limit
-	writer, err := output.NewWriterWithLimit(outputPath, format, maxResources)
+	// Create output writer. Checkpoints need the single-file writer, which
+	// knows its output offset.
+	writerOpts := output.Options{
+		Format:            opts.format,
+		MaxResources:      opts.maxResources,
+		BundleType:        opts.bundleType,
+		BaseURL:           opts.baseURL,
+		IfNoneExistSystem: cfg.Bundle.IfNoneExistSystem,
+		Header:            bundleHeader(cfg.Bundle.Header),
+		Compression:       opts.compression,
+		Canonical:         opts.canonical,
+		Layout:            opts.layout,
+		Converter:         converter,
+		BundleID:          runID,
+		Timestamp:         started,
+	}
+	var writer output.ResourceWriter
+	var fileWriter *output.Writer
+	var serverWriter *output.ServerWriter
+	var partitionWriter *output.PartitionWriter
+	switch {
+	case opts.partitionBy != "":
+		partitionWriter, err = output.NewPartitionWriter(opts.outputDir, writerOpts, opts.partition)
+		writer = partitionWriter
+	case opts.server.URL != "":
+		fmt.Fprintf(os.Stderr, "Sending %s bundles to %s\n", opts.bundleType, opts.server.URL)
+		serverWriter, err = output.NewServerWriter(writerOpts, opts.server)
+		writer = serverWriter
+	case opts.resume:
+		fileWriter, err = output.NewWriterForResume(opts.outputPath, writerOpts, cp.OutputOffset)
+		writer = fileWriter
+	case opts.format == output.FormatBulk:
+		writer, err = output.NewBulkWriter(opts.outputDir, bulkRequest(opts.inputPath), writerOpts)
+	case opts.split.Enabled():
+		writer, err = output.NewSplitWriter(opts.outputPath, writerOpts, opts.split)
+	default:
+		fileWriter, err = output.NewWriterWithOptions(opts.outputPath, writerOpts)
+		writer = fileWriter
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create output writer: %w", err)
 	}
-	defer writer.Close()
+	// Only a successful run moves the output into place
+	defer writer.Abort()
+
+	// Stop reading on SIGINT/SIGTERM; rows already handed to workers are
+	// drained and committed before deciding what to do with the output.
+	// A second signal terminates immediately.
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			fmt.Fprintln(os.Stderr, "Interrupted, finishing rows in progress...")
+			signal.Stop(signals)
+			close(interrupted)
+		}
+	}()
 
 	// Initialize counters
 	rowCount := 0
 	errorCount := 0
 	validationErrorCount := 0
+	resourceCount := 0
+	if cp != nil {
+		resourceCount = cp.Resources
+	}
 
 	// Create channels for parallel processing
 	type job struct {
 		data      map[string]string
 		rowNumber int
+		offset    int64
+		seq       int
 	}
 
 	type result struct {
 		resource         interface{}
+		binaries         []interface{}          // Binary resources of the resource's attachments
+		built            []interface{}          // The binaries and the resource before conversion, when held
+		dropped          []string               // Elements the converter could not represent
+		fingerprints     []baseline.Fingerprint // Of the binaries and the resource, for change detection
+		links            []integrity.Links      // Of the binaries and the resource, for the reference check
+		keys             []string               // Id and identifiers of the resource that must be unique
+		partitionKey     string
 		validationErrors []validation.ValidationError
 		err              error
 		rowNumber        int
+		offset           int64
+		seq              int
+	}
+
+	// annotate computes what the output checks need of the converted
+	// resources: fingerprints for change detection and references
+	annotate := func(res *result) error {
+		res.fingerprints, res.links = nil, nil
+		for _, resource := range append(res.binaries, res.resource) {
+			if index != nil {
+				fingerprint, err := baseline.Hash(resource)
+				if err != nil {
+					return fmt.Errorf("row %d: %w", res.rowNumber, err)
+				}
+				res.fingerprints = append(res.fingerprints, fingerprint)
+			}
+			if checker != nil {
+				links, err := integrity.Extract(resource)
+				if err != nil {
+					return fmt.Errorf("row %d: %w", res.rowNumber, err)
+				}
+				res.links = append(res.links, links)
+			}
+		}
+		return nil
 	}
 
 	// Worker configuration
@@ -163,11 +875,50 @@ func run(inputPath, mappingPath, outputPath string, format output.Format, delimi
 			for j := range jobs {
 				var res result
 				res.rowNumber = j.rowNumber
+				res.offset = j.offset
+				res.seq = j.seq
 
-				if enableValidation {
-					res.resource, res.validationErrors, res.err = transformer.TransformWithValidation(j.data, j.rowNumber)
-				} else {
-					res.resource, res.err = transformer.Transform(j.data, j.rowNumber)
+				res.resource, res.binaries, res.err = transformer.TransformRow(j.data, j.rowNumber)
+				if res.err == nil && len(validators) > 0 {
+					res.validationErrors = transformer.Validate(res.resource)
+				}
+				if res.err == nil {
+					if partitionColumn != "" {
+						res.partitionKey = j.data[partitionColumn]
+					} else if partitionPath != nil {
+						res.partitionKey, res.err = partitionPath.EvaluateString(res.resource)
+					}
+				}
+				// Fingerprints are taken of the converted resources, as written
+				if res.err == nil && converter != nil {
+					if policy.Defers() {
+						res.built = append(append([]interface{}{}, res.binaries...), res.resource)
+					}
+					for i, resource := range append(res.binaries, res.resource) {
+						converted, dropped, err := converter.Convert(resource)
+						if err != nil {
+							res.err = fmt.Errorf("row %d: %w", j.rowNumber, err)
+							break
+						}
+						if i < len(res.binaries) {
+							res.binaries[i] = converted
+						} else {
+							res.resource = converted
+						}
+						res.dropped = append(res.dropped, dropped...)
+					}
+					sort.Strings(res.dropped)
+				}
+				if res.err == nil && outputValidator != nil {
+					res.validationErrors = append(res.validationErrors, outputValidator.Validate(res.resource)...)
+				}
+				if res.err == nil {
+					res.err = annotate(&res)
+				}
+				if res.err == nil {
+					if res.keys, res.err = dedupe.Keys(res.resource); res.err != nil {
+						res.err = fmt.Errorf("row %d: %w", j.rowNumber, res.err)
+					}
 				}
 				results <- res
 			}
@@ -180,67 +931,513 @@ func run(inputPath, mappingPath, outputPath string, format output.Format, delimi
 		close(results)
 	}()
 
-	// Start writer goroutine (Consumer)
-	done := make(chan bool)
-	go func() {
-		for res := range results {
-			// Note: Parallel processing might reorder rows.
+	// saveCheckpoint records the last committed row once its output is on disk
+	saveCheckpoint := func(res result) {
+		if err := fileWriter.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: checkpoint skipped: %v\n", err)
+			return
+		}
+		cp.RowNumber = res.rowNumber
+		cp.InputOffset = res.offset
+		cp.OutputOffset = fileWriter.Offset()
+		cp.Resources = resourceCount
+		if err := cp.Save(opts.checkpointPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
 
-			if res.err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: %v\n", res.err)
-				errorCount++
-				continue
+	// writeProvenance writes a Provenance resource, which belongs to no row or
+	// partition. It gets the mapping's meta and is validated like the rows'
+	// resources.
+	provenanceCount := 0
+	writeProvenance := func(record interface{}) {
+		err := transformer.StampMeta(record)
+		if err == nil && converter != nil {
+			record, _, err = converter.Convert(record)
+		}
+		if err == nil && outputValidator != nil {
+			if issues := outputValidator.Validate(record); len(issues) > 0 {
+				validationErrorCount++
+				fmt.Fprintf(os.Stderr, "%s\n", validation.FormatResourceErrors(issues, "Provenance"))
+				if opts.validationLevel == "error" && validation.HasErrors(issues) {
+					err = fmt.Errorf("failed validation")
+				}
+			}
+		}
+		if err == nil && serverWriter != nil {
+			err = serverWriter.WriteRow(record, 0)
+		} else if err == nil {
+			err = writer.Write(record)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing Provenance: %v\n", err)
+			errorCount++
+			return
+		}
+		provenanceCount++
+		if checker != nil {
+			if links, err := integrity.Extract(record); err == nil {
+				checker.Add(links, 0)
 			}
+		}
+	}
 
-			// Handle validation errors
-			if len(res.validationErrors) > 0 {
-				validationErrorCount++
-				formatted := validation.FormatErrors(res.validationErrors, res.rowNumber)
+	// commit writes a result's resource to output, after the Binary
+	// resources it refers to
+	commit := func(res result) {
+		// i is the position of a resource among the binaries and the
+		// resource, as in fingerprints
+		write := func(resource interface{}, i int) error {
+			var change baseline.Change
+			if index != nil {
+				change = index.Check(res.fingerprints[i])
+				if change.Status == baseline.Unchanged {
+					changes[baseline.Unchanged]++
+					index.Commit(change)
+					if checker != nil {
+						// Written by an earlier run, so still on the server
+						checker.Add(res.links[i], res.rowNumber)
+					}
+					return nil
+				}
+			}
 
-				if validationLevel == "error" {
-					fmt.Fprintf(os.Stderr, "%s\n", formatted)
-					errorCount++
-					continue
-				} else {
-					fmt.Fprintf(os.Stderr, "%s\n", formatted)
+			var err error
+			switch {
+			case serverWriter != nil:
+				err = serverWriter.WriteRow(resource, res.rowNumber)
+			case partitionWriter != nil:
+				err = partitionWriter.WriteKey(res.partitionKey, resource)
+			default:
+				err = writer.Write(resource)
+			}
+			if err != nil {
+				return err
+			}
+			if index != nil {
+				changes[change.Status]++
+				index.Commit(change)
+			}
+			resourceCount++
+			if checker != nil {
+				checker.Add(res.links[i], res.rowNumber)
+			}
+			if recorder != nil {
+				if record := recorder.Add(resource); record != nil {
+					writeProvenance(record)
+				}
+			}
+			return nil
+		}
+		var err error
+		for i, binary := range res.binaries {
+			if err = write(binary, i); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = write(res.resource, len(res.binaries))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing resource: %v\n", err)
+			errorCount++
+		}
+	}
+
+	// failRow counts a row whose resources are not written. They may still be
+	// in the baseline, so none of it is removed.
+	failRow := func() {
+		errorCount++
+		if index != nil {
+			index.Fail()
+		}
+	}
+
+	// handle commits a single result to the output
+	handle := func(res result) {
+		if res.err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", res.err)
+			failRow()
+			return
+		}
+
+		// Handle validation errors
+		if len(res.validationErrors) > 0 {
+			validationErrorCount++
+			formatted := validation.FormatErrors(res.validationErrors, res.rowNumber)
+			if report != nil {
+				if err := report.Add(res.rowNumber, res.validationErrors); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 				}
 			}
 
-			// Write resource to output
-			if err := writer.Write(res.resource); err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing resource: %v\n", err)
-				errorCount++
+			// Warnings, e.g. of extensible bindings, never reject a row
+			if opts.validationLevel == "error" && validation.HasErrors(res.validationErrors) {
+				fmt.Fprintf(os.Stderr, "%s\n", formatted)
+				failRow()
+				return
+			} else {
+				fmt.Fprintf(os.Stderr, "%s\n", formatted)
+			}
+		}
+
+		// Rows sharing an id or identifier with an earlier row are handled by
+		// the mapping's duplicates policy
+		var duplicates []dedupe.Duplicate
+		if policy.Defers() {
+			// Held resources are converted when released, as a merge of
+			// them is only put in element order by the R4 models
+			entry := dedupe.Entry{RowNumber: res.rowNumber, PartitionKey: res.partitionKey}
+			built := res.built
+			if built == nil {
+				built = append(append([]interface{}{}, res.binaries...), res.resource)
+			}
+			var err error
+			for _, binary := range built[:len(built)-1] {
+				var data []byte
+				if data, err = json.Marshal(binary); err != nil {
+					break
+				}
+				entry.Attached = append(entry.Attached, data)
 			}
+			if err == nil {
+				entry.Resource, err = json.Marshal(built[len(built)-1])
+			}
+			if err == nil {
+				duplicates, err = detector.Hold(entry, res.keys)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error holding resource of row %d: %v\n", res.rowNumber, err)
+				failRow()
+				return
+			}
+		} else {
+			var err error
+			if duplicates, err = detector.Check(res.keys, res.rowNumber); err != nil {
+				fmt.Fprintf(os.Stderr, "Error checking duplicates of row %d: %v\n", res.rowNumber, err)
+				failRow()
+				return
+			}
+		}
+		for _, duplicate := range duplicates {
+			fmt.Fprintf(os.Stderr, "Warning: %v; %s\n", duplicate, duplicateOutcomes[policy])
+		}
+		if len(duplicates) > 0 {
+			duplicateCount++
+		}
+		switch {
+		case len(duplicates) > 0 && policy == dedupe.Error:
+			failRow()
+			return
+		case len(duplicates) > 0 && policy == dedupe.KeepFirst:
+			// Skipped
+		case policy.Defers():
+			// Written when the run is complete
+		default:
+			commit(res)
+		}
+		for i, element := range res.dropped {
+			// Sorted, so repeats of an element are adjacent; count each once
+			if i == 0 || element != res.dropped[i-1] {
+				dropped[element]++
+			}
+		}
+
+		rowCount++
+		if rowCount%100 == 0 {
+			fmt.Fprintf(os.Stderr, "Processed %d rows...\n", rowCount)
+		}
+	}
+
+	// Start writer goroutine (Consumer)
+	done := make(chan bool)
+	go func() {
+		// Workers finish out of order; results are committed in row order so
+		// the output is deterministic and a checkpoint covers a contiguous prefix
+		pending := make(map[int]result)
+		next := 0
+		sinceCheckpoint := 0
+		committed := false
+		var last result
+
+		for res := range results {
+			pending[res.seq] = res
+			for {
+				ready, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
+
+				handle(ready)
+				last = ready
+				committed = true
 
-			rowCount++
-			if rowCount%100 == 0 {
-				fmt.Fprintf(os.Stderr, "Processed %d rows...\n", rowCount)
+				if cp != nil {
+					sinceCheckpoint++
+					if sinceCheckpoint >= opts.checkpointInterval {
+						saveCheckpoint(ready)
+						sinceCheckpoint = 0
+					}
+				}
 			}
 		}
+
+		// Cover everything committed so far if the run is cut short
+		if cp != nil && committed && sinceCheckpoint > 0 {
+			saveCheckpoint(last)
+		}
 		done <- true
 	}()
 
 	// Feed the workers (Producer)
 	fmt.Fprintf(os.Stderr, "Processing CSV rows (using %d workers)...\n", numWorkers)
 
-	for {
+	var readErr error
+	wasInterrupted := false
+produce:
+	for seq := 0; ; seq++ {
+		select {
+		case <-interrupted:
+			wasInterrupted = true
+			break produce
+		default:
+		}
+
 		row, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("failed to read CSV row: %w", err)
+			readErr = fmt.Errorf("failed to read CSV row: %w", err)
+			break
 		}
 
-		jobs <- job{data: row.Data, rowNumber: row.RowNumber}
+		select {
+		case jobs <- job{data: row.Data, rowNumber: row.RowNumber, offset: row.Offset, seq: seq}:
+		case <-interrupted:
+			wasInterrupted = true
+			break produce
+		}
 	}
 	close(jobs)
 
 	// Wait for writer to finish
 	<-done
 
+	// reportServerFailures accounts for entries the FHIR server rejected
+	reportServerFailures := func() {
+		if serverWriter == nil {
+			return
+		}
+		for _, failure := range serverWriter.Failures() {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", failure)
+			errorCount++
+			if failure.RowNumber > 0 {
+				resourceCount--
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Server accepted %d resources\n", serverWriter.Accepted())
+	}
+
+	// releaseHeld writes the resources held by the duplicates policy
+	releaseHeld := func() error {
+		err := detector.Release(func(entry dedupe.Entry) error {
+			res := result{rowNumber: entry.RowNumber, partitionKey: entry.PartitionKey}
+			for _, binary := range entry.Attached {
+				res.binaries = append(res.binaries, binary)
+			}
+			resource, err := decodeResource(entry.Resource)
+			if err == nil && converter != nil {
+				for i, binary := range res.binaries {
+					if res.binaries[i], _, err = converter.Convert(binary); err != nil {
+						break
+					}
+				}
+				if err == nil {
+					resource, _, err = converter.Convert(resource)
+				}
+			}
+			if err != nil {
+				err = fmt.Errorf("row %d: %w", entry.RowNumber, err)
+			} else {
+				res.resource = resource
+				// Merged resources differ from the rows they were made of
+				err = annotate(&res)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				failRow()
+				return nil
+			}
+			commit(res)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write held resources: %w", err)
+		}
+		return nil
+	}
+
+	// finishBaseline deletes the baseline resources missing from the input
+	// when asked to and reports the changes
+	finishBaseline := func() {
+		if index == nil {
+			return
+		}
+		removed := index.Removed()
+		if opts.emitDeletes && index.Failed() > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d rows failed and may hold resources of the baseline; no deletions written\n", index.Failed())
+		}
+		if opts.emitDeletes {
+			for _, key := range removed {
+				resourceType, id, _ := strings.Cut(key, "/")
+				if err := writer.Write(output.Deletion{ResourceType: resourceType, ID: id}); err != nil {
+					fmt.Fprintf(os.Stderr, "Error writing deletion of %s: %v\n", key, err)
+					errorCount++
+					index.Retain(key)
+				}
+			}
+		}
+		if opts.baselinePath != "" {
+			fmt.Fprintf(os.Stderr, "Changes against baseline: %d added, %d changed, %d unchanged, %d removed\n",
+				changes[baseline.Added], changes[baseline.Changed], changes[baseline.Unchanged], len(removed))
+		}
+	}
+
+	// reportDropped lists the elements the output's FHIR version has no place for
+	reportDropped := func() {
+		elements := make([]string, 0, len(dropped))
+		for element := range dropped {
+			elements = append(elements, element)
+		}
+		sort.Strings(elements)
+		for _, element := range elements {
+			fmt.Fprintf(os.Stderr, "Warning: %s cannot be represented in FHIR %s and was dropped from %d resources\n",
+				element, opts.fhirVersion, dropped[element])
+		}
+	}
+
+	// reportReferences lists the references to resources that are neither in
+	// the output nor known ids
+	reportReferences := func() {
+		if checker == nil {
+			return
+		}
+		dangling := checker.Dangling()
+		for _, d := range dangling {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", d)
+		}
+		fmt.Fprintf(os.Stderr, "Referential integrity: %d references checked, %d dangling\n", checker.References(), len(dangling))
+	}
+
+	// finishProvenance writes the Provenance for the resources not yet covered
+	finishProvenance := func() {
+		if recorder == nil {
+			return
+		}
+		if record := recorder.Finish(); record != nil {
+			writeProvenance(record)
+		}
+		if n := recorder.Untargeted(); n > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d resources without an id are not listed in Provenance\n", n)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d Provenance resources\n", provenanceCount)
+	}
+
+	// reportPartitions lists the partition files written
+	reportPartitions := func() {
+		if partitionWriter == nil {
+			return
+		}
+		partitions := partitionWriter.Partitions()
+		fmt.Fprintf(os.Stderr, "Wrote %d partitions:\n", len(partitions))
+		for _, partition := range partitions {
+			key := partition.Key
+			if key == "" {
+				key = "(no key)"
+			}
+			fmt.Fprintf(os.Stderr, "  %s: %d resources in %s\n", key, partition.Resources, partition.Path)
+		}
+	}
+
+	// finishReport moves the validation report into place
+	finishReport := func() error {
+		if report == nil {
+			return nil
+		}
+		if err := report.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d validation issues to %s\n", report.Issues(), opts.validationReport)
+		return nil
+	}
+
+	if readErr != nil || wasInterrupted {
+		if readErr == nil {
+			readErr = fmt.Errorf("interrupted after %d rows", rowCount)
+		}
+
+		// Leave the partial output and last checkpoint in place so the run can be resumed
+		if cp != nil {
+			if err := fileWriter.Suspend(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+			return fmt.Errorf("%w (resume with --resume)", readErr)
+		}
+
+		if wasInterrupted && opts.onInterrupt == "keep" {
+			if err := releaseHeld(); err != nil {
+				return err
+			}
+			finishProvenance()
+			writer.MarkIncomplete()
+			if err := writer.Close(); err != nil {
+				return fmt.Errorf("failed to finalize incomplete output: %w", err)
+			}
+			reportServerFailures()
+			reportPartitions()
+			reportDropped()
+			if err := finishReport(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w (output kept and marked incomplete)", readErr)
+		}
+		return readErr
+	}
+
+	if err := releaseHeld(); err != nil {
+		return err
+	}
+	finishBaseline()
+	finishProvenance()
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to finalize output: %w", err)
+	}
+	reportServerFailures()
+	reportPartitions()
+	reportDropped()
+	reportReferences()
+	if err := finishReport(); err != nil {
+		return err
+	}
+	if duplicateCount > 0 {
+		fmt.Fprintf(os.Stderr, "Duplicates: %d rows shared an id or identifier with an earlier row (duplicates: %s)\n", duplicateCount, policy)
+	}
+	if opts.writeBaseline != "" {
+		if err := index.Save(opts.writeBaseline); err != nil {
+			return err
+		}
+	}
+	if cp != nil {
+		if err := checkpoint.Remove(opts.checkpointPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
 	fmt.Fprintf(os.Stderr, "Completed! Processed %d rows (%d errors", rowCount, errorCount)
-	if enableValidation {
+	if validating {
 		fmt.Fprintf(os.Stderr, ", %d validation issues)\n", validationErrorCount)
 	} else {
 		fmt.Fprintf(os.Stderr, ")\n")
@@ -248,3 +1445,83 @@ func run(inputPath, mappingPath, outputPath string, format output.Format, delimi
 
 	return nil
 }
+
+// recoverProvenance restores the Provenance state of an interrupted run from
+// its partial NDJSON output up to the checkpoint
+func recoverProvenance(recorder *provenance.Recorder, outputPath string, offset int64) error {
+	file, err := os.Open(output.PartialPath(outputPath))
+	if err != nil {
+		return fmt.Errorf("failed to open partial output: %w", err)
+	}
+	defer file.Close()
+	return recorder.Recover(io.LimitReader(file, offset))
+}
+
+// decodeResource decodes a held resource into the R4 model of its type. The
+// models write elements in the order of the specification, which a merge of
+// rows does not keep for elements only some of the rows have.
+func decodeResource(data json.RawMessage) (interface{}, error) {
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("failed to read held resource: %w", err)
+	}
+	resourceType, ok := transform.ResourceRegistry[header.ResourceType]
+	if !ok {
+		return data, nil
+	}
+	resource := reflect.New(resourceType).Interface()
+	if err := json.Unmarshal(data, resource); err != nil {
+		return nil, fmt.Errorf("failed to read held %s: %w", header.ResourceType, err)
+	}
+	return resource, nil
+}
+
+// bulkRequest describes the input of a run as the request of a bulk manifest
+func bulkRequest(inputPath string) string {
+	if abs, err := filepath.Abs(inputPath); err == nil {
+		inputPath = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(inputPath)}).String()
+}
+
+// bundleHeader converts the mapping's bundle header to writer options
+func bundleHeader(header config.HeaderConfig) output.BundleHeader {
+	result := output.BundleHeader{
+		Title:        header.Title,
+		Type:         output.Code{System: header.Type.System, Code: header.Type.Code, Display: header.Type.Display},
+		Author:       header.Author,
+		SectionTitle: header.SectionTitle,
+		Event:        output.Code{System: header.Event.System, Code: header.Event.Code, Display: header.Event.Display},
+		Source:       output.Endpoint{Endpoint: header.Source.Endpoint, Name: header.Source.Name},
+	}
+	for _, destination := range header.Destinations {
+		result.Destinations = append(result.Destinations, output.Endpoint{Endpoint: destination.Endpoint, Name: destination.Name})
+	}
+	return result
+}
+
+// duplicateOutcomes tells what each duplicates policy does with a duplicate row
+var duplicateOutcomes = map[dedupe.Policy]string{
+	dedupe.Warn:      "both written",
+	dedupe.Error:     "row rejected",
+	dedupe.KeepFirst: "row skipped",
+	dedupe.KeepLast:  "earlier row replaced",
+	dedupe.Merge:     "rows merged",
+}
+
+// runIDPattern matches run ids that leave room for a -0001 suffix in a FHIR id
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,58}$`)
+
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}